@@ -0,0 +1,54 @@
+package ast
+
+import "fmt"
+
+// Position is a location in a script. Line and Column are 1-based,
+// Line is -1 (parse.EOF) for the end of input.
+type Position struct {
+	Source string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Source, p.Line, p.Column)
+}
+
+// Comment is a comment of a script, from its leading "--" to the end of the
+// line or of the long bracket.
+type Comment struct {
+	Pos  Position
+	Text string
+}
+
+type PositionHolder interface {
+	Pos() Position
+	SetPos(pos Position)
+	EndPos() Position
+	SetEndPos(pos Position)
+}
+
+type Node struct {
+	pos    Position
+	endPos Position
+}
+
+func (n *Node) Pos() Position { return n.pos }
+
+func (n *Node) SetPos(pos Position) { n.pos = pos }
+
+func (n *Node) EndPos() Position { return n.endPos }
+
+func (n *Node) SetEndPos(pos Position) { n.endPos = pos }
+
+type ExprBase struct {
+	Node
+}
+
+func (e *ExprBase) exprMarker() {}
+
+type StmtBase struct {
+	Node
+}
+
+func (s *StmtBase) stmtMarker() {}
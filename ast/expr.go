@@ -19,69 +19,118 @@ const (
 	OpGe
 	OpEqual
 	OpNotEqual
+	OpPow
 )
 
-type Expr interface{}
+type Expr interface {
+	PositionHolder
+	exprMarker()
+}
 
 type StringExpr struct {
+	ExprBase
+
 	Value string
 }
 
 type NumberExpr struct {
+	ExprBase
+
 	Value string
 }
 
-type NilExpr struct{}
-type TrueExpr struct{}
-type FalseExpr struct{}
+type NilExpr struct {
+	ExprBase
+}
+type TrueExpr struct {
+	ExprBase
+}
+type FalseExpr struct {
+	ExprBase
+}
 
 type IdentExpr struct {
+	ExprBase
+
 	Value string
 }
 
 type LogicalOpExpr struct {
+	ExprBase
+
 	Operator int // And, Or, Xor,
 	Lhs, Rhs Expr
 }
 
 type RelationalOpExpr struct {
+	ExprBase
+
 	Operator int // >,<,>=, <=, ==, !=
 	Lhs, Rhs Expr
 }
 
 type ArithmeticOpExpr struct {
-	Operator int // Add,Sub,Mul,Div,Mod
+	ExprBase
+
+	Operator int // Add,Sub,Mul,Div,Mod,Pow
 	Lhs, Rhs Expr
 }
 
 type UnaryOpNotExpr struct {
+	ExprBase
+
 	Expr Expr
 }
 type UnaryOpMinusExpr struct {
+	ExprBase
+
 	Expr Expr
 }
 type FieldGetExpr struct {
+	ExprBase
+
 	Object Expr
 	Key    Expr
 }
 
 type FunctionExpr struct {
-	Params  []string
-	HasVArg bool
-	Block   []Stmt
+	ExprBase
+
+	Params   []string
+	ParamPos []Position // position of each name of Params
+	// type annotations, see FuncDefStmt
+	ParamTypes []string
+	ReturnType string
+	HasVArg    bool
+	Block      []Stmt
 }
 
+// FuncCallExpr is a call of Func, or of the method named Method of Receiver
+// (obj:method(args)), in which case Func is nil.
 type FuncCallExpr struct {
-	Func Expr
-	Args []Expr
+	ExprBase
+
+	Func     Expr
+	Receiver Expr
+	Method   string
+	Args     []Expr
+}
+
+// VarArgExpr is '...', the extra arguments of a vararg function.
+type VarArgExpr struct {
+	ExprBase
 }
 
 type ConcatStrExpr struct {
+	ExprBase
+
 	Lhs Expr
 	Rhs Expr
 }
 
 type DictExpr struct {
+	ExprBase
+
 	Entries []DictEntry
 }
 
@@ -91,9 +140,13 @@ type DictEntry struct {
 }
 
 type ListExpr struct {
+	ExprBase
+
 	Elements []Expr
 }
 
 type LenExpr struct {
+	ExprBase
+
 	Object Expr
 }
@@ -1,63 +1,102 @@
 package ast
 
-type Stmt interface{}
+type Stmt interface {
+	PositionHolder
+	stmtMarker()
+}
 
 type IfStmt struct {
+	StmtBase
+
 	CondExpr  Expr
 	ThenChunk []Stmt
+	ElsePos   Position // position of the else keyword, if any
 	ElseChunk []Stmt
 }
 
 type AssignStmt struct {
+	StmtBase
+
 	Lhs []Expr
 	Rhs []Expr
 }
 
 type WhileStmt struct {
+	StmtBase
+
 	CondExpr Expr
 	Chunk    []Stmt
 }
 
 type ForNumberStmt struct {
+	StmtBase
+
 	CounterName      string
+	CounterPos       Position
 	Start, End, Step Expr
 	Chunk            []Stmt
 }
 
 type ReturnStmt struct {
+	StmtBase
+
 	Exprs []Expr
 }
 
-type BreakStmt struct{}
+type BreakStmt struct {
+	StmtBase
+}
 
 type FuncDefStmt struct {
+	StmtBase
+
 	FuncName string
+	NamePos  Position
 	ParList  []string
-	Block    []Stmt
-	HasVArg  bool
+	ParamPos []Position // position of each name of ParList
+	// type annotations of the parameters, "" when missing, and of the
+	// result. The compiler ignores them.
+	ParamTypes []string
+	ReturnType string
+	Block      []Stmt
+	HasVArg    bool
 }
 
 type VarDefStmt struct {
-	Vars  []string
-	Exprs []Expr
+	StmtBase
+
+	Vars   []string
+	VarPos []Position // position of each name of Vars
+	Types  []string   // type annotation of each name of Vars, "" when missing
+	Exprs  []Expr
 }
 type ParList struct {
 	Names   []string
+	NamePos []Position
+	Types   []string
 	HasVArg bool
 }
 
 type FuncCallStmt struct {
+	StmtBase
+
 	Expr *FuncCallExpr
 }
 
 type ListAppendStmt struct {
+	StmtBase
+
 	Object  Expr
 	Element Expr
 }
 
 type ForRangeStmt struct {
-	Index  string
-	Value  string
-	Object Expr
-	Block  []Stmt
+	StmtBase
+
+	Index    string
+	IndexPos Position
+	Value    string
+	ValuePos Position
+	Object   Expr
+	Block    []Stmt
 }
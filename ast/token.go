@@ -3,4 +3,6 @@ package ast
 type Token struct {
 	Type int // set type in parse pkg
 	Str  string
+	Pos  Position // position of the first character
+	End  Position // position of the last character
 }
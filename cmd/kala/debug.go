@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/vm"
+)
+
+const debugHelp = `commands:
+  b, break [file:]line      break before the first instruction of a line
+  b, break function         break on the entry of a function
+  d, delete [id]            delete a breakpoint, all of them without id
+  w, watch expr             show the value of expr at each stop
+  unwatch id                delete a watch expression
+  i, info                   list the breakpoints and watch expressions
+  c, continue               run until the next breakpoint
+  s, step                   run to the next line, entering calls
+  n, next                   run to the next line of this function
+  f, finish                 run until this function returns
+  si, stepi                 run one instruction
+  bt                        print the call stack
+  frame n                   select the frame n of the call stack
+  l, list                   print the instructions around the current one
+  locals, upvalues, globals print the variables of the selected frame
+  p, print expr             evaluate expr in the selected frame
+  q, quit                   stop the script
+`
+
+// console is the command-line front end of a vm.Debugger.
+type console struct {
+	in    *bufio.Scanner
+	out   io.Writer
+	frame int // frame selected by the frame command
+}
+
+func debugCmd(args []string) int {
+	fs := newFlagSet("debug", "file [args...]")
+	if !parseFlags(fs, args, 1, -1) {
+		return exitUsage
+	}
+	proto, _, err := loadProto(fs.Arg(0))
+	if err != nil {
+		report(err)
+		return exitError
+	}
+	scriptArgs := make([]cpi.KValue, 0, fs.NArg()-1)
+	for _, a := range fs.Args()[1:] {
+		scriptArgs = append(scriptArgs, cpi.KString(a))
+	}
+
+	c := &console{in: bufio.NewScanner(os.Stdin), out: os.Stdout}
+	s := vm.NewState()
+	d := vm.NewDebugger(s, c.stopped)
+	// stop on the first line
+	d.StepInto()
+	fmt.Fprint(c.out, "type h for help\n")
+	if _, err := s.Call(vm.NewLocalClosure(proto), scriptArgs...); err != nil {
+		report(err)
+		return exitError
+	}
+	fmt.Fprintln(c.out, "script finished")
+	return exitOK
+}
+
+func (c *console) stopped(d *vm.Debugger, ev vm.StopEvent) {
+	c.frame = 0
+	top := d.Frames()[0]
+	if ev.Breakpoint != nil {
+		fmt.Fprintf(c.out, "breakpoint %d, ", ev.Breakpoint.ID)
+	}
+	fmt.Fprintf(c.out, "%s:%d in %s (pc %d)\n", top.Source, top.Line, top.Function, top.PC)
+	c.printWatches(d)
+
+	for {
+		fmt.Fprint(c.out, "(kdb) ")
+		if !c.in.Scan() {
+			d.Terminate()
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(c.in.Text()), " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "":
+		case "h", "help":
+			fmt.Fprint(c.out, debugHelp)
+		case "b", "break":
+			c.setBreakpoint(d, top, arg)
+		case "d", "delete":
+			if arg == "" {
+				d.ClearBreakpoints()
+			} else if id, err := strconv.Atoi(arg); err != nil || !d.ClearBreakpoint(id) {
+				fmt.Fprintf(c.out, "no breakpoint %q\n", arg)
+			}
+		case "w", "watch":
+			if arg == "" {
+				fmt.Fprintln(c.out, "usage: watch expr")
+				continue
+			}
+			d.AddWatch(arg)
+			c.printWatches(d)
+		case "unwatch":
+			if id, err := strconv.Atoi(arg); err != nil || !d.RemoveWatch(id) {
+				fmt.Fprintf(c.out, "no watch %q\n", arg)
+			}
+		case "i", "info":
+			for _, bp := range d.Breakpoints() {
+				where := bp.Function
+				if where == "" {
+					where = fmt.Sprintf("%s:%d", bp.Source, bp.Line)
+				}
+				fmt.Fprintf(c.out, "breakpoint %d at %s, hit %d times\n", bp.ID, where, bp.Hits)
+			}
+			for _, w := range d.Watches() {
+				fmt.Fprintf(c.out, "watch %d: %s\n", w.ID, w.Expr)
+			}
+		case "c", "continue":
+			d.Continue()
+			return
+		case "s", "step":
+			d.StepInto()
+			return
+		case "n", "next":
+			d.StepOver()
+			return
+		case "f", "finish":
+			d.StepOut()
+			return
+		case "si", "stepi":
+			d.StepInstruction()
+			return
+		case "q", "quit":
+			d.Terminate()
+			return
+		case "bt":
+			for _, f := range d.Frames() {
+				mark := " "
+				if f.Index == c.frame {
+					mark = "*"
+				}
+				if f.PC < 0 {
+					fmt.Fprintf(c.out, "%s#%d [host] in %s\n", mark, f.Index, f.Function)
+				} else {
+					fmt.Fprintf(c.out, "%s#%d %s:%d in %s\n", mark, f.Index, f.Source, f.Line, f.Function)
+				}
+			}
+		case "frame":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 || n >= len(d.Frames()) {
+				fmt.Fprintf(c.out, "no frame %q\n", arg)
+				continue
+			}
+			c.frame = n
+		case "l", "list":
+			c.list(d, d.FrameProto(c.frame))
+		case "locals":
+			c.printVars(d.Locals(c.frame))
+		case "upvalues":
+			c.printVars(d.Upvalues(c.frame))
+		case "globals":
+			c.printVars(d.Globals())
+		case "p", "print":
+			values, err := d.Evaluate(c.frame, arg)
+			if err != nil {
+				fmt.Fprintln(c.out, strings.TrimRight(err.Error(), "\n"))
+				continue
+			}
+			fmt.Fprintln(c.out, valuesString(values))
+		default:
+			fmt.Fprintf(c.out, "unknown command %q, type h for help\n", cmd)
+		}
+	}
+}
+
+func (c *console) setBreakpoint(d *vm.Debugger, top vm.Frame, arg string) {
+	if arg == "" {
+		fmt.Fprintln(c.out, "usage: break [file:]line | function")
+		return
+	}
+	source, lineStr := top.Source, arg
+	if i := strings.LastIndexByte(arg, ':'); i >= 0 {
+		source, lineStr = arg[:i], arg[i+1:]
+	}
+	var bp *vm.Breakpoint
+	if line, err := strconv.Atoi(lineStr); err == nil {
+		bp = d.SetBreakpoint(source, line)
+		fmt.Fprintf(c.out, "breakpoint %d at %s:%d\n", bp.ID, source, line)
+		return
+	}
+	bp = d.SetFunctionBreakpoint(arg)
+	fmt.Fprintf(c.out, "breakpoint %d at function %s\n", bp.ID, arg)
+}
+
+func (c *console) printWatches(d *vm.Debugger) {
+	for _, w := range d.Watches() {
+		values, err := d.Evaluate(c.frame, w.Expr)
+		if err != nil {
+			fmt.Fprintf(c.out, "%d: %s = <%s>\n", w.ID, w.Expr, strings.TrimRight(err.Error(), "\n"))
+			continue
+		}
+		fmt.Fprintf(c.out, "%d: %s = %s\n", w.ID, w.Expr, valuesString(values))
+	}
+}
+
+func (c *console) printVars(vars []vm.Variable) {
+	for _, v := range vars {
+		fmt.Fprintf(c.out, "%s = %s\n", v.Name, v.Value.Str())
+	}
+}
+
+// list prints the instructions of p around the pc of the selected frame.
+func (c *console) list(d *vm.Debugger, p *cpi.FuncProto) {
+	if p == nil {
+		fmt.Fprintln(c.out, "no bytecode for a host function")
+		return
+	}
+	pc := d.Frames()[c.frame].PC
+	for _, in := range cpi.Disassemble(p).Code {
+		if in.PC < pc-5 || in.PC > pc+5 {
+			continue
+		}
+		mark := " "
+		if in.PC == pc {
+			mark = ">"
+		}
+		fmt.Fprintf(c.out, "%s %d\t[%d]\t%-10s\t%s", mark, in.PC, in.Line, in.Op, strings.Join(in.Operands, " "))
+		if in.Comment != "" {
+			fmt.Fprintf(c.out, "\t; %s", in.Comment)
+		}
+		fmt.Fprintln(c.out)
+	}
+}
+
+func valuesString(values []cpi.KValue) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = v.Str()
+	}
+	return strings.Join(strs, ", ")
+}
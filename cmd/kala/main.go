@@ -0,0 +1,388 @@
+// Command kala runs, compiles and inspects Kala scripts.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/dap"
+	"github.com/khoakmp/kala/format"
+	"github.com/khoakmp/kala/lint"
+	"github.com/khoakmp/kala/lsp"
+	"github.com/khoakmp/kala/parse"
+	"github.com/khoakmp/kala/repl"
+	"github.com/khoakmp/kala/typecheck"
+	"github.com/khoakmp/kala/vm"
+)
+
+const usage = `usage: kala <command> [arguments]
+
+commands:
+  run file [args...]        run a script or a bytecode file
+  repl                      start an interactive session
+  compile [-o out] file     compile a script to bytecode
+  disasm [-json] file       print the bytecode of a script
+  check file...             report the syntax, compile and type errors of scripts
+  fmt [-l] [-w] [file...]   format scripts, stdin when no file is given
+  lint [-json] file...      report the suspicious code of scripts
+  debug file [args...]      run a script under the debugger
+  dap                       serve the Debug Adapter Protocol on stdin and stdout
+  lsp                       serve the Language Server Protocol on stdin and stdout
+`
+
+// exit codes
+const (
+	exitOK    = 0
+	exitError = 1 // the script failed to compile or to run
+	exitUsage = 2
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitUsage)
+	}
+
+	var code int
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "run":
+		code = runCmd(args)
+	case "repl":
+		code = replCmd(args)
+	case "compile":
+		code = compileCmd(args)
+	case "disasm":
+		code = disasmCmd(args)
+	case "check":
+		code = checkCmd(args)
+	case "fmt":
+		code = fmtCmd(args)
+	case "lint":
+		code = lintCmd(args)
+	case "debug":
+		code = debugCmd(args)
+	case "dap":
+		code = dapCmd(args)
+	case "lsp":
+		code = lspCmd(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "kala: unknown command %q\n\n%s", os.Args[1], usage)
+		code = exitUsage
+	}
+	os.Exit(code)
+}
+
+// newFlagSet returns a flag set whose errors are reported as usage errors.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kala %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args and checks that there are between minArgs and
+// maxArgs positional arguments, maxArgs < 0 meaning no upper bound. It prints
+// the usage when they are invalid.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs, maxArgs int) bool {
+	if err := fs.Parse(args); err != nil {
+		// the flag package already printed the error and the usage
+		return false
+	}
+	if n := fs.NArg(); n < minArgs || (maxArgs >= 0 && n > maxArgs) {
+		fs.Usage()
+		return false
+	}
+	return true
+}
+
+// report prints err on stderr, with the traceback of a runtime error.
+func report(err error) {
+	fmt.Fprintln(os.Stderr, strings.TrimRight(err.Error(), "\n"))
+	if rerr, ok := err.(*vm.RuntimeError); ok {
+		fmt.Fprintln(os.Stderr, rerr.StackTrace())
+	}
+}
+
+// loadProto compiles the script at path, or loads it if it holds bytecode.
+// It also returns the parsed script, nil for bytecode.
+func loadProto(path string) (*cpi.FuncProto, []ast.Stmt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.HasPrefix(data, []byte(cpi.BytecodeMagic)) {
+		proto, err := cpi.Load(bytes.NewReader(data))
+		return proto, nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(data), path)
+	if err != nil {
+		return nil, nil, err
+	}
+	proto, err := cpi.Compile(chunk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proto, chunk, nil
+}
+
+func runCmd(args []string) int {
+	fs := newFlagSet("run", "file [args...]")
+	if !parseFlags(fs, args, 1, -1) {
+		return exitUsage
+	}
+	proto, _, err := loadProto(fs.Arg(0))
+	if err != nil {
+		report(err)
+		return exitError
+	}
+
+	// the arguments are the varargs of the main chunk, i.e. ... and arg
+	scriptArgs := make([]cpi.KValue, 0, fs.NArg()-1)
+	for _, a := range fs.Args()[1:] {
+		scriptArgs = append(scriptArgs, cpi.KString(a))
+	}
+	s := vm.NewState()
+	if _, err := s.Call(vm.NewLocalClosure(proto), scriptArgs...); err != nil {
+		report(err)
+		return exitError
+	}
+	return exitOK
+}
+
+func replCmd(args []string) int {
+	fs := newFlagSet("repl", "")
+	if !parseFlags(fs, args, 0, 0) {
+		return exitUsage
+	}
+	r := repl.New(vm.NewState(), os.Stdout, os.Stderr)
+	if err := r.Run(os.Stdin); err != nil {
+		report(err)
+		return exitError
+	}
+	return exitOK
+}
+
+func compileCmd(args []string) int {
+	fs := newFlagSet("compile", "[-o out] file")
+	out := fs.String("o", "", "output file, the script name with the .kbc extension by default")
+	if !parseFlags(fs, args, 1, 1) {
+		return exitUsage
+	}
+	path := fs.Arg(0)
+	proto, _, err := loadProto(path)
+	if err != nil {
+		report(err)
+		return exitError
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + ".kbc"
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := proto.Dump(buf); err != nil {
+		report(err)
+		return exitError
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0o644); err != nil {
+		report(err)
+		return exitError
+	}
+	return exitOK
+}
+
+func disasmCmd(args []string) int {
+	fs := newFlagSet("disasm", "[-json] file")
+	asJSON := fs.Bool("json", false, "write the listing as JSON")
+	if !parseFlags(fs, args, 1, 1) {
+		return exitUsage
+	}
+	proto, _, err := loadProto(fs.Arg(0))
+	if err != nil {
+		report(err)
+		return exitError
+	}
+	listing := cpi.Disassemble(proto)
+	if *asJSON {
+		err = listing.WriteJSON(os.Stdout)
+	} else {
+		err = listing.WriteText(os.Stdout)
+	}
+	if err != nil {
+		report(err)
+		return exitError
+	}
+	return exitOK
+}
+
+// checkCmd reports the syntax, compile and type errors of scripts.
+func checkCmd(args []string) int {
+	fs := newFlagSet("check", "file...")
+	if !parseFlags(fs, args, 1, -1) {
+		return exitUsage
+	}
+	code := exitOK
+	for _, path := range fs.Args() {
+		if !checkFile(path) {
+			code = exitError
+		}
+	}
+	return code
+}
+
+func checkFile(path string) bool {
+	_, chunk, err := loadProto(path)
+	if err != nil {
+		report(err)
+		return false
+	}
+	errs := typecheck.Check(chunk)
+	for _, err := range errs {
+		report(err)
+	}
+	return len(errs) == 0
+}
+
+// fmtCmd prints the formatted scripts, or rewrites them with -w. With -l
+// it lists the scripts whose formatting differs instead of printing them.
+func fmtCmd(args []string) int {
+	fs := newFlagSet("fmt", "[-l] [-w] [file...]")
+	list := fs.Bool("l", false, "list the files whose formatting differs")
+	write := fs.Bool("w", false, "write the result to the files instead of stdout")
+	if !parseFlags(fs, args, 0, -1) {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			src, err = format.Source(src, "<stdin>")
+		}
+		if err != nil {
+			report(err)
+			return exitError
+		}
+		os.Stdout.Write(src)
+		return exitOK
+	}
+
+	code := exitOK
+	for _, path := range fs.Args() {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			report(err)
+			code = exitError
+			continue
+		}
+		out, err := format.Source(src, path)
+		if err != nil {
+			report(err)
+			code = exitError
+			continue
+		}
+		if *list && !bytes.Equal(src, out) {
+			fmt.Println(path)
+		}
+		if *write {
+			if !bytes.Equal(src, out) {
+				if err := os.WriteFile(path, out, 0o644); err != nil {
+					report(err)
+					code = exitError
+				}
+			}
+		} else if !*list {
+			os.Stdout.Write(out)
+		}
+	}
+	return code
+}
+
+// lintCmd prints the issues of the scripts, one per line or as a JSON array
+// with -json. A syntax error is reported as an issue of the check "syntax".
+// The exit code is exitError when there is an issue.
+func lintCmd(args []string) int {
+	fs := newFlagSet("lint", "[-json] file...")
+	asJSON := fs.Bool("json", false, "write the issues as a JSON array")
+	if !parseFlags(fs, args, 1, -1) {
+		return exitUsage
+	}
+	globals := vm.NewState().GlobalNames()
+	issues := []lint.Issue{}
+	for _, path := range fs.Args() {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			report(err)
+			return exitError
+		}
+		chunk, err := parse.Parse(bytes.NewReader(src), path)
+		if perr, ok := err.(*parse.Error); ok {
+			msg := perr.Message
+			if perr.Token != "" {
+				msg = fmt.Sprintf("%s near '%s'", msg, perr.Token)
+			}
+			issues = append(issues, lint.Issue{Pos: perr.Pos, Check: "syntax", Message: msg})
+			continue
+		} else if err != nil {
+			report(err)
+			return exitError
+		}
+		issues = append(issues, lint.Check(chunk, globals)...)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(issues); err != nil {
+			report(err)
+			return exitError
+		}
+	} else {
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+	}
+	if len(issues) > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// dapCmd serves a single debug session to an editor, which launches the
+// script with the program, args and stopOnEntry attributes of its launch
+// configuration.
+func dapCmd(args []string) int {
+	fs := newFlagSet("dap", "")
+	if !parseFlags(fs, args, 0, 0) {
+		return exitUsage
+	}
+	if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "kala dap: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// lspCmd serves an editor until it exits. The completions of globals are
+// the builtins of a new State.
+func lspCmd(args []string) int {
+	fs := newFlagSet("lsp", "")
+	if !parseFlags(fs, args, 0, 0) {
+		return exitUsage
+	}
+	if err := lsp.NewServer(os.Stdin, os.Stdout, nil).Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "kala lsp: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
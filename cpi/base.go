@@ -1,6 +1,10 @@
 package cpi
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/khoakmp/kala/ast"
+)
 
 const (
 	LocalVarListInitSize = 4
@@ -41,11 +45,31 @@ func (l *VarList) List() []string {
 	return l.names
 }
 
+// CompileError is returned by Compile for a chunk that parses but can not be
+// compiled, e.g. a break outside of a loop.
+type CompileError struct {
+	Pos     ast.Position
+	Message string
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("%v line:%d(column:%d): %s", e.Pos.Source, e.Pos.Line, e.Pos.Column, e.Message)
+}
+
+func raiseCompileError(pos ast.Position, format string, args ...any) {
+	panic(&CompileError{Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
 type Block struct {
 	Parent    *Block
 	EndLabel  int
 	varlist   VarList
 	NeedClose bool
+	locVars   []int // indexes into FuncProto.LocVars of the block variables
+
+	// used by CompileSymbols
+	end   ast.Position       // end of the statement of the block
+	decls map[string]*Symbol // declarations of the block variables
 }
 
 func newBlock(endLabel int, offset int, parent *Block) *Block {
@@ -66,12 +90,29 @@ func (b *Block) AddLocalVar(name string) int {
 
 type InstructionList struct {
 	insts []uint32
+	lines []int // source line of each instruction
+	line  int   // line recorded for the next added instructions
 }
 
 func newInstructionList(cap int) *InstructionList {
 	return &InstructionList{
 		insts: make([]uint32, 0, cap),
+		lines: make([]int, 0, cap),
+	}
+}
+
+// SetLine sets the source line of the next added instructions and returns
+// the previous one. Non-positive lines (synthesized nodes) are ignored.
+func (l *InstructionList) SetLine(line int) int {
+	prev := l.line
+	if line > 0 {
+		l.line = line
 	}
+	return prev
+}
+
+func (l *InstructionList) Lines() []int {
+	return l.lines
 }
 
 func (l *InstructionList) LastIndex() int {
@@ -91,6 +132,7 @@ func (i *InstructionList) List() []uint32 {
 
 func (i *InstructionList) Add(ins uint32) {
 	i.insts = append(i.insts, ins)
+	i.lines = append(i.lines, i.line)
 }
 
 func (i *InstructionList) At(idx int) uint32 {
@@ -102,6 +144,7 @@ func (l *InstructionList) AddNil(a, b int) {
 	if opGetOpCode(last) == OP_LOADNIL {
 		if opGetArgB(last) == a-1 {
 			opSetArgB(&last, b)
+			l.insts[len(l.insts)-1] = last
 			return
 		}
 	}
@@ -150,6 +193,15 @@ func (c *Constansts) Print() {
 	}
 }
 
+// LocVar is a named register of a function and the pc range
+// [StartPC, EndPC) in which it is live.
+type LocVar struct {
+	Name    string `json:"name"`
+	Slot    int    `json:"slot"`
+	StartPC int    `json:"start_pc"`
+	EndPC   int    `json:"end_pc"`
+}
+
 type FuncProto struct {
 	Consts           *Constansts
 	InstList         *InstructionList
@@ -159,6 +211,33 @@ type FuncProto struct {
 	HasVarg          bool
 	NumUsedRegisters uint8
 	StringConsts     []string
+
+	// debug info
+	Name         string
+	Source       string
+	LineDefined  int
+	LineInfo     []int // source line of each instruction
+	LocVars      []LocVar
+	UpvalueNames []string
+}
+
+// LineAt returns the source line of the instruction at pc, 0 if unknown.
+func (p *FuncProto) LineAt(pc int) int {
+	if pc < 0 || pc >= len(p.LineInfo) {
+		return 0
+	}
+	return p.LineInfo[pc]
+}
+
+// LocalsAt returns the local variables live at pc, outer scopes first.
+func (p *FuncProto) LocalsAt(pc int) []LocVar {
+	vars := make([]LocVar, 0, len(p.LocVars))
+	for _, v := range p.LocVars {
+		if v.StartPC <= pc && pc < v.EndPC {
+			vars = append(vars, v)
+		}
+	}
+	return vars
 }
 
 func (p *FuncProto) AddChildProto(proto *FuncProto) {
@@ -177,6 +256,7 @@ func newFuncProto(numParam int, hasVarg bool) *FuncProto {
 }
 
 type FunctionContext struct {
+	funcName       string // name given to the next compiled function expression
 	Parent         *FunctionContext
 	labelCnt       int
 	Proto          *FuncProto
@@ -184,8 +264,9 @@ type FunctionContext struct {
 	stackTop       int
 	Inst           *InstructionList
 	Consts         *Constansts
-	Upvalues       *VarList    // upvalues of this function refer to outer functions context
-	LabelPositions map[int]int // map from label to instruction position
+	Upvalues       *VarList     // upvalues of this function refer to outer functions context
+	LabelPositions map[int]int  // map from label to instruction position
+	symbols        *SymbolTable // nil unless compiled by CompileSymbols
 }
 
 func (fc *FunctionContext) GetLabelPosition(label int) int {
@@ -214,7 +295,39 @@ func (fc *FunctionContext) AddLocalVar(name string) int {
 	fc.CurBlock.varlist.Add(name)
 	//fmt.Println("var", name, "slot:", fc.CurBlock.varlist.offset+l)
 	fc.SetStackTop(fc.stackTop + 1)
-	return fc.CurBlock.varlist.offset + l
+	slot := fc.CurBlock.varlist.offset + l
+
+	fc.CurBlock.locVars = append(fc.CurBlock.locVars, len(fc.Proto.LocVars))
+	fc.Proto.LocVars = append(fc.Proto.LocVars, LocVar{
+		Name:    name,
+		Slot:    slot,
+		StartPC: len(fc.Inst.insts),
+	})
+	return slot
+}
+
+// endLocalVars closes the live range of the variables of the current block.
+func (fc *FunctionContext) endLocalVars() {
+	for _, idx := range fc.CurBlock.locVars {
+		fc.Proto.LocVars[idx].EndPC = len(fc.Inst.insts)
+	}
+}
+
+// nameFuncExpr records name as the debug name of expr, if it is a function
+// expression about to be compiled.
+func (fc *FunctionContext) nameFuncExpr(expr ast.Expr, name string) {
+	if _, ok := expr.(*ast.FunctionExpr); ok {
+		fc.funcName = name
+	}
+}
+
+func (fc *FunctionContext) takeFuncName() string {
+	name := fc.funcName
+	fc.funcName = ""
+	if name == "" {
+		return "anonymous"
+	}
+	return name
 }
 
 func (fc *FunctionContext) FindLocalVar(name string) int {
@@ -257,10 +370,16 @@ func NewFunctionContext(parent *FunctionContext, numParam int, hasVarg bool) *Fu
 		Upvalues:       newVarlist(0, 0),
 		LabelPositions: make(map[int]int),
 	}
-
+	if parent != nil {
+		fc.symbols = parent.symbols
+	}
 	return fc
 }
 
+func (fc *FunctionContext) definedAt() ast.Position {
+	return ast.Position{Source: fc.Proto.Source, Line: fc.Proto.LineDefined}
+}
+
 func (fc *FunctionContext) StackTop() int {
 	return fc.stackTop
 }
@@ -285,15 +404,12 @@ func (fc *FunctionContext) LeaveBlock(closeUpvalue bool) {
 	if closeUpvalue {
 		fc.CloseBlock(-1)
 	}
+	fc.endLocalVars()
 	fc.SetStackTop(fc.CurBlock.varlist.offset)
 	fc.CurBlock = fc.CurBlock.Parent
 }
 
 func patchCode(context *FunctionContext) {
-	maxreg := 1
-	if np := int(context.Proto.NumParams); np > 1 {
-		maxreg = np
-	}
 	code := context.Inst.List()
 	for pc := 0; pc < len(code); pc++ {
 		inst := code[pc]
@@ -302,25 +418,17 @@ func patchCode(context *FunctionContext) {
 		case OP_CLOSURE:
 			pc += int(context.Proto.FuncProtos[opGetArgBx(inst)].NumUpvalues)
 			continue
-		case OP_SETGLOBAL, OP_SETUPVAL, OP_EQ, OP_LT, OP_LE, OP_TEST,
-			OP_TAILCALL, OP_RETURN, OP_FORPREP, OP_FORLOOP, OP_TFORLOOP,
-			OP_SETLIST, OP_CLOSE:
-			/* nothing to do */
-		case OP_CALL:
-			if reg := opGetArgA(inst) + opGetArgC(inst) - 2; reg > maxreg {
-				maxreg = reg
+		case OP_MOVE:
+			// the MOVEs that follow are executed by a MOVEN, they are kept so
+			// that a jump to one of them still works
+			n := 0
+			for pc+n+1 < len(code) && n < opMaxArgsC && opGetOpCode(code[pc+n+1]) == OP_MOVE {
+				n++
 			}
-		case OP_VARARG:
-			if reg := opGetArgA(inst) + opGetArgB(inst) - 1; reg > maxreg {
-				maxreg = reg
-			}
-		case OP_SELF:
-			if reg := opGetArgA(inst) + 1; reg > maxreg {
-				maxreg = reg
-			}
-		case OP_LOADNIL:
-			if reg := opGetArgB(inst); reg > maxreg {
-				maxreg = reg
+			if n > 0 {
+				opSetOpCode(&code[pc], OP_MOVEN)
+				opSetArgC(&code[pc], n)
+				pc += n
 			}
 		case OP_JMP:
 			distance := 0
@@ -329,7 +437,7 @@ func patchCode(context *FunctionContext) {
 				d := context.GetLabelPosition(opGetArgSbx(jmp)) - pc
 				if d > opMaxArgSbx {
 					if distance == 0 {
-						panic("Jump too long")
+						raiseCompileError(context.definedAt(), "jump too long")
 					}
 					break
 				}
@@ -341,16 +449,20 @@ func patchCode(context *FunctionContext) {
 			} else {
 				context.Inst.SetSbx(pc, distance)
 			}
-		default:
-			if reg := opGetArgA(inst); reg > maxreg {
-				maxreg = reg
-			}
 		}
+	}
 
+	// the frame holds the parameters, the list of the varargs and every
+	// register used by an instruction
+	maxreg := max(context.Proto.NumParams, 1)
+	if context.Proto.HasVarg {
+		maxreg = context.Proto.NumParams + 1
+	}
+	for _, inst := range code {
+		maxreg = max(maxreg, opRegisters(inst))
 	}
-	maxreg++
 	if maxreg > 255 {
-		panic("exceed max stack slot")
+		raiseCompileError(context.definedAt(), "function uses too many registers")
 	}
 	context.Proto.NumUsedRegisters = uint8(maxreg)
 }
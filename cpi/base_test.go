@@ -1,8 +1,10 @@
 package cpi
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/khoakmp/kala/parse"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +32,75 @@ func TestFunctionContext(t *testing.T) {
 	assert.Equal(t, 0, fc.Consts.IndexOf(KString("kmp")))
 
 }
+
+func TestDebugInfo(t *testing.T) {
+	src := `var a = 1
+func calc(x) {
+	var y = x * 2
+	return y
+}
+var b = calc(a)`
+	chunk, err := parse.Parse(strings.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	proto, err := Compile(chunk)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "main chunk", proto.Name)
+	assert.Equal(t, "script.kala", proto.Source)
+	assert.Equal(t, len(proto.InstList.List()), len(proto.LineInfo))
+	assert.Equal(t, 1, proto.LineAt(0))
+	assert.Equal(t, 6, proto.LineAt(proto.InstList.LastIndex()))
+
+	calc := proto.FuncProtos[0]
+	assert.Equal(t, "calc", calc.Name)
+	assert.Equal(t, "script.kala", calc.Source)
+	assert.Equal(t, 2, calc.LineDefined)
+	for pc, inst := range calc.InstList.List() {
+		if opGetOpCode(inst) == OP_MUL {
+			assert.Equal(t, 3, calc.LineAt(pc))
+		}
+	}
+
+	names := []string{}
+	for _, v := range calc.LocVars {
+		names = append(names, v.Name)
+	}
+	assert.Equal(t, []string{"x", "y"}, names)
+	assert.Equal(t, 0, calc.LocVars[0].StartPC)
+	assert.Equal(t, len(calc.InstList.List()), calc.LocVars[1].EndPC)
+	assert.Equal(t, 2, len(calc.LocalsAt(calc.InstList.LastIndex())))
+}
+
+func TestEmitOpcodes(t *testing.T) {
+	proto := compileString(t, `var a, b, c = 1, 2, 3
+var x, y, z = a, b, c
+var obj = {}
+var f = func(v) {
+	return obj:get(v)
+}`)
+	opcodes := func(p *FuncProto) []int {
+		ops := []int{}
+		for _, inst := range p.InstList.List() {
+			ops = append(ops, opGetOpCode(inst))
+		}
+		return ops
+	}
+
+	main := proto.InstList.List()
+	ops := opcodes(proto)
+	i := 0
+	for ops[i] != OP_MOVEN {
+		i++
+	}
+	// the consecutive MOVEs of the assignments are merged, the followers
+	// stay in place
+	n := opGetArgC(main[i])
+	assert.True(t, n >= 2)
+	for _, op := range ops[i+1 : i+1+n] {
+		assert.Equal(t, OP_MOVE, op)
+	}
+
+	f := proto.FuncProtos[0]
+	assert.Contains(t, opcodes(f), OP_SELF)
+	assert.Contains(t, opcodes(f), OP_TAILCALL)
+}
@@ -0,0 +1,231 @@
+package cpi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ProtoListing is the disassembly of a FuncProto and of its nested functions.
+type ProtoListing struct {
+	Name         string         `json:"name"`
+	Source       string         `json:"source"`
+	LineDefined  int            `json:"line_defined"`
+	NumParams    int            `json:"num_params"`
+	HasVarg      bool           `json:"has_varg"`
+	NumRegisters int            `json:"num_registers"`
+	Constants    []ConstListing `json:"constants"`
+	Upvalues     []string       `json:"upvalues"`
+	Locals       []LocVar       `json:"locals"`
+	Code         []InstListing  `json:"code"`
+	Protos       []ProtoListing `json:"protos"`
+}
+
+// ConstListing is one entry of the constant table.
+type ConstListing struct {
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// InstListing is one decoded instruction. Operands holds A, B and C, A and
+// Bx or A and sBx depending on the format of the opcode, a constant operand
+// is written K<index>. Target is the absolute pc a jump lands on, -1 for
+// instructions that do not jump.
+type InstListing struct {
+	PC       int      `json:"pc"`
+	Line     int      `json:"line"`
+	Op       string   `json:"op"`
+	Operands []string `json:"operands"`
+	Target   int      `json:"target"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+// Disassemble decodes p and its nested functions.
+func Disassemble(p *FuncProto) ProtoListing {
+	l := ProtoListing{
+		Name:         p.Name,
+		Source:       p.Source,
+		LineDefined:  p.LineDefined,
+		NumParams:    p.NumParams,
+		HasVarg:      p.HasVarg,
+		NumRegisters: int(p.NumUsedRegisters),
+		Constants:    make([]ConstListing, 0, p.Consts.Len()),
+		Upvalues:     append([]string{}, p.UpvalueNames...),
+		Locals:       append([]LocVar{}, p.LocVars...),
+		Code:         make([]InstListing, 0, len(p.InstList.List())),
+		Protos:       make([]ProtoListing, 0, len(p.FuncProtos)),
+	}
+	for i := 0; i < p.Consts.Len(); i++ {
+		v := p.Consts.GetAt(i)
+		l.Constants = append(l.Constants, ConstListing{Index: i, Type: TypeNames[v.Type()], Value: constString(v)})
+	}
+
+	code := p.InstList.List()
+	for pc := 0; pc < len(code); pc++ {
+		l.Code = append(l.Code, disasmInst(p, pc, code[pc]))
+		if opGetOpCode(code[pc]) != OP_CLOSURE {
+			continue
+		}
+		// the instructions after a CLOSURE describe where its upvalues come from
+		bx := opGetArgBx(code[pc])
+		if bx >= len(p.FuncProtos) {
+			continue
+		}
+		child := p.FuncProtos[bx]
+		for i := 0; i < child.NumUpvalues && pc+1 < len(code); i++ {
+			pc++
+			l.Code = append(l.Code, disasmUpvalue(p, child, i, pc, code[pc]))
+		}
+	}
+
+	for _, child := range p.FuncProtos {
+		l.Protos = append(l.Protos, Disassemble(child))
+	}
+	return l
+}
+
+func constString(v KValue) string {
+	switch v := v.(type) {
+	case KString:
+		return strconv.Quote(string(v))
+	case KNumber:
+		return strconv.FormatFloat(float64(v), 'g', -1, 64)
+	}
+	return v.Str()
+}
+
+func (p *FuncProto) constComment(idx int) string {
+	if idx >= p.Consts.Len() {
+		return fmt.Sprintf("K%d = ?", idx)
+	}
+	return fmt.Sprintf("K%d = %s", idx, constString(p.Consts.GetAt(idx)))
+}
+
+func disasmInst(p *FuncProto, pc int, inst uint32) InstListing {
+	op := opGetOpCode(inst)
+	il := InstListing{PC: pc, Line: p.LineAt(pc), Op: OpName(op), Target: -1}
+	if op > opCodeMax {
+		il.Operands = []string{fmt.Sprintf("0x%08x", inst)}
+		return il
+	}
+	prop := &opProps[op]
+	a := opGetArgA(inst)
+	comments := []string{}
+
+	constant := func(idx int) string {
+		comments = append(comments, p.constComment(idx))
+		return fmt.Sprintf("K%d", idx)
+	}
+	rk := func(mode opArgMode, v int) string {
+		if mode == opArgModeK && opIsK(v) {
+			return constant(opIndexK(v))
+		}
+		return strconv.Itoa(v)
+	}
+
+	switch prop.Type {
+	case opTypeABC:
+		b, c := opGetArgB(inst), opGetArgC(inst)
+		switch op {
+		// the key of these two is always a constant index, without the RK bit
+		case OP_GETTABLEKS:
+			il.Operands = []string{strconv.Itoa(a), strconv.Itoa(b), constant(c)}
+		case OP_SETTABLEKS:
+			il.Operands = []string{strconv.Itoa(a), constant(b), rk(prop.ModeArgC, c)}
+		default:
+			il.Operands = []string{strconv.Itoa(a), rk(prop.ModeArgB, b), rk(prop.ModeArgC, c)}
+		}
+	case opTypeABx:
+		bx := opGetArgBx(inst)
+		il.Operands = []string{strconv.Itoa(a), strconv.Itoa(bx)}
+		switch op {
+		case OP_LOADK, OP_GETGLOBAL, OP_SETGLOBAL:
+			comments = append(comments, p.constComment(bx))
+		case OP_CLOSURE:
+			if bx < len(p.FuncProtos) {
+				child := p.FuncProtos[bx]
+				comments = append(comments, fmt.Sprintf("function %s (%s:%d)", child.Name, child.Source, child.LineDefined))
+			}
+		}
+	case opTypeASbx:
+		sbx := opGetArgSbx(inst)
+		il.Operands = []string{strconv.Itoa(a), strconv.Itoa(sbx)}
+		switch op {
+		case OP_JMP, OP_FORLOOP, OP_FORPREP:
+			il.Target = pc + 1 + sbx
+			comments = append(comments, fmt.Sprintf("to %d", il.Target))
+		}
+	}
+	il.Comment = strings.Join(comments, ", ")
+	return il
+}
+
+func disasmUpvalue(p, child *FuncProto, idx, pc int, inst uint32) InstListing {
+	il := disasmInst(p, pc, inst)
+	name := "?"
+	if idx < len(child.UpvalueNames) {
+		name = child.UpvalueNames[idx]
+	}
+	switch opGetOpCode(inst) {
+	case OP_MOVE:
+		il.Comment = fmt.Sprintf("upvalue %d %q from register %d", idx, name, opGetArgB(inst))
+	case OP_GETUPVAL:
+		il.Comment = fmt.Sprintf("upvalue %d %q from upvalue %d", idx, name, opGetArgB(inst))
+	}
+	return il
+}
+
+// WriteText writes the listing in a human readable form, each function
+// followed by its nested functions.
+func (l ProtoListing) WriteText(w io.Writer) error {
+	buf := bytes.NewBuffer(nil)
+	l.writeText(buf)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (l ProtoListing) writeText(buf *bytes.Buffer) {
+	vararg := ""
+	if l.HasVarg {
+		vararg = "+"
+	}
+	fmt.Fprintf(buf, "function %s (%s:%d)\n", l.Name, l.Source, l.LineDefined)
+	fmt.Fprintf(buf, "%d%s params, %d registers, %d upvalues, %d constants, %d instructions\n",
+		l.NumParams, vararg, l.NumRegisters, len(l.Upvalues), len(l.Constants), len(l.Code))
+
+	for _, in := range l.Code {
+		fmt.Fprintf(buf, "\t%d\t[%d]\t%-10s\t%s", in.PC, in.Line, in.Op, strings.Join(in.Operands, " "))
+		if in.Comment != "" {
+			fmt.Fprintf(buf, "\t; %s", in.Comment)
+		}
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(buf, "constants (%d):\n", len(l.Constants))
+	for _, k := range l.Constants {
+		fmt.Fprintf(buf, "\t%d\t%s\t%s\n", k.Index, k.Type, k.Value)
+	}
+	fmt.Fprintf(buf, "locals (%d):\n", len(l.Locals))
+	for _, v := range l.Locals {
+		fmt.Fprintf(buf, "\t%d\t%s\t%d\t%d\n", v.Slot, v.Name, v.StartPC, v.EndPC)
+	}
+	fmt.Fprintf(buf, "upvalues (%d):\n", len(l.Upvalues))
+	for i, name := range l.Upvalues {
+		fmt.Fprintf(buf, "\t%d\t%s\n", i, name)
+	}
+
+	for _, child := range l.Protos {
+		buf.WriteByte('\n')
+		child.writeText(buf)
+	}
+}
+
+// WriteJSON writes the listing as an indented JSON document.
+func (l ProtoListing) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
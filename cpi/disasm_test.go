@@ -0,0 +1,63 @@
+package cpi
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisassemble(t *testing.T) {
+	proto := compileString(t, `var obj = {n: 1}
+var f = func(v) {
+	if v > 2.5 {
+		return obj.n
+	}
+	return "none"
+}`)
+	l := Disassemble(proto)
+	assert.Equal(t, "main chunk", l.Name)
+	assert.Equal(t, 1, len(l.Protos))
+	assert.Equal(t, len(proto.InstList.List()), len(l.Code))
+
+	f := l.Protos[0]
+	assert.Equal(t, "f", f.Name)
+	assert.Equal(t, []string{"obj"}, f.Upvalues)
+
+	// constants are shown inline and jumps are resolved to absolute pcs
+	var lt, jmp InstListing
+	for _, in := range f.Code {
+		switch in.Op {
+		case "LT":
+			lt = in
+		case "JMP":
+			jmp = in
+		}
+	}
+	assert.Contains(t, lt.Operands, "K0")
+	assert.Equal(t, "K0 = 2.5", lt.Comment)
+	assert.Equal(t, jmp.PC+1+opGetArgSbx(proto.FuncProtos[0].InstList.List()[jmp.PC]), jmp.Target)
+	assert.Equal(t, "LOADK", f.Code[jmp.Target].Op)
+
+	// the instruction after CLOSURE tells where the upvalue comes from
+	for i, in := range l.Code {
+		if in.Op == "CLOSURE" {
+			assert.Equal(t, `upvalue 0 "obj" from register 1`, l.Code[i+1].Comment)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, l.WriteText(buf))
+	text := buf.String()
+	assert.True(t, strings.HasPrefix(text, "function main chunk"))
+	assert.Contains(t, text, "\nfunction f (")
+	assert.Contains(t, text, `K2 = "none"`)
+
+	buf.Reset()
+	assert.Nil(t, l.WriteJSON(buf))
+	var decoded ProtoListing
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, l, decoded)
+}
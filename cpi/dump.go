@@ -0,0 +1,461 @@
+package cpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+/*
+  bytecode = header payload
+
+  +--------------------------------------------------------+
+  | magic(4) | version(2) | flags(2) | size(4) | crc32(4)  |
+  +--------------------------------------------------------+
+
+  size and crc32 describe the payload, which is the main FuncProto. Integers
+  of the payload are uvarints, numbers are float64 bits and strings are a
+  length followed by their bytes. All fixed size fields are little endian.
+*/
+
+const (
+	BytecodeMagic   = "\x1bKLA"
+	BytecodeVersion = 1
+
+	bytecodeHeaderSize = 16
+	maxProtoDepth      = 200
+	// upvalues are indexed by the B operand of GETUPVAL and SETUPVAL and
+	// parameters are registers
+	maxUpvalues = 0x1ff + 1
+	maxParams   = 255
+)
+
+var (
+	// ErrInvalidBytecode is wrapped by the errors of Load for input that is
+	// not well-formed bytecode.
+	ErrInvalidBytecode = errors.New("invalid bytecode")
+	// ErrBytecodeVersion is returned by Load for bytecode dumped by another
+	// version of the compiler.
+	ErrBytecodeVersion = errors.New("unsupported bytecode version")
+)
+
+// Dump writes p and its nested functions in the bytecode format read by Load.
+func (p *FuncProto) Dump(w io.Writer) error {
+	payload := bytes.NewBuffer(nil)
+	dumpProto(payload, p)
+
+	var header [bytecodeHeaderSize]byte
+	copy(header[:4], BytecodeMagic)
+	binary.LittleEndian.PutUint16(header[4:], BytecodeVersion)
+	binary.LittleEndian.PutUint32(header[8:], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(header[12:], crc32.ChecksumIEEE(payload.Bytes()))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+func dumpUint(buf *bytes.Buffer, v int) {
+	buf.Write(binary.AppendUvarint(nil, uint64(v)))
+}
+
+func dumpString(buf *bytes.Buffer, s string) {
+	dumpUint(buf, len(s))
+	buf.WriteString(s)
+}
+
+func dumpBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func dumpProto(buf *bytes.Buffer, p *FuncProto) {
+	dumpString(buf, p.Name)
+	dumpString(buf, p.Source)
+	dumpUint(buf, p.LineDefined)
+	dumpUint(buf, p.NumParams)
+	dumpUint(buf, p.NumUpvalues)
+	dumpBool(buf, p.HasVarg)
+	buf.WriteByte(p.NumUsedRegisters)
+
+	insts := p.InstList.List()
+	dumpUint(buf, len(insts))
+	for _, inst := range insts {
+		buf.Write(binary.LittleEndian.AppendUint32(nil, inst))
+	}
+
+	dumpUint(buf, p.Consts.Len())
+	for _, v := range p.Consts.data {
+		buf.WriteByte(byte(v.Type()))
+		switch v := v.(type) {
+		case KNumber:
+			buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(float64(v))))
+		case KString:
+			dumpString(buf, string(v))
+		case KBool:
+			dumpBool(buf, bool(v))
+		}
+	}
+
+	dumpUint(buf, len(p.StringConsts))
+	for _, s := range p.StringConsts {
+		dumpString(buf, s)
+	}
+
+	dumpUint(buf, len(p.LineInfo))
+	for _, line := range p.LineInfo {
+		dumpUint(buf, line)
+	}
+	dumpUint(buf, len(p.LocVars))
+	for _, v := range p.LocVars {
+		dumpString(buf, v.Name)
+		dumpUint(buf, v.Slot)
+		dumpUint(buf, v.StartPC)
+		dumpUint(buf, v.EndPC)
+	}
+	dumpUint(buf, len(p.UpvalueNames))
+	for _, name := range p.UpvalueNames {
+		dumpString(buf, name)
+	}
+
+	dumpUint(buf, len(p.FuncProtos))
+	for _, child := range p.FuncProtos {
+		dumpProto(buf, child)
+	}
+}
+
+// Load reads bytecode written by FuncProto.Dump. The bytecode is checked
+// before it is returned, so that running it can not make the VM index out of
+// its instructions, constants, upvalues or nested functions.
+func Load(r io.Reader) (proto *FuncProto, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < bytecodeHeaderSize || string(data[:4]) != BytecodeMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidBytecode)
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != BytecodeVersion {
+		return nil, fmt.Errorf("%w: got %d, expected %d", ErrBytecodeVersion, v, BytecodeVersion)
+	}
+	payload := data[bytecodeHeaderSize:]
+	if size := binary.LittleEndian.Uint32(data[8:]); int64(size) != int64(len(payload)) {
+		return nil, fmt.Errorf("%w: truncated payload", ErrInvalidBytecode)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[12:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidBytecode)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			lerr, ok := r.(*loadError)
+			if !ok {
+				panic(r)
+			}
+			proto, err = nil, fmt.Errorf("%w: %s", ErrInvalidBytecode, lerr.msg)
+		}
+	}()
+	ld := &loader{data: payload}
+	proto = ld.proto(0)
+	if ld.pos != len(ld.data) {
+		ld.fail("trailing data after the main function")
+	}
+	return proto, nil
+}
+
+type loadError struct {
+	msg string
+}
+
+type loader struct {
+	data []byte
+	pos  int
+}
+
+func (ld *loader) fail(format string, args ...any) {
+	panic(&loadError{msg: fmt.Sprintf(format, args...)})
+}
+
+func (ld *loader) bytes(n int) []byte {
+	if n > len(ld.data)-ld.pos {
+		ld.fail("unexpected end of data")
+	}
+	b := ld.data[ld.pos : ld.pos+n]
+	ld.pos += n
+	return b
+}
+
+func (ld *loader) uint() int {
+	v, n := binary.Uvarint(ld.data[ld.pos:])
+	if n <= 0 || v > math.MaxInt32 {
+		ld.fail("bad integer at offset %d", ld.pos)
+	}
+	ld.pos += n
+	return int(v)
+}
+
+// count reads the length of a list whose elements take at least size bytes.
+func (ld *loader) count(size int) int {
+	n := ld.uint()
+	if n*size > len(ld.data)-ld.pos {
+		ld.fail("unexpected end of data")
+	}
+	return n
+}
+
+func (ld *loader) string() string {
+	return string(ld.bytes(ld.count(1)))
+}
+
+func (ld *loader) bool() bool {
+	switch ld.bytes(1)[0] {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	ld.fail("bad boolean at offset %d", ld.pos-1)
+	return false
+}
+
+func (ld *loader) proto(depth int) *FuncProto {
+	if depth > maxProtoDepth {
+		ld.fail("functions nested too deeply")
+	}
+	p := newFuncProto(0, false)
+	p.Name = ld.string()
+	p.Source = ld.string()
+	p.LineDefined = ld.uint()
+	p.NumParams = ld.uint()
+	p.NumUpvalues = ld.uint()
+	// checked before anything is allocated from them
+	if depth == 0 && p.NumUpvalues != 0 {
+		ld.fail("main function has %d upvalues", p.NumUpvalues)
+	}
+	if p.NumUpvalues > maxUpvalues {
+		ld.fail("%s: too many upvalues (%d)", p.Name, p.NumUpvalues)
+	}
+	if p.NumParams > maxParams {
+		ld.fail("%s: too many parameters (%d)", p.Name, p.NumParams)
+	}
+	p.HasVarg = ld.bool()
+	p.NumUsedRegisters = ld.bytes(1)[0]
+
+	insts := make([]uint32, ld.count(4))
+	for i := range insts {
+		insts[i] = binary.LittleEndian.Uint32(ld.bytes(4))
+	}
+
+	consts := make([]KValue, ld.count(1))
+	for i := range consts {
+		switch t := ld.bytes(1)[0]; t {
+		case KTypeNumber:
+			consts[i] = KNumber(math.Float64frombits(binary.LittleEndian.Uint64(ld.bytes(8))))
+		case KTypeString:
+			consts[i] = KString(ld.string())
+		case KTypeBool:
+			consts[i] = KBool(ld.bool())
+		case KTypeNil:
+			consts[i] = KNil{}
+		default:
+			ld.fail("bad constant type %d", t)
+		}
+	}
+	p.Consts = &Constansts{data: consts}
+
+	p.StringConsts = make([]string, ld.count(1))
+	for i := range p.StringConsts {
+		p.StringConsts[i] = ld.string()
+	}
+
+	p.LineInfo = make([]int, ld.count(1))
+	for i := range p.LineInfo {
+		p.LineInfo[i] = ld.uint()
+	}
+	p.LocVars = make([]LocVar, ld.count(4))
+	for i := range p.LocVars {
+		p.LocVars[i] = LocVar{Name: ld.string(), Slot: ld.uint(), StartPC: ld.uint(), EndPC: ld.uint()}
+	}
+	p.UpvalueNames = make([]string, ld.count(1))
+	for i := range p.UpvalueNames {
+		p.UpvalueNames[i] = ld.string()
+	}
+	p.InstList = &InstructionList{insts: insts, lines: p.LineInfo}
+
+	p.FuncProtos = make([]*FuncProto, ld.count(1))
+	for i := range p.FuncProtos {
+		p.FuncProtos[i] = ld.proto(depth + 1)
+	}
+
+	if err := verify(p); err != nil {
+		ld.fail("%s", err)
+	}
+	return p
+}
+
+// verify checks that the operands of every instruction of p refer to
+// existing constants, upvalues, nested functions and instructions. Nested
+// functions are not checked.
+func verify(p *FuncProto) error {
+	insts := p.InstList.List()
+	n := len(insts)
+	nconsts := p.Consts.Len()
+	bad := func(pc int, format string, args ...any) error {
+		return fmt.Errorf("%s: instruction %d (%s): %s", p.Name, pc, OpName(opGetOpCode(insts[pc])), fmt.Sprintf(format, args...))
+	}
+
+	if n == 0 || opGetOpCode(insts[n-1]) != OP_RETURN {
+		return fmt.Errorf("%s: function does not end with RETURN", p.Name)
+	}
+	if len(p.LineInfo) != 0 && len(p.LineInfo) != n {
+		return fmt.Errorf("%s: line info does not match the instructions", p.Name)
+	}
+	if len(p.StringConsts) != nconsts {
+		return fmt.Errorf("%s: string constants do not match the constants", p.Name)
+	}
+	for _, v := range p.LocVars {
+		if v.StartPC > v.EndPC || v.EndPC > n {
+			return fmt.Errorf("%s: bad range of local variable %s", p.Name, v.Name)
+		}
+	}
+
+	nregs := int(p.NumUsedRegisters)
+	if params := p.NumParams; params > nregs || p.HasVarg && params >= nregs {
+		return fmt.Errorf("%s: %d registers for %d parameters", p.Name, nregs, params)
+	}
+	// an operand count of 0 takes the values from a register up to the top
+	// of the stack, set by the instruction before: a call with any number of
+	// results, or VARARG with all the varargs, above that register
+	openFrom := func(pc, reg int) bool {
+		if pc == 0 {
+			return false
+		}
+		prev := insts[pc-1]
+		switch opGetOpCode(prev) {
+		case OP_CALL:
+			return opGetArgC(prev) == 0 && opGetArgA(prev) >= reg
+		case OP_TAILCALL:
+			return opGetArgA(prev) >= reg
+		case OP_VARARG:
+			return opGetArgB(prev) == 0 && opGetArgA(prev) >= reg
+		}
+		return false
+	}
+
+	isString := func(idx int) bool {
+		if idx >= nconsts {
+			return false
+		}
+		_, ok := p.Consts.data[idx].(KString)
+		return ok
+	}
+
+	for pc := 0; pc < n; pc++ {
+		inst := insts[pc]
+		op := opGetOpCode(inst)
+		if op >= len(opProps) {
+			return bad(pc, "unknown opcode %d", op)
+		}
+		prop := opProps[op]
+		b, c := opGetArgB(inst), opGetArgC(inst)
+
+		if prop.Type == opTypeABC {
+			if prop.ModeArgB == opArgModeK && opIsK(b) && opIndexK(b) >= nconsts {
+				return bad(pc, "constant %d out of range", opIndexK(b))
+			}
+			if prop.ModeArgC == opArgModeK && opIsK(c) && opIndexK(c) >= nconsts {
+				return bad(pc, "constant %d out of range", opIndexK(c))
+			}
+		}
+		if r := opRegisters(inst); r > nregs {
+			return bad(pc, "register %d out of range", r-1)
+		}
+		switch op {
+		case OP_CALL, OP_TAILCALL, OP_SETLIST:
+			if b == 0 && !openFrom(pc, opGetArgA(inst)+1) {
+				return bad(pc, "no values up to the top of the stack")
+			}
+		case OP_RETURN:
+			if b == 0 && !openFrom(pc, opGetArgA(inst)) {
+				return bad(pc, "no values up to the top of the stack")
+			}
+		}
+		if prop.IsTest && pc+2 >= n {
+			return bad(pc, "test is not followed by a jump")
+		}
+
+		switch op {
+		case OP_LOADK:
+			if opGetArgBx(inst) >= nconsts {
+				return bad(pc, "constant %d out of range", opGetArgBx(inst))
+			}
+		case OP_GETGLOBAL, OP_SETGLOBAL:
+			if !isString(opGetArgBx(inst)) {
+				return bad(pc, "global name %d is not a string constant", opGetArgBx(inst))
+			}
+		case OP_GETTABLEKS:
+			if !isString(c) {
+				return bad(pc, "key %d is not a string constant", c)
+			}
+		case OP_SETTABLEKS:
+			if !isString(b) {
+				return bad(pc, "key %d is not a string constant", b)
+			}
+		case OP_LOADBOOL:
+			if c != 0 && pc+2 >= n {
+				return bad(pc, "jump out of the function")
+			}
+		case OP_MOVEN:
+			if pc+c >= n-1 {
+				return bad(pc, "missing moves")
+			}
+			for i := 1; i <= c; i++ {
+				if opGetOpCode(insts[pc+i]) != OP_MOVE {
+					return bad(pc+i, "MOVEN is followed by %s", OpName(opGetOpCode(insts[pc+i])))
+				}
+			}
+		case OP_GETUPVAL, OP_SETUPVAL:
+			if b >= p.NumUpvalues {
+				return bad(pc, "upvalue %d out of range", b)
+			}
+		case OP_JMP, OP_FORLOOP, OP_FORPREP:
+			if target := pc + 1 + opGetArgSbx(inst); target < 0 || target >= n {
+				return bad(pc, "jump out of the function")
+			}
+		case OP_CLOSURE:
+			bx := opGetArgBx(inst)
+			if bx >= len(p.FuncProtos) {
+				return bad(pc, "function %d out of range", bx)
+			}
+			// the upvalues of the closure are described by pseudo instructions
+			for range p.FuncProtos[bx].NumUpvalues {
+				pc++
+				if pc >= n-1 {
+					return bad(pc-1, "missing upvalues")
+				}
+				switch opGetOpCode(insts[pc]) {
+				case OP_MOVE:
+					if opGetArgB(insts[pc]) >= nregs {
+						return bad(pc, "register %d out of range", opGetArgB(insts[pc]))
+					}
+				case OP_GETUPVAL:
+					if opGetArgB(insts[pc]) >= p.NumUpvalues {
+						return bad(pc, "upvalue %d out of range", opGetArgB(insts[pc]))
+					}
+				default:
+					return bad(pc, "bad upvalue of a closure")
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package cpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/parse"
+	"github.com/stretchr/testify/assert"
+)
+
+func compileString(t *testing.T, src string) *FuncProto {
+	chunk, err := parse.Parse(strings.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	proto, err := Compile(chunk)
+	assert.Nil(t, err)
+	return proto
+}
+
+func dumpBytes(t *testing.T, proto *FuncProto) []byte {
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, proto.Dump(buf))
+	return buf.Bytes()
+}
+
+func TestDumpLoad(t *testing.T) {
+	proto := compileString(t, `var a = 1.5
+var ok = true
+func counter(step) {
+	var n = 0
+	return func() {
+		n = n + step
+		return n
+	}
+}
+var c = counter(2)
+total = c() .. "!"`)
+	data := dumpBytes(t, proto)
+	assert.Equal(t, BytecodeMagic, string(data[:4]))
+
+	loaded, err := Load(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, proto.InstList.List(), loaded.InstList.List())
+	assert.Equal(t, proto.Consts.data, loaded.Consts.data)
+	assert.Equal(t, proto.StringConsts, loaded.StringConsts)
+	assert.Equal(t, proto.LineInfo, loaded.LineInfo)
+	assert.Equal(t, proto.LocVars, loaded.LocVars)
+	assert.Equal(t, "main chunk", loaded.Name)
+
+	counter := loaded.FuncProtos[0]
+	assert.Equal(t, "counter", counter.Name)
+	assert.Equal(t, 3, counter.LineDefined)
+	assert.Equal(t, 1, counter.NumParams)
+	inner := counter.FuncProtos[0]
+	assert.Equal(t, 2, inner.NumUpvalues)
+	assert.Equal(t, []string{"n", "step"}, inner.UpvalueNames)
+	assert.Equal(t, 6, inner.LineAt(0))
+
+	// loading is lossless
+	assert.Equal(t, data, dumpBytes(t, loaded))
+}
+
+func TestLoadInvalid(t *testing.T) {
+	proto := compileString(t, `var a = "x"
+b = a .. "y"`)
+	data := dumpBytes(t, proto)
+
+	load := func(data []byte) error {
+		_, err := Load(bytes.NewReader(data))
+		return err
+	}
+
+	assert.True(t, errors.Is(load(data[:10]), ErrInvalidBytecode))
+	assert.True(t, errors.Is(load(data[:len(data)-1]), ErrInvalidBytecode))
+
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)-3] ^= 0xff
+	assert.Equal(t, "invalid bytecode: checksum mismatch", load(corrupted).Error())
+
+	newer := bytes.Clone(data)
+	newer[4] = BytecodeVersion + 1
+	assert.True(t, errors.Is(load(newer), ErrBytecodeVersion))
+
+	// well-formed bytecode whose instructions refer to missing constants
+	insts := proto.InstList.insts
+	insts[0] = opCreateABx(OP_LOADK, 1, 100)
+	err := load(dumpBytes(t, proto))
+	assert.True(t, errors.Is(err, ErrInvalidBytecode))
+	assert.Equal(t, "invalid bytecode: main chunk: instruction 0 (LOADK): constant 100 out of range", err.Error())
+
+	insts[0] = opCreateASbx(OP_JMP, 0, 50)
+	assert.True(t, errors.Is(load(dumpBytes(t, proto)), ErrInvalidBytecode))
+
+	insts[0] = opCreateABC(63, 0, 0, 0)
+	assert.True(t, errors.Is(load(dumpBytes(t, proto)), ErrInvalidBytecode))
+
+	insts[0] = opCreateABx(OP_LOADK, 1, 0)
+	proto.NumUpvalues = math.MaxInt32
+	assert.Equal(t, "invalid bytecode: main function has 2147483647 upvalues", load(dumpBytes(t, proto)).Error())
+	proto.NumUpvalues = 0
+
+	proto.InstList.insts = insts[:len(insts)-1]
+	proto.LineInfo = proto.LineInfo[:len(insts)-1]
+	assert.Equal(t, "invalid bytecode: main chunk: function does not end with RETURN", load(dumpBytes(t, proto)).Error())
+}
+
+func TestLoadHugeCounts(t *testing.T) {
+	proto := compileString(t, `func f(a) { return a }`)
+	load := func() error {
+		_, err := Load(bytes.NewReader(dumpBytes(t, proto)))
+		return err
+	}
+	child := proto.FuncProtos[0]
+	child.NumUpvalues = math.MaxInt32
+	assert.Equal(t, "invalid bytecode: f: too many upvalues (2147483647)", load().Error())
+	child.NumUpvalues = 0
+	child.NumParams = math.MaxInt32
+	assert.Equal(t, "invalid bytecode: f: too many parameters (2147483647)", load().Error())
+	child.NumParams = 1
+	assert.Nil(t, load())
+
+	// a count larger than the remaining data is rejected before allocating
+	data := dumpBytes(t, proto)
+	payload := data[bytecodeHeaderSize:]
+	// the name of the main function is "main chunk", followed by its source
+	// name, line, parameters, upvalues, vararg flag, registers and then the
+	// instruction count
+	pos := 1 + len(proto.Name) + 1 + len(proto.Source) + 1 + 1 + 1 + 1 + 1
+	payload = append(bytes.Clone(payload[:pos]), append([]byte{0xff, 0xff, 0xff, 0xff, 0x07}, payload[pos+1:]...)...)
+	_, err := Load(bytes.NewReader(header(payload)))
+	assert.Equal(t, "invalid bytecode: unexpected end of data", err.Error())
+}
+
+func TestLoadRegisters(t *testing.T) {
+	proto := compileString(t, `func f(a, ...) { return a, ... }
+print(f(...))
+return [f(1, 2)]`)
+	load := func() error {
+		_, err := Load(bytes.NewReader(dumpBytes(t, proto)))
+		return err
+	}
+	assert.Nil(t, load())
+
+	find := func(p *FuncProto, op int) int {
+		for pc, inst := range p.InstList.insts {
+			if opGetOpCode(inst) == op {
+				return pc
+			}
+		}
+		t.Fatalf("no %s in %s", OpName(op), p.Name)
+		return -1
+	}
+	insts := proto.InstList.insts
+	nregs := int(proto.NumUsedRegisters)
+
+	pc := find(proto, OP_GETGLOBAL)
+	saved := insts[pc]
+	opSetArgA(&insts[pc], nregs)
+	assert.Equal(t, fmt.Sprintf("invalid bytecode: main chunk: instruction %d (GETGLOBAL): register %d out of range", pc, nregs),
+		load().Error())
+	insts[pc] = saved
+
+	// the arguments of print go up to the top of the stack set by f
+	pc = find(proto, OP_CALL) + 1
+	saved = insts[pc]
+	assert.Equal(t, OP_CALL, opGetOpCode(saved))
+	assert.Equal(t, 0, opGetArgB(saved))
+	insts[pc-1] = opCreateABC(OP_CALL, opGetArgA(insts[pc-1]), opGetArgB(insts[pc-1]), 2)
+	assert.Equal(t, fmt.Sprintf("invalid bytecode: main chunk: instruction %d (CALL): no values up to the top of the stack", pc),
+		load().Error())
+
+	proto = compileString(t, `func f(a, ...) { return a, ... }`)
+	proto.FuncProtos[0].NumUsedRegisters = 1
+	assert.Equal(t, "invalid bytecode: f: 1 registers for 1 parameters", load().Error())
+}
+
+// header returns payload preceded by a valid bytecode header.
+func header(payload []byte) []byte {
+	var h [bytecodeHeaderSize]byte
+	copy(h[:4], BytecodeMagic)
+	binary.LittleEndian.PutUint16(h[4:], BytecodeVersion)
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(h[12:], crc32.ChecksumIEEE(payload))
+	return append(h[:], payload...)
+}
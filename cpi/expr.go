@@ -40,6 +40,7 @@ func compileExprReduceMV(fc *FunctionContext, expr ast.Expr, slot *int, result *
 	if e, ok := expr.(*ast.IdentExpr); ok {
 		idx := fc.FindLocalVar(e.Value)
 		if idx > -1 {
+			fc.reference(e, false)
 			*result = idx
 			return
 		}
@@ -57,7 +58,7 @@ func compileExprReduceLKMV(fc *FunctionContext, expr ast.Expr, slot *int, result
 	}
 
 	if e, ok := expr.(*ast.NumberExpr); ok {
-		kidx := fc.Consts.IndexOf(kNumber(e.Value))
+		kidx := fc.Consts.IndexOf(kNumber(e.Value, e.Pos()))
 		*result = opRkAsk(kidx)
 		return
 	}
@@ -65,6 +66,7 @@ func compileExprReduceLKMV(fc *FunctionContext, expr ast.Expr, slot *int, result
 	if e, ok := expr.(*ast.IdentExpr); ok {
 		idx := fc.FindLocalVar(e.Value)
 		if idx > -1 {
+			fc.reference(e, false)
 			*result = idx
 			return
 		}
@@ -75,6 +77,13 @@ func compileExprReduceLKMV(fc *FunctionContext, expr ast.Expr, slot *int, result
 }
 
 func compileExpr(fc *FunctionContext, expr ast.Expr, slot int, opt exprOption) int {
+	line := fc.Inst.SetLine(expr.Pos().Line)
+	delta := compileExprAt(fc, expr, slot, opt)
+	fc.Inst.SetLine(line)
+	return delta
+}
+
+func compileExprAt(fc *FunctionContext, expr ast.Expr, slot int, opt exprOption) int {
 	rslot := slot
 	if opt.resultSlot != -1 {
 		rslot = opt.resultSlot
@@ -90,7 +99,7 @@ func compileExpr(fc *FunctionContext, expr ast.Expr, slot int, opt exprOption) i
 		fc.AddInst(opCreateABx(OP_LOADK, rslot, s))
 		return delta
 	case *ast.NumberExpr:
-		s := fc.Consts.IndexOf(kNumber(e.Value))
+		s := fc.Consts.IndexOf(kNumber(e.Value, e.Pos()))
 		fc.AddInst(opCreateABx(OP_LOADK, rslot, s))
 		return delta
 	case *ast.NilExpr:
@@ -99,10 +108,20 @@ func compileExpr(fc *FunctionContext, expr ast.Expr, slot int, opt exprOption) i
 	case *ast.TrueExpr:
 		fc.AddInst(opCreateABC(OP_LOADBOOL, rslot, 1, 0))
 		return delta
+	case *ast.VarArgExpr:
+		if !fc.Proto.HasVarg {
+			raiseCompileError(e.Pos(), "cannot use '...' outside a vararg function")
+		}
+		fc.AddInst(opCreateABC(OP_VARARG, rslot, opt.numRetValue+1, 0))
+		if opt.numRetValue < 0 || rslot < slot {
+			return 0
+		}
+		return opt.numRetValue
 	case *ast.FalseExpr:
 		fc.AddInst(opCreateABC(OP_LOADBOOL, rslot, 0, 0))
 		return delta
 	case *ast.IdentExpr:
+		fc.reference(e, false)
 		scope := getVarScope(fc, e.Value)
 		switch scope {
 		case ScopeLocal:
@@ -135,6 +154,8 @@ func compileExpr(fc *FunctionContext, expr ast.Expr, slot int, opt exprOption) i
 
 	case *ast.FunctionExpr:
 		childCtx := NewFunctionContext(fc, len(e.Params), e.HasVArg)
+		childCtx.Proto.Name = fc.takeFuncName()
+		childCtx.Proto.Source = fc.Proto.Source
 		compileFuncExpr(childCtx, e)
 		bx := len(fc.Proto.FuncProtos)
 		fc.Proto.AddChildProto(childCtx.Proto)
@@ -181,6 +202,10 @@ func compileExpr(fc *FunctionContext, expr ast.Expr, slot int, opt exprOption) i
 
 	return 0
 }
+
+// compileLogicalOpExpr compiles and/or used as a value: the result is the
+// left operand if it decides the outcome (false for and, true for or),
+// otherwise the right operand, which is evaluated only in that case.
 func compileLogicalOpExpr(fc *FunctionContext, expr *ast.LogicalOpExpr, slot int, opt exprOption) int {
 	rslot := slot
 	if opt.resultSlot != -1 {
@@ -190,33 +215,23 @@ func compileLogicalOpExpr(fc *FunctionContext, expr *ast.LogicalOpExpr, slot int
 	if rslot < slot {
 		delta = 0
 	}
-	trueLabel := fc.NewLabel()
-	falseLabel := fc.NewLabel()
-
-	if expr.Operator == ast.OpAnd {
-		nextCondLabel := fc.NewLabel()
-		compileBranchCond(fc, expr.Lhs, slot, nextCondLabel, falseLabel, nextCondLabel)
-		fc.MarkLabel(nextCondLabel, fc.Inst.LastIndex())
-		compileBranchCond(fc, expr.Rhs, slot, trueLabel, falseLabel, trueLabel)
+	endLabel := fc.NewLabel()
 
-		fc.MarkLabel(trueLabel, fc.Inst.LastIndex())
-		fc.AddInst(opCreateABC(OP_LOADBOOL, rslot, 1, 1))
-
-		fc.MarkLabel(falseLabel, fc.Inst.LastIndex())
-		fc.AddInst(opCreateABC(OP_LOADBOOL, rslot, 0, 0))
-		return delta
+	var b int
+	lslot := slot
+	compileExprReduceMV(fc, expr.Lhs, &lslot, &b)
+	c := 0
+	if expr.Operator == ast.OpOr {
+		c = 1
 	}
-	// OR
-	nextCondLabel := fc.NewLabel()
-	compileBranchCond(fc, expr.Lhs, slot, trueLabel, nextCondLabel, nextCondLabel)
-	fc.MarkLabel(nextCondLabel, fc.Inst.LastIndex())
-	compileBranchCond(fc, expr.Rhs, slot, trueLabel, falseLabel, falseLabel)
+	// TESTSET A B C   if (R(B) <=> C) then R(A) := R(B) else pc++
+	fc.AddInst(opCreateABC(OP_TESTSET, rslot, b, c))
+	fc.AddInst(opCreateASbx(OP_JMP, 0, endLabel))
 
-	fc.MarkLabel(falseLabel, fc.Inst.LastIndex())
-	fc.AddInst(opCreateABC(OP_LOADBOOL, rslot, 0, 1))
-
-	fc.MarkLabel(trueLabel, fc.Inst.LastIndex())
-	fc.AddInst(opCreateABC(OP_LOADBOOL, rslot, 1, 0))
+	ropt := eOption(1)
+	ropt.resultSlot = rslot
+	compileExpr(fc, expr.Rhs, slot, ropt)
+	fc.MarkLabel(endLabel, fc.Inst.LastIndex())
 	return delta
 }
 func compileArithmeticOpExpr(fc *FunctionContext, expr *ast.ArithmeticOpExpr, slot int, opt exprOption) int {
@@ -242,30 +257,43 @@ func compileArithmeticOpExpr(fc *FunctionContext, expr *ast.ArithmeticOpExpr, sl
 		opcode = OP_DIV
 	case ast.OpMod:
 		opcode = OP_MOD
+	case ast.OpPow:
+		opcode = OP_POW
 	}
 	fc.AddInst(opCreateABC(opcode, a, b, c))
 	return delta
 }
 
 func compileFuncCallExpr(fc *FunctionContext, expr *ast.FuncCallExpr, slot int, opt exprOption) int {
-	compileExpr(fc, expr.Func, slot, eOption(1)) // always incr 1
+	nself := 0
+	if expr.Receiver != nil {
+		// SELF A B C   R(A+1) := R(B); R(A) := R(B)[RK(C)]
+		var oslot int
+		tmp := slot
+		compileExprReduceMV(fc, expr.Receiver, &tmp, &oslot)
+		c := opRkAsk(fc.Consts.IndexOf(KString(expr.Method)))
+		fc.AddInst(opCreateABC(OP_SELF, slot, oslot, c))
+		nself = 1
+	} else {
+		compileExpr(fc, expr.Func, slot, eOption(1)) // always incr 1
+	}
 	narg := len(expr.Args)
 
 	if narg == 0 {
-		fc.AddInst(opCreateABC(OP_CALL, slot, 1, opt.numRetValue+1))
+		fc.AddInst(opCreateABC(OP_CALL, slot, nself+1, opt.numRetValue+1))
 		if opt.numRetValue < 0 {
 			return 0
 		}
 		return opt.numRetValue
 	}
 
-	start := slot + 1
+	start := slot + 1 + nself
 
 	for i := range narg - 1 {
 		start += compileExpr(fc, expr.Args[i], start, eOption(1))
 	}
 	delta := compileExpr(fc, expr.Args[narg-1], start, eOption(-1))
-	b := narg + delta
+	b := nself + narg + delta
 	if delta == 0 {
 		b = 0
 	}
@@ -280,17 +308,30 @@ func compileFuncCallExpr(fc *FunctionContext, expr *ast.FuncCallExpr, slot int,
 func compileFuncExpr(fc *FunctionContext, expr *ast.FunctionExpr) {
 	fc.Proto.NumParams = len(expr.Params)
 	fc.Proto.HasVarg = expr.HasVArg
-	for _, v := range expr.Params {
+	if pos := expr.Pos(); pos.Line > 0 {
+		fc.Proto.Source = pos.Source
+		fc.Proto.LineDefined = pos.Line
+	}
+	fc.Inst.SetLine(fc.Proto.LineDefined)
+	fc.CurBlock.end = expr.EndPos()
+	for i, v := range expr.Params {
 		fc.AddLocalVar(v)
+		if i < len(expr.ParamPos) {
+			fc.declare(v, expr.ParamPos[i], SymbolParam)
+		}
 	}
 	if expr.HasVArg {
 		fc.AddLocalVar("arg")
 	}
 	compileChunk(fc, expr.Block)
+	fc.Inst.SetLine(expr.EndPos().Line)
 	fc.AddInst(opCreateABC(OP_RETURN, 0, 1, 0))
+	fc.endLocalVars()
 	fc.Proto.Consts = fc.Consts
 	fc.Proto.NumUpvalues = fc.Upvalues.Len()
+	fc.Proto.UpvalueNames = fc.Upvalues.List()
 	fc.Proto.InstList = fc.Inst
+	fc.Proto.LineInfo = fc.Inst.Lines()
 
 	stringConsts := make([]string, fc.Consts.Len())
 	for i, s := range fc.Consts.data {
@@ -416,6 +457,7 @@ func compileDictExpr(fc *FunctionContext, expr *ast.DictExpr, slot int, opt expr
 	eslot := slot + 1
 	for _, entry := range expr.Entries {
 		kidx := fc.Consts.IndexOf(KString(entry.Key))
+		fc.nameFuncExpr(entry.Value, entry.Key)
 		compileExpr(fc, entry.Value, eslot, eOption(1))
 		fc.AddInst(opCreateABC(OP_SETTABLEKS, rslot, kidx, eslot))
 	}
@@ -439,9 +481,14 @@ func compileListExprV2(fc *FunctionContext, expr *ast.ListExpr, slot int, opt ex
 		return delta
 	}
 	slot++
-	for _, e := range expr.Elements {
+	last := len(expr.Elements) - 1
+	for _, e := range expr.Elements[:last] {
 		slot += compileExpr(fc, e, slot, eOption(1))
 	}
+	// the last element may expand to several values, B = 0 sets all of them
+	if compileExpr(fc, expr.Elements[last], slot, eOption(-1)) == 0 {
+		l = 0
+	}
 	// not use c
 	fc.AddInst(opCreateABC(OP_SETLIST, a, l, 0))
 	return delta
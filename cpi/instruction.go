@@ -172,6 +172,14 @@ var opProps = []opProp{
 	opProp{"GETKEY", false, true, opArgModeR, opArgModeR, opTypeABC},
 }
 
+// OpName returns the mnemonic of an opcode, e.g. "ADD".
+func OpName(op int) string {
+	if op < 0 || op >= len(opProps) {
+		return "UNKNOWN"
+	}
+	return opProps[op].Name
+}
+
 func opGetOpCode(inst uint32) int {
 	return int(inst >> 26)
 }
@@ -375,3 +383,51 @@ func InstToString(inst uint32) string {
 	}
 	return buf
 }
+
+// opRegisters returns the number of registers inst uses in its frame, one
+// more than the highest register it reads or writes. The values taken up to
+// the top of the stack by an operand count of 0 are not counted.
+func opRegisters(inst uint32) int {
+	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+	rk := func(v int) int {
+		if opIsK(v) {
+			return 0
+		}
+		return v + 1
+	}
+	switch opGetOpCode(inst) {
+	case OP_MOVE, OP_MOVEN, OP_GETTABLEKS, OP_UNM, OP_NOT, OP_LEN, OP_TESTSET, OP_APPEND, OP_LOADNIL:
+		return max(a, b) + 1
+	case OP_LOADK, OP_LOADBOOL, OP_GETUPVAL, OP_GETGLOBAL, OP_SETGLOBAL, OP_SETUPVAL, OP_NEWTABLE,
+		OP_TEST, OP_CLOSE, OP_CLOSURE:
+		return a + 1
+	case OP_CONCAT:
+		return max(a, b, c) + 1
+	case OP_GETTABLE:
+		return max(a+1, b+1, rk(c))
+	case OP_SETTABLE, OP_SETTABLEKS:
+		return max(a+1, rk(b), rk(c))
+	case OP_SELF:
+		return max(a+2, b+1, rk(c))
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW:
+		return max(a+1, rk(b), rk(c))
+	case OP_EQ, OP_LT, OP_LE:
+		return max(rk(b), rk(c))
+	case OP_GETFIELD:
+		return max(a+2, b+1, c+1)
+	case OP_CALL:
+		return max(a+b, a+c-1, a+1)
+	case OP_TAILCALL:
+		return max(a+b, a+1)
+	case OP_RETURN, OP_VARARG:
+		return max(a+b-1, a+1)
+	case OP_SETLIST:
+		return a + b + 1
+	case OP_FORLOOP, OP_FORPREP:
+		return a + 3
+	case OP_TFORLOOP:
+		// the key and the value, and the call of an iterator function
+		return a + 6
+	}
+	return 0
+}
@@ -1,12 +1,11 @@
 package cpi
 
 import (
-	"fmt"
-
 	"github.com/khoakmp/kala/ast"
 )
 
 func compileStmt(fc *FunctionContext, stmt ast.Stmt) {
+	fc.Inst.SetLine(stmt.Pos().Line)
 	switch stmt := stmt.(type) {
 	case *ast.AssignStmt:
 		compileAssignStmt(fc, stmt)
@@ -67,6 +66,9 @@ func compileAssignStmt(fc *FunctionContext, stmt *ast.AssignStmt) {
 
 	compileRight := func(start, end int, slot, num int) {
 		for i := start; i <= end; i++ {
+			if i < lsize {
+				fc.nameFuncExpr(stmt.Rhs[i], funcNameOf(stmt.Lhs[i]))
+			}
 			slot += compileExpr(fc, stmt.Rhs[i], slot, eOption(num))
 		}
 	}
@@ -102,8 +104,7 @@ func compileAssignStmt(fc *FunctionContext, stmt *ast.AssignStmt) {
 	}
 	// len stmt.Lhs > len(stmt.Rhs)
 	if rsize == 0 {
-		// raise error
-		panic("")
+		raiseCompileError(stmt.Pos(), "missing values on the right side of assignment")
 	}
 	if rsize > 1 {
 		compileRight(0, rsize-2, slot, 1)
@@ -113,7 +114,7 @@ func compileAssignStmt(fc *FunctionContext, stmt *ast.AssignStmt) {
 	remain := lsize - rsize + 1
 	delta = compileExpr(fc, stmt.Rhs[rsize-1], slot, eOption(remain))
 	if delta < remain {
-		panic("")
+		raiseCompileError(stmt.Pos(), "assignment has %d variables but %d values", lsize, rsize)
 	}
 	slot += delta
 	assignFn(0, lsize-1, slot-1)
@@ -125,6 +126,7 @@ func compileAssginLeftList(fc *FunctionContext, stmt *ast.AssignStmt) (slotUsed
 	for i, e := range stmt.Lhs {
 		switch e := e.(type) {
 		case *ast.IdentExpr:
+			fc.reference(e, true)
 			ags[i].scope = getVarScope(fc, e.Value)
 			switch ags[i].scope {
 			case ScopeGlobal:
@@ -148,8 +150,10 @@ func compileAssginLeftList(fc *FunctionContext, stmt *ast.AssignStmt) (slotUsed
 	return
 }
 
-func compileBlock(fc *FunctionContext, chunk []ast.Stmt) {
+// compileBlock compiles chunk in a block of its own, which ends at end.
+func compileBlock(fc *FunctionContext, chunk []ast.Stmt, end ast.Position) {
 	fc.EnterBlock(NoBreakLabel)
+	fc.CurBlock.end = end
 	for _, stmt := range chunk {
 		compileStmt(fc, stmt)
 	}
@@ -163,14 +167,18 @@ func compileIfStmt(fc *FunctionContext, stmt *ast.IfStmt) {
 
 	compileBranchCond(fc, stmt.CondExpr, fc.StackTop(), thenLabel, elseLabel, thenLabel)
 	fc.MarkLabel(thenLabel, fc.Inst.LastIndex())
-	compileBlock(fc, stmt.ThenChunk)
+	thenEnd := stmt.EndPos()
+	if len(stmt.ElseChunk) > 0 {
+		thenEnd = stmt.ElseChunk[0].Pos()
+	}
+	compileBlock(fc, stmt.ThenChunk, thenEnd)
 
 	if len(stmt.ElseChunk) > 0 {
 		fc.AddInst(opCreateASbx(OP_JMP, 0, endLabel))
 	}
 	fc.MarkLabel(elseLabel, fc.Inst.LastIndex())
 	if len(stmt.ElseChunk) > 0 {
-		compileBlock(fc, stmt.ElseChunk)
+		compileBlock(fc, stmt.ElseChunk, stmt.EndPos())
 	}
 	fc.MarkLabel(endLabel, fc.Inst.LastIndex())
 }
@@ -181,10 +189,13 @@ func compileWhileStmt(fc *FunctionContext, stmt *ast.WhileStmt) {
 	doLabel := fc.NewLabel()
 
 	fc.EnterBlock(endLabel)
+	fc.CurBlock.end = stmt.EndPos()
 	fc.MarkLabel(condLabel, fc.Inst.LastIndex())
 	compileBranchCond(fc, stmt.CondExpr, fc.StackTop(), doLabel, endLabel, doLabel)
 	fc.MarkLabel(doLabel, fc.Inst.LastIndex())
 	compileChunk(fc, stmt.Chunk)
+	// the instructions that loop back belong to the loop header
+	fc.Inst.SetLine(stmt.Pos().Line)
 	// manually close Upvalues
 	// at runtime, when execute all instruction of chunk in one iter
 	// it must close upvalues for that iter
@@ -199,10 +210,12 @@ func compileForNumberStmt(fc *FunctionContext, stmt *ast.ForNumberStmt) {
 	endLabel := fc.NewLabel()
 	doLabel := fc.NewLabel()
 	fc.EnterBlock(endLabel)
+	fc.CurBlock.end = stmt.EndPos()
 	// counter, end, step is 3 first local vars of the new block
 	counter := fc.AddLocalVar(stmt.CounterName)
-	end := fc.AddLocalVar("_e_")
-	step := fc.AddLocalVar("_sp_")
+	fc.declare(stmt.CounterName, stmt.CounterPos, SymbolLoopVar)
+	end := fc.AddLocalVar("(for limit)")
+	step := fc.AddLocalVar("(for step)")
 
 	slot := fc.StackTop()
 	compileExpr(fc, stmt.Start, slot, eOption(1))
@@ -218,31 +231,31 @@ func compileForNumberStmt(fc *FunctionContext, stmt *ast.ForNumberStmt) {
 		fc.AddInst(opCreateABC(OP_LOADK, step, fc.Consts.IndexOf(KNumber(1)), 0))
 	}
 
-	fc.AddInst(opCreateABC(OP_LT, 0, counter, end))
-	fc.AddInst(opCreateASbx(OP_JMP, 0, endLabel))
+	// OP_FORPREP  A sBx   R(A)-=R(A+2); pc+=sBx, jumps to the FORLOOP
+	prep := fc.Inst.LastIndex() + 1
+	fc.AddInst(opCreateASbx(OP_FORPREP, counter, 0))
 
 	fc.MarkLabel(doLabel, fc.Inst.LastIndex())
 	compileChunk(fc, stmt.Chunk)
 
+	fc.Inst.SetLine(stmt.Pos().Line)
 	fc.CloseBlock(3) // not close counter, end, step
 
 	// OP_FORLOOP
 	/*   A sBx   R(A)+=R(A+2);
-	     if R(A) <?= R(A+1) then { pc+=sBx; R(A+3)=R(A) }*/
-	fc.AddInst(opCreateASbx(OP_FORLOOP, counter, fc.GetLabelPosition(doLabel)-(fc.Inst.LastIndex()+1)))
-
-	/* fc.AddInst(opCreateABC(OP_ADD, counter, counter, step))
-	fc.AddInst(opCreateASbx(OP_JMP, 0, condLabel)) */
+	     if R(A) < R(A+1) (> for a negative step) then pc+=sBx */
+	loop := fc.Inst.LastIndex() + 1
+	fc.Inst.SetSbx(prep, loop-(prep+1))
+	fc.AddInst(opCreateASbx(OP_FORLOOP, counter, fc.GetLabelPosition(doLabel)-loop))
 
 	fc.MarkLabel(endLabel, fc.Inst.LastIndex())
 
 	fc.LeaveBlock(true)
 }
 
-func compileBreakStmt(fc *FunctionContext, _ *ast.BreakStmt) {
+func compileBreakStmt(fc *FunctionContext, stmt *ast.BreakStmt) {
 	block := fc.CurBlock
 	for block != nil {
-		fmt.Println(block)
 		if block.NeedClose {
 			fc.AddInst(opCreateABC(OP_CLOSE, block.varlist.offset, 0, 0))
 		}
@@ -252,7 +265,7 @@ func compileBreakStmt(fc *FunctionContext, _ *ast.BreakStmt) {
 		}
 		block = block.Parent
 	}
-	panic("invalid break")
+	raiseCompileError(stmt.Pos(), "break outside a loop")
 }
 
 func compileReturnStmt(fc *FunctionContext, stmt *ast.ReturnStmt) {
@@ -272,14 +285,27 @@ func compileReturnStmt(fc *FunctionContext, stmt *ast.ReturnStmt) {
 	if delta == 0 {
 		b = 0
 	}
+	if _, ok := stmt.Exprs[0].(*ast.FuncCallExpr); ok && nexp == 1 {
+		// return f(x) reuses the frame of the returning function
+		fc.Inst.SetOpCode(fc.Inst.LastIndex(), OP_TAILCALL)
+	}
 
 	fc.AddInst(opCreateABC(OP_RETURN, fc.StackTop(), b, 0))
 }
 func compileVarDefStmt(fc *FunctionContext, stmt *ast.VarDefStmt) {
 	var nvars, nexps = len(stmt.Vars), len(stmt.Exprs)
 	slot := fc.StackTop()
-	for _, v := range stmt.Vars {
+	for i, v := range stmt.Vars {
 		fc.AddLocalVar(v)
+		if i < len(stmt.VarPos) {
+			kind := SymbolVar
+			if i < nexps {
+				if _, ok := stmt.Exprs[i].(*ast.FunctionExpr); ok {
+					kind = SymbolFunction
+				}
+			}
+			fc.declare(v, stmt.VarPos[i], kind)
+		}
 	}
 
 	if nexps == 0 {
@@ -289,21 +315,26 @@ func compileVarDefStmt(fc *FunctionContext, stmt *ast.VarDefStmt) {
 	}
 
 	if nexps > nvars {
-		panic("too many exprs on rhs")
+		raiseCompileError(stmt.Pos(), "var declares %d variables but has %d values", nvars, nexps)
 	}
 
 	right := slot + nvars
-
-	if nvars > nexps {
-		fc.AddInst(opCreateABC(OP_LOADNIL, slot+nexps, slot+nvars-1, 0))
+	for i, e := range stmt.Exprs {
+		fc.nameFuncExpr(e, stmt.Vars[i])
+		n := 1
+		if i == nexps-1 {
+			// a call or ... at the end gives the values of the remaining
+			// variables
+			n = nvars - nexps + 1
+		}
+		right += compileExpr(fc, e, right, eOption(n))
 	}
 
-	for _, e := range stmt.Exprs {
-		compileExpr(fc, e, right, eOption(1))
-		right++
+	nvalues := right - (slot + nvars)
+	if nvalues < nvars {
+		fc.AddInst(opCreateABC(OP_LOADNIL, slot+nvalues, slot+nvars-1, 0))
 	}
-
-	for i := nexps - 1; i >= 0; i-- {
+	for i := nvalues - 1; i >= 0; i-- {
 		right--
 		fc.AddInst(opCreateABC(OP_MOVE, slot+i, right, 0))
 	}
@@ -311,11 +342,15 @@ func compileVarDefStmt(fc *FunctionContext, stmt *ast.VarDefStmt) {
 
 func compileFuncDefStmt(fc *FunctionContext, stmt *ast.FuncDefStmt) {
 	fc.AddLocalVar(stmt.FuncName)
+	fc.declare(stmt.FuncName, stmt.NamePos, SymbolFunction)
 	funcExpr := &ast.FunctionExpr{
-		Params:  stmt.ParList,
-		HasVArg: stmt.HasVArg,
-		Block:   stmt.Block,
+		Params:   stmt.ParList,
+		ParamPos: stmt.ParamPos,
+		HasVArg:  stmt.HasVArg,
+		Block:    stmt.Block,
 	}
+	funcExpr.SetPos(stmt.Pos())
+	funcExpr.SetEndPos(stmt.EndPos())
 	assignStmt := &ast.AssignStmt{
 		Lhs: []ast.Expr{&ast.IdentExpr{Value: stmt.FuncName}},
 		Rhs: []ast.Expr{funcExpr},
@@ -335,43 +370,36 @@ func compileListAppendStmt(fc *FunctionContext, stmt *ast.ListAppendStmt) {
 func compileForRangeStmt(fc *FunctionContext, stmt *ast.ForRangeStmt) {
 	endLabel := fc.NewLabel()
 	doLabel := fc.NewLabel()
+	loopLabel := fc.NewLabel()
 
 	fc.EnterBlock(endLabel)
-
-	slot := fc.StackTop()
-	var oslot int
-	var used int = 3 // index, value
-
-	compileExprReduceMV(fc, stmt.Object, &slot, &oslot)
-	if oslot == slot {
-		fc.AddLocalVar("__o")
-		used = 4
-	}
-
-	lslot := fc.AddLocalVar("__l")
-
-	fc.AddInst(opCreateABC(OP_LEN, lslot, oslot, 0))
-	kst0 := fc.Consts.IndexOf(KNumber(0))
-
-	index := fc.AddLocalVar("__i")
-	key := fc.AddLocalVar(stmt.Index)
+	fc.CurBlock.end = stmt.EndPos()
+
+	// the list, dict or iterator function, the state passed to the iterator
+	// and the control value are the 3 first local vars of the new block,
+	// followed by the index and the value
+	generator := fc.AddLocalVar("(for generator)")
+	fc.AddLocalVar("(for state)")
+	control := fc.AddLocalVar("(for control)")
+	compileExpr(fc, stmt.Object, generator, eOption(1))
+	fc.AddInst(opCreateABC(OP_LOADNIL, generator+1, control, 0))
+
+	fc.AddLocalVar(stmt.Index)
 	fc.AddLocalVar(stmt.Value)
-
-	fc.AddInst(opCreateABx(OP_LOADK, index, kst0))
-	fc.AddInst(opCreateABC(OP_LT, 0, index, lslot))
-	fc.AddInst(opCreateASbx(OP_JMP, 0, endLabel))
+	fc.declare(stmt.Index, stmt.IndexPos, SymbolLoopVar)
+	fc.declare(stmt.Value, stmt.ValuePos, SymbolLoopVar)
+	fc.AddInst(opCreateASbx(OP_JMP, 0, loopLabel))
 
 	fc.MarkLabel(doLabel, fc.Inst.LastIndex())
-	fc.AddInst(opCreateABC(OP_GETFIELD, key, oslot, index))
-
-	//fc.AddInst(opCreateABC(OP_GETTABLE, value, oslot, index))
-
 	compileChunk(fc, stmt.Block)
 
-	fc.CloseBlock(used)
+	fc.Inst.SetLine(stmt.Pos().Line)
+	fc.CloseBlock(3) // not close generator, state, control
 
-	fc.AddInst(opCreateABC(OP_ADD, index, index, opRkAsk(fc.Consts.IndexOf(KNumber(1)))))
-	fc.AddInst(opCreateABC(OP_LT, 1, index, lslot))
+	// OP_TFORLOOP  A C   R(A+3), R(A+4) := next item of R(A);
+	//                    if there is one R(A+2) := control value else pc++
+	fc.MarkLabel(loopLabel, fc.Inst.LastIndex())
+	fc.AddInst(opCreateABC(OP_TFORLOOP, generator, 0, 2))
 	fc.AddInst(opCreateASbx(OP_JMP, 0, doLabel))
 
 	fc.MarkLabel(endLabel, fc.Inst.LastIndex())
@@ -384,13 +412,45 @@ func compileChunk(fc *FunctionContext, chunk []ast.Stmt) {
 	}
 }
 
-func Compile(chunk []ast.Stmt) *FuncProto {
+// funcNameOf returns the name a function gets when assigned to lhs.
+func funcNameOf(lhs ast.Expr) string {
+	switch e := lhs.(type) {
+	case *ast.IdentExpr:
+		return e.Value
+	case *ast.FieldGetExpr:
+		if k, ok := e.Key.(*ast.StringExpr); ok {
+			return k.Value
+		}
+	}
+	return ""
+}
+
+// Compile compiles a parsed chunk into the prototype of its main function.
+func Compile(chunk []ast.Stmt) (*FuncProto, error) {
+	return compile(chunk, nil)
+}
+
+func compile(chunk []ast.Stmt, symbols *SymbolTable) (proto *FuncProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cerr, ok := r.(*CompileError)
+			if !ok {
+				panic(r)
+			}
+			err = cerr
+		}
+	}()
 	funcExpr := &ast.FunctionExpr{
 		Params:  []string{},
 		HasVArg: true,
 		Block:   chunk,
 	}
+	if len(chunk) > 0 {
+		funcExpr.SetPos(chunk[0].Pos())
+	}
 	context := NewFunctionContext(nil, 0, true)
+	context.Proto.Name = "main chunk"
+	context.symbols = symbols
 	compileFuncExpr(context, funcExpr)
-	return context.Proto
+	return context.Proto, nil
 }
@@ -0,0 +1,134 @@
+package cpi
+
+import (
+	"github.com/khoakmp/kala/ast"
+)
+
+// kinds of the declarations of a SymbolTable
+const (
+	SymbolVar = iota
+	SymbolFunction
+	SymbolParam
+	SymbolLoopVar
+)
+
+// Symbol is a name of a chunk as resolved by the compiler, either the
+// declaration of a local variable or a use of a name.
+type Symbol struct {
+	Name  string
+	Pos   ast.Position // first character of the name
+	Scope int          // ScopeLocal, ScopeUpValue or ScopeGlobal
+	// Decl is the declaration of a local or an upvalue, the symbol itself
+	// for a declaration and nil for a global.
+	Decl *Symbol
+
+	// uses only
+	Assign bool // the name is assigned, not read
+
+	// declarations only
+	Kind int
+	// End is the end of the block of the declaration, the variable is
+	// visible from Pos to End. Its Line is 0 for the main chunk.
+	End ast.Position
+	// Func is the name of the function declaring the variable.
+	Func string
+}
+
+// InScope reports whether the declaration d is visible at pos.
+func (d *Symbol) InScope(pos ast.Position) bool {
+	if before(pos, d.Pos) {
+		return false
+	}
+	return d.End.Line == 0 || !before(d.End, pos)
+}
+
+func before(a, b ast.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// SymbolTable lists the declarations and the uses of the names of a chunk,
+// in the order the compiler meets them.
+type SymbolTable struct {
+	Decls []*Symbol
+	Uses  []*Symbol
+}
+
+// At returns the symbol, declaration or use, whose name covers pos.
+func (t *SymbolTable) At(pos ast.Position) *Symbol {
+	covers := func(s *Symbol) bool {
+		return s.Pos.Line == pos.Line && s.Pos.Column <= pos.Column && pos.Column < s.Pos.Column+len(s.Name)
+	}
+	for _, s := range t.Uses {
+		if covers(s) {
+			return s
+		}
+	}
+	for _, s := range t.Decls {
+		if covers(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Visible returns the declarations visible at pos, a shadowed declaration
+// is left out.
+func (t *SymbolTable) Visible(pos ast.Position) []*Symbol {
+	byName := map[string]int{}
+	vars := []*Symbol{}
+	for _, d := range t.Decls {
+		if !d.InScope(pos) {
+			continue
+		}
+		// inner declarations come after outer ones
+		if i, ok := byName[d.Name]; ok {
+			vars[i] = d
+			continue
+		}
+		byName[d.Name] = len(vars)
+		vars = append(vars, d)
+	}
+	return vars
+}
+
+// CompileSymbols compiles chunk like Compile and also returns the symbols
+// of chunk. The symbols met before a compile error are returned with it.
+func CompileSymbols(chunk []ast.Stmt) (*FuncProto, *SymbolTable, error) {
+	symbols := &SymbolTable{}
+	proto, err := compile(chunk, symbols)
+	return proto, symbols, err
+}
+
+// declare records the declaration of the local variable name, just added to
+// the current block.
+func (fc *FunctionContext) declare(name string, pos ast.Position, kind int) {
+	if fc.symbols == nil || pos.Line <= 0 {
+		return
+	}
+	d := &Symbol{Name: name, Pos: pos, Scope: ScopeLocal, Kind: kind, End: fc.CurBlock.end, Func: fc.Proto.Name}
+	d.Decl = d
+	if fc.CurBlock.decls == nil {
+		fc.CurBlock.decls = map[string]*Symbol{}
+	}
+	// like FindLocalVar, a name declared twice in a block refers to the first
+	// variable
+	if _, ok := fc.CurBlock.decls[name]; !ok {
+		fc.CurBlock.decls[name] = d
+	}
+	fc.symbols.Decls = append(fc.symbols.Decls, d)
+}
+
+// reference records a use of the name e.
+func (fc *FunctionContext) reference(e *ast.IdentExpr, assign bool) {
+	if fc.symbols == nil || e.Pos().Line <= 0 {
+		return
+	}
+	use := &Symbol{Name: e.Value, Pos: e.Pos(), Scope: getVarScope(fc, e.Value), Assign: assign}
+	for f := fc; f != nil && use.Scope != ScopeGlobal; f = f.Parent {
+		if idx, block := f.FindLocaVarAndBlock(e.Value); idx > -1 {
+			use.Decl = block.decls[e.Value]
+			break
+		}
+	}
+	fc.symbols.Uses = append(fc.symbols.Uses, use)
+}
@@ -0,0 +1,66 @@
+package cpi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/parse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileSymbols(t *testing.T) {
+	src := `var count = 0
+func incr(step) {
+	count = count + step
+	total = count
+}
+for i = 0, 3 {
+	var x = i
+	incr(x)
+}
+print(total)`
+	chunk, err := parse.Parse(strings.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	_, symbols, err := CompileSymbols(chunk)
+	assert.Nil(t, err)
+
+	decls := []string{}
+	for _, d := range symbols.Decls {
+		decls = append(decls, d.Name)
+	}
+	assert.Equal(t, []string{"count", "incr", "step", "i", "x"}, decls)
+	assert.Equal(t, SymbolFunction, symbols.Decls[1].Kind)
+	assert.Equal(t, "incr", symbols.Decls[2].Func)
+
+	pos := func(line, column int) ast.Position {
+		return ast.Position{Source: "script.kala", Line: line, Column: column}
+	}
+	// count = count + step
+	count := symbols.At(pos(3, 2))
+	assert.Equal(t, ScopeUpValue, count.Scope)
+	assert.True(t, count.Assign)
+	assert.Equal(t, pos(1, 5), count.Decl.Pos)
+	step := symbols.At(pos(3, 18))
+	assert.Equal(t, ScopeLocal, step.Scope)
+	assert.Equal(t, pos(2, 11), step.Decl.Pos)
+
+	total := symbols.At(pos(10, 8))
+	assert.Equal(t, "total", total.Name)
+	assert.Equal(t, ScopeGlobal, total.Scope)
+	assert.Nil(t, total.Decl)
+
+	// a declaration is its own symbol
+	assert.Equal(t, symbols.Decls[4], symbols.At(pos(7, 6)))
+
+	names := func(vars []*Symbol) []string {
+		list := []string{}
+		for _, v := range vars {
+			list = append(list, v.Name)
+		}
+		return list
+	}
+	assert.Equal(t, []string{"count", "incr", "step"}, names(symbols.Visible(pos(4, 1))))
+	assert.Equal(t, []string{"count", "incr", "i", "x"}, names(symbols.Visible(pos(8, 1))))
+	assert.Equal(t, []string{"count", "incr"}, names(symbols.Visible(pos(10, 1))))
+}
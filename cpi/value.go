@@ -3,8 +3,11 @@ package cpi
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"slices"
 	"strconv"
+
+	"github.com/khoakmp/kala/ast"
 )
 
 const (
@@ -50,10 +53,11 @@ func (k KString) Str() string {
 
 type KNumber float64
 
-func kNumber(v string) KNumber {
+// kNumber returns the value of the number literal v, found at pos.
+func kNumber(v string, pos ast.Position) KNumber {
 	value, err := strconv.ParseFloat(v, 64)
 	if err != nil {
-		panic(err)
+		raiseCompileError(pos, "malformed number %q", v)
 	}
 	return KNumber(value)
 }
@@ -104,19 +108,58 @@ func (d KDict) Type() int {
 	return KTypeDict
 }
 
+// Str lists the fields of d in the order of their keys, see GetKeyValue. A
+// dict or list met again inside itself is printed as {...} or [...].
 func (d KDict) Str() string {
-	buffer := bytes.NewBuffer([]byte("{"))
-	l := len(d.dict)
-	idx := 0
-	for k, v := range d.dict {
-		buffer.WriteString(fmt.Sprintf(" %s:%s", k, v.Str()))
-		if idx < l-1 {
-			buffer.WriteRune(',')
+	buffer := bytes.NewBuffer(nil)
+	writeStr(buffer, d, nil)
+	return buffer.String()
+}
+
+// WriteStr writes the string of v, as returned by its Str method, to w piece
+// by piece, so a writer can bound the output as it grows.
+func WriteStr(w io.Writer, v KValue) {
+	writeStr(w, v, nil)
+}
+
+// writeStr writes the string of v to w. parents are the dicts and lists
+// being written, by the pointer they share with their copies.
+func writeStr(w io.Writer, v KValue, parents []any) {
+	switch v := v.(type) {
+	case KDict:
+		if slices.Contains(parents, any(v.keys)) {
+			io.WriteString(w, "{...}")
+			return
 		}
-		idx++
+		parents = append(parents, v.keys)
+		io.WriteString(w, "{")
+		l := len(v.keys.array)
+		for idx, k := range v.keys.array {
+			fmt.Fprintf(w, " %s:", k)
+			writeStr(w, v.dict[k], parents)
+			if idx < l-1 {
+				io.WriteString(w, ",")
+			}
+		}
+		io.WriteString(w, "}")
+	case KList:
+		if slices.Contains(parents, any(v.list)) {
+			io.WriteString(w, "[...]")
+			return
+		}
+		parents = append(parents, v.list)
+		io.WriteString(w, "[")
+		l := len(v.list.array)
+		for idx, e := range v.list.array {
+			writeStr(w, e, parents)
+			if idx < l-1 {
+				io.WriteString(w, ",")
+			}
+		}
+		io.WriteString(w, "]")
+	default:
+		io.WriteString(w, v.Str())
 	}
-	buffer.WriteRune('}')
-	return buffer.String()
 }
 
 func (d KDict) GetField(field string) KValue {
@@ -127,6 +170,12 @@ func (d KDict) GetField(field string) KValue {
 	return KNil{}
 }
 
+// Has reports whether field is set in d.
+func (d KDict) Has(field string) bool {
+	_, ok := d.dict[field]
+	return ok
+}
+
 func (d KDict) SetField(field string, value KValue) {
 	d.dict[field] = value
 	if !slices.Contains(d.keys.array, field) {
@@ -134,6 +183,17 @@ func (d KDict) SetField(field string, value KValue) {
 	}
 }
 
+// Delete removes field from d, the following keys move down by one in the
+// order of GetKeyValue.
+func (d KDict) Delete(field string) {
+	if _, ok := d.dict[field]; !ok {
+		return
+	}
+	delete(d.dict, field)
+	i := slices.Index(d.keys.array, field)
+	d.keys.array = slices.Delete(d.keys.array, i, i+1)
+}
+
 func (d KDict) GetAt(index int) KValue {
 	if len(d.keys.array) <= index {
 		panic("index out of len dict")
@@ -152,6 +212,9 @@ func (d KDict) GetKeyValue(index int) (string, KValue) {
 
 func (d KDict) Len() int { return len(d.keys.array) }
 
+// Same reports whether d and o refer to the same dict.
+func (d KDict) Same(o KDict) bool { return d.keys == o.keys }
+
 type KList struct {
 	list *klist
 }
@@ -160,16 +223,10 @@ func (l KList) Type() int {
 	return KTypeList
 }
 
+// Str lists the values of l, see KDict.Str.
 func (k KList) Str() string {
-	buffer := bytes.NewBuffer([]byte("["))
-	l := len(k.list.array)
-	for idx, e := range k.list.array {
-		buffer.WriteString(e.Str())
-		if idx < l-1 {
-			buffer.WriteRune(',')
-		}
-	}
-	buffer.WriteRune(']')
+	buffer := bytes.NewBuffer(nil)
+	writeStr(buffer, k, nil)
 	return buffer.String()
 }
 
@@ -206,6 +263,21 @@ func (l KList) SetAt(index int, v KValue) {
 	l.list.array[index] = v
 }
 
+// Insert inserts v at index, which must be in [0, Len()].
+func (l KList) Insert(index int, v KValue) {
+	l.list.array = slices.Insert(l.list.array, index, v)
+}
+
+// Remove removes and returns the value at index.
+func (l KList) Remove(index int) KValue {
+	v := l.list.array[index]
+	l.list.array = slices.Delete(l.list.array, index, index+1)
+	return v
+}
+
+// Same reports whether l and o refer to the same list.
+func (l KList) Same(o KList) bool { return l.list == o.list }
+
 func (l KList) Len() int {
 	return len(l.list.array)
 }
@@ -0,0 +1,32 @@
+package cpi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrCycles(t *testing.T) {
+	d := NewKDict(2)
+	d.SetField("a", KNumber(1))
+	d.SetField("self", d)
+	assert.Equal(t, "{ a:1.00, self:{...}}", d.Str())
+
+	l := NewKList(2)
+	l.Append(KBool(true))
+	l.Append(l)
+	assert.Equal(t, "[true,[...]]", l.Str())
+
+	// a value met twice outside of a cycle is printed each time
+	shared := NewKList(1)
+	shared.Append(KString("x"))
+	outer := NewKList(3)
+	outer.AppendArray([]KValue{shared, shared, d})
+	assert.Equal(t, "[[x],[x],{ a:1.00, self:{...}}]", outer.Str())
+
+	// the cycle goes through a dict and a list
+	inner := NewKDict(1)
+	inner.SetField("up", l)
+	l.SetAt(0, inner)
+	assert.Equal(t, "[{ up:[...]},[...]]", l.Str())
+}
@@ -0,0 +1,149 @@
+package dap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/khoakmp/kala/internal/jsonrpc"
+)
+
+// message is the envelope of every message of the Debug Adapter Protocol.
+// Requests carry Command and Arguments, responses RequestSeq, Success,
+// Command, Message and Body, events Event and Body.
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    *bool           `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       any             `json:"body,omitempty"`
+}
+
+// conn reads and writes the messages of a session.
+type conn struct {
+	rpc *jsonrpc.Conn
+
+	mu  sync.Mutex // keeps the sequence numbers in the order of the writes
+	seq int
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{rpc: jsonrpc.NewConn(r, w)}
+}
+
+func (c *conn) read() (*message, error) {
+	msg := &message{}
+	if err := c.rpc.Read(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *conn) write(msg *message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	msg.Seq = c.seq
+	return c.rpc.Write(msg)
+}
+
+func (c *conn) respond(req *message, body any) error {
+	success := true
+	return c.write(&message{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: &success, Body: body})
+}
+
+func (c *conn) respondError(req *message, format string, args ...any) error {
+	success := false
+	return c.write(&message{
+		Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: &success,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *conn) event(name string, body any) error {
+	return c.write(&message{Type: "event", Event: name, Body: body})
+}
+
+// The bodies and arguments below hold the fields of the protocol used by
+// the server, the others are ignored.
+
+type capabilities struct {
+	SupportsConfigurationDoneRequest bool `json:"supportsConfigurationDoneRequest"`
+	SupportsFunctionBreakpoints      bool `json:"supportsFunctionBreakpoints"`
+	SupportsEvaluateForHovers        bool `json:"supportsEvaluateForHovers"`
+	SupportsTerminateRequest         bool `json:"supportsTerminateRequest"`
+}
+
+type launchArguments struct {
+	Program     string   `json:"program"`
+	Args        []string `json:"args"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+	NoDebug     bool     `json:"noDebug"`
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+}
+
+type functionBreakpoint struct {
+	Name string `json:"name"`
+}
+
+type setFunctionBreakpointsArguments struct {
+	Breakpoints []functionBreakpoint `json:"breakpoints"`
+}
+
+type breakpoint struct {
+	ID       int     `json:"id"`
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line,omitempty"`
+	Source   *source `json:"source,omitempty"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type stackFrame struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type frameArguments struct {
+	ThreadID           int    `json:"threadId"`
+	FrameID            int    `json:"frameId"`
+	VariablesReference int    `json:"variablesReference"`
+	Expression         string `json:"expression"`
+}
@@ -0,0 +1,454 @@
+// Package dap implements a Debug Adapter Protocol server for Kala scripts,
+// on top of vm.Debugger. The server debugs one script per session, which
+// runs in a goroutine of its own and is the single thread of the session.
+package dap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+	"github.com/khoakmp/kala/vm"
+)
+
+// threadID is the id of the only thread of a session.
+const threadID = 1
+
+// Server is a debug session read from and written to a pair of streams,
+// usually the stdin and stdout of the adapter process.
+type Server struct {
+	conn *conn
+
+	state    *vm.State
+	debugger *vm.Debugger
+	proto    *cpi.FuncProto
+	args     []cpi.KValue
+	entry    bool // stop on the first line
+
+	mu          sync.Mutex
+	started     bool                    // configurationDone started the script
+	stopped     bool                    // the script is suspended in the debug handler
+	cmds        chan func(*vm.Debugger) // run by the script goroutine while it is stopped
+	terminating bool
+	sourceBps   map[string][]int // ids of the breakpoints set for each source
+	functionBps []int
+	done        chan struct{} // closed when the script ends
+
+	// variable references, only used by the script goroutine while it is
+	// stopped. They are valid until the script resumes.
+	refs []func() []variable
+}
+
+// NewServer returns a server reading requests from r and writing responses
+// and events to w.
+func NewServer(r io.Reader, w io.Writer) *Server {
+	s := &Server{
+		conn:      newConn(r, w),
+		state:     vm.NewState(),
+		cmds:      make(chan func(*vm.Debugger)),
+		sourceBps: map[string][]int{},
+		done:      make(chan struct{}),
+	}
+	s.debugger = vm.NewDebugger(s.state, s.stoppedHandler)
+	// the output of print goes to the client, stdout carries the protocol
+	s.state.Register("print", func(st *vm.State) int {
+		buf := bytes.NewBuffer(nil)
+		for i := 1; i <= st.ArgCount(); i++ {
+			buf.WriteString(st.Arg(i).Str())
+			buf.WriteByte(' ')
+		}
+		buf.WriteByte('\n')
+		s.output("stdout", buf.String())
+		return 0
+	})
+	return s
+}
+
+// Serve handles requests until the client disconnects or the input ends.
+func (s *Server) Serve() error {
+	for {
+		req, err := s.conn.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				s.terminate()
+				return nil
+			}
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if err := s.handle(req); err != nil {
+			return err
+		}
+		if req.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+func (s *Server) handle(req *message) error {
+	switch req.Command {
+	case "initialize":
+		if err := s.conn.respond(req, capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsFunctionBreakpoints:      true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		}); err != nil {
+			return err
+		}
+		return s.conn.event("initialized", nil)
+	case "launch":
+		return s.launch(req)
+	case "setBreakpoints":
+		return s.setBreakpoints(req)
+	case "setFunctionBreakpoints":
+		return s.setFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		return s.conn.respond(req, map[string]any{"breakpoints": []breakpoint{}})
+	case "configurationDone":
+		s.mu.Lock()
+		start := s.proto != nil && !s.started
+		s.started = s.started || start
+		s.mu.Unlock()
+		if !start {
+			return s.conn.respondError(req, "configurationDone: no program to start")
+		}
+		if err := s.conn.respond(req, nil); err != nil {
+			return err
+		}
+		go s.run()
+		return nil
+	case "threads":
+		return s.conn.respond(req, map[string]any{"threads": []thread{{ID: threadID, Name: "main"}}})
+	case "stackTrace":
+		return s.whileStopped(req, s.stackTrace)
+	case "scopes":
+		return s.whileStopped(req, s.scopes)
+	case "variables":
+		return s.whileStopped(req, s.variables)
+	case "evaluate":
+		return s.whileStopped(req, s.evaluate)
+	case "continue":
+		return s.resume(req, (*vm.Debugger).Continue, map[string]any{"allThreadsContinued": true})
+	case "next":
+		return s.resume(req, (*vm.Debugger).StepOver, nil)
+	case "stepIn":
+		return s.resume(req, (*vm.Debugger).StepInto, nil)
+	case "stepOut":
+		return s.resume(req, (*vm.Debugger).StepOut, nil)
+	case "pause":
+		s.debugger.Pause()
+		return s.conn.respond(req, nil)
+	case "terminate", "disconnect":
+		s.terminate()
+		return s.conn.respond(req, nil)
+	}
+	return s.conn.respondError(req, "unsupported request %q", req.Command)
+}
+
+func (s *Server) launch(req *message) error {
+	var args launchArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil || args.Program == "" {
+		return s.conn.respondError(req, "launch: a program is required")
+	}
+	path, err := filepath.Abs(args.Program)
+	if err != nil {
+		return s.conn.respondError(req, "launch: %v", err)
+	}
+	proto, err := compileFile(path)
+	if err != nil {
+		return s.conn.respondError(req, "%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	s.proto = proto
+	for _, a := range args.Args {
+		s.args = append(s.args, cpi.KString(a))
+	}
+	s.entry = args.StopOnEntry
+	if args.NoDebug {
+		s.debugger.Detach()
+	}
+	return s.conn.respond(req, nil)
+}
+
+// compileFile loads a script or a compiled chunk, like kala run.
+func compileFile(path string) (*cpi.FuncProto, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(cpi.BytecodeMagic)) {
+		return cpi.Load(bytes.NewReader(data))
+	}
+	chunk, err := parse.Parse(bytes.NewReader(data), path)
+	if err != nil {
+		return nil, err
+	}
+	return cpi.Compile(chunk)
+}
+
+// run runs the script and reports its end, it is the script goroutine.
+func (s *Server) run() {
+	defer close(s.done)
+	if s.entry {
+		s.debugger.StepInto()
+	}
+	exitCode := 0
+	if _, err := s.state.Call(vm.NewLocalClosure(s.proto), s.args...); err != nil && !errors.Is(err, vm.ErrTerminated) {
+		msg := strings.TrimRight(err.Error(), "\n") + "\n"
+		if rerr, ok := err.(*vm.RuntimeError); ok {
+			msg += rerr.StackTrace() + "\n"
+		}
+		s.output("stderr", msg)
+		exitCode = 1
+	}
+	s.conn.event("exited", map[string]any{"exitCode": exitCode})
+	s.conn.event("terminated", nil)
+}
+
+func (s *Server) output(category, text string) {
+	s.conn.event("output", map[string]any{"category": category, "output": text})
+}
+
+// stoppedHandler is the vm.DebugHandler of the session. It runs the commands
+// sent by the requests until one of them resumes the script.
+func (s *Server) stoppedHandler(d *vm.Debugger, ev vm.StopEvent) {
+	reason := "step"
+	switch {
+	case s.entry:
+		reason = "entry"
+		s.entry = false
+	case ev.Reason == vm.StopBreakpoint:
+		reason = "breakpoint"
+		if ev.Breakpoint.Function != "" {
+			reason = "function breakpoint"
+		}
+	case ev.Reason == vm.StopPause:
+		reason = "pause"
+	}
+
+	s.mu.Lock()
+	if s.terminating {
+		s.mu.Unlock()
+		d.Terminate()
+		return
+	}
+	s.stopped = true
+	s.refs = s.refs[:0]
+	s.mu.Unlock()
+	s.conn.event("stopped", map[string]any{"reason": reason, "threadId": threadID, "allThreadsStopped": true})
+
+	for cmd := range s.cmds {
+		cmd(d)
+		s.mu.Lock()
+		resumed := !s.stopped
+		s.mu.Unlock()
+		if resumed {
+			return
+		}
+	}
+}
+
+// whileStopped runs handler on the script goroutine, which must be stopped.
+func (s *Server) whileStopped(req *message, handler func(d *vm.Debugger, req *message) error) error {
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+	if !stopped {
+		return s.conn.respondError(req, "%s: the script is not stopped", req.Command)
+	}
+	errc := make(chan error, 1)
+	s.cmds <- func(d *vm.Debugger) {
+		errc <- handler(d, req)
+	}
+	return <-errc
+}
+
+// resume resumes the stopped script with step. The script is marked running
+// before step is sent, so that no later request waits on a script that
+// has gone.
+func (s *Server) resume(req *message, step func(*vm.Debugger), body any) error {
+	s.mu.Lock()
+	stopped := s.stopped
+	s.stopped = false
+	s.mu.Unlock()
+	if !stopped {
+		return s.conn.respondError(req, "%s: the script is not stopped", req.Command)
+	}
+	err := s.conn.respond(req, body)
+	s.cmds <- step
+	return err
+}
+
+// terminate stops the script, if it runs, and waits for its end.
+func (s *Server) terminate() {
+	s.mu.Lock()
+	s.terminating = true
+	started, stopped := s.started, s.stopped
+	s.stopped = false
+	s.mu.Unlock()
+	if !started {
+		return
+	}
+	if stopped {
+		s.cmds <- (*vm.Debugger).Terminate
+	} else {
+		s.debugger.Pause()
+	}
+	<-s.done
+}
+
+func (s *Server) setBreakpoints(req *message) error {
+	var args setBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.conn.respondError(req, "setBreakpoints: %v", err)
+	}
+	path := args.Source.Path
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.sourceBps[path] {
+		s.debugger.ClearBreakpoint(id)
+	}
+	ids := []int{}
+	bps := []breakpoint{}
+	for _, b := range args.Breakpoints {
+		bp := s.debugger.SetBreakpoint(path, b.Line)
+		ids = append(ids, bp.ID)
+		bps = append(bps, breakpoint{ID: bp.ID, Verified: true, Line: b.Line, Source: &args.Source})
+	}
+	s.sourceBps[path] = ids
+	return s.conn.respond(req, map[string]any{"breakpoints": bps})
+}
+
+func (s *Server) setFunctionBreakpoints(req *message) error {
+	var args setFunctionBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.conn.respondError(req, "setFunctionBreakpoints: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.functionBps {
+		s.debugger.ClearBreakpoint(id)
+	}
+	s.functionBps = s.functionBps[:0]
+	bps := []breakpoint{}
+	for _, b := range args.Breakpoints {
+		bp := s.debugger.SetFunctionBreakpoint(b.Name)
+		s.functionBps = append(s.functionBps, bp.ID)
+		bps = append(bps, breakpoint{ID: bp.ID, Verified: true})
+	}
+	return s.conn.respond(req, map[string]any{"breakpoints": bps})
+}
+
+func (s *Server) stackTrace(d *vm.Debugger, req *message) error {
+	frames := []stackFrame{}
+	for _, f := range d.Frames() {
+		sf := stackFrame{ID: f.Index, Name: f.Function, Line: f.Line, Column: 1}
+		if f.PC >= 0 {
+			sf.Source = &source{Name: filepath.Base(f.Source), Path: f.Source}
+		}
+		frames = append(frames, sf)
+	}
+	return s.conn.respond(req, map[string]any{"stackFrames": frames, "totalFrames": len(frames)})
+}
+
+func (s *Server) scopes(d *vm.Debugger, req *message) error {
+	var args frameArguments
+	json.Unmarshal(req.Arguments, &args)
+	frame := args.FrameID
+	scopes := []scope{
+		{Name: "Locals", VariablesReference: s.newRef(func() []variable { return s.variableList(d.Locals(frame)) })},
+		{Name: "Upvalues", VariablesReference: s.newRef(func() []variable { return s.variableList(d.Upvalues(frame)) })},
+		{Name: "Globals", VariablesReference: s.newRef(func() []variable { return s.variableList(d.Globals()) }), Expensive: true},
+	}
+	return s.conn.respond(req, map[string]any{"scopes": scopes})
+}
+
+func (s *Server) variables(d *vm.Debugger, req *message) error {
+	var args frameArguments
+	json.Unmarshal(req.Arguments, &args)
+	ref := args.VariablesReference
+	if ref < 1 || ref > len(s.refs) {
+		return s.conn.respondError(req, "variables: invalid reference %d", ref)
+	}
+	return s.conn.respond(req, map[string]any{"variables": s.refs[ref-1]()})
+}
+
+func (s *Server) evaluate(d *vm.Debugger, req *message) error {
+	var args frameArguments
+	json.Unmarshal(req.Arguments, &args)
+	values, err := d.Evaluate(args.FrameID, args.Expression)
+	if err != nil {
+		return s.conn.respondError(req, "%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	strs := make([]string, len(values))
+	ref := 0
+	for i, v := range values {
+		strs[i] = v.Str()
+	}
+	if len(values) == 1 {
+		ref = s.valueRef(values[0])
+	}
+	return s.conn.respond(req, map[string]any{"result": strings.Join(strs, ", "), "variablesReference": ref})
+}
+
+// newRef registers the children of a scope or of a value and returns their
+// reference, references start at 1.
+func (s *Server) newRef(children func() []variable) int {
+	s.refs = append(s.refs, children)
+	return len(s.refs)
+}
+
+// valueRef returns the reference of the elements of a dict or a list, 0 for
+// the other values.
+func (s *Server) valueRef(v cpi.KValue) int {
+	switch v := v.(type) {
+	case cpi.KDict:
+		return s.newRef(func() []variable {
+			vars := make([]vm.Variable, 0, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				k, val := v.GetKeyValue(i)
+				vars = append(vars, vm.Variable{Name: k, Value: val})
+			}
+			sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+			return s.variableList(vars)
+		})
+	case cpi.KList:
+		return s.newRef(func() []variable {
+			vars := make([]vm.Variable, 0, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				vars = append(vars, vm.Variable{Name: fmt.Sprintf("[%d]", i), Value: v.GetAt(i)})
+			}
+			return s.variableList(vars)
+		})
+	}
+	return 0
+}
+
+func (s *Server) variableList(vars []vm.Variable) []variable {
+	list := make([]variable, 0, len(vars))
+	for _, v := range vars {
+		list = append(list, variable{
+			Name:               v.Name,
+			Value:              v.Value.Str(),
+			Type:               cpi.TypeNames[v.Value.Type()],
+			VariablesReference: s.valueRef(v.Value),
+		})
+	}
+	return list
+}
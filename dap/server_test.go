@@ -0,0 +1,246 @@
+package dap
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testScript = `var total = 0
+func add(x) {
+	var y = x * 2
+	total = total + y
+	return y
+}
+var items = [1, 2]
+for i = 0, 3 {
+	add(i)
+}
+print("total", total)
+result = {"total": total}
+print("done")`
+
+// client drives a Server through a pair of pipes, it decodes the bodies as
+// generic JSON.
+type client struct {
+	t    *testing.T
+	conn *conn
+	msgs chan *message // read ahead, so that the server never blocks on a write
+	errc chan error
+	out  []string // output events
+}
+
+func newClient(t *testing.T) *client {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	c := &client{t: t, conn: newConn(respR, reqW), msgs: make(chan *message, 100), errc: make(chan error, 1)}
+	go func() {
+		for {
+			msg, err := c.conn.read()
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	go func() {
+		err := NewServer(reqR, respW).Serve()
+		respW.Close()
+		c.errc <- err
+	}()
+	return c
+}
+
+type reply struct {
+	Success bool
+	Message string
+	Body    map[string]any
+}
+
+// request sends a request and returns its response.
+func (c *client) request(command string, args any) reply {
+	raw, _ := json.Marshal(args)
+	err := c.conn.write(&message{Type: "request", Command: command, Arguments: raw})
+	assert.Nil(c.t, err)
+	seq := c.conn.seq
+	for {
+		msg := c.next()
+		if msg.Type == "response" && msg.RequestSeq == seq {
+			r := reply{Success: *msg.Success, Message: msg.Message}
+			r.Body, _ = msg.Body.(map[string]any)
+			return r
+		}
+	}
+}
+
+// waitEvent skips messages until the event name and returns its body.
+func (c *client) waitEvent(name string) map[string]any {
+	for {
+		msg := c.next()
+		if msg.Type == "event" && msg.Event == name {
+			body, _ := msg.Body.(map[string]any)
+			return body
+		}
+	}
+}
+
+func (c *client) next() *message {
+	msg, ok := <-c.msgs
+	if !ok {
+		c.t.Fatal("the server closed the connection")
+	}
+	if msg.Event == "output" {
+		c.out = append(c.out, msg.Body.(map[string]any)["output"].(string))
+	}
+	return msg
+}
+
+func (c *client) topLine() float64 {
+	r := c.request("stackTrace", frameArguments{ThreadID: threadID})
+	frames := r.Body["stackFrames"].([]any)
+	return frames[0].(map[string]any)["line"].(float64)
+}
+
+// variables returns the variables of ref by name, with their value and reference.
+func (c *client) variables(ref float64) map[string][2]any {
+	r := c.request("variables", frameArguments{VariablesReference: int(ref)})
+	assert.True(c.t, r.Success, r.Message)
+	vars := map[string][2]any{}
+	for _, v := range r.Body["variables"].([]any) {
+		v := v.(map[string]any)
+		vars[v["name"].(string)] = [2]any{v["value"], v["variablesReference"]}
+	}
+	return vars
+}
+
+func writeScript(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "script.kala")
+	assert.Nil(t, os.WriteFile(path, []byte(testScript), 0o644))
+	return path
+}
+
+func TestServerSession(t *testing.T) {
+	path := writeScript(t)
+	c := newClient(t)
+
+	r := c.request("initialize", map[string]any{"adapterID": "kala"})
+	assert.True(t, r.Success)
+	assert.Equal(t, true, r.Body["supportsConfigurationDoneRequest"])
+	c.waitEvent("initialized")
+
+	assert.True(t, c.request("launch", launchArguments{Program: path}).Success)
+	r = c.request("setBreakpoints", setBreakpointsArguments{
+		Source:      source{Path: path},
+		Breakpoints: []sourceBreakpoint{{Line: 4}},
+	})
+	assert.True(t, r.Success)
+	assert.Len(t, r.Body["breakpoints"], 1)
+	assert.True(t, c.request("configurationDone", nil).Success)
+
+	ev := c.waitEvent("stopped")
+	assert.Equal(t, "breakpoint", ev["reason"])
+	assert.Equal(t, float64(4), c.topLine())
+
+	r = c.request("stackTrace", frameArguments{ThreadID: threadID})
+	frames := r.Body["stackFrames"].([]any)
+	assert.Len(t, frames, 2)
+	assert.Equal(t, "add", frames[0].(map[string]any)["name"])
+	assert.Equal(t, float64(9), frames[1].(map[string]any)["line"])
+
+	// the scopes of the caller, items expands to its elements
+	r = c.request("scopes", frameArguments{FrameID: 1})
+	scopes := r.Body["scopes"].([]any)
+	assert.Len(t, scopes, 3)
+	locals := c.variables(scopes[0].(map[string]any)["variablesReference"].(float64))
+	assert.Equal(t, "0.00", locals["total"][0])
+	assert.Equal(t, "0.00", locals["i"][0])
+	items := c.variables(locals["items"][1].(float64))
+	assert.Equal(t, "1.00", items["[0]"][0])
+	assert.Equal(t, "2.00", items["[1]"][0])
+
+	r = c.request("scopes", frameArguments{FrameID: 0})
+	scopes = r.Body["scopes"].([]any)
+	locals = c.variables(scopes[0].(map[string]any)["variablesReference"].(float64))
+	assert.Equal(t, "0.00", locals["x"][0])
+	upvalues := c.variables(scopes[1].(map[string]any)["variablesReference"].(float64))
+	assert.Equal(t, "0.00", upvalues["total"][0])
+
+	r = c.request("evaluate", frameArguments{FrameID: 0, Expression: "x + 10"})
+	assert.True(t, r.Success)
+	assert.Equal(t, "10.00", r.Body["result"])
+
+	// stepping
+	assert.True(t, c.request("next", frameArguments{ThreadID: threadID}).Success)
+	assert.Equal(t, "step", c.waitEvent("stopped")["reason"])
+	assert.Equal(t, float64(5), c.topLine())
+	assert.True(t, c.request("stepOut", frameArguments{ThreadID: threadID}).Success)
+	c.waitEvent("stopped")
+	assert.Equal(t, float64(8), c.topLine())
+
+	// without breakpoints the script runs to its end
+	r = c.request("setBreakpoints", setBreakpointsArguments{Source: source{Path: path}})
+	assert.Len(t, r.Body["breakpoints"], 0)
+	assert.True(t, c.request("continue", frameArguments{ThreadID: threadID}).Success)
+	assert.Equal(t, float64(0), c.waitEvent("exited")["exitCode"])
+	c.waitEvent("terminated")
+	assert.Equal(t, []string{"total 6.00 \n", "done \n"}, c.out)
+
+	// the script is gone
+	assert.False(t, c.request("stackTrace", frameArguments{ThreadID: threadID}).Success)
+	assert.True(t, c.request("disconnect", nil).Success)
+	assert.Nil(t, <-c.errc)
+}
+
+func TestServerGlobalsAndEntry(t *testing.T) {
+	path := writeScript(t)
+	c := newClient(t)
+	c.request("initialize", nil)
+	c.request("launch", launchArguments{Program: path, StopOnEntry: true})
+	c.request("setFunctionBreakpoints", setFunctionBreakpointsArguments{})
+	c.request("configurationDone", nil)
+
+	assert.Equal(t, "entry", c.waitEvent("stopped")["reason"])
+	assert.Equal(t, float64(1), c.topLine())
+
+	// stop on the last line, after result is set
+	c.request("setBreakpoints", setBreakpointsArguments{
+		Source:      source{Path: path},
+		Breakpoints: []sourceBreakpoint{{Line: 13}},
+	})
+	c.request("continue", nil)
+	assert.Equal(t, "breakpoint", c.waitEvent("stopped")["reason"])
+
+	r := c.request("scopes", frameArguments{FrameID: 0})
+	globals := c.variables(r.Body["scopes"].([]any)[2].(map[string]any)["variablesReference"].(float64))
+	result := c.variables(globals["result"][1].(float64))
+	assert.Equal(t, "6.00", result["total"][0])
+
+	// disconnecting stops the script
+	assert.True(t, c.request("disconnect", nil).Success)
+	assert.Nil(t, <-c.errc)
+}
+
+func TestServerErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fail.kala")
+	assert.Nil(t, os.WriteFile(path, []byte("var x = 1\nx = x + nil\n"), 0o644))
+	c := newClient(t)
+	c.request("initialize", nil)
+
+	r := c.request("launch", launchArguments{Program: filepath.Join(t.TempDir(), "missing.kala")})
+	assert.False(t, r.Success)
+	assert.False(t, c.request("configurationDone", nil).Success)
+	assert.False(t, c.request("bogus", nil).Success)
+
+	assert.True(t, c.request("launch", launchArguments{Program: path}).Success)
+	c.request("configurationDone", nil)
+	assert.Equal(t, float64(1), c.waitEvent("exited")["exitCode"])
+	assert.Len(t, c.out, 1)
+	assert.Contains(t, c.out[0], "fail.kala:2")
+	c.request("disconnect", nil)
+	assert.Nil(t, <-c.errc)
+}
@@ -0,0 +1,543 @@
+// Package format prints Kala scripts in their canonical layout: one
+// statement per line, blocks indented with tabs, single spaces around binary
+// operators and parentheses only where the precedence requires them.
+//
+// The comments are kept, a comment is printed before the statement that
+// follows it, or at the end of the line of the code it trails. Blank lines
+// between statements are kept, several of them are reduced to one.
+package format
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/parse"
+)
+
+// Source formats the script src, name is the source name used in syntax
+// errors. Formatting the result again leaves it unchanged.
+func Source(src []byte, name string) ([]byte, error) {
+	chunk, comments, err := parse.ParseWithComments(bytes.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := Fprint(buf, chunk, comments); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Fprint writes chunk to w in the canonical layout, with comments placed
+// after their positions in the source of chunk.
+func Fprint(w io.Writer, chunk []ast.Stmt, comments []ast.Comment) error {
+	p := &printer{comments: comments}
+	for _, stmt := range chunk {
+		p.stmtLine(stmt)
+	}
+	p.flush(ast.Position{Line: int(^uint(0) >> 1)})
+	if p.buf.Len() > 0 {
+		p.buf.WriteByte('\n')
+	}
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+type printer struct {
+	buf      bytes.Buffer
+	indent   int
+	comments []ast.Comment
+	next     int // index of the first comment not printed yet
+
+	// lastLine is the source line of the last code or comment printed, a
+	// comment on that line trails it.
+	lastLine int
+	// blockStart is set at the start of a block, where blank lines are
+	// dropped.
+	blockStart bool
+}
+
+func before(a, b ast.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+func (p *printer) write(s string) {
+	p.buf.WriteString(s)
+}
+
+// line starts a new line for code or a comment found at srcLine in the
+// source, after a blank line if the source has one.
+func (p *printer) line(srcLine int) {
+	if p.buf.Len() > 0 {
+		if !p.blockStart && p.lastLine > 0 && srcLine > p.lastLine+1 {
+			p.buf.WriteByte('\n')
+		}
+		p.buf.WriteByte('\n')
+	}
+	for i := 0; i < p.indent; i++ {
+		p.buf.WriteByte('\t')
+	}
+	p.blockStart = false
+}
+
+// flush prints the comments placed before pos.
+func (p *printer) flush(pos ast.Position) {
+	for ; p.next < len(p.comments) && before(p.comments[p.next].Pos, pos); p.next++ {
+		c := p.comments[p.next]
+		if c.Pos.Line == p.lastLine && p.buf.Len() > 0 {
+			p.write(" ")
+		} else {
+			p.line(c.Pos.Line)
+		}
+		p.write(c.Text)
+		p.lastLine = c.Pos.Line + strings.Count(c.Text, "\n")
+	}
+}
+
+// hasComment reports whether a comment is placed before pos.
+func (p *printer) hasComment(pos ast.Position) bool {
+	return p.next < len(p.comments) && before(p.comments[p.next].Pos, pos)
+}
+
+func (p *printer) stmtLine(stmt ast.Stmt) {
+	p.flush(stmt.Pos())
+	p.line(stmt.Pos().Line)
+	p.stmt(stmt)
+	p.lastLine = stmt.EndPos().Line
+}
+
+// block prints the braces and the statements of a block. header is the
+// source line of the opening brace, end is the position of the closing one.
+func (p *printer) block(chunk []ast.Stmt, header int, end ast.Position) {
+	p.write("{")
+	p.lastLine = header
+	if len(chunk) == 0 && !p.hasComment(end) {
+		p.write("}")
+		return
+	}
+	p.indent++
+	p.blockStart = true
+	for _, stmt := range chunk {
+		p.stmtLine(stmt)
+	}
+	p.flush(end)
+	p.indent--
+	p.blockStart = true
+	p.line(0)
+	p.write("}")
+	p.lastLine = end.Line
+}
+
+func (p *printer) stmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		p.exprList(s.Lhs)
+		p.write(" = ")
+		p.exprList(s.Rhs)
+	case *ast.VarDefStmt:
+		p.write("var " + typedNames(s.Vars, s.Types))
+		if len(s.Exprs) > 0 {
+			p.write(" = ")
+			p.exprList(s.Exprs)
+		}
+	case *ast.FuncDefStmt:
+		p.write("func " + s.FuncName)
+		p.params(s.ParList, s.ParamTypes, s.HasVArg, s.ReturnType)
+		p.write(" ")
+		p.block(s.Block, s.Pos().Line, s.EndPos())
+	case *ast.IfStmt:
+		p.ifStmt(s)
+	case *ast.WhileStmt:
+		p.write("while ")
+		p.expr(s.CondExpr)
+		p.write(" ")
+		p.block(s.Chunk, s.CondExpr.EndPos().Line, s.EndPos())
+	case *ast.ForNumberStmt:
+		p.write("for " + s.CounterName + " = ")
+		p.expr(s.Start)
+		p.write(", ")
+		p.expr(s.End)
+		last := s.End
+		if s.Step != nil {
+			p.write(", ")
+			p.expr(s.Step)
+			last = s.Step
+		}
+		p.write(" ")
+		p.block(s.Chunk, last.EndPos().Line, s.EndPos())
+	case *ast.ForRangeStmt:
+		p.write("for " + s.Index + ", " + s.Value + " = range ")
+		p.expr(s.Object)
+		p.write(" ")
+		p.block(s.Block, s.Object.EndPos().Line, s.EndPos())
+	case *ast.ReturnStmt:
+		p.write("return")
+		if len(s.Exprs) > 0 {
+			p.write(" ")
+			p.exprList(s.Exprs)
+		}
+	case *ast.BreakStmt:
+		p.write("break")
+	case *ast.FuncCallStmt:
+		p.expr(s.Expr)
+	case *ast.ListAppendStmt:
+		p.write("append(")
+		p.expr(s.Object)
+		p.write(", ")
+		p.expr(s.Element)
+		p.write(")")
+	}
+}
+
+func (p *printer) ifStmt(s *ast.IfStmt) {
+	p.write("if ")
+	p.expr(s.CondExpr)
+	p.write(" ")
+	if s.ElsePos.Line == 0 {
+		p.block(s.ThenChunk, s.CondExpr.EndPos().Line, s.EndPos())
+		return
+	}
+	p.block(s.ThenChunk, s.CondExpr.EndPos().Line, s.ElsePos)
+	p.write(" else ")
+	// else { if ... } is printed as such when the if is not next to the else
+	// keyword
+	if len(s.ElseChunk) == 1 {
+		if elif, ok := s.ElseChunk[0].(*ast.IfStmt); ok && elif.Pos().Line == s.ElsePos.Line && !p.hasComment(elif.Pos()) {
+			p.ifStmt(elif)
+			return
+		}
+	}
+	p.block(s.ElseChunk, s.ElsePos.Line, s.EndPos())
+}
+
+func (p *printer) params(names, types []string, hasVArg bool, result string) {
+	list := typedNames(names, types)
+	if hasVArg {
+		if list != "" {
+			list += ", "
+		}
+		list += "..."
+	}
+	p.write("(" + list + ")")
+	if result != "" {
+		p.write(": " + result)
+	}
+}
+
+// typedNames returns names separated by commas, with their type annotation.
+func typedNames(names, types []string) string {
+	buf := &strings.Builder{}
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(name)
+		if i < len(types) && types[i] != "" {
+			buf.WriteString(": " + types[i])
+		}
+	}
+	return buf.String()
+}
+
+func (p *printer) exprList(exprs []ast.Expr) {
+	for i, e := range exprs {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(e)
+	}
+}
+
+// precedences of the operators, from the grammar
+const (
+	precLowest = iota
+	precOr
+	precAnd
+	precCompare
+	precConcat
+	precAdd
+	precMul
+	precUnary
+	precPow
+	precPrimary
+)
+
+func precedence(e ast.Expr) int {
+	switch e := e.(type) {
+	case *ast.LogicalOpExpr:
+		if e.Operator == ast.OpOr {
+			return precOr
+		}
+		return precAnd
+	case *ast.RelationalOpExpr:
+		return precCompare
+	case *ast.ConcatStrExpr:
+		return precConcat
+	case *ast.ArithmeticOpExpr:
+		switch e.Operator {
+		case ast.OpAdd, ast.OpSubtract:
+			return precAdd
+		case ast.OpMul, ast.OpDiv, ast.OpMod:
+			return precMul
+		case ast.OpPow:
+			return precPow
+		}
+		// | and & have no precedence of their own
+		return precLowest
+	case *ast.UnaryOpMinusExpr, *ast.UnaryOpNotExpr, *ast.LenExpr:
+		return precUnary
+	}
+	return precPrimary
+}
+
+var operators = map[int]string{
+	ast.OpAnd: "and", ast.OpOr: "or",
+	ast.OpAdd: "+", ast.OpSubtract: "-", ast.OpMul: "*", ast.OpDiv: "/", ast.OpMod: "%",
+	ast.OpPow: "^", ast.OpBitOr: "|", ast.OpBitAnd: "&",
+	ast.OpLt: "<", ast.OpLe: "<=", ast.OpGt: ">", ast.OpGe: ">=",
+	ast.OpEqual: "==", ast.OpNotEqual: "!=",
+}
+
+func (p *printer) expr(e ast.Expr) {
+	p.operand(e, precLowest, true)
+}
+
+// operand prints e, in parentheses if it binds less than prec. last tells
+// whether e ends the enclosing expression: '#' has no precedence in the
+// grammar and takes the whole expression on its right, so it must be
+// parenthesized when an operator follows it.
+func (p *printer) operand(e ast.Expr, prec int, last bool) {
+	_, isLen := e.(*ast.LenExpr)
+	if precedence(e) < prec || isLen && !last {
+		p.write("(")
+		p.operand(e, precLowest, true)
+		p.write(")")
+		return
+	}
+
+	switch e := e.(type) {
+	case *ast.NilExpr:
+		p.write("nil")
+	case *ast.TrueExpr:
+		p.write("true")
+	case *ast.FalseExpr:
+		p.write("false")
+	case *ast.NumberExpr:
+		p.write(e.Value)
+	case *ast.StringExpr:
+		p.write(quote(e.Value))
+	case *ast.VarArgExpr:
+		p.write("...")
+	case *ast.IdentExpr:
+		p.write(e.Value)
+	case *ast.LogicalOpExpr:
+		p.binary(e.Lhs, e.Rhs, operators[e.Operator], precedence(e), false, last)
+	case *ast.RelationalOpExpr:
+		p.binary(e.Lhs, e.Rhs, operators[e.Operator], precCompare, false, last)
+	case *ast.ConcatStrExpr:
+		p.binary(e.Lhs, e.Rhs, "..", precConcat, true, last)
+	case *ast.ArithmeticOpExpr:
+		prec := precedence(e)
+		if prec == precLowest {
+			// parenthesize both sides of | and &
+			prec = precPrimary - 1
+		}
+		p.binary(e.Lhs, e.Rhs, operators[e.Operator], prec, e.Operator == ast.OpPow, last)
+	case *ast.UnaryOpMinusExpr:
+		p.unary("-", e.Expr, last)
+	case *ast.UnaryOpNotExpr:
+		p.unary("!", e.Expr, last)
+	case *ast.LenExpr:
+		p.write("#")
+		// a binary operand is parenthesized for readability, the parser
+		// would read it the same way without
+		p.operand(e.Object, precUnary, true)
+	case *ast.FieldGetExpr:
+		p.operand(e.Object, precPrimary, false)
+		if key, ok := e.Key.(*ast.StringExpr); ok && isName(key.Value) {
+			p.write("." + key.Value)
+		} else {
+			p.write("[")
+			p.expr(e.Key)
+			p.write("]")
+		}
+	case *ast.FuncCallExpr:
+		if e.Func != nil {
+			p.operand(e.Func, precPrimary, false)
+		} else {
+			p.operand(e.Receiver, precPrimary, false)
+			p.write(":" + e.Method)
+		}
+		p.write("(")
+		p.exprList(e.Args)
+		p.write(")")
+	case *ast.FunctionExpr:
+		p.write("func")
+		p.params(e.Params, e.ParamTypes, e.HasVArg, e.ReturnType)
+		p.write(" ")
+		p.block(e.Block, e.Pos().Line, e.EndPos())
+	case *ast.ListExpr:
+		p.list(e, "[", "]", e.Elements, func(i int) {
+			p.expr(e.Elements[i])
+		})
+	case *ast.DictExpr:
+		values := make([]ast.Expr, len(e.Entries))
+		for i, entry := range e.Entries {
+			values[i] = entry.Value
+		}
+		p.list(e, "{", "}", values, func(i int) {
+			entry := e.Entries[i]
+			if isName(entry.Key) {
+				p.write(entry.Key)
+			} else {
+				p.write(quote(entry.Key))
+			}
+			p.write(": ")
+			p.expr(entry.Value)
+		})
+	}
+}
+
+func (p *printer) binary(lhs, rhs ast.Expr, op string, prec int, rightAssoc, last bool) {
+	lprec, rprec := prec, prec+1
+	if rightAssoc {
+		lprec, rprec = prec+1, prec
+	}
+	p.operand(lhs, lprec, false)
+	p.write(" " + op + " ")
+	p.operand(rhs, rprec, last)
+}
+
+func (p *printer) unary(op string, operand ast.Expr, last bool) {
+	p.write(op)
+	if op == "-" {
+		if _, ok := operand.(*ast.UnaryOpMinusExpr); ok {
+			// "--" starts a comment
+			p.write(" ")
+		}
+	}
+	p.operand(operand, precUnary, last)
+}
+
+// list prints the elements of a list or dict constructor e, whose values
+// are values. The constructors with a line break before an element in the
+// source are printed with one element per line. elem prints the i-th
+// element.
+func (p *printer) list(e ast.Expr, open, close string, values []ast.Expr, elem func(i int)) {
+	n := len(values)
+	multiline := false
+	for i, line := 0, e.Pos().Line; i < n && !multiline; i++ {
+		multiline = values[i].Pos().Line > line
+		line = values[i].EndPos().Line
+	}
+	if !multiline {
+		p.write(open)
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				p.write(", ")
+			}
+			elem(i)
+		}
+		p.write(close)
+		return
+	}
+
+	p.write(open)
+	p.lastLine = e.Pos().Line
+	p.indent++
+	p.blockStart = true
+	for i := 0; i < n; i++ {
+		v := values[i]
+		p.flush(v.Pos())
+		p.line(v.Pos().Line)
+		elem(i)
+		if i < n-1 {
+			p.write(",")
+		}
+		p.lastLine = v.EndPos().Line
+	}
+	p.flush(e.EndPos())
+	p.indent--
+	p.blockStart = true
+	p.line(0)
+	p.write(close)
+	p.lastLine = e.EndPos().Line
+}
+
+// isName reports whether s can be written as a name, in a dict key or after
+// a dot.
+func isName(s string) bool {
+	if s == "" || parse.IsReserved(s) {
+		return false
+	}
+	for i, c := range []byte(s) {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// quote returns s as a string literal, within long brackets if it spans
+// several lines.
+func quote(s string) string {
+	if strings.Contains(s, "\n") && utf8.ValidString(s) && !strings.ContainsFunc(s, isControl) {
+		return longBracket(s)
+	}
+	buf := &strings.Builder{}
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch c := s[i]; {
+		case r == utf8.RuneError && size <= 1:
+			writeDecimal(buf, c)
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c < ' ' || c == 0x7f:
+			writeDecimal(buf, c)
+		default:
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// isControl reports whether c cannot be written as is in a long bracket.
+func isControl(c rune) bool {
+	return c < ' ' && c != '\n' && c != '\t' || c == 0x7f
+}
+
+// writeDecimal writes c as a 3-digit escape, a following digit can't be
+// read as part of it.
+func writeDecimal(buf *strings.Builder, c byte) {
+	buf.WriteByte('\\')
+	buf.WriteByte('0' + c/100)
+	buf.WriteByte('0' + c/10%10)
+	buf.WriteByte('0' + c%10)
+}
+
+// longBracket returns s within the shortest long brackets [==[ ]==] whose
+// closing one is not in s.
+func longBracket(s string) string {
+	level := ""
+	for strings.Contains(s+"]", "]"+level+"]") {
+		level += "="
+	}
+	// the parser drops a newline right after the opening bracket
+	if strings.HasPrefix(s, "\n") {
+		s = "\n" + s
+	}
+	return "[" + level + "[" + s + "]" + level + "]"
+}
@@ -0,0 +1,170 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+	"github.com/stretchr/testify/assert"
+)
+
+const messy = `-- header comment
+--[[ block
+   comment ]]
+
+var   a,b = 1 ,  2   -- trailing
+func add( x , y ) { -- after brace
+  return x+y
+}
+
+
+-- before if
+if a<b { print("lt") } else if a>b {
+    print( 'gt' )
+} else {
+  -- inside else
+  print("eq")
+}
+if a {
+} else {
+	if b { print(1) }
+}
+var d = {
+  -- first
+  a: 1, -- one
+  "b c": func(n, ...) { return n*2 },
+  "append": [1,2,
+   3]
+}
+var e = (1+2)*3 - -a ^ 2 .. "x" .. ("y" .. "z")
+var m = !(a and b) or - -a
+print(d.a, d["b c"](3), #(d), (#d) + 1)
+while a < 10 { a = a + 1; if a == 5 { break } }
+for k, v = range d {
+	append(d.c, v)
+}
+-- end comment
+`
+
+const formatted = `-- header comment
+--[[ block
+   comment ]]
+
+var a, b = 1, 2 -- trailing
+func add(x, y) { -- after brace
+	return x + y
+}
+
+-- before if
+if a < b {
+	print("lt")
+} else if a > b {
+	print("gt")
+} else {
+	-- inside else
+	print("eq")
+}
+if a {} else {
+	if b {
+		print(1)
+	}
+}
+var d = {
+	-- first
+	a: 1, -- one
+	"b c": func(n, ...) {
+		return n * 2
+	},
+	"append": [
+		1,
+		2,
+		3
+	]
+}
+var e = (1 + 2) * 3 - -a ^ 2 .. "x" .. "y" .. "z"
+var m = !(a and b) or - -a
+print(d.a, d["b c"](3), #d, (#d) + 1)
+while a < 10 {
+	a = a + 1
+	if a == 5 {
+		break
+	}
+}
+for k, v = range d {
+	append(d.c, v)
+}
+-- end comment
+`
+
+func TestSource(t *testing.T) {
+	out, err := Source([]byte(messy), "messy.kala")
+	assert.Nil(t, err)
+	assert.Equal(t, formatted, string(out))
+
+	again, err := Source(out, "messy.kala")
+	assert.Nil(t, err)
+	assert.Equal(t, string(out), string(again))
+
+	out, err = Source(nil, "empty.kala")
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(out))
+
+	_, err = Source([]byte("var a = = 1"), "bad.kala")
+	assert.NotNil(t, err)
+}
+
+// sameCode checks that a and b compile to the same code, whatever their
+// lines.
+func sameCode(t *testing.T, a, b *cpi.FuncProto) {
+	assert.Equal(t, a.InstList.List(), b.InstList.List())
+	assert.Equal(t, a.Consts.Len(), b.Consts.Len())
+	for i := 0; i < a.Consts.Len() && i < b.Consts.Len(); i++ {
+		assert.Equal(t, a.Consts.GetAt(i), b.Consts.GetAt(i))
+	}
+	assert.Equal(t, len(a.FuncProtos), len(b.FuncProtos))
+	for i := 0; i < len(a.FuncProtos) && i < len(b.FuncProtos); i++ {
+		sameCode(t, a.FuncProtos[i], b.FuncProtos[i])
+	}
+}
+
+func compile(t *testing.T, src []byte) *cpi.FuncProto {
+	chunk, err := parse.Parse(bytes.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	proto, err := cpi.Compile(chunk)
+	assert.Nil(t, err)
+	return proto
+}
+
+func TestSameCode(t *testing.T) {
+	scripts := []string{
+		messy,
+		"var x = 2 ^ -3 ^ 2\nvar y = (2 ^ 3) ^ 2\nvar z = -(2 ^ 2) .. (1 .. 2) .. 3",
+		"var a, b, c = 1, 2, 3\nvar x = a - (b - c) - a / (b * c) % 2\nvar y = a < b == (b < c)",
+		"var l = [1]\nvar n = #l + 1\nvar m = 1 + #l * 2\nvar k = !#l",
+		"var t = {}\nt.x = {y: [func() { return 1 }]}\nprint(t.x.y[0](), t[\"x\"][\"y\"])",
+		"func add(x: number, y: number): number {\n\treturn x + y\n}\nvar n: number, s = 1, func(...): nil {}",
+		"var s = \"tab\\tquote\\\"\\\\ \\001\\0127\"\nvar u = \"\\255 é\\n]]\\n]=\"\nvar l = [[\n\nfirst]]",
+	}
+	for _, src := range scripts {
+		out, err := Source([]byte(src), "script.kala")
+		if !assert.Nil(t, err, src) {
+			continue
+		}
+		sameCode(t, compile(t, []byte(src)), compile(t, out))
+		again, _ := Source(out, "script.kala")
+		assert.Equal(t, string(out), string(again))
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "a\"b\\c", "\x00\x01\x7f1", "\xff\xfe", "é日本",
+		"two\nlines", "\nleading newline", "ends with ]", "]]\n]=]", "cr\r\nlf"} {
+		chunk, err := parse.Parse(bytes.NewReader([]byte("var s = "+quote(s))), "quote.kala")
+		if assert.Nil(t, err, quote(s)) {
+			assert.Equal(t, s, chunk[0].(*ast.VarDefStmt).Exprs[0].(*ast.StringExpr).Value, quote(s))
+		}
+	}
+	assert.Equal(t, "[=[]]\n]=]", quote("]]\n"))
+}
@@ -0,0 +1,65 @@
+// Package jsonrpc implements the framing shared by the language server and
+// the debug adapter: JSON documents preceded by a Content-Length header.
+package jsonrpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Conn reads and writes the messages of a session. Writes are serialized,
+// so a Conn may be written from several goroutines; reads are not.
+type Conn struct {
+	rd *textproto.Reader
+	br *bufio.Reader
+
+	mu sync.Mutex // serializes the writes
+	w  io.Writer
+}
+
+// NewConn returns a Conn reading from r and writing to w.
+func NewConn(r io.Reader, w io.Writer) *Conn {
+	br := bufio.NewReader(r)
+	return &Conn{rd: textproto.NewReader(br), br: br, w: w}
+}
+
+// Read reads the next message and decodes it into v.
+func (c *Conn) Read(v any) error {
+	header, err := c.rd.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if err != nil || length < 0 {
+		return fmt.Errorf("jsonrpc: invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("jsonrpc: invalid message: %w", err)
+	}
+	return nil
+}
+
+// Write encodes v and writes it with its header.
+func (c *Conn) Write(v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(body)
+	return err
+}
@@ -0,0 +1,48 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type note struct {
+	N    int    `json:"n"`
+	Text string `json:"text"`
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewConn(nil, &buf)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, w.Write(note{N: i, Text: strings.Repeat("x", i*100)}))
+		}(i)
+	}
+	wg.Wait()
+
+	r := NewConn(&buf, nil)
+	seen := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		var n note
+		assert.Nil(t, r.Read(&n))
+		assert.Equal(t, n.N*100, len(n.Text))
+		seen[n.N] = true
+	}
+	assert.Equal(t, 50, len(seen))
+}
+
+func TestReadErrors(t *testing.T) {
+	var n note
+	err := NewConn(strings.NewReader("Content-Length: x\r\n\r\n{}"), nil).Read(&n)
+	assert.EqualError(t, err, `jsonrpc: invalid Content-Length "x"`)
+
+	err = NewConn(strings.NewReader("Content-Length: 2\r\n\r\n{]"), nil).Read(&n)
+	assert.ErrorContains(t, err, "jsonrpc: invalid message")
+}
@@ -0,0 +1,409 @@
+// Package lint reports the suspicious constructs of a Kala script: the
+// mistakes the compiler accepts but which are most likely bugs, such as a
+// misspelled name read as a global.
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/khoakmp/kala/ast"
+)
+
+// names of the checks, the Check of an Issue
+const (
+	CheckUndefinedGlobal  = "undefined-global"
+	CheckUnusedVar        = "unused-var"
+	CheckUnusedParam      = "unused-param"
+	CheckShadow           = "shadow"
+	CheckUnreachable      = "unreachable"
+	CheckBreakOutsideLoop = "break-outside-loop"
+	CheckCallNonFunction  = "call-non-function"
+)
+
+// Issue is a finding of a check at Pos.
+type Issue struct {
+	Pos     ast.Position
+	Check   string
+	Message string
+}
+
+// String returns the issue as "source:line:column: message (check)".
+func (i Issue) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", i.Pos.Source, i.Pos.Line, i.Pos.Column, i.Message, i.Check)
+}
+
+func (i Issue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Source  string `json:"source"`
+		Line    int    `json:"line"`
+		Column  int    `json:"column"`
+		Check   string `json:"check"`
+		Message string `json:"message"`
+	}{i.Pos.Source, i.Pos.Line, i.Pos.Column, i.Check, i.Message})
+}
+
+// Check runs all the checks on chunk and returns the issues sorted by
+// position. globals are the names set by the host before the script runs,
+// e.g. the builtin functions, reading them is not reported.
+//
+// The names starting with an underscore are never reported as unused.
+func Check(chunk []ast.Stmt, globals []string) []Issue {
+	l := &linter{assigned: map[string]bool{}}
+	for _, name := range globals {
+		l.assigned[name] = true
+	}
+	main := l.enterFunction(nil, true)
+	l.chunk(main, chunk)
+	l.leave(main)
+
+	for _, e := range l.globalReads {
+		if !l.assigned[e.Value] {
+			l.report(e.Pos(), CheckUndefinedGlobal, "%s is read but never assigned", e.Value)
+		}
+	}
+	for _, call := range l.calls {
+		if !call.v.reassigned {
+			l.report(call.pos, CheckCallNonFunction, "%s holds a %s, not a function", call.v.name, call.v.literal)
+		}
+	}
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		a, b := l.issues[i].Pos, l.issues[j].Pos
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return l.issues
+}
+
+// kinds of variables
+const (
+	kindVar = iota
+	kindParam
+	kindFunction
+	kindLoopVar
+	kindImplicit // arg of a vararg function
+)
+
+type variable struct {
+	name       string
+	pos        ast.Position
+	kind       int
+	reads      int
+	reassigned bool
+	literal    string // type of the literal value of the declaration, if any
+}
+
+// scope is a block. Like the compiler, a name declared twice in a block
+// refers to the first variable.
+type scope struct {
+	parent   *scope
+	vars     map[string]*variable
+	order    []*variable
+	loop     bool // body of a loop
+	function bool // body of a function, break can't cross it
+}
+
+type linter struct {
+	issues      []Issue
+	assigned    map[string]bool // globals assigned by the host or the script
+	globalReads []*ast.IdentExpr
+	calls       []call
+}
+
+// call is a call of a variable declared with a literal value, reported
+// unless the variable is assigned later.
+type call struct {
+	v   *variable
+	pos ast.Position
+}
+
+func (l *linter) report(pos ast.Position, check, format string, args ...any) {
+	l.issues = append(l.issues, Issue{Pos: pos, Check: check, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) enterFunction(parent *scope, hasVArg bool) *scope {
+	sc := &scope{parent: parent, vars: map[string]*variable{}, function: true}
+	if hasVArg {
+		l.declare(sc, "arg", ast.Position{}, kindImplicit, nil)
+	}
+	return sc
+}
+
+func (l *linter) enterBlock(parent *scope, loop bool) *scope {
+	return &scope{parent: parent, vars: map[string]*variable{}, loop: loop}
+}
+
+// leave reports the unused variables of sc.
+func (l *linter) leave(sc *scope) {
+	for _, v := range sc.order {
+		if v.reads > 0 || strings.HasPrefix(v.name, "_") {
+			continue
+		}
+		switch v.kind {
+		case kindVar:
+			l.report(v.pos, CheckUnusedVar, "%s is declared but never read", v.name)
+		case kindParam:
+			l.report(v.pos, CheckUnusedParam, "parameter %s is never read", v.name)
+		}
+	}
+}
+
+func lookup(sc *scope, name string) *variable {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (l *linter) declare(sc *scope, name string, pos ast.Position, kind int, value ast.Expr) {
+	if prev, ok := sc.vars[name]; ok {
+		if prev.kind != kindImplicit {
+			l.report(pos, CheckShadow, "%s is redeclared in this block, the uses refer to the declaration at line %d", name, prev.pos.Line)
+		}
+		return
+	}
+	if prev := lookup(sc.parent, name); prev != nil && prev.kind != kindImplicit && !strings.HasPrefix(name, "_") {
+		l.report(pos, CheckShadow, "%s shadows the variable declared at line %d", name, prev.pos.Line)
+	}
+	v := &variable{name: name, pos: pos, kind: kind, literal: literalType(value)}
+	sc.vars[name] = v
+	sc.order = append(sc.order, v)
+}
+
+// literalType returns the type of value if it is a literal which can't be a
+// function, "" otherwise.
+func literalType(value ast.Expr) string {
+	switch value.(type) {
+	case *ast.NumberExpr, *ast.ArithmeticOpExpr, *ast.UnaryOpMinusExpr, *ast.LenExpr:
+		return "number"
+	case *ast.StringExpr, *ast.ConcatStrExpr:
+		return "string"
+	case *ast.TrueExpr, *ast.FalseExpr, *ast.UnaryOpNotExpr, *ast.RelationalOpExpr:
+		return "boolean"
+	case *ast.NilExpr:
+		return "nil"
+	case *ast.DictExpr:
+		return "dict"
+	case *ast.ListExpr:
+		return "list"
+	}
+	return ""
+}
+
+func position(positions []ast.Position, i int) ast.Position {
+	if i < len(positions) {
+		return positions[i]
+	}
+	return ast.Position{}
+}
+
+// chunk checks the statements of a block and reports the first one which
+// can't be reached.
+func (l *linter) chunk(sc *scope, chunk []ast.Stmt) {
+	for i, stmt := range chunk {
+		l.stmt(sc, stmt)
+		if i < len(chunk)-1 && terminates(stmt) {
+			l.report(chunk[i+1].Pos(), CheckUnreachable, "unreachable code")
+		}
+	}
+}
+
+// terminates reports whether the statements after stmt in its block can't be
+// reached.
+func terminates(stmt ast.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt, *ast.BreakStmt:
+		return true
+	case *ast.IfStmt:
+		return s.ElsePos.Line > 0 && blockTerminates(s.ThenChunk) && blockTerminates(s.ElseChunk)
+	case *ast.WhileStmt:
+		// an endless loop without break
+		_, endless := s.CondExpr.(*ast.TrueExpr)
+		return endless && !breaks(s.Chunk)
+	}
+	return false
+}
+
+func blockTerminates(chunk []ast.Stmt) bool {
+	return len(chunk) > 0 && terminates(chunk[len(chunk)-1])
+}
+
+// breaks reports whether chunk has a break out of the loop whose body it is.
+func breaks(chunk []ast.Stmt) bool {
+	for _, stmt := range chunk {
+		switch s := stmt.(type) {
+		case *ast.BreakStmt:
+			return true
+		case *ast.IfStmt:
+			if breaks(s.ThenChunk) || breaks(s.ElseChunk) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *linter) stmt(sc *scope, stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		for _, e := range s.Rhs {
+			l.expr(sc, e)
+		}
+		for _, e := range s.Lhs {
+			l.assign(sc, e)
+		}
+	case *ast.VarDefStmt:
+		// the variables are declared before their values are evaluated
+		for i, name := range s.Vars {
+			var value ast.Expr
+			if i < len(s.Exprs) && len(s.Exprs) == len(s.Vars) {
+				value = s.Exprs[i]
+			}
+			l.declare(sc, name, position(s.VarPos, i), kindVar, value)
+		}
+		for _, e := range s.Exprs {
+			l.expr(sc, e)
+		}
+	case *ast.FuncDefStmt:
+		l.declare(sc, s.FuncName, s.NamePos, kindFunction, nil)
+		l.function(sc, s.ParList, s.ParamPos, s.HasVArg, s.Block)
+	case *ast.IfStmt:
+		l.expr(sc, s.CondExpr)
+		l.block(sc, s.ThenChunk, false)
+		if s.ElsePos.Line > 0 {
+			l.block(sc, s.ElseChunk, false)
+		}
+	case *ast.WhileStmt:
+		l.expr(sc, s.CondExpr)
+		l.block(sc, s.Chunk, true)
+	case *ast.ForNumberStmt:
+		l.expr(sc, s.Start)
+		l.expr(sc, s.End)
+		if s.Step != nil {
+			l.expr(sc, s.Step)
+		}
+		body := l.enterBlock(sc, true)
+		l.declare(body, s.CounterName, s.CounterPos, kindLoopVar, nil)
+		l.chunk(body, s.Chunk)
+		l.leave(body)
+	case *ast.ForRangeStmt:
+		l.expr(sc, s.Object)
+		body := l.enterBlock(sc, true)
+		l.declare(body, s.Index, s.IndexPos, kindLoopVar, nil)
+		l.declare(body, s.Value, s.ValuePos, kindLoopVar, nil)
+		l.chunk(body, s.Block)
+		l.leave(body)
+	case *ast.ReturnStmt:
+		for _, e := range s.Exprs {
+			l.expr(sc, e)
+		}
+	case *ast.BreakStmt:
+		for b := sc; !b.loop; b = b.parent {
+			if b.function {
+				l.report(s.Pos(), CheckBreakOutsideLoop, "break outside a loop")
+				break
+			}
+		}
+	case *ast.FuncCallStmt:
+		l.expr(sc, s.Expr)
+	case *ast.ListAppendStmt:
+		l.expr(sc, s.Object)
+		l.expr(sc, s.Element)
+	}
+}
+
+func (l *linter) block(sc *scope, chunk []ast.Stmt, loop bool) {
+	b := l.enterBlock(sc, loop)
+	l.chunk(b, chunk)
+	l.leave(b)
+}
+
+func (l *linter) function(sc *scope, params []string, pos []ast.Position, hasVArg bool, chunk []ast.Stmt) {
+	body := l.enterFunction(sc, hasVArg)
+	for i, name := range params {
+		l.declare(body, name, position(pos, i), kindParam, nil)
+	}
+	l.chunk(body, chunk)
+	l.leave(body)
+}
+
+// assign checks the target e of an assignment.
+func (l *linter) assign(sc *scope, e ast.Expr) {
+	ident, ok := e.(*ast.IdentExpr)
+	if !ok {
+		l.expr(sc, e)
+		return
+	}
+	if v := lookup(sc, ident.Value); v != nil {
+		v.reassigned = true
+		return
+	}
+	l.assigned[ident.Value] = true
+}
+
+func (l *linter) expr(sc *scope, e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.IdentExpr:
+		if v := lookup(sc, e.Value); v != nil {
+			v.reads++
+		} else {
+			l.globalReads = append(l.globalReads, e)
+		}
+	case *ast.LogicalOpExpr:
+		l.expr(sc, e.Lhs)
+		l.expr(sc, e.Rhs)
+	case *ast.RelationalOpExpr:
+		l.expr(sc, e.Lhs)
+		l.expr(sc, e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		l.expr(sc, e.Lhs)
+		l.expr(sc, e.Rhs)
+	case *ast.ConcatStrExpr:
+		l.expr(sc, e.Lhs)
+		l.expr(sc, e.Rhs)
+	case *ast.UnaryOpMinusExpr:
+		l.expr(sc, e.Expr)
+	case *ast.UnaryOpNotExpr:
+		l.expr(sc, e.Expr)
+	case *ast.LenExpr:
+		l.expr(sc, e.Object)
+	case *ast.FieldGetExpr:
+		l.expr(sc, e.Object)
+		l.expr(sc, e.Key)
+	case *ast.FuncCallExpr:
+		if e.Func != nil {
+			l.callee(sc, e.Func)
+		} else {
+			l.expr(sc, e.Receiver)
+		}
+		for _, arg := range e.Args {
+			l.expr(sc, arg)
+		}
+	case *ast.FunctionExpr:
+		l.function(sc, e.Params, e.ParamPos, e.HasVArg, e.Block)
+	case *ast.DictExpr:
+		for _, entry := range e.Entries {
+			l.expr(sc, entry.Value)
+		}
+	case *ast.ListExpr:
+		for _, elem := range e.Elements {
+			l.expr(sc, elem)
+		}
+	}
+}
+
+// callee checks the function e of a call.
+func (l *linter) callee(sc *scope, e ast.Expr) {
+	if typ := literalType(e); typ != "" {
+		l.report(e.Pos(), CheckCallNonFunction, "call of a %s", typ)
+	}
+	l.expr(sc, e)
+	if ident, ok := e.(*ast.IdentExpr); ok {
+		if v := lookup(sc, ident.Value); v != nil && v.literal != "" {
+			l.calls = append(l.calls, call{v: v, pos: e.Pos()})
+		}
+	}
+}
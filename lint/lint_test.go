@@ -0,0 +1,81 @@
+package lint
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/parse"
+	"github.com/stretchr/testify/assert"
+)
+
+const script = `var count = 0
+var unused = 1
+var _ignored = 2
+func incr(step, extra) {
+	var count = step
+	total = count + totl
+	return count
+}
+func each(l, f) {
+	for i, v = range l {
+		f(v)
+	}
+	while true {
+		if count > 3 {
+			break
+		}
+		count = count + 1
+	}
+	break
+}
+var n = 3
+var s = "text"
+s = func() { return 1 }
+print(n(), s(), incr(1), each([], print), total, arg)
+func sign(x) {
+	if x < 0 {
+		return -1
+	} else {
+		return 1
+	}
+	print("never")
+}
+var x = sign(1)
+var x = 2
+`
+
+func lint(t *testing.T, src string) []string {
+	chunk, err := parse.Parse(strings.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	found := []string{}
+	for _, issue := range Check(chunk, []string{"print"}) {
+		found = append(found, issue.String())
+	}
+	return found
+}
+
+func TestCheck(t *testing.T) {
+	assert.Equal(t, []string{
+		"script.kala:2:5: unused is declared but never read (unused-var)",
+		"script.kala:4:17: parameter extra is never read (unused-param)",
+		"script.kala:5:6: count shadows the variable declared at line 1 (shadow)",
+		"script.kala:6:18: totl is read but never assigned (undefined-global)",
+		"script.kala:19:2: break outside a loop (break-outside-loop)",
+		"script.kala:24:7: n holds a number, not a function (call-non-function)",
+		"script.kala:31:2: unreachable code (unreachable)",
+		"script.kala:33:5: x is declared but never read (unused-var)",
+		"script.kala:34:5: x is redeclared in this block, the uses refer to the declaration at line 33 (shadow)",
+	}, lint(t, script))
+
+	assert.Equal(t, []string{}, lint(t, "while true {\n\tif arg {\n\t\tbreak\n\t}\n}\nprint(2)"))
+	assert.Equal(t, []string{"script.kala:3:1: unreachable code (unreachable)"}, lint(t, "while true {\n}\nprint(1)"))
+}
+
+func TestIssueJSON(t *testing.T) {
+	issue := Issue{Pos: ast.Position{Source: "a.kala", Line: 3, Column: 5}, Check: CheckUnusedVar, Message: "x is declared but never read"}
+	data, err := json.Marshal([]Issue{issue})
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"source":"a.kala","line":3,"column":5,"check":"unused-var","message":"x is declared but never read"}]`, string(data))
+}
@@ -0,0 +1,164 @@
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/khoakmp/kala/internal/jsonrpc"
+)
+
+// message is a JSON-RPC 2.0 request, notification (a request without ID)
+// or response.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *responseError  `json:"error,omitempty"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// error codes of JSON-RPC and of the protocol
+const (
+	codeInvalidParams  = -32602
+	codeMethodNotFound = -32601
+	codeInvalidRequest = -32600
+)
+
+// conn reads and writes the messages of a session.
+type conn struct {
+	rpc *jsonrpc.Conn
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{rpc: jsonrpc.NewConn(r, w)}
+}
+
+func (c *conn) read() (*message, error) {
+	msg := &message{}
+	if err := c.rpc.Read(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *conn) write(msg *message) error {
+	msg.JSONRPC = "2.0"
+	return c.rpc.Write(msg)
+}
+
+// reply answers req with result, which is sent as null when nil.
+func (c *conn) reply(req *message, result any) error {
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return c.write(&message{ID: req.ID, Result: result})
+}
+
+func (c *conn) replyError(req *message, code int, format string, args ...any) error {
+	return c.write(&message{ID: req.ID, Error: &responseError{Code: code, Message: fmt.Sprintf(format, args...)}})
+}
+
+func (c *conn) notify(method string, params any) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.write(&message{Method: method, Params: raw})
+}
+
+// The structures below hold the fields of the protocol used by the server,
+// the others are ignored.
+
+// position is 0-based, Character counts UTF-16 code units.
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type textRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string    `json:"uri"`
+	Range textRange `json:"range"`
+}
+
+// severities of a diagnostic
+const (
+	severityError   = 1
+	severityWarning = 2
+)
+
+type diagnostic struct {
+	Range    textRange `json:"range"`
+	Severity int       `json:"severity"`
+	Source   string    `json:"source"`
+	Message  string    `json:"message"`
+}
+
+type publishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+type textDocumentItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type textDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type didOpenParams struct {
+	TextDocument textDocumentItem `json:"textDocument"`
+}
+
+type didChangeParams struct {
+	TextDocument   textDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type didCloseParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type positionParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+}
+
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type hover struct {
+	Contents markupContent `json:"contents"`
+	Range    textRange     `json:"range"`
+}
+
+// kinds of a completion item
+const (
+	completionFunction = 3
+	completionField    = 5
+	completionVariable = 6
+	completionKeyword  = 14
+)
+
+type completionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
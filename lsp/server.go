@@ -0,0 +1,390 @@
+// Package lsp implements a Language Server Protocol server for Kala
+// scripts. It publishes the syntax and compile errors of the open documents
+// and answers hover, go-to-definition and completion requests from the
+// names resolved by the compiler, see cpi.CompileSymbols.
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+	"github.com/khoakmp/kala/vm"
+)
+
+var keywords = []string{
+	"and", "append", "break", "else", "false", "for", "func", "if",
+	"nil", "or", "range", "return", "true", "var", "while",
+}
+
+// Server is a language server session read from and written to a pair of
+// streams, usually the stdin and stdout of the server process.
+type Server struct {
+	conn  *conn
+	state *vm.State // its globals are the host functions known to the scripts
+	docs  map[string]*document
+}
+
+// document is an open script.
+type document struct {
+	uri   string
+	lines []string
+	// symbols of the last version that parsed, completion still works while
+	// the current line is incomplete
+	symbols *cpi.SymbolTable
+}
+
+// NewServer returns a server reading requests from r and writing responses
+// and notifications to w. The globals of s are offered as completions and
+// are not reported as undefined, nil means the globals of vm.NewState.
+func NewServer(r io.Reader, w io.Writer, s *vm.State) *Server {
+	if s == nil {
+		s = vm.NewState()
+	}
+	return &Server{conn: newConn(r, w), state: s, docs: map[string]*document{}}
+}
+
+// Serve handles messages until the exit notification or the end of input.
+func (s *Server) Serve() error {
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) error {
+	isRequest := len(msg.ID) > 0
+	switch msg.Method {
+	case "initialize":
+		return s.conn.reply(msg, map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   1, // the full text is sent on each change
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]any{"triggerCharacters": []string{"."}},
+			},
+			"serverInfo": map[string]any{"name": "kala"},
+		})
+	case "shutdown":
+		return s.conn.reply(msg, nil)
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			return s.update(params.TextDocument.URI, params.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var params didChangeParams
+		if json.Unmarshal(msg.Params, &params) == nil && len(params.ContentChanges) > 0 {
+			return s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var params didCloseParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			delete(s.docs, params.TextDocument.URI)
+			return s.conn.notify("textDocument/publishDiagnostics",
+				publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []diagnostic{}})
+		}
+	case "textDocument/hover", "textDocument/definition", "textDocument/completion":
+		var params positionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return s.conn.replyError(msg, codeInvalidParams, "%v", err)
+		}
+		doc := s.docs[params.TextDocument.URI]
+		if doc == nil {
+			return s.conn.replyError(msg, codeInvalidRequest, "%s is not open", params.TextDocument.URI)
+		}
+		switch msg.Method {
+		case "textDocument/hover":
+			return s.conn.reply(msg, s.hover(doc, params.Position))
+		case "textDocument/definition":
+			return s.conn.reply(msg, s.definition(doc, params.Position))
+		}
+		return s.conn.reply(msg, s.completion(doc, params.Position))
+	default:
+		if isRequest {
+			return s.conn.replyError(msg, codeMethodNotFound, "unsupported method %q", msg.Method)
+		}
+	}
+	return nil
+}
+
+// sourceName returns the source name of the script at uri, its path for a
+// file.
+func sourceName(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return uri
+}
+
+// update compiles the new text of a document and publishes its errors.
+func (s *Server) update(uri, text string) error {
+	doc := s.docs[uri]
+	if doc == nil {
+		doc = &document{uri: uri}
+		s.docs[uri] = doc
+	}
+	doc.lines = strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	diags := []diagnostic{}
+	chunk, err := parse.Parse(strings.NewReader(text), sourceName(uri))
+	if err != nil {
+		var perr *parse.Error
+		if errors.As(err, &perr) {
+			diags = append(diags, doc.diagnostic(perr.Pos, len(perr.Token), perr.Message))
+		} else {
+			diags = append(diags, doc.diagnostic(ast.Position{Line: 1, Column: 1}, 0, err.Error()))
+		}
+	} else {
+		_, symbols, err := cpi.CompileSymbols(chunk)
+		doc.symbols = symbols
+		var cerr *cpi.CompileError
+		if errors.As(err, &cerr) {
+			diags = append(diags, doc.diagnostic(cerr.Pos, 0, cerr.Message))
+		}
+	}
+	return s.conn.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: diags})
+}
+
+// diagnostic returns an error at pos covering length bytes, the rest of the
+// line when length is 0.
+func (doc *document) diagnostic(pos ast.Position, length int, msg string) diagnostic {
+	if pos.Line == parse.EOF {
+		last := len(doc.lines)
+		pos = ast.Position{Line: last, Column: len(doc.lines[last-1]) + 1}
+	}
+	pos.Column = max(pos.Column, 1)
+	end := pos
+	if length > 0 {
+		end.Column += length
+	} else if pos.Line >= 1 && pos.Line <= len(doc.lines) {
+		end.Column = len(doc.lines[pos.Line-1]) + 1
+	}
+	return diagnostic{
+		Range:    textRange{Start: doc.toLSP(pos), End: doc.toLSP(end)},
+		Severity: severityError,
+		Source:   "kala",
+		Message:  msg,
+	}
+}
+
+// toLSP converts a 1-based byte position to a 0-based UTF-16 position.
+func (doc *document) toLSP(pos ast.Position) position {
+	if pos.Line < 1 || pos.Line > len(doc.lines) {
+		return position{Line: max(pos.Line-1, 0)}
+	}
+	line := doc.lines[pos.Line-1]
+	n := min(max(pos.Column-1, 0), len(line))
+	return position{Line: pos.Line - 1, Character: len(utf16.Encode([]rune(line[:n])))}
+}
+
+// fromLSP converts a 0-based UTF-16 position to a 1-based byte position.
+func (doc *document) fromLSP(p position) ast.Position {
+	pos := ast.Position{Line: p.Line + 1, Column: 1}
+	if p.Line < 0 || p.Line >= len(doc.lines) {
+		return pos
+	}
+	line := doc.lines[p.Line]
+	units := 0
+	for i, r := range line {
+		if units >= p.Character {
+			pos.Column = i + 1
+			return pos
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	pos.Column = len(line) + 1
+	return pos
+}
+
+func (doc *document) rangeOf(sym *cpi.Symbol) textRange {
+	end := sym.Pos
+	end.Column += len(sym.Name)
+	return textRange{Start: doc.toLSP(sym.Pos), End: doc.toLSP(end)}
+}
+
+// symbolAt returns the symbol under the cursor, which may also be right
+// after the name.
+func (doc *document) symbolAt(p position) *cpi.Symbol {
+	if doc.symbols == nil {
+		return nil
+	}
+	pos := doc.fromLSP(p)
+	if sym := doc.symbols.At(pos); sym != nil {
+		return sym
+	}
+	pos.Column--
+	return doc.symbols.At(pos)
+}
+
+var kindNames = map[int]string{
+	cpi.SymbolVar:      "var",
+	cpi.SymbolFunction: "func",
+	cpi.SymbolParam:    "parameter",
+	cpi.SymbolLoopVar:  "loop variable",
+}
+
+func (s *Server) hover(doc *document, p position) any {
+	sym := doc.symbolAt(p)
+	if sym == nil {
+		return nil
+	}
+	var text string
+	switch sym.Scope {
+	case cpi.ScopeLocal, cpi.ScopeUpValue:
+		scope := "local"
+		if sym.Scope == cpi.ScopeUpValue {
+			scope = "upvalue"
+		}
+		if sym.Decl == nil {
+			// a name declared by the compiler, e.g. arg
+			text = fmt.Sprintf("%s `%s`", scope, sym.Name)
+			break
+		}
+		text = fmt.Sprintf("%s %s `%s`\n\ndeclared at line %d in %s",
+			scope, kindNames[sym.Decl.Kind], sym.Name, sym.Decl.Pos.Line, sym.Decl.Func)
+	default:
+		text = fmt.Sprintf("global `%s`", sym.Name)
+		switch {
+		case s.isHostFunction(sym.Name):
+			text += "\n\nhost function"
+		case s.state.GetGlobal(sym.Name).Type() != cpi.KTypeNil:
+			text += "\n\nhost value"
+		case doc.globalAssignment(sym.Name) == nil:
+			text += "\n\nnever assigned in this script"
+		}
+	}
+	return hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: doc.rangeOf(sym)}
+}
+
+func (s *Server) isHostFunction(name string) bool {
+	_, ok := s.state.GetGlobal(name).(*vm.ClosureFunc)
+	return ok
+}
+
+// globalAssignment returns the first assignment of the global name.
+func (doc *document) globalAssignment(name string) *cpi.Symbol {
+	for _, use := range doc.symbols.Uses {
+		if use.Scope == cpi.ScopeGlobal && use.Assign && use.Name == name {
+			return use
+		}
+	}
+	return nil
+}
+
+// definition returns the declaration of a local or an upvalue, the first
+// assignment of a global.
+func (s *Server) definition(doc *document, p position) any {
+	sym := doc.symbolAt(p)
+	if sym == nil {
+		return nil
+	}
+	target := sym.Decl
+	if sym.Scope == cpi.ScopeGlobal {
+		target = doc.globalAssignment(sym.Name)
+	}
+	if target == nil {
+		return nil
+	}
+	return []location{{URI: doc.uri, Range: doc.rangeOf(target)}}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// completion returns the names visible at the cursor: locals and upvalues,
+// globals and keywords. After "name." it returns the fields of the global
+// dict name, e.g. the functions of a library.
+func (s *Server) completion(doc *document, p position) any {
+	pos := doc.fromLSP(p)
+	if pos.Line < 1 || pos.Line > len(doc.lines) {
+		return []completionItem{}
+	}
+	line := doc.lines[pos.Line-1][:pos.Column-1]
+	start := len(line)
+	for start > 0 && isIdentByte(line[start-1]) {
+		start--
+	}
+	prefix := line[start:]
+
+	items := []completionItem{}
+	seen := map[string]bool{}
+	add := func(item completionItem) {
+		if !seen[item.Label] && strings.HasPrefix(item.Label, prefix) {
+			seen[item.Label] = true
+			items = append(items, item)
+		}
+	}
+
+	if start > 0 && line[start-1] == '.' {
+		obj := start - 1
+		for obj > 0 && isIdentByte(line[obj-1]) {
+			obj--
+		}
+		dict, ok := s.state.GetGlobal(line[obj : start-1]).(cpi.KDict)
+		if !ok {
+			return items
+		}
+		for i := 0; i < dict.Len(); i++ {
+			k, v := dict.GetKeyValue(i)
+			kind := completionField
+			if _, ok := v.(*vm.ClosureFunc); ok {
+				kind = completionFunction
+			}
+			add(completionItem{Label: k, Kind: kind, Detail: cpi.TypeNames[v.Type()]})
+		}
+		return items
+	}
+
+	if doc.symbols != nil {
+		// the innermost declarations first
+		vars := doc.symbols.Visible(pos)
+		for i := len(vars) - 1; i >= 0; i-- {
+			kind := completionVariable
+			if vars[i].Kind == cpi.SymbolFunction {
+				kind = completionFunction
+			}
+			add(completionItem{Label: vars[i].Name, Kind: kind, Detail: "local " + kindNames[vars[i].Kind]})
+		}
+	}
+	names := s.state.GlobalNames()
+	sort.Strings(names)
+	for _, name := range names {
+		kind := completionVariable
+		if s.isHostFunction(name) {
+			kind = completionFunction
+		}
+		add(completionItem{Label: name, Kind: kind, Detail: "global"})
+	}
+	if doc.symbols != nil {
+		for _, use := range doc.symbols.Uses {
+			if use.Scope == cpi.ScopeGlobal && use.Assign {
+				add(completionItem{Label: use.Name, Kind: completionVariable, Detail: "global"})
+			}
+		}
+	}
+	for _, kw := range keywords {
+		add(completionItem{Label: kw, Kind: completionKeyword})
+	}
+	return items
+}
@@ -0,0 +1,230 @@
+package lsp
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+const testURI = "file:///scripts/score.kala"
+
+const testScript = `var count = 0
+func incr(step) {
+	count = count + step
+	total = count
+}
+for i = 0, 3 {
+	incr(i)
+}
+print(totl)`
+
+// client drives a Server through a pair of pipes, results are decoded as
+// generic JSON.
+type client struct {
+	t    *testing.T
+	conn *conn
+	msgs chan *message
+	id   int
+	errc chan error
+}
+
+func newClient(t *testing.T, s *vm.State) *client {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	c := &client{t: t, conn: newConn(respR, reqW), msgs: make(chan *message, 100), errc: make(chan error, 1)}
+	go func() {
+		for {
+			msg, err := c.conn.read()
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	go func() {
+		err := NewServer(reqR, respW, s).Serve()
+		respW.Close()
+		c.errc <- err
+	}()
+	return c
+}
+
+func (c *client) send(method string, params any, id int) {
+	raw, _ := json.Marshal(params)
+	msg := &message{Method: method, Params: raw}
+	if id > 0 {
+		msg.ID = json.RawMessage(strconv.Itoa(id))
+	}
+	assert.Nil(c.t, c.conn.write(msg))
+}
+
+func (c *client) notify(method string, params any) {
+	c.send(method, params, 0)
+}
+
+// request sends a request and returns its result, or its error message.
+func (c *client) request(method string, params any) (any, string) {
+	c.id++
+	c.send(method, params, c.id)
+	for msg := range c.msgs {
+		if string(msg.ID) != strconv.Itoa(c.id) {
+			continue
+		}
+		if msg.Error != nil {
+			return nil, msg.Error.Message
+		}
+		return msg.Result, ""
+	}
+	c.t.Fatal("the server closed the connection")
+	return nil, ""
+}
+
+func (c *client) diagnostics() []any {
+	for msg := range c.msgs {
+		if msg.Method == "textDocument/publishDiagnostics" {
+			var params map[string]any
+			assert.Nil(c.t, json.Unmarshal(msg.Params, &params))
+			return params["diagnostics"].([]any)
+		}
+	}
+	c.t.Fatal("the server closed the connection")
+	return nil
+}
+
+func (c *client) open(text string) []any {
+	c.notify("textDocument/didOpen", map[string]any{
+		"textDocument": map[string]any{"uri": testURI, "languageId": "kala", "version": 1, "text": text},
+	})
+	return c.diagnostics()
+}
+
+func (c *client) change(text string) []any {
+	c.notify("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": testURI, "version": 2},
+		"contentChanges": []any{map[string]any{"text": text}},
+	})
+	return c.diagnostics()
+}
+
+func at(line, character int) map[string]any {
+	return map[string]any{
+		"textDocument": map[string]any{"uri": testURI},
+		"position":     map[string]any{"line": line, "character": character},
+	}
+}
+
+func startOf(v any) [2]float64 {
+	start := v.(map[string]any)["range"].(map[string]any)["start"].(map[string]any)
+	return [2]float64{start["line"].(float64), start["character"].(float64)}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t, nil)
+	result, _ := c.request("initialize", map[string]any{})
+	caps := result.(map[string]any)["capabilities"].(map[string]any)
+	assert.Equal(t, true, caps["hoverProvider"])
+	c.notify("initialized", map[string]any{})
+
+	assert.Len(t, c.open(testScript), 0)
+
+	diags := c.change("var x = 1\nx = = 2\n")
+	assert.Len(t, diags, 1)
+	assert.Equal(t, [2]float64{1, 4}, startOf(diags[0]))
+
+	diags = c.change("var x = 1\nbreak\n")
+	assert.Len(t, diags, 1)
+	assert.Contains(t, diags[0].(map[string]any)["message"], "break outside a loop")
+	assert.Equal(t, [2]float64{1, 0}, startOf(diags[0]))
+
+	diags = c.change("func f() {\n")
+	assert.Len(t, diags, 1)
+
+	c.notify("textDocument/didClose", map[string]any{"textDocument": map[string]any{"uri": testURI}})
+	assert.Len(t, c.diagnostics(), 0)
+	_, errMsg := c.request("textDocument/hover", at(0, 0))
+	assert.Contains(t, errMsg, "not open")
+	_, errMsg = c.request("textDocument/formatting", at(0, 0))
+	assert.Contains(t, errMsg, "unsupported")
+
+	result, errMsg = c.request("shutdown", nil)
+	assert.Nil(t, result)
+	assert.Equal(t, "", errMsg)
+	c.notify("exit", nil)
+	assert.Nil(t, <-c.errc)
+}
+
+func TestHoverAndDefinition(t *testing.T) {
+	c := newClient(t, nil)
+	c.request("initialize", map[string]any{})
+	c.open(testScript)
+
+	hoverText := func(line, character int) string {
+		result, _ := c.request("textDocument/hover", at(line, character))
+		if result == nil {
+			return ""
+		}
+		return result.(map[string]any)["contents"].(map[string]any)["value"].(string)
+	}
+	assert.Equal(t, "upvalue var `count`\n\ndeclared at line 1 in main chunk", hoverText(2, 1))
+	assert.Equal(t, "local parameter `step`\n\ndeclared at line 2 in incr", hoverText(2, 18))
+	// right after the name
+	assert.Equal(t, "local parameter `step`\n\ndeclared at line 2 in incr", hoverText(2, 21))
+	assert.Equal(t, "global `print`\n\nhost function", hoverText(8, 0))
+	assert.Equal(t, "global `totl`\n\nnever assigned in this script", hoverText(8, 7))
+	assert.Equal(t, "global `total`", hoverText(3, 2))
+	assert.Equal(t, "", hoverText(5, 0))
+
+	definition := func(line, character int) [2]float64 {
+		result, _ := c.request("textDocument/definition", at(line, character))
+		if result == nil {
+			return [2]float64{-1, -1}
+		}
+		return startOf(result.([]any)[0])
+	}
+	assert.Equal(t, [2]float64{0, 4}, definition(2, 10))
+	assert.Equal(t, [2]float64{1, 10}, definition(2, 18))
+	assert.Equal(t, [2]float64{5, 4}, definition(6, 6))
+	assert.Equal(t, [2]float64{1, 5}, definition(6, 2))
+	// a global is defined by its first assignment
+	assert.Equal(t, [2]float64{3, 1}, definition(3, 3))
+	assert.Equal(t, [2]float64{-1, -1}, definition(8, 7))
+}
+
+func TestCompletion(t *testing.T) {
+	s := vm.NewState()
+	s.Register("lookup", func(s *vm.State) int { return 0 })
+	lib := cpi.NewKDict(1)
+	lib.SetField("query", s.NewFunction("query", func(s *vm.State) int { return 0 }))
+	s.SetGlobal("db", lib)
+
+	c := newClient(t, s)
+	c.request("initialize", map[string]any{})
+	c.open(testScript)
+
+	labels := func(line, character int) []string {
+		result, _ := c.request("textDocument/completion", at(line, character))
+		list := []string{}
+		for _, item := range result.([]any) {
+			list = append(list, item.(map[string]any)["label"].(string))
+		}
+		return list
+	}
+	// inside incr, the innermost names first
+	all := labels(3, 0)
+	assert.Equal(t, []string{"step", "incr", "count", "db", "dict", "error", "json", "list", "lookup", "math", "pcall", "print", "string", "total"}, all[:14])
+	assert.Contains(t, all, "while")
+
+	assert.Equal(t, []string{"i", "incr", "if"}, labels(6, 2))
+	assert.Equal(t, []string{"print"}, labels(8, 3))
+
+	// an incomplete line keeps the names of the last version that compiled
+	c.change(testScript + "\ndb.q")
+	assert.Equal(t, []string{"query"}, labels(9, 4))
+	assert.Equal(t, []string{"query"}, labels(9, 3))
+}
@@ -9,6 +9,7 @@ import "github.com/khoakmp/kala/ast"
 %type<expr> lhs prefixexp expr functioncall dictConstructor listConstructor
 %type<namelist> namelist
 %type<parlist> parlist
+%type<token> typeann typename
 %type<entries> entries
 %type<entry> entry
 
@@ -19,6 +20,8 @@ import "github.com/khoakmp/kala/ast"
   stmts []ast.Stmt
   exprlist []ast.Expr 
   namelist []string
+  positions []ast.Position
+  types []string
   parlist *ast.ParList
   entries []ast.DictEntry
   entry ast.DictEntry
@@ -29,7 +32,7 @@ import "github.com/khoakmp/kala/ast"
 
 
 /* Literals , get Str of TNumber, TString, TIdent */
-%token<token> Number String Ident Eq2 Neq Ge Le Dot3 Dot2 '{' '(' '!' '.'
+%token<token> Number String Ident Eq2 Neq Ge Le Dot3 Dot2 '{' '}' '(' ')' '[' ']' '!' '.' '-' '#'
 
 /* Operators */
 %left Or
@@ -69,33 +72,51 @@ import "github.com/khoakmp/kala/ast"
   
   laststmt: Break {
     $$ = &ast.BreakStmt{}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | Return {
     $$ = &ast.ReturnStmt{Exprs: []ast.Expr{}}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | Return exprlist {
     $$ = &ast.ReturnStmt{Exprs:  $2}    
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($2[len($2)-1].EndPos())
   }
   
   stmt: lhslist '=' exprlist{
     $$ = &ast.AssignStmt {Lhs: $1, Rhs: $3}
+    $$.SetPos($1[0].Pos())
+    $$.SetEndPos($3[len($3)-1].EndPos())
   } | While expr block{
     $$ = &ast.WhileStmt {CondExpr: $2, Chunk: $3}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>3.End)
   } | ifstmt {
     $$ = $1
   } | forNumStmt {
     $$ = $1 
   } | forRangeStmt{
     $$ = $1
-  } | Function Ident parlist block {
-    $$ = &ast.FuncDefStmt {FuncName: $2.Str, ParList: $3.Names, HasVArg: $3.HasVArg, Block: $4}
+  } | Function Ident parlist typeann block {
+    $$ = &ast.FuncDefStmt {FuncName: $2.Str, NamePos: $2.Pos, ParList: $3.Names, ParamPos: $3.NamePos, ParamTypes: $3.Types, ReturnType: $4.Str, HasVArg: $3.HasVArg, Block: $5}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>5.End)
   } | Var namelist {
-    $$ = &ast.VarDefStmt{Vars : $2, Exprs : []ast.Expr{} }
+    $$ = &ast.VarDefStmt{Vars : $2, VarPos: $<positions>2, Types: $<types>2, Exprs : []ast.Expr{} }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>2.End)
   } | Var namelist '=' exprlist {
-    $$ = &ast.VarDefStmt {Vars: $2, Exprs: $4}
+    $$ = &ast.VarDefStmt {Vars: $2, VarPos: $<positions>2, Types: $<types>2, Exprs: $4}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($4[len($4)-1].EndPos())
   } | functioncall {
     if e , ok:= $1.(*ast.FuncCallExpr); ok {
       $$ = &ast.FuncCallStmt{
         Expr: e,
       }  
+      $$.SetPos(e.Pos())
+      $$.SetEndPos(e.EndPos())
     } else {
       yylex.(*Lexer).Error("parse error")
     }
@@ -104,46 +125,91 @@ import "github.com/khoakmp/kala/ast"
       Object: $3, 
       Element: $5,
     }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($6.End)
   }
   
   ifstmt: If  expr  block {
     $$ = &ast.IfStmt{CondExpr: $2, ThenChunk: $3, ElseChunk: []ast.Stmt{}}  
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>3.End)
   } | If expr block Else block {
-    $$ = &ast.IfStmt{CondExpr: $2, ThenChunk: $3, ElseChunk: $5}
+    $$ = &ast.IfStmt{CondExpr: $2, ThenChunk: $3, ElsePos: $4.Pos, ElseChunk: $5}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>5.End)
   } | If expr block Else ifstmt {
-    $$ = &ast.IfStmt{CondExpr: $2, ThenChunk: $3, ElseChunk: []ast.Stmt{$5}}
+    $$ = &ast.IfStmt{CondExpr: $2, ThenChunk: $3, ElsePos: $4.Pos, ElseChunk: []ast.Stmt{$5}}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($5.EndPos())
   }
   
-  forRangeStmt: For Ident ',' Ident '=' Range lhs block {
+  forRangeStmt: For Ident ',' Ident '=' Range expr block {
     $$ = &ast.ForRangeStmt{
       Index: $2.Str,
+      IndexPos: $2.Pos,
       Value: $4.Str,
+      ValuePos: $4.Pos,
       Object: $7,
       Block: $8,
     }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>8.End)
   }
   forNumStmt: For Ident '=' expr ',' expr  block {
-    $$ = &ast.ForNumberStmt { CounterName: $2.Str, Start: $4, End: $6, Step: nil, Chunk: $7}
+    $$ = &ast.ForNumberStmt { CounterName: $2.Str, CounterPos: $2.Pos, Start: $4, End: $6, Step: nil, Chunk: $7}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>7.End)
   }  | For Ident '=' expr ',' expr ',' expr block {
-    $$ = &ast.ForNumberStmt { CounterName: $2.Str, Start: $4, End: $6, Step: $8, Chunk: $9}
+    $$ = &ast.ForNumberStmt { CounterName: $2.Str, CounterPos: $2.Pos, Start: $4, End: $6, Step: $8, Chunk: $9}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>9.End)
   }
   
   parlist: '(' ')'{
     $$ = &ast.ParList{Names :[]string{}, HasVArg: false}
   } | '(' namelist ')' {
-    $$ = &ast.ParList {Names : $2 , HasVArg: false}
+    $$ = &ast.ParList {Names : $2, NamePos: $<positions>2, Types: $<types>2, HasVArg: false}
   }| '(' namelist ',' Dot3 ')' {
-    $$ = &ast.ParList{Names: $2, HasVArg: true}
+    $$ = &ast.ParList{Names: $2, NamePos: $<positions>2, Types: $<types>2, HasVArg: true}
+  } | '(' Dot3 ')' {
+    $$ = &ast.ParList{Names: []string{}, HasVArg: true}
   }
   
-  namelist: Ident{
+  /* the positions of the names are kept in the positions field, their type
+     annotations, "" when missing, in the types field */
+  namelist: Ident typeann {
     $$ = []string{$1.Str}
-  } | namelist ',' Ident {
+    $<token>$ = $1
+    if $2.Str != "" {
+      $<token>$ = $2
+    }
+    $<positions>$ = []ast.Position{$1.Pos}
+    $<types>$ = []string{$2.Str}
+  } | namelist ',' Ident typeann {
     $$ = append($1, $3.Str)
+    $<token>$ = $3
+    if $4.Str != "" {
+      $<token>$ = $4
+    }
+    $<positions>$ = append($<positions>1, $3.Pos)
+    $<types>$ = append($<types>1, $4.Str)
+  }
+  typeann: {
+    $$ = ast.Token{}
+  } | ':' typename {
+    $$ = $2
+  }
+  typename: Ident {
+    $$ = $1
+  } | Nil {
+    $$ = $1
   }
 
+  /* the closing brace is kept in the token field so that rules ending with
+     a block can record their end position */
   block: '{' chunk '}' {
     $$ = $2
+    $<token>$ = $3
   }
 
   lhslist: lhs {
@@ -160,10 +226,19 @@ import "github.com/khoakmp/kala/ast"
   
   lhs: Ident {
     $$ = &ast.IdentExpr {Value: $1.Str}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | prefixexp '.' Ident {
-    $$ = &ast.FieldGetExpr{Object: $1, Key: &ast.StringExpr{Value: $3.Str}}
+    key := &ast.StringExpr{Value: $3.Str}
+    key.SetPos($3.Pos)
+    key.SetEndPos($3.End)
+    $$ = &ast.FieldGetExpr{Object: $1, Key: key}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.End)
   } | prefixexp '[' expr ']' {
     $$ = &ast.FieldGetExpr{Object: $1, Key: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($4.End)
   } 
   
   prefixexp: lhs {
@@ -174,8 +249,20 @@ import "github.com/khoakmp/kala/ast"
 
   functioncall: prefixexp '(' ')' {
     $$ = &ast.FuncCallExpr{Func: $1, Args :[]ast.Expr{}}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.End)
   } | prefixexp '(' args ')'{
     $$ = &ast.FuncCallExpr{Func: $1, Args: $3}    
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($4.End)
+  } | prefixexp ':' Ident '(' ')' {
+    $$ = &ast.FuncCallExpr{Receiver: $1, Method: $3.Str, Args: []ast.Expr{}}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($5.End)
+  } | prefixexp ':' Ident '(' args ')' {
+    $$ = &ast.FuncCallExpr{Receiver: $1, Method: $3.Str, Args: $5}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($6.End)
   }
   
   args: expr {
@@ -186,78 +273,140 @@ import "github.com/khoakmp/kala/ast"
   
   expr: True {
     $$ = &ast.TrueExpr{}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | False {
     $$ = &ast.FalseExpr{}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | Nil {
     $$ = &ast.NilExpr{}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | Number {
     $$ = &ast.NumberExpr{Value: $1.Str}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | String {
     $$ = &ast.StringExpr{Value: $1.Str} 
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
+  } | Dot3 {
+    $$ = &ast.VarArgExpr{}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($1.End)
   } | prefixexp {
     $$ = $1
-  } | Function parlist block {
+  } | Function parlist typeann block {
     $$ = &ast.FunctionExpr{
       Params: $2.Names, 
+      ParamPos: $2.NamePos,
+      ParamTypes: $2.Types,
+      ReturnType: $3.Str,
       HasVArg: $2.HasVArg,
-      Block: $3,
+      Block: $4,
     }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($<token>4.End)
   } | expr '+' expr {
     $$ = &ast.ArithmeticOpExpr{
       Operator: ast.OpAdd,
       Lhs: $1, Rhs: $3,
     }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '-' expr {
     $$ = &ast.ArithmeticOpExpr{
       Operator: ast.OpSubtract,
       Lhs: $1, Rhs: $3,
     }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '*' expr {
     $$ = &ast.ArithmeticOpExpr{
       Operator: ast.OpMul,
       Lhs: $1, Rhs: $3,
     }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '/' expr {
     $$ = &ast.ArithmeticOpExpr{
       Operator: ast.OpDiv,
       Lhs: $1, Rhs: $3,
-    } 
+    }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '%' expr {
     $$ = &ast.ArithmeticOpExpr{
       Operator: ast.OpMod,
       Lhs: $1, Rhs: $3,
     }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
+  } | expr '^' expr {
+    $$ = &ast.ArithmeticOpExpr{
+      Operator: ast.OpPow,
+      Lhs: $1, Rhs: $3,
+    }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '|' expr {
     $$ = &ast.ArithmeticOpExpr{
       Operator: ast.OpBitOr,
       Lhs: $1, Rhs: $3,
     }
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '&' expr {
     $$ = &ast.ArithmeticOpExpr{ Operator: ast.OpBitAnd, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr And expr {
     $$ = &ast.LogicalOpExpr { Operator: ast.OpAnd, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr Or expr {
     $$ = &ast.LogicalOpExpr { Operator: ast.OpOr, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '<' expr {
     $$ = &ast.RelationalOpExpr { Operator: ast.OpLt, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr '>' expr {
     $$ = &ast.RelationalOpExpr { Operator: ast.OpGt, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr Le expr {
     $$ = &ast.RelationalOpExpr { Operator: ast.OpLe, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr Ge expr {
     $$ = &ast.RelationalOpExpr { Operator: ast.OpGe, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr Eq2 expr {
     $$ = &ast.RelationalOpExpr { Operator: ast.OpEqual, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | expr Neq expr {
     $$ = &ast.RelationalOpExpr { Operator: ast.OpNotEqual, Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | '(' expr ')' {
     $$ = $2
   } | expr Dot2 expr {
     $$ = &ast.ConcatStrExpr {Lhs: $1, Rhs: $3}
+    $$.SetPos($1.Pos())
+    $$.SetEndPos($3.EndPos())
   } | '-' expr %prec UNARY {
     $$ = &ast.UnaryOpMinusExpr {Expr: $2}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($2.EndPos())
   } | '!' expr %prec UNARY {
     $$ = &ast.UnaryOpNotExpr {Expr : $2}
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($2.EndPos())
   } | dictConstructor{
     $$ = $1
   } | listConstructor {
@@ -266,17 +415,22 @@ import "github.com/khoakmp/kala/ast"
     $$ = &ast.LenExpr{
       Object: $2,
     }     
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($2.EndPos())
   }
 
   dictConstructor: '{' '}'{
     $$ = &ast.DictExpr {
       Entries: []ast.DictEntry{},
     }
-    
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($2.End)
   } | '{' entries '}' {
     $$ = &ast.DictExpr {
       Entries: $2,
     }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($3.End)
   }
 
   entries: entry {
@@ -301,10 +455,14 @@ import "github.com/khoakmp/kala/ast"
     $$ = &ast.ListExpr{
       Elements: []ast.Expr{},
     }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($2.End)
   } | '[' exprlist ']' {
     $$ = &ast.ListExpr{
       Elements: $2,
     }
+    $$.SetPos($1.Pos)
+    $$.SetEndPos($3.End)
   }
 %%
 
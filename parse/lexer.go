@@ -17,21 +17,17 @@ const whitespace1 = 1<<'\t' | 1<<' '
 const whitespace2 = 1<<'\t' | 1<<'\n' | 1<<'\r' | 1<<' '
 
 type Error struct {
-	//Pos     ast.Position
+	Pos     ast.Position
 	Message string
 	Token   string
 }
 
 func (e *Error) Error() string {
-	//pos := e.Pos
-	/* if pos.Line == EOF {
+	pos := e.Pos
+	if pos.Line == EOF {
 		return fmt.Sprintf("%v at EOF:   %s\n", pos.Source, e.Message)
-	} else {
-		return fmt.Sprintf("%v line:%d(column:%d) near '%v':   %s\n", pos.Source, pos.Line, pos.Column, e.Token, e.Message)
-	} */
-
-	return fmt.Sprintf("%v line:%d(column:%d) near '%v':   %s\n", 0, 0, 0, e.Token, e.Message)
-
+	}
+	return fmt.Sprintf("%v line:%d(column:%d) near '%v':   %s\n", pos.Source, pos.Line, pos.Column, e.Token, e.Message)
 }
 
 func writeChar(buf *bytes.Buffer, c int) { buf.WriteByte(byte(c)) }
@@ -47,24 +43,30 @@ func isDigit(ch int) bool {
 }
 
 type Scanner struct {
-	//Pos    ast.Position
+	Pos    ast.Position
 	reader *bufio.Reader
+
+	// KeepComments makes the scanner collect the comments it skips into
+	// Comments.
+	KeepComments bool
+	Comments     []ast.Comment
+	comment      *bytes.Buffer // text of the comment being skipped
 }
 
 func NewScanner(reader io.Reader, source string) *Scanner {
 	return &Scanner{
-		/* Pos: ast.Position{
+		Pos: ast.Position{
 			Source: source,
 			Line:   1,
 			Column: 0,
-		}, */
+		},
 		reader: bufio.NewReaderSize(reader, 4096),
 	}
 }
 
-func (sc *Scanner) Error(tok string, msg string) *Error { return &Error{msg, tok} }
+func (sc *Scanner) Error(tok string, msg string) *Error { return &Error{sc.Pos, msg, tok} }
 
-func (sc *Scanner) TokenError(tok ast.Token, msg string) *Error { return &Error{msg, tok.Str} }
+func (sc *Scanner) TokenError(tok ast.Token, msg string) *Error { return &Error{tok.Pos, msg, tok.Str} }
 
 func (sc *Scanner) readNext() int {
 	ch, err := sc.reader.ReadByte()
@@ -78,8 +80,8 @@ func (sc *Scanner) Newline(ch int) {
 	if ch < 0 {
 		return
 	}
-	/* sc.Pos.Line += 1
-	sc.Pos.Column = 0 */
+	sc.Pos.Line += 1
+	sc.Pos.Column = 0
 	next := sc.Peek()
 	if ch == '\n' && next == '\r' || ch == '\r' && next == '\n' {
 		sc.reader.ReadByte()
@@ -93,10 +95,13 @@ func (sc *Scanner) Next() int {
 		sc.Newline(ch)
 		ch = int('\n')
 	case EOF:
-		/* sc.Pos.Line = EOF
-		sc.Pos.Column = 0 */
+		sc.Pos.Line = EOF
+		sc.Pos.Column = 0
 	default:
-		//sc.Pos.Column++
+		sc.Pos.Column++
+	}
+	if sc.comment != nil && ch != EOF {
+		sc.comment.WriteByte(byte(ch))
 	}
 	return ch
 }
@@ -292,6 +297,13 @@ var reservedWords = map[string]int{
 	"return": Return, "true": True, "append": Append,
 	"while": While}
 
+// IsReserved reports whether name is a reserved word, which can't be used as
+// a name.
+func IsReserved(name string) bool {
+	_, ok := reservedWords[name]
+	return ok
+}
+
 func (sc *Scanner) Scan(lexer *Lexer) (ast.Token, error) {
 redo:
 	var err error
@@ -312,7 +324,7 @@ redo:
 
 	var _buf bytes.Buffer
 	buf := &_buf
-	//tok.Pos = sc.Pos
+	tok.Pos = sc.Pos
 
 	switch {
 	case isIdent(ch, 0):
@@ -335,7 +347,15 @@ redo:
 			tok.Type = EOF
 		case '-':
 			if sc.Peek() == '-' {
+				if sc.KeepComments {
+					sc.comment = bytes.NewBufferString("-")
+				}
 				err = sc.skipComments(sc.Next())
+				if sc.comment != nil {
+					text := strings.TrimRight(sc.comment.String(), " \t\n")
+					sc.Comments = append(sc.Comments, ast.Comment{Pos: tok.Pos, Text: text})
+					sc.comment = nil
+				}
 				if err != nil {
 					goto finally
 				}
@@ -435,7 +455,7 @@ redo:
 	}
 
 finally:
-	//tok. = TokenName(int(tok.Type))
+	tok.End = sc.Pos
 	return tok, err
 }
 
@@ -455,16 +475,16 @@ func (lx *Lexer) Lex(lval *yySymType) int {
 	if err != nil {
 		panic(err)
 	}
+	lx.Token = tok
 	if tok.Type < 0 {
 		return 0
 	}
 	lval.token = tok
-	lx.Token = tok
 	return int(tok.Type)
 }
 
 func (lx *Lexer) Error(message string) {
-	panic(lx.scanner.Error(lx.Token.Str, message))
+	panic(lx.scanner.TokenError(lx.Token, message))
 }
 
 func (lx *Lexer) TokenError(tok ast.Token, message string) {
@@ -472,7 +492,19 @@ func (lx *Lexer) TokenError(tok ast.Token, message string) {
 }
 
 func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
+	chunk, _, err = parse(reader, name, false)
+	return
+}
+
+// ParseWithComments parses like Parse and also returns the comments of the
+// script, in source order.
+func ParseWithComments(reader io.Reader, name string) ([]ast.Stmt, []ast.Comment, error) {
+	return parse(reader, name, true)
+}
+
+func parse(reader io.Reader, name string, keepComments bool) (chunk []ast.Stmt, comments []ast.Comment, err error) {
 	lexer := &Lexer{NewScanner(reader, name), nil, false, ast.Token{Str: ""}, Nil}
+	lexer.scanner.KeepComments = keepComments
 	chunk = nil
 	defer func() {
 		if e := recover(); e != nil {
@@ -481,6 +513,7 @@ func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
 	}()
 	yyParse(lexer)
 	chunk = lexer.Stmts
+	comments = lexer.scanner.Comments
 	return
 }
 
@@ -8,18 +8,20 @@ import __yyfmt__ "fmt"
 //line grammar.y:2
 import "github.com/khoakmp/kala/ast"
 
-//line grammar.y:15
+//line grammar.y:16
 type yySymType struct {
-	yys      int
-	token    ast.Token
-	stmt     ast.Stmt
-	expr     ast.Expr
-	stmts    []ast.Stmt
-	exprlist []ast.Expr
-	namelist []string
-	parlist  *ast.ParList
-	entries  []ast.DictEntry
-	entry    ast.DictEntry
+	yys       int
+	token     ast.Token
+	stmt      ast.Stmt
+	expr      ast.Expr
+	stmts     []ast.Stmt
+	exprlist  []ast.Expr
+	namelist  []string
+	positions []ast.Position
+	types     []string
+	parlist   *ast.ParList
+	entries   []ast.DictEntry
+	entry     ast.DictEntry
 }
 
 const If = 57346
@@ -77,13 +79,18 @@ var yyToknames = [...]string{
 	"Dot3",
 	"Dot2",
 	"'{'",
+	"'}'",
 	"'('",
+	"')'",
+	"'['",
+	"']'",
 	"'!'",
 	"'.'",
+	"'-'",
+	"'#'",
 	"'>'",
 	"'<'",
 	"'+'",
-	"'-'",
 	"'*'",
 	"'/'",
 	"'%'",
@@ -92,14 +99,9 @@ var yyToknames = [...]string{
 	"';'",
 	"'='",
 	"','",
-	"')'",
-	"'}'",
-	"'['",
-	"']'",
+	"':'",
 	"'|'",
 	"'&'",
-	"'#'",
-	"':'",
 }
 
 var yyStatenames = [...]string{}
@@ -108,7 +110,7 @@ const yyEofCode = 1
 const yyErrCode = 2
 const yyInitialStackSize = 16
 
-//line grammar.y:309
+//line grammar.y:467
 
 func TokenName(c int) string {
 	if c >= And && c-And < len(yyToknames) {
@@ -125,180 +127,199 @@ var yyExca = [...]int8{
 	1, -1,
 	-2, 0,
 	-1, 15,
-	29, 40,
-	31, 40,
-	46, 40,
+	30, 45,
+	32, 45,
+	35, 45,
+	49, 45,
 	-2, 18,
 	-1, 17,
-	42, 32,
-	43, 32,
-	-2, 39,
-	-1, 85,
-	42, 33,
-	43, 33,
-	-2, 39,
+	47, 37,
+	48, 37,
+	-2, 44,
+	-1, 88,
+	47, 38,
+	48, 38,
+	-2, 44,
 }
 
 const yyPrivate = 57344
 
-const yyLast = 459
+const yyLast = 552
 
 var yyAct = [...]uint8{
-	24, 86, 10, 30, 79, 1, 20, 23, 46, 124,
-	44, 123, 60, 61, 54, 70, 80, 81, 125, 49,
-	142, 153, 55, 56, 57, 58, 59, 53, 38, 51,
-	122, 17, 121, 73, 74, 75, 60, 61, 76, 71,
-	54, 77, 138, 137, 52, 136, 135, 20, 130, 83,
-	84, 92, 20, 96, 99, 100, 101, 102, 103, 104,
-	105, 106, 107, 108, 109, 110, 111, 112, 113, 114,
-	115, 116, 85, 117, 57, 58, 59, 91, 47, 94,
-	93, 119, 89, 90, 146, 88, 60, 61, 42, 43,
-	127, 62, 63, 126, 22, 133, 18, 128, 72, 48,
-	87, 118, 151, 68, 69, 67, 66, 129, 70, 87,
-	80, 81, 149, 65, 64, 55, 56, 57, 58, 59,
-	87, 21, 132, 129, 140, 141, 95, 139, 50, 60,
-	61, 143, 47, 144, 145, 45, 131, 148, 39, 78,
-	36, 15, 35, 98, 8, 12, 11, 4, 152, 62,
-	63, 3, 2, 0, 155, 20, 157, 158, 0, 0,
-	159, 68, 69, 67, 66, 0, 70, 87, 0, 0,
-	0, 65, 64, 55, 56, 57, 58, 59, 62, 63,
-	154, 0, 156, 0, 0, 0, 0, 60, 61, 0,
-	68, 69, 67, 66, 0, 70, 62, 63, 0, 0,
-	65, 64, 55, 56, 57, 58, 59, 0, 68, 69,
-	67, 66, 150, 70, 0, 0, 60, 61, 65, 64,
-	55, 56, 57, 58, 59, 62, 63, 0, 0, 147,
-	0, 0, 0, 0, 60, 61, 0, 68, 69, 67,
-	66, 0, 70, 62, 63, 0, 0, 65, 64, 55,
-	56, 57, 58, 59, 0, 68, 69, 67, 66, 0,
-	70, 0, 134, 60, 61, 65, 64, 55, 56, 57,
-	58, 59, 62, 63, 0, 0, 0, 120, 0, 0,
-	0, 60, 61, 0, 68, 69, 67, 66, 0, 70,
-	62, 0, 0, 0, 65, 64, 55, 56, 57, 58,
-	59, 0, 68, 69, 67, 66, 0, 70, 0, 0,
-	60, 61, 65, 64, 55, 56, 57, 58, 59, 0,
-	0, 0, 0, 31, 25, 26, 27, 0, 60, 61,
-	28, 29, 21, 0, 0, 31, 25, 26, 27, 40,
-	32, 34, 28, 29, 21, 0, 33, 0, 0, 0,
-	0, 40, 32, 34, 0, 97, 0, 41, 33, 0,
-	0, 37, 0, 0, 0, 0, 0, 0, 0, 41,
-	82, 0, 0, 37, 31, 25, 26, 27, 0, 0,
-	0, 28, 29, 21, 0, 0, 0, 0, 0, 0,
-	40, 32, 34, 0, 0, 0, 0, 33, 0, 0,
-	0, 0, 0, 0, 68, 69, 67, 66, 41, 70,
-	0, 0, 37, 0, 65, 64, 55, 56, 57, 58,
-	59, 18, 0, 19, 9, 6, 7, 0, 0, 13,
-	60, 61, 0, 14, 16, 0, 0, 0, 21, 0,
-	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0, 5,
+	24, 89, 103, 10, 82, 94, 23, 1, 47, 73,
+	45, 59, 60, 61, 95, 62, 132, 131, 58, 50,
+	63, 64, 57, 59, 60, 61, 54, 62, 53, 171,
+	150, 52, 63, 64, 76, 77, 78, 62, 133, 79,
+	162, 31, 63, 64, 20, 55, 147, 151, 56, 86,
+	87, 141, 97, 56, 101, 104, 22, 106, 107, 108,
+	109, 110, 111, 112, 113, 114, 115, 116, 117, 118,
+	119, 120, 121, 122, 123, 65, 66, 146, 39, 148,
+	124, 17, 172, 129, 126, 75, 20, 71, 72, 70,
+	69, 20, 73, 90, 147, 99, 98, 135, 134, 136,
+	144, 58, 130, 68, 67, 57, 59, 60, 61, 74,
+	62, 92, 93, 175, 152, 63, 64, 18, 49, 19,
+	9, 6, 7, 88, 156, 13, 149, 90, 96, 14,
+	16, 48, 154, 155, 21, 153, 127, 157, 43, 44,
+	137, 125, 159, 158, 160, 167, 161, 18, 164, 104,
+	143, 166, 83, 84, 83, 84, 91, 140, 137, 5,
+	105, 80, 100, 139, 170, 21, 51, 48, 65, 66,
+	173, 90, 174, 46, 169, 176, 177, 142, 81, 178,
+	71, 72, 70, 69, 40, 73, 90, 15, 138, 37,
+	36, 8, 12, 11, 58, 4, 68, 67, 57, 59,
+	60, 61, 3, 62, 65, 66, 2, 0, 63, 64,
+	0, 0, 0, 0, 0, 0, 71, 72, 70, 69,
+	0, 73, 0, 0, 0, 168, 0, 0, 0, 0,
+	58, 0, 68, 67, 57, 59, 60, 61, 0, 62,
+	65, 66, 0, 0, 63, 64, 0, 0, 0, 0,
+	0, 0, 71, 72, 70, 69, 0, 73, 0, 0,
+	0, 0, 0, 0, 0, 0, 58, 0, 68, 67,
+	57, 59, 60, 61, 0, 62, 65, 66, 163, 0,
+	63, 64, 0, 0, 0, 0, 0, 0, 71, 72,
+	70, 69, 0, 73, 0, 0, 0, 0, 0, 145,
+	0, 0, 58, 0, 68, 67, 57, 59, 60, 61,
+	0, 62, 65, 66, 0, 0, 63, 64, 0, 0,
+	0, 0, 0, 0, 71, 72, 70, 69, 0, 73,
+	0, 0, 0, 128, 0, 0, 0, 0, 58, 0,
+	68, 67, 57, 59, 60, 61, 0, 62, 65, 66,
+	0, 0, 63, 64, 0, 0, 0, 0, 0, 0,
+	71, 72, 70, 69, 0, 73, 0, 0, 0, 0,
+	0, 0, 0, 0, 58, 0, 68, 67, 57, 59,
+	60, 61, 65, 62, 0, 0, 0, 0, 63, 64,
+	0, 0, 0, 0, 71, 72, 70, 69, 0, 73,
+	0, 0, 0, 0, 0, 0, 0, 0, 58, 0,
+	68, 67, 57, 59, 60, 61, 0, 62, 0, 0,
+	0, 0, 63, 64, 71, 72, 70, 69, 0, 73,
+	0, 0, 0, 0, 0, 0, 0, 0, 58, 0,
+	68, 67, 57, 59, 60, 61, 0, 62, 32, 25,
+	26, 27, 63, 64, 0, 28, 29, 21, 0, 0,
+	0, 0, 30, 0, 41, 0, 33, 165, 42, 0,
+	35, 0, 34, 38, 32, 25, 26, 27, 0, 0,
+	0, 28, 29, 21, 0, 0, 0, 0, 30, 0,
+	41, 0, 33, 102, 42, 0, 35, 0, 34, 38,
+	32, 25, 26, 27, 0, 0, 0, 28, 29, 21,
+	0, 0, 0, 0, 30, 0, 41, 0, 33, 0,
+	42, 85, 35, 0, 34, 38, 32, 25, 26, 27,
+	0, 0, 0, 28, 29, 21, 0, 0, 0, 0,
+	30, 0, 41, 0, 33, 0, 42, 0, 35, 0,
+	34, 38,
 }
 
 var yyPact = [...]int16{
-	-1000, -1000, 417, 53, -1000, -1000, -1000, 362, 46, 362,
-	-1000, -1000, -1000, 114, 111, -1000, 70, -1000, 362, 107,
-	-2, -1000, -1000, -3, 262, -1000, -1000, -1000, -1000, -1000,
-	-2, 69, 362, 362, 362, -1000, -1000, 362, -1000, -1000,
-	-4, 323, 362, 100, 81, 69, 40, -1000, 100, 81,
-	37, 105, 362, 311, 362, 362, 362, 362, 362, 362,
-	362, 362, 362, 362, 362, 362, 362, 362, 362, 362,
-	362, 72, 57, 233, -36, -36, 262, -1000, -13, -1000,
-	-40, -42, -1000, -29, -3, -1000, -1000, -1000, 72, 362,
-	102, 5, 131, 101, 362, -1000, 215, -1000, 2, 262,
-	262, 38, 38, -36, -36, -36, 262, 262, 382, 280,
-	-12, -12, -12, -12, -12, -12, -12, -1000, -1000, -1,
-	-1000, -1000, 90, 362, 362, -1000, -25, -1000, -3, -1000,
-	362, 92, 42, 186, -1000, -1000, 362, -1000, 86, -1000,
-	262, 262, -1000, 168, -1000, -1000, 84, 362, 262, -23,
-	-1000, 100, 139, -1000, 72, -1000, 362, -1000, 81, -1000,
+	-1000, -1000, 113, 10, -1000, -1000, -1000, 514, 91, 514,
+	-1000, -1000, -1000, 152, 146, -1000, 88, -1000, 514, 145,
+	-4, -1000, -1000, 0, 338, -1000, -1000, -1000, -1000, -1000,
+	-1000, -4, 55, 514, 514, 514, -1000, -1000, 514, -1000,
+	-1000, 132, 488, 514, 144, 158, 55, 64, -35, 144,
+	158, 48, 141, 514, 462, 139, 514, 514, 514, 514,
+	514, 514, 514, 514, 514, 514, 514, 514, 514, 514,
+	514, 514, 514, 514, -35, 110, 302, -8, -8, 338,
+	-1000, 54, -1000, -32, -33, -1000, 5, 0, -1000, -1000,
+	-1000, -35, 514, 137, -1000, 142, 3, 172, 129, 514,
+	-1000, 266, -1000, 46, 338, 49, 338, -30, -30, -8,
+	-8, -8, -8, 338, 338, 402, 372, -18, -18, -18,
+	-18, -18, -18, -18, 99, -1000, -1, 83, -1000, -1000,
+	134, 514, 514, -1000, 95, 99, 0, -35, -1000, -1000,
+	-1000, 514, 143, -7, 230, -1000, -1000, 514, 436, -1000,
+	-1000, 119, -1000, -1000, 338, 338, -1000, -1000, -1000, 194,
+	-1000, -1000, 156, 514, 338, -1000, -2, 51, -1000, 514,
+	65, -1000, -1000, 158, -1000, 514, -1000, 158, -1000,
 }
 
 var yyPgo = [...]uint8{
-	0, 5, 152, 1, 151, 147, 146, 2, 145, 144,
-	7, 143, 28, 3, 0, 138, 142, 140, 8, 39,
-	139, 4,
+	0, 7, 206, 1, 202, 195, 193, 3, 192, 191,
+	6, 2, 78, 41, 0, 184, 190, 189, 8, 109,
+	5, 188, 178, 4,
 }
 
 var yyR1 = [...]int8{
 	0, 1, 1, 1, 2, 2, 2, 4, 4, 4,
 	5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
-	7, 7, 7, 8, 6, 6, 19, 19, 19, 18,
-	18, 3, 9, 9, 10, 10, 12, 12, 12, 13,
-	13, 15, 15, 11, 11, 14, 14, 14, 14, 14,
+	7, 7, 7, 8, 6, 6, 19, 19, 19, 19,
+	18, 18, 20, 20, 21, 21, 3, 9, 9, 10,
+	10, 12, 12, 12, 13, 13, 15, 15, 15, 15,
+	11, 11, 14, 14, 14, 14, 14, 14, 14, 14,
 	14, 14, 14, 14, 14, 14, 14, 14, 14, 14,
 	14, 14, 14, 14, 14, 14, 14, 14, 14, 14,
-	14, 14, 14, 14, 16, 16, 20, 20, 21, 21,
-	17, 17,
+	14, 14, 14, 16, 16, 22, 22, 23, 23, 17,
+	17,
 }
 
 var yyR2 = [...]int8{
 	0, 1, 2, 3, 0, 2, 2, 1, 1, 2,
-	3, 3, 1, 1, 1, 4, 2, 4, 1, 6,
-	3, 5, 5, 8, 7, 9, 2, 3, 5, 1,
-	3, 3, 1, 3, 1, 3, 1, 3, 4, 1,
-	1, 3, 4, 1, 3, 1, 1, 1, 1, 1,
-	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 3, 2,
-	2, 1, 1, 2, 2, 3, 1, 3, 3, 3,
-	2, 3,
+	3, 3, 1, 1, 1, 5, 2, 4, 1, 6,
+	3, 5, 5, 8, 7, 9, 2, 3, 5, 3,
+	2, 4, 0, 2, 1, 1, 3, 1, 3, 1,
+	3, 1, 3, 4, 1, 1, 3, 4, 5, 6,
+	1, 3, 1, 1, 1, 1, 1, 1, 1, 4,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 2, 2,
+	1, 1, 2, 2, 3, 1, 3, 3, 3, 2,
+	3,
 }
 
 var yyChk = [...]int16{
-	-1000, -1, -2, -4, -5, 41, 8, 9, -9, 7,
+	-1000, -1, -2, -4, -5, 46, 8, 9, -9, 7,
 	-7, -6, -8, 12, 16, -15, 17, -12, 4, 6,
-	-13, 21, 41, -10, -14, 13, 14, 15, 19, 20,
-	-13, 12, 29, 35, 30, -16, -17, 50, -12, -15,
-	28, 46, 42, 43, -14, 21, -18, 21, 29, -14,
-	21, 31, 46, 29, 43, 34, 35, 36, 37, 38,
-	48, 49, 10, 11, 33, 32, 25, 24, 22, 23,
-	27, -19, 29, -14, -14, -14, -14, 45, -20, -21,
-	20, 21, 47, -10, -10, -12, -3, 28, -19, 42,
-	43, -12, -3, 43, 42, 21, -14, 44, -11, -14,
+	-13, 21, 46, -10, -14, 13, 14, 15, 19, 20,
+	26, -13, 12, 30, 36, 34, -16, -17, 37, -12,
+	-15, 28, 32, 47, 48, -14, 21, -18, 21, 30,
+	-14, 21, 35, 32, 30, 49, 48, 40, 36, 41,
+	42, 43, 45, 50, 51, 10, 11, 39, 38, 25,
+	24, 22, 23, 27, -19, 30, -14, -14, -14, -14,
+	29, -22, -23, 20, 21, 33, -10, -10, -12, -3,
+	28, -19, 47, 48, -20, 49, -12, -3, 48, 47,
+	21, -14, 31, -11, -14, 21, -14, -14, -14, -14,
 	-14, -14, -14, -14, -14, -14, -14, -14, -14, -14,
-	-14, -14, -14, -14, -14, -14, -14, -3, 44, -18,
-	44, 45, 43, 51, 51, 47, -1, -3, -10, 21,
-	43, 5, 21, -14, 47, 44, 43, 44, 43, -21,
-	-14, -14, 45, -14, -3, -7, 42, 43, -14, 26,
-	44, 18, -14, 44, -12, -3, 43, -3, -14, -3,
+	-14, -14, -14, -14, -20, 31, -18, 26, 31, 29,
+	48, 49, 49, 33, -1, -20, -10, 21, -21, 21,
+	15, 48, 5, 21, -14, 33, 31, 48, 30, -3,
+	31, 48, 31, -23, -14, -14, 29, -3, -20, -14,
+	-3, -7, 47, 48, -14, 31, -11, 26, 31, 18,
+	-14, 31, 31, -14, -3, 48, -3, -14, -3,
 }
 
 var yyDef = [...]int8{
 	4, -2, 1, 2, 5, 6, 7, 8, 0, 0,
 	12, 13, 14, 0, 0, -2, 0, -2, 0, 0,
-	0, 36, 3, 9, 34, 45, 46, 47, 48, 49,
-	50, 0, 0, 0, 0, 71, 72, 0, 39, 40,
-	0, 0, 0, 0, 0, 0, 16, 29, 0, 0,
+	0, 41, 3, 9, 39, 52, 53, 54, 55, 56,
+	57, 58, 0, 0, 0, 0, 80, 81, 0, 44,
+	45, 0, 0, 0, 0, 0, 0, 16, 32, 0,
 	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 69, 70, 73, 74, 0, 76,
-	0, 0, 80, 0, 10, -2, 11, 4, 0, 0,
-	0, 39, 20, 0, 0, 37, 0, 41, 0, 43,
-	35, 52, 53, 54, 55, 56, 57, 58, 59, 60,
-	61, 62, 63, 64, 65, 66, 68, 51, 26, 0,
-	67, 75, 0, 0, 0, 81, 0, 15, 17, 30,
-	0, 0, 0, 0, 38, 42, 0, 27, 0, 77,
-	78, 79, 31, 0, 21, 22, 0, 0, 44, 0,
-	19, 0, 0, 28, 39, 24, 0, 23, 0, 25,
+	0, 0, 0, 0, 32, 0, 0, 78, 79, 82,
+	83, 0, 85, 0, 0, 89, 0, 10, -2, 11,
+	4, 32, 0, 0, 30, 0, 44, 20, 0, 0,
+	42, 0, 46, 0, 50, 0, 40, 60, 61, 62,
+	63, 64, 65, 66, 67, 68, 69, 70, 71, 72,
+	73, 74, 75, 77, 0, 26, 0, 0, 76, 84,
+	0, 0, 0, 90, 0, 0, 17, 32, 33, 34,
+	35, 0, 0, 0, 0, 43, 47, 0, 0, 59,
+	27, 0, 29, 86, 87, 88, 36, 15, 31, 0,
+	21, 22, 0, 0, 51, 48, 0, 0, 19, 0,
+	0, 49, 28, 0, 24, 0, 23, 0, 25,
 }
 
 var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 30, 3, 50, 3, 38, 49, 3,
-	29, 44, 36, 34, 43, 35, 31, 37, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 51, 41,
-	33, 42, 32, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 34, 3, 37, 3, 43, 51, 3,
+	30, 31, 41, 40, 48, 36, 35, 42, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 49, 46,
+	39, 47, 38, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 46, 3, 47, 40, 3, 3, 3, 3, 3,
+	3, 32, 3, 33, 45, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 28, 48, 45,
+	3, 3, 3, 28, 50, 29,
 }
 
 var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
-	22, 23, 24, 25, 26, 27, 39,
+	22, 23, 24, 25, 26, 27, 44,
 }
 
 var yyTok3 = [...]int8{
@@ -644,7 +665,7 @@ yydefault:
 
 	case 1:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:45
+//line grammar.y:48
 		{
 			yyVAL.stmts = yyDollar[1].stmts
 			if l, ok := yylex.(*Lexer); ok {
@@ -653,7 +674,7 @@ yydefault:
 		}
 	case 2:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:50
+//line grammar.y:53
 		{
 			yyVAL.stmts = append(yyDollar[1].stmts, yyDollar[2].stmt)
 			if l, ok := yylex.(*Lexer); ok {
@@ -662,7 +683,7 @@ yydefault:
 		}
 	case 3:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:55
+//line grammar.y:58
 		{
 			yyVAL.stmts = append(yyDollar[1].stmts, yyDollar[2].stmt)
 			if l, ok := yylex.(*Lexer); ok {
@@ -671,524 +692,709 @@ yydefault:
 		}
 	case 4:
 		yyDollar = yyS[yypt-0 : yypt+1]
-//line grammar.y:62
+//line grammar.y:65
 		{
 			yyVAL.stmts = []ast.Stmt{}
 		}
 	case 5:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:64
+//line grammar.y:67
 		{
 			yyVAL.stmts = append(yyDollar[1].stmts, yyDollar[2].stmt)
 		}
 	case 6:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:66
+//line grammar.y:69
 		{
 			yyVAL.stmts = yyDollar[1].stmts
 		}
 	case 7:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:70
+//line grammar.y:73
 		{
 			yyVAL.stmt = &ast.BreakStmt{}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[1].token.End)
 		}
 	case 8:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:72
+//line grammar.y:77
 		{
 			yyVAL.stmt = &ast.ReturnStmt{Exprs: []ast.Expr{}}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[1].token.End)
 		}
 	case 9:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:74
+//line grammar.y:81
 		{
 			yyVAL.stmt = &ast.ReturnStmt{Exprs: yyDollar[2].exprlist}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[2].exprlist[len(yyDollar[2].exprlist)-1].EndPos())
 		}
 	case 10:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:78
+//line grammar.y:87
 		{
 			yyVAL.stmt = &ast.AssignStmt{Lhs: yyDollar[1].exprlist, Rhs: yyDollar[3].exprlist}
+			yyVAL.stmt.SetPos(yyDollar[1].exprlist[0].Pos())
+			yyVAL.stmt.SetEndPos(yyDollar[3].exprlist[len(yyDollar[3].exprlist)-1].EndPos())
 		}
 	case 11:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:80
+//line grammar.y:91
 		{
 			yyVAL.stmt = &ast.WhileStmt{CondExpr: yyDollar[2].expr, Chunk: yyDollar[3].stmts}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[3].token.End)
 		}
 	case 12:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:82
+//line grammar.y:95
 		{
 			yyVAL.stmt = yyDollar[1].stmt
 		}
 	case 13:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:84
+//line grammar.y:97
 		{
 			yyVAL.stmt = yyDollar[1].stmt
 		}
 	case 14:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:86
+//line grammar.y:99
 		{
 			yyVAL.stmt = yyDollar[1].stmt
 		}
 	case 15:
-		yyDollar = yyS[yypt-4 : yypt+1]
-//line grammar.y:88
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:101
 		{
-			yyVAL.stmt = &ast.FuncDefStmt{FuncName: yyDollar[2].token.Str, ParList: yyDollar[3].parlist.Names, HasVArg: yyDollar[3].parlist.HasVArg, Block: yyDollar[4].stmts}
+			yyVAL.stmt = &ast.FuncDefStmt{FuncName: yyDollar[2].token.Str, NamePos: yyDollar[2].token.Pos, ParList: yyDollar[3].parlist.Names, ParamPos: yyDollar[3].parlist.NamePos, ParamTypes: yyDollar[3].parlist.Types, ReturnType: yyDollar[4].token.Str, HasVArg: yyDollar[3].parlist.HasVArg, Block: yyDollar[5].stmts}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[5].token.End)
 		}
 	case 16:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:90
+//line grammar.y:105
 		{
-			yyVAL.stmt = &ast.VarDefStmt{Vars: yyDollar[2].namelist, Exprs: []ast.Expr{}}
+			yyVAL.stmt = &ast.VarDefStmt{Vars: yyDollar[2].namelist, VarPos: yyDollar[2].positions, Types: yyDollar[2].types, Exprs: []ast.Expr{}}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[2].token.End)
 		}
 	case 17:
 		yyDollar = yyS[yypt-4 : yypt+1]
-//line grammar.y:92
+//line grammar.y:109
 		{
-			yyVAL.stmt = &ast.VarDefStmt{Vars: yyDollar[2].namelist, Exprs: yyDollar[4].exprlist}
+			yyVAL.stmt = &ast.VarDefStmt{Vars: yyDollar[2].namelist, VarPos: yyDollar[2].positions, Types: yyDollar[2].types, Exprs: yyDollar[4].exprlist}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[4].exprlist[len(yyDollar[4].exprlist)-1].EndPos())
 		}
 	case 18:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:94
+//line grammar.y:113
 		{
 			if e, ok := yyDollar[1].expr.(*ast.FuncCallExpr); ok {
 				yyVAL.stmt = &ast.FuncCallStmt{
 					Expr: e,
 				}
+				yyVAL.stmt.SetPos(e.Pos())
+				yyVAL.stmt.SetEndPos(e.EndPos())
 			} else {
 				yylex.(*Lexer).Error("parse error")
 			}
 		}
 	case 19:
 		yyDollar = yyS[yypt-6 : yypt+1]
-//line grammar.y:102
+//line grammar.y:123
 		{
 			yyVAL.stmt = &ast.ListAppendStmt{
 				Object:  yyDollar[3].expr,
 				Element: yyDollar[5].expr,
 			}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[6].token.End)
 		}
 	case 20:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:109
+//line grammar.y:132
 		{
 			yyVAL.stmt = &ast.IfStmt{CondExpr: yyDollar[2].expr, ThenChunk: yyDollar[3].stmts, ElseChunk: []ast.Stmt{}}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[3].token.End)
 		}
 	case 21:
 		yyDollar = yyS[yypt-5 : yypt+1]
-//line grammar.y:111
+//line grammar.y:136
 		{
-			yyVAL.stmt = &ast.IfStmt{CondExpr: yyDollar[2].expr, ThenChunk: yyDollar[3].stmts, ElseChunk: yyDollar[5].stmts}
+			yyVAL.stmt = &ast.IfStmt{CondExpr: yyDollar[2].expr, ThenChunk: yyDollar[3].stmts, ElsePos: yyDollar[4].token.Pos, ElseChunk: yyDollar[5].stmts}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[5].token.End)
 		}
 	case 22:
 		yyDollar = yyS[yypt-5 : yypt+1]
-//line grammar.y:113
+//line grammar.y:140
 		{
-			yyVAL.stmt = &ast.IfStmt{CondExpr: yyDollar[2].expr, ThenChunk: yyDollar[3].stmts, ElseChunk: []ast.Stmt{yyDollar[5].stmt}}
+			yyVAL.stmt = &ast.IfStmt{CondExpr: yyDollar[2].expr, ThenChunk: yyDollar[3].stmts, ElsePos: yyDollar[4].token.Pos, ElseChunk: []ast.Stmt{yyDollar[5].stmt}}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[5].stmt.EndPos())
 		}
 	case 23:
 		yyDollar = yyS[yypt-8 : yypt+1]
-//line grammar.y:117
+//line grammar.y:146
 		{
 			yyVAL.stmt = &ast.ForRangeStmt{
-				Index:  yyDollar[2].token.Str,
-				Value:  yyDollar[4].token.Str,
-				Object: yyDollar[7].expr,
-				Block:  yyDollar[8].stmts,
+				Index:    yyDollar[2].token.Str,
+				IndexPos: yyDollar[2].token.Pos,
+				Value:    yyDollar[4].token.Str,
+				ValuePos: yyDollar[4].token.Pos,
+				Object:   yyDollar[7].expr,
+				Block:    yyDollar[8].stmts,
 			}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[8].token.End)
 		}
 	case 24:
 		yyDollar = yyS[yypt-7 : yypt+1]
-//line grammar.y:125
+//line grammar.y:158
 		{
-			yyVAL.stmt = &ast.ForNumberStmt{CounterName: yyDollar[2].token.Str, Start: yyDollar[4].expr, End: yyDollar[6].expr, Step: nil, Chunk: yyDollar[7].stmts}
+			yyVAL.stmt = &ast.ForNumberStmt{CounterName: yyDollar[2].token.Str, CounterPos: yyDollar[2].token.Pos, Start: yyDollar[4].expr, End: yyDollar[6].expr, Step: nil, Chunk: yyDollar[7].stmts}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[7].token.End)
 		}
 	case 25:
 		yyDollar = yyS[yypt-9 : yypt+1]
-//line grammar.y:127
+//line grammar.y:162
 		{
-			yyVAL.stmt = &ast.ForNumberStmt{CounterName: yyDollar[2].token.Str, Start: yyDollar[4].expr, End: yyDollar[6].expr, Step: yyDollar[8].expr, Chunk: yyDollar[9].stmts}
+			yyVAL.stmt = &ast.ForNumberStmt{CounterName: yyDollar[2].token.Str, CounterPos: yyDollar[2].token.Pos, Start: yyDollar[4].expr, End: yyDollar[6].expr, Step: yyDollar[8].expr, Chunk: yyDollar[9].stmts}
+			yyVAL.stmt.SetPos(yyDollar[1].token.Pos)
+			yyVAL.stmt.SetEndPos(yyDollar[9].token.End)
 		}
 	case 26:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:131
+//line grammar.y:168
 		{
 			yyVAL.parlist = &ast.ParList{Names: []string{}, HasVArg: false}
 		}
 	case 27:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:133
+//line grammar.y:170
 		{
-			yyVAL.parlist = &ast.ParList{Names: yyDollar[2].namelist, HasVArg: false}
+			yyVAL.parlist = &ast.ParList{Names: yyDollar[2].namelist, NamePos: yyDollar[2].positions, Types: yyDollar[2].types, HasVArg: false}
 		}
 	case 28:
 		yyDollar = yyS[yypt-5 : yypt+1]
-//line grammar.y:135
+//line grammar.y:172
 		{
-			yyVAL.parlist = &ast.ParList{Names: yyDollar[2].namelist, HasVArg: true}
+			yyVAL.parlist = &ast.ParList{Names: yyDollar[2].namelist, NamePos: yyDollar[2].positions, Types: yyDollar[2].types, HasVArg: true}
 		}
 	case 29:
-		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:139
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:174
 		{
-			yyVAL.namelist = []string{yyDollar[1].token.Str}
+			yyVAL.parlist = &ast.ParList{Names: []string{}, HasVArg: true}
 		}
 	case 30:
-		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:141
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:180
 		{
-			yyVAL.namelist = append(yyDollar[1].namelist, yyDollar[3].token.Str)
+			yyVAL.namelist = []string{yyDollar[1].token.Str}
+			yyVAL.token = yyDollar[1].token
+			if yyDollar[2].token.Str != "" {
+				yyVAL.token = yyDollar[2].token
+			}
+			yyVAL.positions = []ast.Position{yyDollar[1].token.Pos}
+			yyVAL.types = []string{yyDollar[2].token.Str}
 		}
 	case 31:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:188
+		{
+			yyVAL.namelist = append(yyDollar[1].namelist, yyDollar[3].token.Str)
+			yyVAL.token = yyDollar[3].token
+			if yyDollar[4].token.Str != "" {
+				yyVAL.token = yyDollar[4].token
+			}
+			yyVAL.positions = append(yyDollar[1].positions, yyDollar[3].token.Pos)
+			yyVAL.types = append(yyDollar[1].types, yyDollar[4].token.Str)
+		}
+	case 32:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:197
+		{
+			yyVAL.token = ast.Token{}
+		}
+	case 33:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:199
+		{
+			yyVAL.token = yyDollar[2].token
+		}
+	case 34:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:202
+		{
+			yyVAL.token = yyDollar[1].token
+		}
+	case 35:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:204
+		{
+			yyVAL.token = yyDollar[1].token
+		}
+	case 36:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:145
+//line grammar.y:210
 		{
 			yyVAL.stmts = yyDollar[2].stmts
+			yyVAL.token = yyDollar[3].token
 		}
-	case 32:
+	case 37:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:149
+//line grammar.y:215
 		{
 			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
-	case 33:
+	case 38:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:151
+//line grammar.y:217
 		{
 			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr)
 		}
-	case 34:
+	case 39:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:155
+//line grammar.y:221
 		{
 			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
-	case 35:
+	case 40:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:157
+//line grammar.y:223
 		{
 			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr)
 		}
-	case 36:
+	case 41:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:161
+//line grammar.y:227
 		{
 			yyVAL.expr = &ast.IdentExpr{Value: yyDollar[1].token.Str}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
 		}
-	case 37:
+	case 42:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:163
+//line grammar.y:231
 		{
-			yyVAL.expr = &ast.FieldGetExpr{Object: yyDollar[1].expr, Key: &ast.StringExpr{Value: yyDollar[3].token.Str}}
+			key := &ast.StringExpr{Value: yyDollar[3].token.Str}
+			key.SetPos(yyDollar[3].token.Pos)
+			key.SetEndPos(yyDollar[3].token.End)
+			yyVAL.expr = &ast.FieldGetExpr{Object: yyDollar[1].expr, Key: key}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].token.End)
 		}
-	case 38:
+	case 43:
 		yyDollar = yyS[yypt-4 : yypt+1]
-//line grammar.y:165
+//line grammar.y:238
 		{
 			yyVAL.expr = &ast.FieldGetExpr{Object: yyDollar[1].expr, Key: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[4].token.End)
 		}
-	case 39:
+	case 44:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:169
+//line grammar.y:244
 		{
 			yyVAL.expr = yyDollar[1].expr
 		}
-	case 40:
+	case 45:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:171
+//line grammar.y:246
 		{
 			yyVAL.expr = yyDollar[1].expr
 		}
-	case 41:
+	case 46:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:175
+//line grammar.y:250
 		{
 			yyVAL.expr = &ast.FuncCallExpr{Func: yyDollar[1].expr, Args: []ast.Expr{}}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].token.End)
 		}
-	case 42:
+	case 47:
 		yyDollar = yyS[yypt-4 : yypt+1]
-//line grammar.y:177
+//line grammar.y:254
 		{
 			yyVAL.expr = &ast.FuncCallExpr{Func: yyDollar[1].expr, Args: yyDollar[3].exprlist}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[4].token.End)
 		}
-	case 43:
+	case 48:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:258
+		{
+			yyVAL.expr = &ast.FuncCallExpr{Receiver: yyDollar[1].expr, Method: yyDollar[3].token.Str, Args: []ast.Expr{}}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[5].token.End)
+		}
+	case 49:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line grammar.y:262
+		{
+			yyVAL.expr = &ast.FuncCallExpr{Receiver: yyDollar[1].expr, Method: yyDollar[3].token.Str, Args: yyDollar[5].exprlist}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[6].token.End)
+		}
+	case 50:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:181
+//line grammar.y:268
 		{
 			yyVAL.exprlist = []ast.Expr{yyDollar[1].expr}
 		}
-	case 44:
+	case 51:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:183
+//line grammar.y:270
 		{
 			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr)
 		}
-	case 45:
+	case 52:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:187
+//line grammar.y:274
 		{
 			yyVAL.expr = &ast.TrueExpr{}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
 		}
-	case 46:
+	case 53:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:189
+//line grammar.y:278
 		{
 			yyVAL.expr = &ast.FalseExpr{}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
 		}
-	case 47:
+	case 54:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:191
+//line grammar.y:282
 		{
 			yyVAL.expr = &ast.NilExpr{}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
 		}
-	case 48:
+	case 55:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:193
+//line grammar.y:286
 		{
 			yyVAL.expr = &ast.NumberExpr{Value: yyDollar[1].token.Str}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
 		}
-	case 49:
+	case 56:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:195
+//line grammar.y:290
 		{
 			yyVAL.expr = &ast.StringExpr{Value: yyDollar[1].token.Str}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
 		}
-	case 50:
+	case 57:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:197
+//line grammar.y:294
+		{
+			yyVAL.expr = &ast.VarArgExpr{}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[1].token.End)
+		}
+	case 58:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:298
 		{
 			yyVAL.expr = yyDollar[1].expr
 		}
-	case 51:
-		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:199
+	case 59:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:300
 		{
 			yyVAL.expr = &ast.FunctionExpr{
-				Params:  yyDollar[2].parlist.Names,
-				HasVArg: yyDollar[2].parlist.HasVArg,
-				Block:   yyDollar[3].stmts,
+				Params:     yyDollar[2].parlist.Names,
+				ParamPos:   yyDollar[2].parlist.NamePos,
+				ParamTypes: yyDollar[2].parlist.Types,
+				ReturnType: yyDollar[3].token.Str,
+				HasVArg:    yyDollar[2].parlist.HasVArg,
+				Block:      yyDollar[4].stmts,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[4].token.End)
 		}
-	case 52:
+	case 60:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:205
+//line grammar.y:311
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{
 				Operator: ast.OpAdd,
 				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 53:
+	case 61:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:210
+//line grammar.y:318
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{
 				Operator: ast.OpSubtract,
 				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 54:
+	case 62:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:215
+//line grammar.y:325
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{
 				Operator: ast.OpMul,
 				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 55:
+	case 63:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:220
+//line grammar.y:332
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{
 				Operator: ast.OpDiv,
 				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 56:
+	case 64:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:225
+//line grammar.y:339
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{
 				Operator: ast.OpMod,
 				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 57:
+	case 65:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:230
+//line grammar.y:346
+		{
+			yyVAL.expr = &ast.ArithmeticOpExpr{
+				Operator: ast.OpPow,
+				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
+			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
+		}
+	case 66:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:353
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{
 				Operator: ast.OpBitOr,
 				Lhs:      yyDollar[1].expr, Rhs: yyDollar[3].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 58:
+	case 67:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:235
+//line grammar.y:360
 		{
 			yyVAL.expr = &ast.ArithmeticOpExpr{Operator: ast.OpBitAnd, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 59:
+	case 68:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:237
+//line grammar.y:364
 		{
 			yyVAL.expr = &ast.LogicalOpExpr{Operator: ast.OpAnd, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 60:
+	case 69:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:239
+//line grammar.y:368
 		{
 			yyVAL.expr = &ast.LogicalOpExpr{Operator: ast.OpOr, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 61:
+	case 70:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:241
+//line grammar.y:372
 		{
 			yyVAL.expr = &ast.RelationalOpExpr{Operator: ast.OpLt, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 62:
+	case 71:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:243
+//line grammar.y:376
 		{
 			yyVAL.expr = &ast.RelationalOpExpr{Operator: ast.OpGt, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 63:
+	case 72:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:245
+//line grammar.y:380
 		{
 			yyVAL.expr = &ast.RelationalOpExpr{Operator: ast.OpLe, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 64:
+	case 73:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:247
+//line grammar.y:384
 		{
 			yyVAL.expr = &ast.RelationalOpExpr{Operator: ast.OpGe, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 65:
+	case 74:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:249
+//line grammar.y:388
 		{
 			yyVAL.expr = &ast.RelationalOpExpr{Operator: ast.OpEqual, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 66:
+	case 75:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:251
+//line grammar.y:392
 		{
 			yyVAL.expr = &ast.RelationalOpExpr{Operator: ast.OpNotEqual, Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 67:
+	case 76:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:253
+//line grammar.y:396
 		{
 			yyVAL.expr = yyDollar[2].expr
 		}
-	case 68:
+	case 77:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:255
+//line grammar.y:398
 		{
 			yyVAL.expr = &ast.ConcatStrExpr{Lhs: yyDollar[1].expr, Rhs: yyDollar[3].expr}
+			yyVAL.expr.SetPos(yyDollar[1].expr.Pos())
+			yyVAL.expr.SetEndPos(yyDollar[3].expr.EndPos())
 		}
-	case 69:
+	case 78:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:257
+//line grammar.y:402
 		{
 			yyVAL.expr = &ast.UnaryOpMinusExpr{Expr: yyDollar[2].expr}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[2].expr.EndPos())
 		}
-	case 70:
+	case 79:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:259
+//line grammar.y:406
 		{
 			yyVAL.expr = &ast.UnaryOpNotExpr{Expr: yyDollar[2].expr}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[2].expr.EndPos())
 		}
-	case 71:
+	case 80:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:261
+//line grammar.y:410
 		{
 			yyVAL.expr = yyDollar[1].expr
 		}
-	case 72:
+	case 81:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:263
+//line grammar.y:412
 		{
 			yyVAL.expr = yyDollar[1].expr
 		}
-	case 73:
+	case 82:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:265
+//line grammar.y:414
 		{
 			yyVAL.expr = &ast.LenExpr{
 				Object: yyDollar[2].expr,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[2].expr.EndPos())
 		}
-	case 74:
+	case 83:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:271
+//line grammar.y:422
 		{
 			yyVAL.expr = &ast.DictExpr{
 				Entries: []ast.DictEntry{},
 			}
-
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[2].token.End)
 		}
-	case 75:
+	case 84:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:276
+//line grammar.y:428
 		{
 			yyVAL.expr = &ast.DictExpr{
 				Entries: yyDollar[2].entries,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[3].token.End)
 		}
-	case 76:
+	case 85:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line grammar.y:282
+//line grammar.y:436
 		{
 			yyVAL.entries = []ast.DictEntry{yyDollar[1].entry}
 		}
-	case 77:
+	case 86:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:284
+//line grammar.y:438
 		{
 			yyVAL.entries = append(yyDollar[1].entries, yyDollar[3].entry)
 		}
-	case 78:
+	case 87:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:288
+//line grammar.y:442
 		{
 			yyVAL.entry = ast.DictEntry{
 				Key:   yyDollar[1].token.Str,
 				Value: yyDollar[3].expr,
 			}
 		}
-	case 79:
+	case 88:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:293
+//line grammar.y:447
 		{
 			yyVAL.entry = ast.DictEntry{
 				Key:   yyDollar[1].token.Str,
 				Value: yyDollar[3].expr,
 			}
 		}
-	case 80:
+	case 89:
 		yyDollar = yyS[yypt-2 : yypt+1]
-//line grammar.y:300
+//line grammar.y:454
 		{
 			yyVAL.expr = &ast.ListExpr{
 				Elements: []ast.Expr{},
 			}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[2].token.End)
 		}
-	case 81:
+	case 90:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line grammar.y:304
+//line grammar.y:460
 		{
 			yyVAL.expr = &ast.ListExpr{
 				Elements: yyDollar[2].exprlist,
 			}
+			yyVAL.expr.SetPos(yyDollar[1].token.Pos)
+			yyVAL.expr.SetEndPos(yyDollar[3].token.End)
 		}
 	}
 	goto yystack /* stack new state and value */
@@ -0,0 +1,64 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPositions(t *testing.T) {
+	src := `var a = 1
+while a < 3 {
+  a = a + f(1)
+}`
+	chunk, err := Parse(strings.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(chunk))
+
+	assert.Equal(t, ast.Position{Source: "script.kala", Line: 1, Column: 1}, chunk[0].Pos())
+	assert.Equal(t, ast.Position{Source: "script.kala", Line: 1, Column: 9}, chunk[0].EndPos())
+
+	w := chunk[1].(*ast.WhileStmt)
+	assert.Equal(t, 2, w.Pos().Line)
+	assert.Equal(t, 4, w.EndPos().Line)
+	assert.Equal(t, 7, w.CondExpr.Pos().Column)
+	assert.Equal(t, 11, w.CondExpr.EndPos().Column)
+
+	assign := w.Chunk[0].(*ast.AssignStmt)
+	assert.Equal(t, ast.Position{Source: "script.kala", Line: 3, Column: 3}, assign.Pos())
+	call := assign.Rhs[0].(*ast.ArithmeticOpExpr).Rhs.(*ast.FuncCallExpr)
+	assert.Equal(t, 11, call.Pos().Column)
+	assert.Equal(t, 14, call.EndPos().Column)
+}
+
+func TestParseError(t *testing.T) {
+	_, err := Parse(strings.NewReader("var a = 1\nvar b = a +\n  * 3\n"), "script.kala")
+	perr, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, ast.Position{Source: "script.kala", Line: 3, Column: 3}, perr.Pos)
+	assert.Equal(t, "*", perr.Token)
+	assert.Equal(t, "script.kala line:3(column:3) near '*':   syntax error\n", perr.Error())
+
+	_, err = Parse(strings.NewReader("var a = 1 @ 2"), "script.kala")
+	assert.Equal(t, "script.kala line:1(column:11) near '@':   Invalid token\n", err.Error())
+
+	_, err = Parse(strings.NewReader("var a = (1\n"), "script.kala")
+	assert.Equal(t, "script.kala at EOF:   syntax error\n", err.Error())
+}
+
+func TestParseWithComments(t *testing.T) {
+	src := "-- first\nvar a = 1 -- trailing  \n--[==[ long\n]] ]==]\nb = a - -a\n"
+	chunk, comments, err := ParseWithComments(strings.NewReader(src), "script.kala")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(chunk))
+	assert.Equal(t, []ast.Comment{
+		{Pos: ast.Position{Source: "script.kala", Line: 1, Column: 1}, Text: "-- first"},
+		{Pos: ast.Position{Source: "script.kala", Line: 2, Column: 11}, Text: "-- trailing"},
+		{Pos: ast.Position{Source: "script.kala", Line: 3, Column: 1}, Text: "--[==[ long\n]] ]==]"},
+	}, comments)
+
+	chunk, _ = Parse(strings.NewReader("if a {\n} else {\n}"), "script.kala")
+	assert.Equal(t, ast.Position{Source: "script.kala", Line: 2, Column: 3}, chunk[0].(*ast.IfStmt).ElsePos)
+}
@@ -0,0 +1,201 @@
+// Package repl implements an interactive session on top of a vm.State.
+// The chunks entered one after the other share the globals of the state, and
+// the top-level variables and functions of a chunk are made globals so the
+// next chunks see them too.
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+	"github.com/khoakmp/kala/vm"
+)
+
+// SourceName is the source name of the chunks entered in a REPL.
+const SourceName = "<repl>"
+
+// ErrIncomplete is returned by Eval for a chunk that ends before its last
+// statement does, e.g. with an unclosed brace.
+var ErrIncomplete = errors.New("incomplete chunk")
+
+// REPL reads chunks from an input, runs them and prints their results.
+type REPL struct {
+	Prompt         string // printed before a new chunk
+	ContinuePrompt string // printed before each continuation line of a chunk
+
+	state  *vm.State
+	out    io.Writer
+	errOut io.Writer
+}
+
+// New returns a REPL that runs the chunks in s, writes the results to out and
+// the errors to errOut.
+func New(s *vm.State, out, errOut io.Writer) *REPL {
+	return &REPL{
+		Prompt:         "> ",
+		ContinuePrompt: ">> ",
+		state:          s,
+		out:            out,
+		errOut:         errOut,
+	}
+}
+
+// State returns the state the chunks run in.
+func (r *REPL) State() *vm.State {
+	return r.state
+}
+
+// Eval runs src and returns its results. A bare expression is evaluated and
+// its values are returned.
+func (r *REPL) Eval(src string) ([]cpi.KValue, error) {
+	chunk, err := parseChunk(src)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := cpi.Compile(globalize(chunk))
+	if err != nil {
+		return nil, err
+	}
+	return r.state.Call(vm.NewLocalClosure(proto))
+}
+
+// parseChunk parses src as an expression whose values are returned, or as
+// a list of statements if it is not an expression.
+func parseChunk(src string) ([]ast.Stmt, error) {
+	chunk, exprErr := parse.Parse(strings.NewReader("return "+src), SourceName)
+	if exprErr == nil {
+		return chunk, nil
+	}
+	chunk, err := parse.Parse(strings.NewReader(src), SourceName)
+	if err == nil {
+		return chunk, nil
+	}
+	if atEOF(exprErr) || atEOF(err) {
+		return nil, ErrIncomplete
+	}
+	return nil, err
+}
+
+func atEOF(err error) bool {
+	perr, ok := err.(*parse.Error)
+	return ok && perr.Pos.Line == parse.EOF
+}
+
+// globalize turns the top-level var and func declarations of chunk into
+// assignments of globals.
+func globalize(chunk []ast.Stmt) []ast.Stmt {
+	for i, stmt := range chunk {
+		switch stmt := stmt.(type) {
+		case *ast.VarDefStmt:
+			assign := &ast.AssignStmt{Rhs: stmt.Exprs}
+			for _, name := range stmt.Vars {
+				assign.Lhs = append(assign.Lhs, identExpr(stmt, name))
+			}
+			// a var without enough values sets the other names to nil, an
+			// assignment requires as many values as names
+			if !multiValue(assign.Rhs) {
+				for len(assign.Rhs) < len(assign.Lhs) {
+					assign.Rhs = append(assign.Rhs, &ast.NilExpr{})
+				}
+			}
+			assign.SetPos(stmt.Pos())
+			assign.SetEndPos(stmt.EndPos())
+			chunk[i] = assign
+		case *ast.FuncDefStmt:
+			fn := &ast.FunctionExpr{Params: stmt.ParList, HasVArg: stmt.HasVArg, Block: stmt.Block}
+			fn.SetPos(stmt.Pos())
+			fn.SetEndPos(stmt.EndPos())
+			assign := &ast.AssignStmt{
+				Lhs: []ast.Expr{identExpr(stmt, stmt.FuncName)},
+				Rhs: []ast.Expr{fn},
+			}
+			assign.SetPos(stmt.Pos())
+			assign.SetEndPos(stmt.EndPos())
+			chunk[i] = assign
+		}
+	}
+	return chunk
+}
+
+// multiValue reports whether the last of exprs is a call or "...", which
+// give as many values as needed.
+func multiValue(exprs []ast.Expr) bool {
+	if len(exprs) == 0 {
+		return false
+	}
+	switch exprs[len(exprs)-1].(type) {
+	case *ast.FuncCallExpr, *ast.VarArgExpr:
+		return true
+	}
+	return false
+}
+
+func identExpr(stmt ast.Stmt, name string) *ast.IdentExpr {
+	e := &ast.IdentExpr{Value: name}
+	e.SetPos(stmt.Pos())
+	e.SetEndPos(stmt.Pos())
+	return e
+}
+
+// Run reads chunks from in until it ends. A line that leaves the chunk
+// incomplete is followed by continuation lines.
+func (r *REPL) Run(in io.Reader) error {
+	rd := bufio.NewReader(in)
+	var pending []string
+	for {
+		if len(pending) == 0 {
+			fmt.Fprint(r.out, r.Prompt)
+		} else {
+			fmt.Fprint(r.out, r.ContinuePrompt)
+		}
+		line, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF && line == "" {
+			fmt.Fprintln(r.out)
+			return nil
+		}
+
+		pending = append(pending, strings.TrimRight(line, "\r\n"))
+		src := strings.Join(pending, "\n")
+		if strings.TrimSpace(src) == "" {
+			pending = pending[:0]
+			continue
+		}
+		values, evalErr := r.Eval(src)
+		if evalErr == ErrIncomplete && err == nil {
+			continue
+		}
+		pending = pending[:0]
+		if evalErr != nil {
+			r.printError(evalErr)
+			continue
+		}
+		r.printValues(values)
+	}
+}
+
+func (r *REPL) printValues(values []cpi.KValue) {
+	if len(values) == 0 {
+		return
+	}
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = v.Str()
+	}
+	fmt.Fprintln(r.out, strings.Join(strs, "\t"))
+}
+
+func (r *REPL) printError(err error) {
+	fmt.Fprintln(r.errOut, strings.TrimRight(err.Error(), "\n"))
+	if rerr, ok := err.(*vm.RuntimeError); ok {
+		fmt.Fprintln(r.errOut, rerr.StackTrace())
+	}
+}
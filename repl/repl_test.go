@@ -0,0 +1,75 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEval(t *testing.T) {
+	r := New(vm.NewState(), nil, nil)
+
+	values, err := r.Eval(`var a, b = 1, 2`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(values))
+	_, err = r.Eval(`func add(x, y) {
+		return x + y
+	}`)
+	assert.Nil(t, err)
+
+	// the declarations of a chunk are seen by the next ones
+	values, err = r.Eval(`add(a, b) * 10`)
+	assert.Nil(t, err)
+	assert.Equal(t, []cpi.KValue{cpi.KNumber(30)}, values)
+
+	values, err = r.Eval(`var none`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(values))
+	values, err = r.Eval(`none, a`)
+	assert.Nil(t, err)
+	assert.Equal(t, []cpi.KValue{cpi.KNil{}, cpi.KNumber(1)}, values)
+
+	// names without a value are set to nil, as in a script
+	_, err = r.Eval(`var x, y`)
+	assert.Nil(t, err)
+	_, err = r.Eval(`var c, d = 5`)
+	assert.Nil(t, err)
+	_, err = r.Eval(`var e, f = pcall(add, 1, 1)`)
+	assert.Nil(t, err)
+	values, err = r.Eval(`x, y, c, d, e, f`)
+	assert.Nil(t, err)
+	assert.Equal(t, []cpi.KValue{cpi.KNil{}, cpi.KNil{}, cpi.KNumber(5), cpi.KNil{}, cpi.KBool(true), cpi.KNumber(2)}, values)
+
+	_, err = r.Eval(`func f() {`)
+	assert.Equal(t, ErrIncomplete, err)
+	_, err = r.Eval(`1 +`)
+	assert.Equal(t, ErrIncomplete, err)
+	_, err = r.Eval(`var = 1`)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrIncomplete, err)
+}
+
+func TestRun(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	errOut := bytes.NewBuffer(nil)
+	r := New(vm.NewState(), out, errOut)
+	in := strings.NewReader(`var total = 0
+func addAll(lst) {
+	for i, v = range lst {
+		total = total + v
+	}
+}
+addAll([1, 2, 3])
+total
+total.x
+"done"
+`)
+	assert.Nil(t, r.Run(in))
+	assert.Equal(t, "> > >> >> >> >> > > 6.00\n> > done\n> \n", out.String())
+	assert.True(t, strings.HasPrefix(errOut.String(), "attempt to index a non-dict value"))
+	assert.Contains(t, errOut.String(), "<repl>:1 in main chunk")
+}
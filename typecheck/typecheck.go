@@ -0,0 +1,411 @@
+// Package typecheck checks the type annotations of a Kala script before it
+// runs.
+//
+// The annotations are optional: a variable, a parameter or a function
+// without one has the type any, which matches every type. The types are the
+// names of cpi.TypeNames and any. nil matches every type, an annotated
+// variable may be unset.
+//
+// Besides the annotations, the checker reports the operations whose operands
+// have a known type the VM rejects, e.g. a string literal in an addition.
+package typecheck
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/cpi"
+)
+
+const typeAny = "any"
+
+var (
+	typeNumber   = cpi.TypeNames[cpi.KTypeNumber]
+	typeString   = cpi.TypeNames[cpi.KTypeString]
+	typeNil      = cpi.TypeNames[cpi.KTypeNil]
+	typeBool     = cpi.TypeNames[cpi.KTypeBool]
+	typeDict     = cpi.TypeNames[cpi.KTypeDict]
+	typeList     = cpi.TypeNames[cpi.KTypeList]
+	typeFunction = cpi.TypeNames[cpi.KTypeFunction]
+)
+
+// Error is a type error found at Pos.
+type Error struct {
+	Pos     ast.Position
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v line:%d(column:%d): %s", e.Pos.Source, e.Pos.Line, e.Pos.Column, e.Message)
+}
+
+// Check checks chunk and returns its type errors sorted by position.
+func Check(chunk []ast.Stmt) []*Error {
+	c := &checker{}
+	main := &scope{vars: map[string]*variable{}}
+	main.vars["arg"] = &variable{typ: typeList}
+	c.chunk(main, chunk)
+	sort.SliceStable(c.errors, func(i, j int) bool {
+		a, b := c.errors[i].Pos, c.errors[j].Pos
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return c.errors
+}
+
+// signature is the type of a function declared with func name(...).
+type signature struct {
+	name    string
+	params  []string
+	hasVArg bool
+	result  string
+	typed   bool // has an annotation, the count of arguments is checked
+}
+
+type variable struct {
+	typ string
+	fn  *signature // set for a function declared by name
+}
+
+type scope struct {
+	parent *scope
+	vars   map[string]*variable
+	result string // result type of the function of the block, "" if none
+}
+
+type checker struct {
+	errors []*Error
+}
+
+func (c *checker) errorf(pos ast.Position, format string, args ...any) {
+	c.errors = append(c.errors, &Error{Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+func (sc *scope) lookup(name string) *variable {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (sc *scope) enter() *scope {
+	return &scope{parent: sc, vars: map[string]*variable{}, result: sc.result}
+}
+
+// declare adds a variable to sc. Like the compiler, a name declared twice in
+// a block refers to the first variable.
+func (sc *scope) declare(name, typ string, fn *signature) {
+	if _, ok := sc.vars[name]; !ok {
+		sc.vars[name] = &variable{typ: typ, fn: fn}
+	}
+}
+
+// annotation returns the type of the annotation typ at pos, any if there is
+// none.
+func (c *checker) annotation(typ string, pos ast.Position) string {
+	switch typ {
+	case "":
+		return typeAny
+	case typeAny, typeNumber, typeString, typeNil, typeBool, typeDict, typeList, typeFunction:
+		return typ
+	}
+	c.errorf(pos, "unknown type %s", typ)
+	return typeAny
+}
+
+func assignable(typ, to string) bool {
+	return typ == to || typ == typeAny || to == typeAny || typ == typeNil
+}
+
+func annotationAt(types []string, i int) string {
+	if i < len(types) {
+		return types[i]
+	}
+	return ""
+}
+
+func positionAt(positions []ast.Position, i int) ast.Position {
+	if i < len(positions) {
+		return positions[i]
+	}
+	return ast.Position{}
+}
+
+func (c *checker) chunk(sc *scope, chunk []ast.Stmt) {
+	for _, stmt := range chunk {
+		c.stmt(sc, stmt)
+	}
+}
+
+func (c *checker) stmt(sc *scope, stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.VarDefStmt:
+		types := make([]string, len(s.Vars))
+		for i, name := range s.Vars {
+			types[i] = c.annotation(annotationAt(s.Types, i), positionAt(s.VarPos, i))
+			sc.declare(name, types[i], nil)
+		}
+		for i, e := range s.Exprs {
+			typ := c.expr(sc, e)
+			// a call in last place fills the names left with its other
+			// results, which have no declared type
+			if i < len(types) && !assignable(typ, types[i]) {
+				c.errorf(e.Pos(), "cannot use a %s as the %s %s", typ, types[i], s.Vars[i])
+			}
+		}
+	case *ast.AssignStmt:
+		types := make([]string, len(s.Rhs))
+		for i, e := range s.Rhs {
+			types[i] = c.expr(sc, e)
+		}
+		for i, e := range s.Lhs {
+			ident, ok := e.(*ast.IdentExpr)
+			if !ok {
+				c.expr(sc, e)
+				continue
+			}
+			v := sc.lookup(ident.Value)
+			if v == nil || i >= len(types) {
+				continue
+			}
+			if !assignable(types[i], v.typ) {
+				c.errorf(s.Rhs[i].Pos(), "cannot use a %s as the %s %s", types[i], v.typ, ident.Value)
+			}
+		}
+	case *ast.FuncDefStmt:
+		sig := c.signature(s.FuncName, s.ParList, s.ParamTypes, s.ParamPos, s.HasVArg, s.ReturnType, s.NamePos)
+		sc.declare(s.FuncName, typeFunction, sig)
+		c.function(sc, sig, s.ParList, s.Block, s.EndPos())
+	case *ast.IfStmt:
+		c.expr(sc, s.CondExpr)
+		c.chunk(sc.enter(), s.ThenChunk)
+		c.chunk(sc.enter(), s.ElseChunk)
+	case *ast.WhileStmt:
+		c.expr(sc, s.CondExpr)
+		c.chunk(sc.enter(), s.Chunk)
+	case *ast.ForNumberStmt:
+		for _, e := range []ast.Expr{s.Start, s.End, s.Step} {
+			if e != nil {
+				c.want(e, c.expr(sc, e), "a for loop bound", typeNumber)
+			}
+		}
+		body := sc.enter()
+		body.declare(s.CounterName, typeNumber, nil)
+		c.chunk(body, s.Chunk)
+	case *ast.ForRangeStmt:
+		c.want(s.Object, c.expr(sc, s.Object), "range", typeDict, typeList, typeFunction)
+		body := sc.enter()
+		body.declare(s.Index, typeAny, nil)
+		body.declare(s.Value, typeAny, nil)
+		c.chunk(body, s.Block)
+	case *ast.ReturnStmt:
+		c.returnStmt(sc, s)
+	case *ast.FuncCallStmt:
+		c.expr(sc, s.Expr)
+	case *ast.ListAppendStmt:
+		c.want(s.Object, c.expr(sc, s.Object), "append", typeList)
+		c.expr(sc, s.Element)
+	}
+}
+
+func (c *checker) returnStmt(sc *scope, s *ast.ReturnStmt) {
+	types := make([]string, len(s.Exprs))
+	for i, e := range s.Exprs {
+		types[i] = c.expr(sc, e)
+	}
+	if sc.result == "" || sc.result == typeAny {
+		return
+	}
+	switch {
+	case len(s.Exprs) == 0:
+		if sc.result != typeNil {
+			c.errorf(s.Pos(), "missing return value, the function returns a %s", sc.result)
+		}
+	case len(s.Exprs) > 1:
+		c.errorf(s.Pos(), "too many return values, the function returns a %s", sc.result)
+	case !assignable(types[0], sc.result):
+		c.errorf(s.Exprs[0].Pos(), "cannot return a %s, the function returns a %s", types[0], sc.result)
+	}
+}
+
+func (c *checker) signature(name string, params, types []string, pos []ast.Position, hasVArg bool, result string, declared ast.Position) *signature {
+	sig := &signature{name: name, hasVArg: hasVArg, typed: result != ""}
+	for i := range params {
+		sig.typed = sig.typed || annotationAt(types, i) != ""
+		sig.params = append(sig.params, c.annotation(annotationAt(types, i), positionAt(pos, i)))
+	}
+	sig.result = typeAny
+	if result != "" {
+		sig.result = c.annotation(result, declared)
+	}
+	return sig
+}
+
+// function checks the body of a function whose end is at end.
+func (c *checker) function(sc *scope, sig *signature, params []string, chunk []ast.Stmt, end ast.Position) {
+	body := &scope{parent: sc, vars: map[string]*variable{}, result: sig.result}
+	for i, name := range params {
+		body.declare(name, sig.params[i], nil)
+	}
+	if sig.hasVArg {
+		body.declare("arg", typeList, nil)
+	}
+	c.chunk(body, chunk)
+	if sig.result != typeAny && sig.result != typeNil && !returns(chunk) {
+		c.errorf(end, "missing return at the end of a function returning a %s", sig.result)
+	}
+}
+
+// returns reports whether chunk ends with a return on every path.
+func returns(chunk []ast.Stmt) bool {
+	if len(chunk) == 0 {
+		return false
+	}
+	switch s := chunk[len(chunk)-1].(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.IfStmt:
+		return returns(s.ThenChunk) && returns(s.ElseChunk)
+	case *ast.WhileStmt:
+		// an endless loop leaves the function only by a return
+		_, endless := s.CondExpr.(*ast.TrueExpr)
+		return endless && !breaks(s.Chunk)
+	}
+	return false
+}
+
+func breaks(chunk []ast.Stmt) bool {
+	for _, stmt := range chunk {
+		switch s := stmt.(type) {
+		case *ast.BreakStmt:
+			return true
+		case *ast.IfStmt:
+			if breaks(s.ThenChunk) || breaks(s.ElseChunk) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// want reports an error if typ, the type of e, is none of types. what names
+// the operation.
+func (c *checker) want(e ast.Expr, typ, what string, types ...string) {
+	if typ == typeAny {
+		return
+	}
+	for _, t := range types {
+		if typ == t {
+			return
+		}
+	}
+	c.errorf(e.Pos(), "%s on a %s", what, typ)
+}
+
+// expr checks e and returns its type.
+func (c *checker) expr(sc *scope, e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.NumberExpr:
+		return typeNumber
+	case *ast.StringExpr:
+		return typeString
+	case *ast.TrueExpr, *ast.FalseExpr:
+		return typeBool
+	case *ast.NilExpr:
+		return typeNil
+	case *ast.DictExpr:
+		for _, entry := range e.Entries {
+			c.expr(sc, entry.Value)
+		}
+		return typeDict
+	case *ast.ListExpr:
+		for _, elem := range e.Elements {
+			c.expr(sc, elem)
+		}
+		return typeList
+	case *ast.IdentExpr:
+		if v := sc.lookup(e.Value); v != nil {
+			return v.typ
+		}
+		return typeAny
+	case *ast.ArithmeticOpExpr:
+		c.want(e.Lhs, c.expr(sc, e.Lhs), "arithmetic", typeNumber)
+		c.want(e.Rhs, c.expr(sc, e.Rhs), "arithmetic", typeNumber)
+		return typeNumber
+	case *ast.UnaryOpMinusExpr:
+		c.want(e.Expr, c.expr(sc, e.Expr), "arithmetic", typeNumber)
+		return typeNumber
+	case *ast.ConcatStrExpr:
+		c.want(e.Lhs, c.expr(sc, e.Lhs), "concatenation", typeString)
+		c.want(e.Rhs, c.expr(sc, e.Rhs), "concatenation", typeString)
+		return typeString
+	case *ast.RelationalOpExpr:
+		lhs, rhs := c.expr(sc, e.Lhs), c.expr(sc, e.Rhs)
+		if e.Operator != ast.OpEqual && e.Operator != ast.OpNotEqual {
+			c.want(e.Lhs, lhs, "comparison", typeNumber)
+			c.want(e.Rhs, rhs, "comparison", typeNumber)
+		}
+		return typeBool
+	case *ast.UnaryOpNotExpr:
+		c.want(e.Expr, c.expr(sc, e.Expr), "negation", typeBool)
+		return typeBool
+	case *ast.LogicalOpExpr:
+		lhs, rhs := c.expr(sc, e.Lhs), c.expr(sc, e.Rhs)
+		if lhs == rhs {
+			return lhs
+		}
+		return typeAny
+	case *ast.LenExpr:
+		c.want(e.Object, c.expr(sc, e.Object), "length", typeDict, typeList)
+		return typeNumber
+	case *ast.FieldGetExpr:
+		c.want(e.Object, c.expr(sc, e.Object), "indexing", typeDict, typeList)
+		c.expr(sc, e.Key)
+		return typeAny
+	case *ast.FunctionExpr:
+		sig := c.signature("", e.Params, e.ParamTypes, e.ParamPos, e.HasVArg, e.ReturnType, e.Pos())
+		c.function(sc, sig, e.Params, e.Block, e.EndPos())
+		return typeFunction
+	case *ast.FuncCallExpr:
+		return c.call(sc, e)
+	}
+	return typeAny
+}
+
+// call checks a call and returns the type of its first result.
+func (c *checker) call(sc *scope, e *ast.FuncCallExpr) string {
+	var sig *signature
+	if e.Func != nil {
+		c.want(e.Func, c.expr(sc, e.Func), "call", typeFunction)
+		if ident, ok := e.Func.(*ast.IdentExpr); ok {
+			if v := sc.lookup(ident.Value); v != nil {
+				sig = v.fn
+			}
+		}
+	} else {
+		c.expr(sc, e.Receiver)
+	}
+
+	for i, arg := range e.Args {
+		typ := c.expr(sc, arg)
+		if sig == nil {
+			continue
+		}
+		if i >= len(sig.params) {
+			if sig.typed && !sig.hasVArg {
+				c.errorf(arg.Pos(), "too many arguments in call of %s, it takes %d", sig.name, len(sig.params))
+				sig = nil
+			}
+			continue
+		}
+		if !assignable(typ, sig.params[i]) {
+			c.errorf(arg.Pos(), "cannot use a %s as argument %d of %s, a %s", typ, i+1, sig.name, sig.params[i])
+		}
+	}
+	if sig == nil {
+		return typeAny
+	}
+	return sig.result
+}
@@ -0,0 +1,117 @@
+package typecheck
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/ast"
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+	"github.com/stretchr/testify/assert"
+)
+
+func check(t *testing.T, src string) []string {
+	chunk, err := parse.Parse(strings.NewReader(src), "script.kala")
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	found := []string{}
+	for _, err := range Check(chunk) {
+		found = append(found, err.Error())
+	}
+	return found
+}
+
+func TestCheck(t *testing.T) {
+	src := `func add(x: number, y: number): number {
+	return x + y
+}
+func greet(name: string, ...): string {
+	if name == "" {
+		return
+	}
+	return "hello " .. name
+}
+var total: number = add(1, "2")
+var label: string, count: number = "n", add(1, 2)
+label = 3
+count = add(count, count)
+print(greet(label, 1, 2), add(1, 2, 3), #total, -label, !count, total < "1")
+var nothing: nil
+var f: function = func(l: list): bool {
+	append(l, 1)
+	for i = 0, #l {
+		if l[i] == 1 {
+			return true
+		}
+	}
+}
+var d: dict = {}
+for k, v = range d {
+	d.x = k .. v
+}
+for k, v = range f {
+}
+for k, v = range total {
+}
+var u: thing = 1
+f()()`
+	assert.Equal(t, []string{
+		"script.kala line:6(column:3): missing return value, the function returns a string",
+		"script.kala line:10(column:28): cannot use a string as argument 2 of add, a number",
+		"script.kala line:12(column:9): cannot use a number as the string label",
+		"script.kala line:14(column:37): too many arguments in call of add, it takes 2",
+		"script.kala line:14(column:42): length on a number",
+		"script.kala line:14(column:50): arithmetic on a string",
+		"script.kala line:14(column:58): negation on a number",
+		"script.kala line:14(column:73): comparison on a string",
+		"script.kala line:23(column:1): missing return at the end of a function returning a bool",
+		"script.kala line:30(column:18): range on a number",
+		"script.kala line:32(column:5): unknown type thing",
+	}, check(t, src))
+
+	// a call in last place fills its first target with its declared result,
+	// and the other targets with values of unknown type
+	src = `func add(x: number, y: number): number {
+	return x + y
+}
+var s: string = add(1, 2)
+var a: number, b: string = add(1, 2)
+s, a = "s", add(a, a)
+s, a = add(a, a)
+print(add(add(1, 2), add(3, 4)), add(1, s))`
+	assert.Equal(t, []string{
+		"script.kala line:4(column:17): cannot use a number as the string s",
+		"script.kala line:7(column:8): cannot use a number as the string s",
+		"script.kala line:8(column:41): cannot use a string as argument 2 of add, a number",
+	}, check(t, src))
+
+	// nothing to check without annotations, nor with any
+	assert.Equal(t, []string{}, check(t, "func f(a, b) {\n\treturn a + b\n}\nvar x: any = f(1, 2, 3)\nx = \"s\""))
+}
+
+// stripped compiles like its annotated version
+func TestErased(t *testing.T) {
+	annotated := "func add(x: number, y: number): number {\n\treturn x + y\n}\nvar n: number, s: string = add(1, 2), \"a\"\nvar f = func(a: list): nil {\n\tappend(a, n)\n}"
+	stripped := "func add(x, y) {\n\treturn x + y\n}\nvar n, s = add(1, 2), \"a\"\nvar f = func(a) {\n\tappend(a, n)\n}"
+	compile := func(src string) *cpi.FuncProto {
+		chunk, err := parse.Parse(strings.NewReader(src), "script.kala")
+		assert.Nil(t, err)
+		proto, err := cpi.Compile(chunk)
+		assert.Nil(t, err)
+		return proto
+	}
+	a, b := compile(annotated), compile(stripped)
+	assert.Equal(t, b.InstList.List(), a.InstList.List())
+	assert.Equal(t, b.FuncProtos[0].InstList.List(), a.FuncProtos[0].InstList.List())
+	assert.Equal(t, b.FuncProtos[1].InstList.List(), a.FuncProtos[1].InstList.List())
+
+	chunk, _ := parse.Parse(strings.NewReader(annotated), "script.kala")
+	def := chunk[0].(*ast.FuncDefStmt)
+	assert.Equal(t, []string{"number", "number"}, def.ParamTypes)
+	assert.Equal(t, "number", def.ReturnType)
+	assert.Equal(t, []string{"number", "string"}, chunk[1].(*ast.VarDefStmt).Types)
+	// the end of a declaration without value is its last annotation
+	chunk, _ = parse.Parse(strings.NewReader("var a: number"), "script.kala")
+	assert.Equal(t, 13, chunk[0].EndPos().Column)
+}
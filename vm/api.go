@@ -0,0 +1,339 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+)
+
+// HostFunc is a Go function callable from scripts. It reads its arguments
+// with the Arg/Check* methods of s, pushes its results with Push and returns
+// how many values it pushed.
+type HostFunc func(s *State) int
+
+// DefaultMaxCallDepth is the call depth limit of a State created without
+// Options.MaxCallDepth.
+const DefaultMaxCallDepth = 200000
+
+// Options are the limits of a State. Each of them applies to one run, i.e.
+// one call of Call, DoString or DoFile made from the host. A script that
+// exceeds a limit stops with a *RuntimeError whose Cause is the matching
+// Err*Limit error.
+//
+// MaxMemory bounds the approximate number of bytes allocated by the run for
+// lists, dicts, strings, closures and the growth of the register stack. The
+// memory released by the garbage collector is not given back, so it is a
+// budget of allocations rather than a bound of the live heap.
+type Options struct {
+	MaxInstructions int64 // 0 means no limit
+	MaxCallDepth    int   // 0 means DefaultMaxCallDepth
+	MaxMemory       int64 // 0 means no limit
+}
+
+// State is the embedding API of the VM. A State owns its globals and its
+// stack, it must not be used by several goroutines at once.
+type State struct {
+	rt *RuntimeState
+}
+
+// NewState returns a State whose globals hold only the builtin functions.
+// At most one Options may be passed.
+func NewState(opts ...Options) *State {
+	return NewRState(opts...).state
+}
+
+// SetContext makes the running scripts stop once ctx is done. The check is
+// made every few instructions, the error is a *RuntimeError whose Cause is
+// ctx.Err(). A nil ctx removes the previous one.
+func (s *State) SetContext(ctx context.Context) {
+	s.rt.ctx = ctx
+}
+
+// Context returns the context set by SetContext.
+func (s *State) Context() context.Context {
+	return s.rt.ctx
+}
+
+// Load compiles the script read from r without running it. name is the
+// source name used in error messages and tracebacks.
+func (s *State) Load(r io.Reader, name string) (*ClosureFunc, error) {
+	chunk, err := parse.Parse(r, name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := cpi.Compile(chunk)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalClosure(proto), nil
+}
+
+// DoString runs src as a script.
+func (s *State) DoString(src string) error {
+	fn, err := s.Load(strings.NewReader(src), "<string>")
+	if err != nil {
+		return err
+	}
+	_, err = s.Call(fn)
+	return err
+}
+
+// DoFile runs the script stored in the file at path.
+func (s *State) DoFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fn, err := s.Load(bufio.NewReader(f), path)
+	if err != nil {
+		return err
+	}
+	_, err = s.Call(fn)
+	return err
+}
+
+// SetGlobal sets the global variable name to v.
+func (s *State) SetGlobal(name string, v cpi.KValue) {
+	s.rt.Global.SetField(name, v)
+}
+
+// GetGlobal returns the global variable name, KNil if it is not set.
+func (s *State) GetGlobal(name string) cpi.KValue {
+	return s.rt.Global.GetField(name)
+}
+
+// GlobalNames returns the names of the global variables, in the order they
+// were first set.
+func (s *State) GlobalNames() []string {
+	global := s.rt.Global
+	names := make([]string, global.Len())
+	for i := range names {
+		names[i], _ = global.GetKeyValue(i)
+	}
+	return names
+}
+
+// NewFunction wraps fn into a function value, name is used in tracebacks.
+func (s *State) NewFunction(name string, fn HostFunc) *ClosureFunc {
+	return newHostFunction(name, fn)
+}
+
+func newHostFunction(name string, fn HostFunc) *ClosureFunc {
+	closure := NewGlobalClosure(func(rt *RuntimeState) {
+		cf := rt.currentFrame
+		n := fn(rt.state)
+		if pushed := rt.stackValue.top - (cf.LocalBase + cf.NumArg); n > pushed {
+			n = pushed
+		}
+		cf.NumRetValue = max(n, 0)
+	})
+	closure.Name = name
+	return closure
+}
+
+// Register makes fn callable from scripts as the global function name.
+func (s *State) Register(name string, fn HostFunc) {
+	s.SetGlobal(name, s.NewFunction(name, fn))
+}
+
+// RegisterFunc makes the Go function fn callable from scripts as the global
+// function name. Its arguments and results are converted as by FromKValue
+// and ToKValue, a call with a wrong number of arguments or with arguments
+// which can't be converted to the types of its parameters raises an error.
+// If the last result of fn is an error, it is not returned to the script,
+// instead a non-nil error is raised as a runtime error, which pcall catches.
+func (s *State) RegisterFunc(name string, fn any) error {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return fmt.Errorf("cannot register %T as a function", fn)
+	}
+	s.SetGlobal(name, goFunction(name, fv))
+	return nil
+}
+
+// Call calls fn with args and returns all of its results. A failing call
+// returns a *RuntimeError and leaves the State usable.
+func (s *State) Call(fn cpi.KValue, args ...cpi.KValue) (rets []cpi.KValue, err error) {
+	rt := s.rt
+	stack := rt.stackValue
+	depth := len(rt.stackCallFrame.array)
+	ra := stack.top
+	if depth == 0 {
+		rt.numInsts = 0
+		rt.memUsed = 0
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = rt.recoverError(r)
+			rets = nil
+			rt.CloseUpvalues(ra)
+			for len(rt.stackCallFrame.array) > depth {
+				rt.stackCallFrame.Pop()
+			}
+			rt.currentFrame = rt.stackCallFrame.Last()
+			// the failure may have left the top past the end of the
+			// stack, which must not make the unwinding panic too
+			if top := min(stack.top, len(stack.array)); ra < top {
+				stack.Clear(ra, top)
+			}
+			stack.top = ra
+		}
+	}()
+
+	if rt.ctx != nil {
+		if err := rt.ctx.Err(); err != nil {
+			rt.abort(err)
+		}
+	}
+	stack.Set(ra, fn)
+	for i, arg := range args {
+		stack.Set(ra+1+i, arg)
+	}
+	stack.top = ra + 1 + len(args)
+	rt.precall(ra, len(args), -1)
+	rt.execute(depth)
+
+	rets = stack.CopyRange(ra, stack.top-ra)
+	stack.Clear(ra, stack.top)
+	stack.top = ra
+	return rets, nil
+}
+
+// MemoryUsed returns the number of bytes charged to the last run, see
+// Options.MaxMemory.
+func (s *State) MemoryUsed() int64 {
+	return s.rt.memUsed
+}
+
+// ArgCount returns the number of arguments passed to the running HostFunc.
+func (s *State) ArgCount() int {
+	return s.rt.currentFrame.NumArg
+}
+
+// Arg returns the n-th argument (1-based) of the running HostFunc, KNil if
+// fewer arguments were passed.
+func (s *State) Arg(n int) cpi.KValue {
+	cf := s.rt.currentFrame
+	if n < 1 || n > cf.NumArg {
+		return cpi.KNil{}
+	}
+	return s.rt.stackValue.Get(cf.LocalBase + n - 1)
+}
+
+func (s *State) argError(n int, expected string) {
+	s.RaiseError("bad argument #%d to '%s' (%s expected, got %s)",
+		n, s.rt.currentFrame.Closure.FuncName(), expected, typeName(s.Arg(n)))
+}
+
+// CheckNumber returns the n-th argument, raising an error if it is not a number.
+func (s *State) CheckNumber(n int) float64 {
+	v, ok := s.Arg(n).(cpi.KNumber)
+	if !ok {
+		s.argError(n, cpi.TypeNames[cpi.KTypeNumber])
+	}
+	return float64(v)
+}
+
+// CheckInteger returns the n-th argument, raising an error if it is not a
+// number with an integer value, see math.isinteger.
+func (s *State) CheckInteger(n int) int {
+	v := s.CheckNumber(n)
+	if !isInteger(v) {
+		s.RaiseError("bad argument #%d to '%s' (number has no integer representation)",
+			n, s.rt.currentFrame.Closure.FuncName())
+	}
+	return int(v)
+}
+
+// OptNumber returns the n-th argument, or def if it is nil or missing. It
+// raises an error if the argument is set and is not a number.
+func (s *State) OptNumber(n int, def float64) float64 {
+	if _, ok := s.Arg(n).(cpi.KNil); ok {
+		return def
+	}
+	return s.CheckNumber(n)
+}
+
+// OptInteger is OptNumber for CheckInteger.
+func (s *State) OptInteger(n int, def int) int {
+	if _, ok := s.Arg(n).(cpi.KNil); ok {
+		return def
+	}
+	return s.CheckInteger(n)
+}
+
+// OptString returns the n-th argument, or def if it is nil or missing. It
+// raises an error if the argument is set and is not a string.
+func (s *State) OptString(n int, def string) string {
+	if _, ok := s.Arg(n).(cpi.KNil); ok {
+		return def
+	}
+	return s.CheckString(n)
+}
+
+// CheckString returns the n-th argument, raising an error if it is not a string.
+func (s *State) CheckString(n int) string {
+	v, ok := s.Arg(n).(cpi.KString)
+	if !ok {
+		s.argError(n, cpi.TypeNames[cpi.KTypeString])
+	}
+	return string(v)
+}
+
+// CheckBool returns the n-th argument, raising an error if it is not a boolean.
+func (s *State) CheckBool(n int) bool {
+	v, ok := s.Arg(n).(cpi.KBool)
+	if !ok {
+		s.argError(n, cpi.TypeNames[cpi.KTypeBool])
+	}
+	return bool(v)
+}
+
+// CheckDict returns the n-th argument, raising an error if it is not a dict.
+func (s *State) CheckDict(n int) cpi.KDict {
+	v, ok := s.Arg(n).(cpi.KDict)
+	if !ok {
+		s.argError(n, cpi.TypeNames[cpi.KTypeDict])
+	}
+	return v
+}
+
+// CheckList returns the n-th argument, raising an error if it is not a list.
+func (s *State) CheckList(n int) cpi.KList {
+	v, ok := s.Arg(n).(cpi.KList)
+	if !ok {
+		s.argError(n, cpi.TypeNames[cpi.KTypeList])
+	}
+	return v
+}
+
+// CheckFunction returns the n-th argument, raising an error if it is not a function.
+func (s *State) CheckFunction(n int) *ClosureFunc {
+	v, ok := s.Arg(n).(*ClosureFunc)
+	if !ok {
+		s.argError(n, cpi.TypeNames[cpi.KTypeFunction])
+	}
+	return v
+}
+
+// Push pushes a result of the running HostFunc.
+func (s *State) Push(v cpi.KValue) {
+	if v == nil {
+		v = cpi.KNil{}
+	}
+	s.rt.stackValue.Push(v)
+}
+
+// RaiseError aborts the running HostFunc and the script that called it.
+func (s *State) RaiseError(format string, args ...any) {
+	s.rt.RaiseHostError(format, args...)
+}
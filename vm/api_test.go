@@ -0,0 +1,467 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestState(t *testing.T) {
+	t.Run("register", func(t *testing.T) {
+		s := NewState()
+		s.Register("add", func(s *State) int {
+			s.Push(cpi.KNumber(s.CheckNumber(1) + s.CheckNumber(2)))
+			return 1
+		})
+		s.Register("pair", func(s *State) int {
+			s.Push(cpi.KString("x"))
+			s.Push(cpi.KNumber(float64(s.ArgCount())))
+			return 2
+		})
+		err := s.DoString(`
+		result = add(1, 2)
+		first = pair()
+		`)
+		assert.Nil(t, err)
+		assert.Equal(t, cpi.KNumber(3), s.GetGlobal("result"))
+		assert.Equal(t, cpi.KString("x"), s.GetGlobal("first"))
+
+		rets, err := s.Call(s.GetGlobal("pair"), cpi.KNil{}, cpi.KNil{}, cpi.KNil{})
+		assert.Nil(t, err)
+		assert.Equal(t, []cpi.KValue{cpi.KString("x"), cpi.KNumber(3)}, rets)
+	})
+
+	t.Run("call", func(t *testing.T) {
+		s := NewState()
+		s.SetGlobal("base", cpi.KNumber(10))
+		err := s.DoString(`
+		scale = func(x, y) {
+			return x * base, y
+		}`)
+		assert.Nil(t, err)
+		rets, err := s.Call(s.GetGlobal("scale"), cpi.KNumber(2), cpi.KString("k"))
+		assert.Nil(t, err)
+		assert.Equal(t, []cpi.KValue{cpi.KNumber(20), cpi.KString("k")}, rets)
+
+		_, err = s.Call(s.GetGlobal("scale"), cpi.KString("a"), cpi.KNil{})
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.Equal(t, cpi.OP_MUL, rerr.Opcode)
+
+		// the state is still usable after a failed call
+		rets, err = s.Call(s.GetGlobal("scale"), cpi.KNumber(1), cpi.KNil{})
+		assert.Nil(t, err)
+		assert.Equal(t, cpi.KNumber(10), rets[0])
+		assert.Equal(t, 0, s.rt.stackValue.top)
+		assert.Equal(t, 0, len(s.rt.stackCallFrame.array))
+	})
+
+	t.Run("bad_argument", func(t *testing.T) {
+		s := NewState()
+		s.Register("twice", func(s *State) int {
+			s.Push(cpi.KNumber(2 * s.CheckNumber(1)))
+			return 1
+		})
+		err := s.DoString(`var a = twice("1")`)
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.Equal(t, "bad argument #1 to 'twice' (number expected, got string)", rerr.Error())
+		assert.Equal(t, "[host] in twice", rerr.Traceback[0].String())
+	})
+
+	t.Run("compile_error", func(t *testing.T) {
+		s := NewState()
+		_, ok := s.DoString(`var a = (1`).(error)
+		assert.True(t, ok)
+		err := s.DoString(`break`)
+		_, ok = err.(*cpi.CompileError)
+		assert.True(t, ok)
+	})
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("instructions", func(t *testing.T) {
+		s := NewState(Options{MaxInstructions: 1000})
+		err := s.DoString(`while true {}`)
+		assert.True(t, errors.Is(err, ErrInstructionLimit))
+		assert.Equal(t, "instruction limit exceeded", err.Error())
+
+		// the budget is per run
+		assert.Nil(t, s.DoString(`var i = 0
+		while i < 100 { i = i + 1 }`))
+		assert.Nil(t, s.DoString(`var i = 0
+		while i < 100 { i = i + 1 }`))
+	})
+
+	t.Run("context", func(t *testing.T) {
+		s := NewState()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		s.SetContext(ctx)
+		err := s.DoString(`while true {}`)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+		err = s.DoString(`var a = 1`)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		s.SetContext(nil)
+		assert.Nil(t, s.DoString(`var a = 1`))
+	})
+
+	t.Run("call_depth", func(t *testing.T) {
+		s := NewState(Options{MaxCallDepth: 50})
+		err := s.DoString(`
+		f = func(n) {
+			return 1 + f(n + 1)
+		}
+		f(0)`)
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.True(t, errors.Is(err, ErrCallDepthLimit))
+		// the 10 innermost and outermost frames, with the 30 others counted
+		if assert.Equal(t, 21, len(rerr.Traceback)) {
+			assert.Equal(t, "<string>:3 in f", rerr.Traceback[9].String())
+			assert.Equal(t, "... 30 more ...", rerr.Traceback[10].String())
+			assert.Equal(t, "<string>:3 in f", rerr.Traceback[11].String())
+			assert.Equal(t, "main chunk", rerr.Traceback[20].Function)
+		}
+
+		// an error caught deep in the stack, over and over, has the same
+		// traceback
+		err = s.DoString(`
+		h = func(n) {
+			if n == 0 {
+				var e
+				for i = 0, 100 {
+					_, e = pcall(error, "deep")
+				}
+				return e
+			}
+			var e = h(n - 1)
+			return e
+		}
+		e = h(45)`)
+		assert.Nil(t, err)
+		traceback := s.GetGlobal("e").(cpi.KDict).GetField("traceback").(cpi.KList)
+		assert.Equal(t, 21, traceback.Len())
+		assert.Equal(t, cpi.KString("[host] in error"), traceback.GetAt(0))
+		assert.Equal(t, cpi.KString("... 29 more ..."), traceback.GetAt(10))
+
+		s = NewState()
+		err = s.DoString(`
+		f = func(n) {
+			return 1 + f(n + 1)
+		}
+		f(0)`)
+		assert.True(t, errors.Is(err, ErrCallDepthLimit))
+		rerr = err.(*RuntimeError)
+		assert.Equal(t, 21, len(rerr.Traceback))
+		assert.Equal(t, DefaultMaxCallDepth-20, rerr.Traceback[10].Skipped)
+
+		err = s.DoString(`
+		g = func(n) {
+			if n == 0 {
+				return 0
+			}
+			return g(n - 1)
+		}
+		g(20)`)
+		assert.Nil(t, err)
+	})
+}
+
+func TestMemoryLimit(t *testing.T) {
+	t.Run("concat", func(t *testing.T) {
+		s := NewState(Options{MaxMemory: 1 << 20})
+		err := s.DoString(`var a = "0123456789"
+		while true { a = a .. a }`)
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.True(t, errors.Is(err, ErrMemoryLimit))
+		assert.Equal(t, "main chunk", rerr.Traceback[0].Function)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		s := NewState(Options{MaxMemory: 1 << 16})
+		err := s.DoString(`var a = []
+		while true { append(a, [1, 2, 3]) }`)
+		assert.True(t, errors.Is(err, ErrMemoryLimit))
+	})
+
+	t.Run("dict", func(t *testing.T) {
+		s := NewState(Options{MaxMemory: 1 << 16})
+		err := s.DoString(`var d = {}
+		var k = "k"
+		while true {
+			k = k .. "k"
+			d[k] = 1
+		}`)
+		assert.True(t, errors.Is(err, ErrMemoryLimit))
+	})
+
+	t.Run("within_budget", func(t *testing.T) {
+		s := NewState(Options{MaxMemory: 1 << 16})
+		src := `var a = []
+		var i = 0
+		while i < 100 {
+			append(a, "x" .. "y")
+			i = i + 1
+		}`
+		assert.Nil(t, s.DoString(src))
+		used := s.MemoryUsed()
+		assert.True(t, used > 100*memValueSize)
+		// the budget is per run, the stack already has the size it needs
+		assert.Nil(t, s.DoString(src))
+		assert.True(t, s.MemoryUsed() > 0 && s.MemoryUsed() <= used)
+	})
+}
+
+func TestRunLoadedBytecode(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, compile(`var add = func(a, b) { return a + b }
+	result = add(40, 2)`).Dump(buf))
+	proto, err := cpi.Load(buf)
+	assert.Nil(t, err)
+
+	s := NewState()
+	_, err = s.Call(NewLocalClosure(proto))
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KNumber(42), s.GetGlobal("result"))
+}
+
+func TestCallCorruptedFrame(t *testing.T) {
+	// a call of a host function with more arguments than the frame holds,
+	// which verified bytecode can not make
+	proto := compile(`var f = func() { error("failed") }
+	var g = string.len
+	g("x")
+	f()`)
+	code := proto.InstList.List()
+	for pc, inst := range code {
+		if opGetOpCode(inst) == cpi.OP_CALL && pc > 0 && opGetOpCode(code[pc-1]) == cpi.OP_LOADK {
+			code[pc] = inst&^0x1ff | 300
+			break
+		}
+	}
+	s := NewState()
+	var err error
+	assert.NotPanics(t, func() {
+		_, err = s.Call(NewLocalClosure(proto))
+	})
+	assert.Equal(t, "failed", err.Error())
+	assert.Equal(t, 0, s.rt.stackValue.top)
+}
+
+// FuzzLoad runs the bytecode accepted by cpi.Load, which must fail with an
+// error and leave the stack empty, never panic.
+func FuzzLoad(f *testing.F) {
+	for _, src := range []string{
+		`var add = func(a, b) { return a + b } result = add(40, 2)`,
+		`var f = func(...) { return [...] } return f(1, f(2, 3))`,
+		`var d = {a: 1} for k, v = range d { d[k] = v .. "x" }`,
+		`var n = 0 for i = 0, 10 { n = n + i } return n, string.format("%d", n)`,
+		`var o = {n: 1} o.m = func(self) { return self.n } return o:m() or pcall(error, "x")`,
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := compile(src).Dump(buf); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// a valid header, so that the mutations reach the payload
+		if len(data) >= 16 {
+			data = bytes.Clone(data)
+			binary.LittleEndian.PutUint32(data[8:], uint32(len(data)-16))
+			binary.LittleEndian.PutUint32(data[12:], crc32.ChecksumIEEE(data[16:]))
+		}
+		proto, err := cpi.Load(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		s := NewState(Options{MaxInstructions: 10000, MaxMemory: 1 << 20, MaxCallDepth: 50})
+		s.Call(NewLocalClosure(proto))
+		if top := s.rt.stackValue.top; top != 0 {
+			t.Fatalf("stack top is %d after the call", top)
+		}
+	})
+}
+
+func TestPCall(t *testing.T) {
+	t.Run("results", func(t *testing.T) {
+		s := NewState()
+		err := s.DoString(`
+		ok, a, b = pcall(func(x, y) { return x + y, x * y }, 2, 3)
+		okPrint = pcall(print)
+		bad, e = pcall(func(x) { return x + 1 }, "one")
+		notFunc, e2 = pcall(3)
+		`)
+		assert.Nil(t, err)
+		assert.Equal(t, cpi.KBool(true), s.GetGlobal("ok"))
+		assert.Equal(t, cpi.KNumber(5), s.GetGlobal("a"))
+		assert.Equal(t, cpi.KNumber(6), s.GetGlobal("b"))
+		assert.Equal(t, cpi.KBool(true), s.GetGlobal("okPrint"))
+
+		assert.Equal(t, cpi.KBool(false), s.GetGlobal("bad"))
+		e := s.GetGlobal("e").(cpi.KDict)
+		assert.Equal(t, cpi.KString("attempt to perform arithmetic on a non-number value (ADD: string, number)"), e.GetField("message"))
+		assert.Equal(t, cpi.KString(KindRuntime), e.GetField("kind"))
+		traceback := e.GetField("traceback").(cpi.KList)
+		assert.Equal(t, cpi.KString("<string>:4 in anonymous"), traceback.GetAt(0))
+		assert.False(t, e.Has("value"))
+
+		assert.Equal(t, cpi.KBool(false), s.GetGlobal("notFunc"))
+		assert.Equal(t, 0, s.rt.stackValue.top)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		s := NewState()
+		err := s.DoString(`
+		func parse(row) {
+			if row == "" {
+				error("empty row", "validation")
+			}
+			return row
+		}
+		_, e1 = pcall(parse, "")
+		_, e2 = pcall(error, {code: 7})
+		-- a caught error raised again keeps its kind
+		_, e3 = pcall(func() {
+			var ok, e = pcall(parse, "")
+			error(e)
+		})
+		`)
+		assert.Nil(t, err)
+		e1 := s.GetGlobal("e1").(cpi.KDict)
+		assert.Equal(t, cpi.KString("empty row"), e1.GetField("message"))
+		assert.Equal(t, cpi.KString("validation"), e1.GetField("kind"))
+		e2 := s.GetGlobal("e2").(cpi.KDict)
+		assert.Equal(t, cpi.KString("error"), e2.GetField("kind"))
+		assert.Equal(t, cpi.KNumber(7), e2.GetField("value").(cpi.KDict).GetField("code"))
+		e3 := s.GetGlobal("e3").(cpi.KDict)
+		assert.Equal(t, cpi.KString("empty row"), e3.GetField("message"))
+		assert.Equal(t, cpi.KString("validation"), e3.GetField("kind"))
+
+		err = s.DoString(`error("stop", "fatal")`)
+		rerr := err.(*RuntimeError)
+		assert.Equal(t, "stop", rerr.Error())
+		assert.Equal(t, "fatal", rerr.Kind)
+	})
+
+	t.Run("unwind", func(t *testing.T) {
+		s := NewState()
+		// the closure made by the failed call keeps the value of its upvalue,
+		// the locals of the caller are intact
+		err := s.DoString(`
+		var keep
+		var before = "local"
+		func fail(n) {
+			var captured = n * 2
+			keep = func() { return captured }
+			var deep = func() { return {} + 1 }
+			return deep()
+		}
+		var total = 0
+		for i = 0, 100 {
+			var ok = pcall(fail, i)
+			if !ok {
+				total = total + 1
+			}
+		}
+		result = keep()
+		count = total
+		local = before
+		`)
+		assert.Nil(t, err)
+		assert.Equal(t, cpi.KNumber(198), s.GetGlobal("result"))
+		assert.Equal(t, cpi.KNumber(100), s.GetGlobal("count"))
+		assert.Equal(t, cpi.KString("local"), s.GetGlobal("local"))
+		assert.Equal(t, 0, s.rt.stackValue.top)
+		assert.Equal(t, 0, len(s.rt.stackCallFrame.array))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		s := NewState(Options{MaxInstructions: 1000})
+		err := s.DoString(`
+		var ok = pcall(func() { while true {} })
+		caught = true`)
+		assert.True(t, errors.Is(err, ErrInstructionLimit))
+		assert.Equal(t, cpi.KNil{}, s.GetGlobal("caught"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s = NewState()
+		s.SetContext(ctx)
+		s.Register("check", func(s *State) int { return 0 })
+		_, err = s.Call(s.GetGlobal("pcall"), s.GetGlobal("check"))
+		assert.True(t, errors.Is(err, context.Canceled))
+	})
+}
+
+func TestRegisterFunc(t *testing.T) {
+	type row struct {
+		ID   int    `kala:"id"`
+		Name string `kala:"name"`
+	}
+	rows := map[int]row{1: {1, "ann"}, 2: {2, "bob"}}
+	s := NewState()
+	assert.Nil(t, s.RegisterFunc("get", func(id int) (*row, error) {
+		r, ok := rows[id]
+		if !ok {
+			return nil, fmt.Errorf("no row %d", id)
+		}
+		return &r, nil
+	}))
+	assert.Nil(t, s.RegisterFunc("put", func(r row) { rows[r.ID] = r }))
+	assert.Nil(t, s.RegisterFunc("sum", func(base float64, xs ...int) float64 {
+		for _, x := range xs {
+			base += float64(x)
+		}
+		return base
+	}))
+	assert.Nil(t, s.RegisterFunc("pair", func() (string, bool) { return "a", true }))
+
+	err := s.DoString(`
+	r = get(1)
+	put({id: 3, name: string.upper(r.name)})
+	ok, e = pcall(get, 9)
+	a, b = pair()
+	total = [sum(0.5), sum(0.5, 1, 2)]
+	`)
+	assert.Nil(t, err)
+	assert.Equal(t, "{ id:1.00, name:ann}", s.GetGlobal("r").Str())
+	assert.Equal(t, row{3, "ANN"}, rows[3])
+	assert.Equal(t, cpi.KBool(false), s.GetGlobal("ok"))
+	assert.Equal(t, cpi.KString("no row 9"), s.GetGlobal("e").(cpi.KDict).GetField("message"))
+	assert.Equal(t, cpi.KString("a"), s.GetGlobal("a"))
+	assert.Equal(t, cpi.KBool(true), s.GetGlobal("b"))
+	assert.Equal(t, "[0.50,3.50]", s.GetGlobal("total").Str())
+
+	errors := []struct {
+		script string
+		want   string
+	}{
+		{`get(1, 2)`, "wrong number of arguments to 'get' (1 expected, got 2)"},
+		{`sum()`, "wrong number of arguments to 'sum' (at least 1 expected, got 0)"},
+		{`sum(1, "2")`, "bad argument #2 to 'sum' (cannot convert string to int)"},
+		{`put({id: 1.5})`, "bad argument #1 to 'put' (cannot convert 1.5 to int at $.id)"},
+		{`get(9)`, "no row 9"},
+	}
+	for _, test := range errors {
+		err := s.DoString(test.script)
+		if assert.NotNil(t, err, test.script) {
+			assert.Equal(t, test.want, err.Error(), test.script)
+			assert.Equal(t, "[host] in "+test.script[:3], err.(*RuntimeError).Traceback[0].String())
+		}
+	}
+
+	assert.EqualError(t, s.RegisterFunc("x", 1), "cannot register int as a function")
+	assert.EqualError(t, s.RegisterFunc("x", (func())(nil)), "cannot register func() as a function")
+}
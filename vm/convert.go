@@ -0,0 +1,539 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khoakmp/kala/cpi"
+)
+
+// maxConvertDepth bounds the nesting of the values converted by ToKValue and
+// FromKValue, which would otherwise loop forever on cyclic Go pointers.
+const maxConvertDepth = 1000
+
+var (
+	timeType  = reflect.TypeFor[time.Time]()
+	errorType = reflect.TypeFor[error]()
+)
+
+// ToKValue converts a Go value into a Kala value:
+//
+//   - nil, nil pointers, nil maps and nil slices become nil
+//   - bools, numbers and strings become bool, number and string values;
+//     integers must be exactly representable, see math.isinteger
+//   - []byte and time.Time become strings, the latter in RFC 3339 format
+//   - slices and arrays become lists
+//   - maps with string or integer keys become dicts, sorted by key
+//   - structs become dicts of their exported fields, in order
+//   - funcs become host functions, see State.NewFunction
+//   - pointers and interfaces are converted to the value they point to
+//   - Kala values are returned as is
+//
+// A struct field is named by its kala tag if it has one, e.g.
+// `kala:"name"`; `kala:"-"` skips the field and `kala:"name,omitempty"` skips
+// it when it is the zero value. The fields of embedded structs are converted
+// as fields of the outer struct.
+func ToKValue(v any) (cpi.KValue, error) {
+	c := &converter{}
+	return c.toKValue(reflect.ValueOf(v))
+}
+
+// FromKValue stores the Kala value v into the Go value pointed to by out,
+// converting it the opposite way to ToKValue. Numbers stored into integers
+// must be integers in their range, dicts stored into structs set the fields
+// whose name is a key of the dict, the other fields are left unchanged.
+// Values stored into an interface{} become nil, bool, float64, string,
+// []any, map[string]any or, for functions, *ClosureFunc. Functions can't be
+// stored into Go funcs.
+func FromKValue(v cpi.KValue, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("out must be a non-nil pointer, got %T", out)
+	}
+	c := &converter{}
+	return c.fromKValue(v, rv.Elem())
+}
+
+// converter tracks the path from the converted value to the value being
+// converted, for error messages.
+type converter struct {
+	path []string
+}
+
+func (c *converter) errorf(format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if len(c.path) == 0 {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s at $%s", msg, strings.Join(c.path, ""))
+}
+
+func (c *converter) push(elem string) error {
+	if len(c.path) >= maxConvertDepth {
+		return c.errorf("value nested too deeply")
+	}
+	c.path = append(c.path, elem)
+	return nil
+}
+
+func (c *converter) pop() {
+	c.path = c.path[:len(c.path)-1]
+}
+
+func (c *converter) toKValue(rv reflect.Value) (cpi.KValue, error) {
+	if !rv.IsValid() {
+		return cpi.KNil{}, nil
+	}
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func:
+		if rv.IsNil() {
+			return cpi.KNil{}, nil
+		}
+	}
+	if rv.CanInterface() {
+		if v, ok := rv.Interface().(cpi.KValue); ok {
+			return v, nil
+		}
+	}
+	t := rv.Type()
+	if t == timeType && rv.CanInterface() {
+		return cpi.KString(rv.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return cpi.KBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := rv.Int()
+		if n > maxSafeInteger || n < -maxSafeInteger {
+			return nil, c.errorf("integer %d is not exactly representable as a number", n)
+		}
+		return cpi.KNumber(n), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := rv.Uint()
+		if n > maxSafeInteger {
+			return nil, c.errorf("integer %d is not exactly representable as a number", n)
+		}
+		return cpi.KNumber(n), nil
+	case reflect.Float32, reflect.Float64:
+		return cpi.KNumber(rv.Float()), nil
+	case reflect.String:
+		return cpi.KString(rv.String()), nil
+	case reflect.Pointer, reflect.Interface:
+		if err := c.push(""); err != nil {
+			return nil, err
+		}
+		defer c.pop()
+		return c.toKValue(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && rv.Kind() == reflect.Slice {
+			return cpi.KString(rv.Bytes()), nil
+		}
+		list := cpi.NewKList(rv.Len())
+		for i := range rv.Len() {
+			if err := c.push(fmt.Sprintf("[%d]", i)); err != nil {
+				return nil, err
+			}
+			v, err := c.toKValue(rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			c.pop()
+			list.Append(v)
+		}
+		return list, nil
+	case reflect.Map:
+		keys := make([]string, 0, rv.Len())
+		values := make(map[string]reflect.Value, rv.Len())
+		for iter := rv.MapRange(); iter.Next(); {
+			key, err := c.mapKey(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			values[key] = iter.Value()
+		}
+		slices.Sort(keys)
+		dict := cpi.NewKDict(len(keys))
+		for _, key := range keys {
+			if err := c.push("." + key); err != nil {
+				return nil, err
+			}
+			v, err := c.toKValue(values[key])
+			if err != nil {
+				return nil, err
+			}
+			c.pop()
+			dict.SetField(key, v)
+		}
+		return dict, nil
+	case reflect.Struct:
+		fields := structFields(t)
+		dict := cpi.NewKDict(len(fields))
+		for _, f := range fields {
+			fv, err := rv.FieldByIndexErr(f.index)
+			if err != nil || f.omitEmpty && fv.IsZero() {
+				continue // in a nil embedded pointer
+			}
+			if err := c.push("." + f.name); err != nil {
+				return nil, err
+			}
+			v, err := c.toKValue(fv)
+			if err != nil {
+				return nil, err
+			}
+			c.pop()
+			dict.SetField(f.name, v)
+		}
+		return dict, nil
+	case reflect.Func:
+		return goFunction(funcName(rv), rv), nil
+	}
+	return nil, c.errorf("cannot convert %s", t)
+}
+
+func (c *converter) mapKey(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", c.errorf("cannot convert map with %s keys", key.Type())
+}
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structFields returns the fields of the struct type t which are converted
+// to and from dict entries.
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for _, f := range reflect.VisibleFields(t) {
+		tag := f.Tag.Get("kala")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				continue // its fields are listed as fields of t
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{name, f.Index, opts == "omitempty"})
+	}
+	return fields
+}
+
+func (c *converter) fromKValue(v cpi.KValue, rv reflect.Value) error {
+	if v == nil {
+		v = cpi.KNil{}
+	}
+	t := rv.Type()
+	if !rv.CanSet() {
+		return c.errorf("cannot set unexported field of %s", t)
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		return c.toInterface(v, rv)
+	}
+	if vt := reflect.TypeOf(v); vt.AssignableTo(t) {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+	if _, ok := v.(cpi.KNil); ok {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			rv.SetZero()
+			return nil
+		}
+		return c.errorf("cannot convert nil to %s", t)
+	}
+	if t == timeType {
+		str, ok := v.(cpi.KString)
+		if !ok {
+			return c.errorf("cannot convert %s to %s", typeName(v), t)
+		}
+		tm, err := time.Parse(time.RFC3339Nano, string(str))
+		if err != nil {
+			return c.errorf("cannot convert %q to %s: not in RFC 3339 format", string(str), t)
+		}
+		rv.Set(reflect.ValueOf(tm))
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(t.Elem()))
+		}
+		return c.fromKValue(v, rv.Elem())
+	case reflect.Bool:
+		if b, ok := v.(cpi.KBool); ok {
+			rv.SetBool(bool(b))
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := v.(cpi.KNumber); ok {
+			if !isInteger(float64(n)) || rv.OverflowInt(int64(n)) {
+				return c.errorf("cannot convert %g to %s", float64(n), t)
+			}
+			rv.SetInt(int64(n))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := v.(cpi.KNumber); ok {
+			if !isInteger(float64(n)) || n < 0 || rv.OverflowUint(uint64(n)) {
+				return c.errorf("cannot convert %g to %s", float64(n), t)
+			}
+			rv.SetUint(uint64(n))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := v.(cpi.KNumber); ok {
+			if rv.OverflowFloat(float64(n)) {
+				return c.errorf("cannot convert %g to %s", float64(n), t)
+			}
+			rv.SetFloat(float64(n))
+			return nil
+		}
+	case reflect.String:
+		if str, ok := v.(cpi.KString); ok {
+			rv.SetString(string(str))
+			return nil
+		}
+	case reflect.Slice:
+		if str, ok := v.(cpi.KString); ok && t.Elem().Kind() == reflect.Uint8 {
+			rv.Set(reflect.ValueOf([]byte(str)).Convert(t))
+			return nil
+		}
+		if list, ok := v.(cpi.KList); ok {
+			slice := reflect.MakeSlice(t, list.Len(), list.Len())
+			if err := c.fromList(list, slice); err != nil {
+				return err
+			}
+			rv.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		if list, ok := v.(cpi.KList); ok {
+			if list.Len() > t.Len() {
+				return c.errorf("cannot convert list of %d values to %s", list.Len(), t)
+			}
+			rv.SetZero()
+			return c.fromList(list, rv)
+		}
+	case reflect.Map:
+		if dict, ok := v.(cpi.KDict); ok {
+			return c.fromDictToMap(dict, rv)
+		}
+	case reflect.Struct:
+		if dict, ok := v.(cpi.KDict); ok {
+			return c.fromDictToStruct(dict, rv)
+		}
+	}
+	return c.errorf("cannot convert %s to %s", typeName(v), t)
+}
+
+// toInterface stores v into rv of type interface{} as its natural Go value.
+func (c *converter) toInterface(v cpi.KValue, rv reflect.Value) error {
+	var t reflect.Type
+	switch v.(type) {
+	case cpi.KNil:
+		rv.SetZero()
+		return nil
+	case cpi.KBool:
+		t = reflect.TypeFor[bool]()
+	case cpi.KNumber:
+		t = reflect.TypeFor[float64]()
+	case cpi.KString:
+		t = reflect.TypeFor[string]()
+	case cpi.KList:
+		t = reflect.TypeFor[[]any]()
+	case cpi.KDict:
+		t = reflect.TypeFor[map[string]any]()
+	default:
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+	value := reflect.New(t).Elem()
+	if err := c.fromKValue(v, value); err != nil {
+		return err
+	}
+	rv.Set(value)
+	return nil
+}
+
+func (c *converter) fromList(list cpi.KList, rv reflect.Value) error {
+	for i := range list.Len() {
+		if err := c.push(fmt.Sprintf("[%d]", i)); err != nil {
+			return err
+		}
+		if err := c.fromKValue(list.GetAt(i), rv.Index(i)); err != nil {
+			return err
+		}
+		c.pop()
+	}
+	return nil
+}
+
+func (c *converter) fromDictToMap(dict cpi.KDict, rv reflect.Value) error {
+	t := rv.Type()
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMapWithSize(t, dict.Len()))
+	}
+	for i := range dict.Len() {
+		key, value := dict.GetKeyValue(i)
+		kv := reflect.New(t.Key()).Elem()
+		switch t.Key().Kind() {
+		case reflect.String:
+			kv.SetString(key)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(key, 10, t.Key().Bits())
+			if err != nil {
+				return c.errorf("cannot convert key %q to %s", key, t.Key())
+			}
+			kv.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			n, err := strconv.ParseUint(key, 10, t.Key().Bits())
+			if err != nil {
+				return c.errorf("cannot convert key %q to %s", key, t.Key())
+			}
+			kv.SetUint(n)
+		default:
+			return c.errorf("cannot convert dict to %s", t)
+		}
+		if err := c.push("." + key); err != nil {
+			return err
+		}
+		ev := reflect.New(t.Elem()).Elem()
+		if err := c.fromKValue(value, ev); err != nil {
+			return err
+		}
+		c.pop()
+		rv.SetMapIndex(kv, ev)
+	}
+	return nil
+}
+
+func (c *converter) fromDictToStruct(dict cpi.KDict, rv reflect.Value) error {
+	for _, f := range structFields(rv.Type()) {
+		if !dict.Has(f.name) {
+			continue
+		}
+		if err := c.push("." + f.name); err != nil {
+			return err
+		}
+		fv, err := c.fieldByIndex(rv, f.index)
+		if err != nil {
+			return err
+		}
+		if err := c.fromKValue(dict.GetField(f.name), fv); err != nil {
+			return err
+		}
+		c.pop()
+	}
+	return nil
+}
+
+// fieldByIndex is rv.FieldByIndex, allocating the nil embedded pointers on
+// the way. Like encoding/json, it fails on a nil pointer to an unexported
+// struct, which can not be set.
+func (c *converter) fieldByIndex(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, c.errorf("cannot set embedded pointer to unexported struct %s", rv.Type().Elem())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
+
+// funcName returns the name of the Go function fv without its package path.
+func funcName(fv reflect.Value) string {
+	f := runtime.FuncForPC(fv.Pointer())
+	if f == nil {
+		return ""
+	}
+	name := f.Name()
+	return name[strings.LastIndexByte(name, '/')+1:]
+}
+
+// goFunction returns a host function calling the Go function fv. Its
+// arguments are converted with FromKValue and must match the parameters of
+// fv in number, a variadic fv takes any number of arguments for its last
+// parameter. Its results are converted with ToKValue. A trailing error
+// result is not returned, a non-nil error is raised as a runtime error.
+func goFunction(name string, fv reflect.Value) *ClosureFunc {
+	t := fv.Type()
+	nin := t.NumIn()
+	if t.IsVariadic() {
+		nin--
+	}
+	nout := t.NumOut()
+	hasError := nout > 0 && t.Out(nout-1) == errorType
+	if hasError {
+		nout--
+	}
+	return newHostFunction(name, func(s *State) int {
+		fn := s.rt.currentFrame.Closure.FuncName()
+		switch {
+		case t.IsVariadic() && s.ArgCount() < nin:
+			s.RaiseError("wrong number of arguments to '%s' (at least %d expected, got %d)", fn, nin, s.ArgCount())
+		case !t.IsVariadic() && s.ArgCount() != nin:
+			s.RaiseError("wrong number of arguments to '%s' (%d expected, got %d)", fn, nin, s.ArgCount())
+		}
+		args := make([]reflect.Value, s.ArgCount())
+		for i := range args {
+			if i < nin {
+				args[i] = reflect.New(t.In(i)).Elem()
+			} else {
+				args[i] = reflect.New(t.In(nin).Elem()).Elem()
+			}
+			c := &converter{}
+			if err := c.fromKValue(s.Arg(i+1), args[i]); err != nil {
+				s.RaiseError("bad argument #%d to '%s' (%s)", i+1, fn, err)
+			}
+		}
+		rets := fv.Call(args)
+		if hasError {
+			if err, _ := rets[nout].Interface().(error); err != nil {
+				s.RaiseError("%s", err)
+			}
+		}
+		for _, r := range rets[:nout] {
+			c := &converter{}
+			v, err := c.toKValue(r)
+			if err != nil {
+				s.RaiseError("bad result from '%s' (%s)", fn, err)
+			}
+			s.Push(v)
+		}
+		return nout
+	})
+}
@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+type convertBase struct {
+	ID      int       `kala:"id"`
+	Created time.Time `kala:"created"`
+}
+
+type convertRow struct {
+	convertBase
+	Name    string         `kala:"name"`
+	Tags    []string       `kala:"tags"`
+	Score   *float64       `kala:"score"`
+	Attrs   map[string]any `kala:"attrs"`
+	Counts  map[int]uint8  `kala:"counts,omitempty"`
+	Raw     []byte         `kala:"raw"`
+	Secret  string         `kala:"-"`
+	Extra   cpi.KValue     `kala:"extra"`
+	Nested  *convertBase   `kala:"nested"`
+	Flags   [2]bool        `kala:"flags"`
+	Plain   string
+	private int
+}
+
+type convertInner struct{ X int }
+
+type convertOuter struct {
+	*convertInner
+	Y int
+}
+
+func TestToKValue(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	score := 9.5
+	row := convertRow{
+		convertBase: convertBase{ID: 7, Created: created},
+		Name:        "héllo",
+		Tags:        []string{"a", "b"},
+		Score:       &score,
+		Attrs:       map[string]any{"z": 1, "a": nil, "m": []int{1}},
+		Raw:         []byte("raw"),
+		Secret:      "hidden",
+		Extra:       cpi.KBool(true),
+		Flags:       [2]bool{true, false},
+		Plain:       "p",
+	}
+	v, err := ToKValue(&row)
+	assert.Nil(t, err)
+	assert.Equal(t, "{ id:7.00, created:2024-05-01T12:30:00Z, name:héllo, tags:[a,b], score:9.50, "+
+		"attrs:{ a:nil, m:[1.00], z:1.00}, raw:raw, extra:true, nested:nil, flags:[true,false], Plain:p}", v.Str())
+
+	v, err = ToKValue(map[int][]int(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KNil{}, v)
+
+	_, err = ToKValue(map[string]any{"rows": []any{map[string]any{"ch": make(chan int)}}})
+	assert.EqualError(t, err, "cannot convert chan int at $.rows[0].ch")
+	_, err = ToKValue(int64(1) << 60)
+	assert.EqualError(t, err, "integer 1152921504606846976 is not exactly representable as a number")
+	_, err = ToKValue(map[bool]int{true: 1})
+	assert.EqualError(t, err, "cannot convert map with bool keys")
+
+	type cycle struct{ Next *cycle }
+	c := &cycle{}
+	c.Next = c
+	_, err = ToKValue(c)
+	assert.ErrorContains(t, err, "value nested too deeply at $.Next")
+}
+
+func TestFromKValue(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	row = {
+		id: 7, created: "2024-05-01T12:30:00Z", name: "héllo", tags: ["a", "b"],
+		score: 9.5, attrs: {z: 1, l: [true, nil, {k: "v"}]}, counts: {"3": 4},
+		raw: "raw", Secret: "s", extra: [1], nested: {id: 2}, flags: [true],
+		Plain: "p", unknown: 1
+	}
+	`)
+	assert.Nil(t, err)
+	var row convertRow
+	assert.Nil(t, FromKValue(s.GetGlobal("row"), &row))
+	score := 9.5
+	assert.Equal(t, convertRow{
+		convertBase: convertBase{ID: 7, Created: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)},
+		Name:        "héllo",
+		Tags:        []string{"a", "b"},
+		Score:       &score,
+		Attrs:       map[string]any{"z": 1.0, "l": []any{true, nil, map[string]any{"k": "v"}}},
+		Counts:      map[int]uint8{3: 4},
+		Raw:         []byte("raw"),
+		Extra:       s.GetGlobal("row").(cpi.KDict).GetField("extra"),
+		Nested:      &convertBase{ID: 2},
+		Flags:       [2]bool{true, false},
+		Plain:       "p",
+	}, row)
+
+	// round trip through a Kala value
+	v, err := ToKValue(row)
+	assert.Nil(t, err)
+	var back convertRow
+	assert.Nil(t, FromKValue(v, &back))
+	assert.Equal(t, row, back)
+
+	errors := []struct {
+		v    cpi.KValue
+		out  any
+		want string
+	}{
+		{cpi.KNumber(1.5), new(int), "cannot convert 1.5 to int"},
+		{cpi.KNumber(300), new(uint8), "cannot convert 300 to uint8"},
+		{cpi.KNumber(-1), new(uint), "cannot convert -1 to uint"},
+		{cpi.KNil{}, new(string), "cannot convert nil to string"},
+		{cpi.KString("x"), new(bool), "cannot convert string to bool"},
+		{cpi.KString("May 1"), new(time.Time), `cannot convert "May 1" to time.Time: not in RFC 3339 format`},
+		{s.GetGlobal("row"), new(map[bool]any), "cannot convert dict to map[bool]interface {}"},
+		{s.GetGlobal("row"), new(struct{ Tags []int }), ""},
+		{s.GetGlobal("row"), new(struct {
+			Tags []int `kala:"tags"`
+		}), "cannot convert string to int at $.tags[0]"},
+		{s.GetGlobal("row"), new(struct {
+			Flags [0]bool `kala:"flags"`
+		}), "cannot convert list of 1 values to [0]bool at $.flags"},
+		{cpi.KNumber(1), 3, "out must be a non-nil pointer, got int"},
+	}
+	for _, test := range errors {
+		err := FromKValue(test.v, test.out)
+		if test.want == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.EqualError(t, err, test.want)
+	}
+
+	// the promoted fields of a nil pointer to an unexported struct can not
+	// be set, but those of an allocated one can
+	assert.Nil(t, s.DoString(`point = {X: 1, Y: 2}`))
+	var outer convertOuter
+	err = FromKValue(s.GetGlobal("point"), &outer)
+	assert.EqualError(t, err, "cannot set embedded pointer to unexported struct vm.convertInner at $.X")
+	outer = convertOuter{convertInner: &convertInner{}}
+	assert.Nil(t, FromKValue(s.GetGlobal("point"), &outer))
+	assert.Equal(t, convertOuter{convertInner: &convertInner{X: 1}, Y: 2}, outer)
+}
+
+func TestGoFunction(t *testing.T) {
+	s := NewState()
+	lookup, err := ToKValue(func(id int, fields []string) (map[string]any, error) {
+		if id < 0 {
+			return nil, errors.New("no such row")
+		}
+		return map[string]any{"id": id, "fields": fields}, nil
+	})
+	assert.Nil(t, err)
+	s.SetGlobal("lookup", lookup)
+	err = s.DoString(`
+	row = lookup(3, ["a"])
+	ok, e = pcall(lookup, -1, [])
+	`)
+	assert.Nil(t, err)
+	assert.Equal(t, "{ fields:[a], id:3.00}", s.GetGlobal("row").Str())
+	assert.Equal(t, cpi.KBool(false), s.GetGlobal("ok"))
+	assert.Equal(t, cpi.KString("no such row"), s.GetGlobal("e").(cpi.KDict).GetField("message"))
+
+	errors := []struct {
+		script string
+		want   string
+	}{
+		{`lookup(1)`, "wrong number of arguments to 'vm.TestGoFunction.func1' (2 expected, got 1)"},
+		{`lookup("1", [])`, "bad argument #1 to 'vm.TestGoFunction.func1' (cannot convert string to int)"},
+		{`lookup(1, [2])`, "bad argument #2 to 'vm.TestGoFunction.func1' (cannot convert number to string at $[0])"},
+	}
+	for _, test := range errors {
+		err := s.DoString(test.script)
+		if assert.NotNil(t, err, test.script) {
+			assert.Equal(t, test.want, err.Error(), test.script)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package vm
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/khoakmp/kala/parse"
+)
+
+// ErrTerminated is the Cause of the RuntimeError of a script stopped by
+// Debugger.Terminate.
+var ErrTerminated = errors.New("terminated by the debugger")
+
+// evalMaxInstructions bounds the instructions run by Debugger.Evaluate, so a
+// watch expression can not hang the debugger.
+const evalMaxInstructions = 1000000
+
+// StopReason tells why a debugged script stopped.
+type StopReason int
+
+const (
+	StopStep       StopReason = iota // a step command completed
+	StopBreakpoint                   // a breakpoint was hit
+	StopPause                        // Pause was called
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopStep:
+		return "step"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopPause:
+		return "pause"
+	}
+	return "unknown"
+}
+
+// StopEvent describes a stop of the debugged script.
+type StopEvent struct {
+	Reason     StopReason
+	Breakpoint *Breakpoint // the breakpoint hit, for StopBreakpoint
+}
+
+// DebugHandler is called, on the goroutine running the script, each time the
+// script stops. The script is suspended until the handler returns, it then
+// resumes as set by the last of Continue, StepInto, StepOver, StepOut,
+// StepInstruction or Terminate called by the handler. A handler that calls
+// none of them continues the script.
+type DebugHandler func(d *Debugger, ev StopEvent)
+
+// Breakpoint stops the script before the first instruction of a source line,
+// or on the entry of the functions named Function.
+type Breakpoint struct {
+	ID       int
+	Source   string // empty for a function breakpoint
+	Line     int
+	Function string // empty for a line breakpoint
+	Hits     int    // updated by the goroutine running the script
+}
+
+func (bp *Breakpoint) matchSource(source string) bool {
+	if bp.Source == source {
+		return true
+	}
+	// a breakpoint set on a bare file name matches that file in any directory
+	return !strings.ContainsRune(bp.Source, filepath.Separator) && filepath.Base(source) == bp.Source
+}
+
+// Frame is one frame of the call stack of a stopped script, the innermost
+// frame has index 0.
+type Frame struct {
+	Index    int
+	Function string
+	Source   string
+	Line     int // 0 when the proto carries no line info
+	PC       int // next instruction of frame 0, the running CALL of the others, -1 for host functions
+}
+
+// Variable is a named value of a stopped script.
+type Variable struct {
+	Name  string
+	Value cpi.KValue
+}
+
+// Watch is an expression evaluated at each stop.
+type Watch struct {
+	ID   int
+	Expr string
+}
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepInto
+	stepOver
+	stepOut
+	stepInstruction
+	stepTerminate
+)
+
+// Debugger suspends the scripts run by a State at breakpoints and steps and
+// gives access to their call stack and variables. It is driven by its
+// DebugHandler, which backs a console as well as an IDE integration.
+//
+// The breakpoints may be changed and Pause may be called from any goroutine,
+// the other methods must be called by the DebugHandler or while no script
+// runs.
+type Debugger struct {
+	rt      *RuntimeState
+	handler DebugHandler
+
+	mu          sync.Mutex                    // serializes the changes of breakpoints and nextID
+	breakpoints atomic.Pointer[[]*Breakpoint] // replaced, never modified, so the hook reads it without lock
+	watches     []Watch
+	nextID      int
+
+	mode      stepMode
+	stepDepth int
+	paused    atomic.Bool
+	stopped   bool
+}
+
+// NewDebugger attaches a debugger to s. Scripts run by s stop where the
+// debugger tells them to until Detach is called.
+func NewDebugger(s *State, handler DebugHandler) *Debugger {
+	d := &Debugger{rt: s.rt, handler: handler}
+	s.rt.hook = d.hook
+	return d
+}
+
+// Detach removes the debugger from its State, the scripts then run freely.
+func (d *Debugger) Detach() {
+	d.rt.hook = nil
+}
+
+// SetBreakpoint adds a breakpoint on line of the script source.
+func (d *Debugger) SetBreakpoint(source string, line int) *Breakpoint {
+	return d.addBreakpoint(&Breakpoint{Source: source, Line: line})
+}
+
+// SetFunctionBreakpoint adds a breakpoint on the entry of the Kala functions
+// named name.
+func (d *Debugger) SetFunctionBreakpoint(name string) *Breakpoint {
+	return d.addBreakpoint(&Breakpoint{Function: name})
+}
+
+func (d *Debugger) addBreakpoint(bp *Breakpoint) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	bp.ID = d.nextID
+	bps := append(d.Breakpoints(), bp)
+	d.breakpoints.Store(&bps)
+	return bp
+}
+
+// ClearBreakpoint removes the breakpoint id and reports whether it existed.
+func (d *Debugger) ClearBreakpoint(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bps := d.Breakpoints()
+	for i, bp := range bps {
+		if bp.ID == id {
+			bps = append(bps[:i], bps[i+1:]...)
+			d.breakpoints.Store(&bps)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearBreakpoints removes all the breakpoints.
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints.Store(nil)
+}
+
+// Breakpoints returns the breakpoints in the order they were set.
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	bps := d.breakpoints.Load()
+	if bps == nil {
+		return []*Breakpoint{}
+	}
+	return append([]*Breakpoint{}, *bps...)
+}
+
+// AddWatch adds an expression evaluated by Watches and returns its id.
+func (d *Debugger) AddWatch(expr string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	d.watches = append(d.watches, Watch{ID: d.nextID, Expr: expr})
+	return d.nextID
+}
+
+// RemoveWatch removes the watch id and reports whether it existed.
+func (d *Debugger) RemoveWatch(id int) bool {
+	for i, w := range d.watches {
+		if w.ID == id {
+			d.watches = append(d.watches[:i], d.watches[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Watches returns the watch expressions.
+func (d *Debugger) Watches() []Watch {
+	return append([]Watch{}, d.watches...)
+}
+
+// Continue resumes the script until the next breakpoint.
+func (d *Debugger) Continue() {
+	d.setMode(stepNone)
+}
+
+// StepInto resumes the script until it reaches another source line, entering
+// the functions called on the current one.
+func (d *Debugger) StepInto() {
+	d.setMode(stepInto)
+}
+
+// StepOver resumes the script until it reaches another source line of the
+// current function or returns from it.
+func (d *Debugger) StepOver() {
+	d.setMode(stepOver)
+}
+
+// StepOut resumes the script until the current function returns.
+func (d *Debugger) StepOut() {
+	d.setMode(stepOut)
+}
+
+// StepInstruction resumes the script for a single instruction.
+func (d *Debugger) StepInstruction() {
+	d.setMode(stepInstruction)
+}
+
+// Terminate stops the script with a RuntimeError whose Cause is ErrTerminated.
+func (d *Debugger) Terminate() {
+	d.setMode(stepTerminate)
+}
+
+// Pause stops the running script before its next instruction. It may be
+// called from any goroutine.
+func (d *Debugger) Pause() {
+	d.paused.Store(true)
+}
+
+func (d *Debugger) setMode(mode stepMode) {
+	d.mode = mode
+	d.stepDepth = len(d.rt.stackCallFrame.array)
+}
+
+// hook is called by the VM before each instruction.
+func (d *Debugger) hook(s *RuntimeState) {
+	cf := s.currentFrame
+	proto := cf.Closure.Proto
+	pc := cf.PC
+	line := proto.LineAt(pc)
+	// a new line starts when the frame enters it or jumps back to it
+	newLine := line != cf.hookLine || pc <= cf.hookPC
+	cf.hookLine, cf.hookPC = line, pc
+	depth := len(s.stackCallFrame.array)
+
+	ev := StopEvent{Reason: StopStep}
+	stop := false
+	switch d.mode {
+	case stepInto:
+		stop = newLine
+	case stepOver:
+		stop = newLine && depth <= d.stepDepth
+	case stepOut:
+		stop = depth < d.stepDepth
+	case stepInstruction:
+		stop = true
+	}
+	if !stop && d.paused.Load() {
+		stop, ev.Reason = true, StopPause
+	}
+	if bps := d.breakpoints.Load(); !stop && bps != nil {
+		for _, bp := range *bps {
+			hit := false
+			if bp.Function != "" {
+				hit = pc == 0 && proto.Name == bp.Function
+			} else {
+				hit = newLine && line == bp.Line && bp.matchSource(proto.Source)
+			}
+			if hit {
+				bp.Hits++
+				stop, ev = true, StopEvent{Reason: StopBreakpoint, Breakpoint: bp}
+				break
+			}
+		}
+	}
+	if !stop {
+		return
+	}
+
+	d.paused.Store(false)
+	d.mode = stepNone
+	d.stopped = true
+	if d.handler != nil {
+		d.handler(d, ev)
+	}
+	d.stopped = false
+	if d.mode == stepTerminate {
+		d.mode = stepNone
+		s.abort(ErrTerminated)
+	}
+}
+
+// Stopped reports whether the script is suspended in the DebugHandler, which
+// is when the stack can be inspected.
+func (d *Debugger) Stopped() bool {
+	return d.stopped
+}
+
+func (d *Debugger) frame(index int) (*CallFrame, int, bool) {
+	frames := d.rt.stackCallFrame.array
+	if index < 0 || index >= len(frames) {
+		return nil, 0, false
+	}
+	cf := frames[len(frames)-1-index]
+	pc := cf.PC
+	if index > 0 {
+		pc--
+	}
+	return cf, pc, true
+}
+
+// Frames returns the call stack, innermost first.
+func (d *Debugger) Frames() []Frame {
+	n := len(d.rt.stackCallFrame.array)
+	frames := make([]Frame, 0, n)
+	for i := 0; i < n; i++ {
+		cf, pc, _ := d.frame(i)
+		if cf.Closure.IsGlobal {
+			frames = append(frames, Frame{Index: i, Function: cf.Closure.FuncName(), PC: -1})
+			continue
+		}
+		proto := cf.Closure.Proto
+		frames = append(frames, Frame{
+			Index:    i,
+			Function: proto.Name,
+			Source:   proto.Source,
+			Line:     proto.LineAt(pc),
+			PC:       pc,
+		})
+	}
+	return frames
+}
+
+// FrameProto returns the function of a frame, nil for a host function.
+func (d *Debugger) FrameProto(frame int) *cpi.FuncProto {
+	cf, _, ok := d.frame(frame)
+	if !ok || cf.Closure.IsGlobal {
+		return nil
+	}
+	return cf.Closure.Proto
+}
+
+// Locals returns the local variables of a frame live at its pc, outer scopes
+// first. The compiler's hidden locals are left out.
+func (d *Debugger) Locals(frame int) []Variable {
+	cf, pc, ok := d.frame(frame)
+	if !ok || cf.Closure.IsGlobal {
+		return nil
+	}
+	vars := []Variable{}
+	for _, v := range cf.Closure.Proto.LocalsAt(pc) {
+		if strings.HasPrefix(v.Name, "(") {
+			continue
+		}
+		vars = append(vars, Variable{Name: v.Name, Value: d.rt.stackValue.Get(cf.LocalBase + v.Slot)})
+	}
+	return vars
+}
+
+// Upvalues returns the upvalues of the function of a frame.
+func (d *Debugger) Upvalues(frame int) []Variable {
+	cf, _, ok := d.frame(frame)
+	if !ok || cf.Closure.IsGlobal {
+		return nil
+	}
+	names := cf.Closure.Proto.UpvalueNames
+	vars := make([]Variable, 0, len(cf.Closure.Upvalues))
+	for i, uv := range cf.Closure.Upvalues {
+		name := "?"
+		if i < len(names) {
+			name = names[i]
+		}
+		vars = append(vars, Variable{Name: name, Value: uv.Get(d.rt.stackValue)})
+	}
+	return vars
+}
+
+// Globals returns the global variables sorted by name.
+func (d *Debugger) Globals() []Variable {
+	global := d.rt.Global
+	vars := make([]Variable, 0, global.Len())
+	for i := 0; i < global.Len(); i++ {
+		k, v := global.GetKeyValue(i)
+		vars = append(vars, Variable{Name: k, Value: v})
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+// Lookup returns the variable name as seen from a frame: a local, else an
+// upvalue, else a global.
+func (d *Debugger) Lookup(frame int, name string) (cpi.KValue, bool) {
+	locals := d.Locals(frame)
+	for i := len(locals) - 1; i >= 0; i-- {
+		if locals[i].Name == name {
+			return locals[i].Value, true
+		}
+	}
+	for _, v := range d.Upvalues(frame) {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	if d.rt.Global.Has(name) {
+		return d.rt.Global.GetField(name), true
+	}
+	return cpi.KNil{}, false
+}
+
+// Evaluate evaluates the expression expr as seen from a frame and returns
+// its values. The variables of the frame are globals of the evaluation, so
+// assignments to variables made by the expression are not seen by the
+// script, while changes to the dicts and lists it reaches are. It runs on the
+// stack of the stopped script, above the registers of its running function,
+// so the closures it calls share their open upvalues with the script.
+func (d *Debugger) Evaluate(frame int, expr string) ([]cpi.KValue, error) {
+	chunk, err := parse.Parse(strings.NewReader("return "+expr), "<eval>")
+	if err != nil {
+		return nil, err
+	}
+	proto, err := cpi.Compile(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	env := cpi.NewKDict(d.rt.Global.Len())
+	for _, v := range d.Globals() {
+		env.SetField(v.Name, v.Value)
+	}
+	for _, v := range d.Upvalues(frame) {
+		env.SetField(v.Name, v.Value)
+	}
+	for _, v := range d.Locals(frame) {
+		env.SetField(v.Name, v.Value)
+	}
+
+	// the evaluation has its own globals and instruction budget, and does
+	// not stop on breakpoints
+	rt := d.rt
+	stack := rt.stackValue
+	current, top := rt.currentFrame, stack.top
+	global, hook, numInsts, maxInsts := rt.Global, rt.hook, rt.numInsts, rt.options.MaxInstructions
+	defer func() {
+		rt.currentFrame, stack.top = current, top
+		rt.Global, rt.hook, rt.numInsts, rt.options.MaxInstructions = global, hook, numInsts, maxInsts
+	}()
+	rt.Global, rt.hook, rt.numInsts, rt.options.MaxInstructions = env, nil, 0, evalMaxInstructions
+	if current != nil && !current.Closure.IsGlobal {
+		stack.top = max(top, current.LocalBase+int(current.Closure.Proto.NumUsedRegisters))
+	}
+	return rt.state.Call(NewLocalClosure(proto))
+}
@@ -0,0 +1,162 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+const debugScript = `var total = 0
+func add(x) {
+	var y = x * 2
+	total = total + y
+	return y
+}
+for i = 0, 3 {
+	add(i)
+}
+result = total`
+
+// debugRun runs debugScript under a debugger whose handler records each stop
+// as "function:line" and then calls the next of actions.
+func debugRun(t *testing.T, setup func(d *Debugger), actions ...func(d *Debugger)) ([]string, error) {
+	s := NewState()
+	stops := []string{}
+	d := NewDebugger(s, func(d *Debugger, ev StopEvent) {
+		top := d.Frames()[0]
+		stops = append(stops, fmt.Sprintf("%s:%d", top.Function, top.Line))
+		if len(actions) > 0 {
+			actions[0](d)
+			actions = actions[1:]
+		}
+	})
+	setup(d)
+	fn, err := s.Load(strings.NewReader(debugScript), "script.kala")
+	assert.Nil(t, err)
+	_, err = s.Call(fn)
+	return stops, err
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	var bp *Breakpoint
+	stops, err := debugRun(t, func(d *Debugger) {
+		bp = d.SetBreakpoint("script.kala", 4)
+		d.SetFunctionBreakpoint("nothing")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"add:4", "add:4", "add:4"}, stops)
+	assert.Equal(t, 3, bp.Hits)
+
+	// function breakpoints, a bare file name matches the path of the source
+	stops, err = debugRun(t, func(d *Debugger) {
+		d.SetFunctionBreakpoint("add")
+	}, func(d *Debugger) {
+		d.ClearBreakpoints()
+		d.SetBreakpoint("kala/script.kala", 10)
+		d.SetBreakpoint("script.kala", 10)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"add:3", "main chunk:10"}, stops)
+}
+
+func TestDebuggerStep(t *testing.T) {
+	stops, err := debugRun(t, func(d *Debugger) {
+		d.SetBreakpoint("script.kala", 8)
+	},
+		(*Debugger).StepInto, // enters add
+		(*Debugger).StepOver,
+		(*Debugger).StepOut, // right after the call, on the FORLOOP of the header
+		(*Debugger).StepOver,
+		func(d *Debugger) { d.ClearBreakpoints(); d.StepOver() },
+		(*Debugger).StepInstruction,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"main chunk:8", "add:3", "add:4", "main chunk:7", "main chunk:8", "main chunk:7", "main chunk:8",
+	}, stops)
+}
+
+func TestDebuggerInspect(t *testing.T) {
+	var locals, upvalues []Variable
+	var frames []Frame
+	var value cpi.KValue
+	var evaluated []cpi.KValue
+	var evalErr error
+	_, err := debugRun(t, func(d *Debugger) {
+		d.SetBreakpoint("script.kala", 5)
+	}, func(d *Debugger) {
+		frames = d.Frames()
+		locals = d.Locals(0)
+		upvalues = d.Upvalues(0)
+		value, _ = d.Lookup(1, "i")
+		evaluated, evalErr = d.Evaluate(0, "y + total, x")
+		d.Terminate()
+	})
+	assert.True(t, errors.Is(err, ErrTerminated))
+
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, Frame{Index: 0, Function: "add", Source: "script.kala", Line: 5, PC: frames[0].PC}, frames[0])
+	assert.Equal(t, 8, frames[1].Line)
+	assert.Equal(t, []Variable{{"x", cpi.KNumber(0)}, {"y", cpi.KNumber(0)}}, locals)
+	assert.Equal(t, []Variable{{"total", cpi.KNumber(0)}}, upvalues)
+	assert.Equal(t, cpi.KNumber(0), value)
+	assert.Nil(t, evalErr)
+	assert.Equal(t, []cpi.KValue{cpi.KNumber(0), cpi.KNumber(0)}, evaluated)
+}
+
+func TestDebuggerWatchAndPause(t *testing.T) {
+	values := []string{}
+	_, err := debugRun(t, func(d *Debugger) {
+		d.AddWatch("total * 10")
+		d.SetBreakpoint("script.kala", 5)
+	}, func(d *Debugger) {
+		for _, w := range d.Watches() {
+			v, err := d.Evaluate(0, w.Expr)
+			assert.Nil(t, err)
+			values = append(values, v[0].Str())
+		}
+		d.ClearBreakpoints()
+		d.Pause()
+	}, func(d *Debugger) {
+		// stopped by the pause right after the breakpoint
+		top := d.Frames()[0]
+		values = append(values, fmt.Sprintf("%s:%d", top.Function, top.Line))
+		d.Detach()
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0.00", "add:5"}, values)
+}
+
+func TestDebuggerEvaluateUpvalues(t *testing.T) {
+	s := NewState()
+	var evaluated []cpi.KValue
+	var evalErr, failed error
+	d := NewDebugger(s, func(d *Debugger, ev StopEvent) {
+		evaluated, evalErr = d.Evaluate(0, "n, get(), set(5)")
+		// a failed evaluation leaves the stack of the script as it was
+		_, failed = d.Evaluate(0, "get() + set(1) + nothing")
+	})
+	d.SetBreakpoint("script.kala", 6)
+	fn, err := s.Load(strings.NewReader(`func main() {
+	var n = 1
+	var get = func() { return n }
+	var set = func(v) { n = v }
+	n = 2
+	return get()
+}
+result = main()`), "script.kala")
+	assert.Nil(t, err)
+	_, err = s.Call(fn)
+	assert.Nil(t, err)
+
+	// the closures read and write the local they captured, as changed by
+	// the script
+	assert.Nil(t, evalErr)
+	assert.Equal(t, []cpi.KValue{cpi.KNumber(2), cpi.KNumber(2)}, evaluated)
+	assert.NotNil(t, failed)
+	assert.Equal(t, cpi.KNumber(1), s.GetGlobal("result"))
+}
@@ -0,0 +1,53 @@
+package vm
+
+import "github.com/khoakmp/kala/cpi"
+
+// openDict returns the dict library. Keys and values are listed in the order
+// the keys were first set.
+func openDict() cpi.KDict {
+	return newLib("dict", []libFunc{
+		{"delete", dictDelete},
+		{"has", dictHas},
+		{"keys", dictKeys},
+		{"values", dictValues},
+	})
+}
+
+// dict.keys(d) returns the list of the keys of d.
+func dictKeys(s *State) int {
+	d := s.CheckDict(1)
+	arr := make([]cpi.KValue, d.Len())
+	for i := range arr {
+		key, _ := d.GetKeyValue(i)
+		arr[i] = cpi.KString(key)
+	}
+	s.Push(s.newList(arr))
+	return 1
+}
+
+// dict.values(d) returns the list of the values of d.
+func dictValues(s *State) int {
+	d := s.CheckDict(1)
+	arr := make([]cpi.KValue, d.Len())
+	for i := range arr {
+		arr[i] = d.GetAt(i)
+	}
+	s.Push(s.newList(arr))
+	return 1
+}
+
+// dict.has(d, key) reports whether key is set in d.
+func dictHas(s *State) int {
+	s.Push(cpi.KBool(s.CheckDict(1).Has(s.CheckString(2))))
+	return 1
+}
+
+// dict.delete(d, key) removes key from d and returns its value, nil if it
+// was not set.
+func dictDelete(s *State) int {
+	d := s.CheckDict(1)
+	key := s.CheckString(2)
+	s.Push(d.GetField(key))
+	d.Delete(key)
+	return 1
+}
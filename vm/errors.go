@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/khoakmp/kala/cpi"
+)
+
+// NoOpcode is the Opcode of a RuntimeError that is not raised by an instruction.
+const NoOpcode = -1
+
+// Errors reported as the Cause of a RuntimeError when a script exceeds one of
+// the budgets set in Options. A cancelled or expired context is reported with
+// the error of the context instead.
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrCallDepthLimit   = errors.New("call depth limit exceeded")
+	ErrMemoryLimit      = errors.New("memory limit exceeded")
+)
+
+// tracebackEdge is the number of innermost and of outermost frames kept in
+// a traceback, the frames between them are counted by a single entry.
+const tracebackEdge = 10
+
+// TraceEntry is one Kala call frame of a stack traceback, innermost first.
+type TraceEntry struct {
+	Function string
+	Source   string
+	Line     int // 0 when the proto carries no line info
+	PC       int // index of the instruction being executed, -1 for host functions
+	// Skipped, when not 0, is the number of frames left out of a deep
+	// traceback at the place of this entry, which has no other field set.
+	Skipped int
+}
+
+func (e TraceEntry) String() string {
+	if e.Skipped != 0 {
+		return fmt.Sprintf("... %d more ...", e.Skipped)
+	}
+	if e.PC < 0 {
+		return "[host] in " + e.Function
+	}
+	if e.Line == 0 {
+		return fmt.Sprintf("%s (pc %d) in %s", e.Source, e.PC, e.Function)
+	}
+	return fmt.Sprintf("%s:%d in %s", e.Source, e.Line, e.Function)
+}
+
+// RuntimeError is the error returned by the VM when a script fails. It never
+// escapes as a Go panic from Run.
+type RuntimeError struct {
+	Opcode    int      // opcode being executed, NoOpcode if unknown
+	Operands  []string // type names of the offending operands
+	Message   string
+	Traceback []TraceEntry
+	Cause     error // set when the script was stopped by the host, see Options
+	// Kind is KindRuntime, or the kind given to the error builtin, which
+	// also sets Value to the value it raised.
+	Kind  string
+	Value cpi.KValue
+}
+
+// KindRuntime is the Kind of the errors raised by the VM and by host
+// functions.
+const KindRuntime = "runtime"
+
+func (e *RuntimeError) Error() string {
+	buf := bytes.NewBufferString(e.Message)
+	if e.Opcode != NoOpcode {
+		fmt.Fprintf(buf, " (%s", cpi.OpName(e.Opcode))
+		for i, t := range e.Operands {
+			if i == 0 {
+				buf.WriteString(": ")
+			} else {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(t)
+		}
+		buf.WriteByte(')')
+	}
+	return buf.String()
+}
+
+// Unwrap returns the Cause, so errors.Is(err, ErrInstructionLimit) and
+// errors.Is(err, context.DeadlineExceeded) work on a RuntimeError.
+func (e *RuntimeError) Unwrap() error {
+	return e.Cause
+}
+
+// StackTrace formats the traceback, one frame per line.
+func (e *RuntimeError) StackTrace() string {
+	buf := bytes.NewBufferString("stack traceback:")
+	for _, entry := range e.Traceback {
+		buf.WriteString("\n\t")
+		buf.WriteString(entry.String())
+	}
+	return buf.String()
+}
+
+func typeNames(values []cpi.KValue) []string {
+	names := make([]string, len(values))
+	for i, v := range values {
+		names[i] = typeName(v)
+	}
+	return names
+}
+
+func typeName(v cpi.KValue) string {
+	if v == nil {
+		return cpi.TypeNames[cpi.KTypeNil]
+	}
+	return cpi.TypeNames[v.Type()]
+}
+
+// traceback returns the entries of the frames of s, innermost first. Only the
+// tracebackEdge innermost and outermost frames of a deeper stack are kept, so
+// raising an error costs the same at any depth, which matters to the scripts
+// calling pcall in a loop.
+func (s *RuntimeState) traceback() []TraceEntry {
+	frames := s.stackCallFrame.array
+	entries := make([]TraceEntry, 0, min(len(frames), 2*tracebackEdge+1))
+	for i := len(frames) - 1; i >= 0; i-- {
+		if len(entries) == tracebackEdge && i > tracebackEdge {
+			entries = append(entries, TraceEntry{Skipped: i + 1 - tracebackEdge})
+			i = tracebackEdge
+			continue
+		}
+		cf := frames[i]
+		if cf.Closure.IsGlobal {
+			entries = append(entries, TraceEntry{Function: cf.Closure.FuncName(), PC: -1})
+			continue
+		}
+		proto := cf.Closure.Proto
+		entries = append(entries, TraceEntry{
+			Function: proto.Name,
+			Source:   proto.Source,
+			Line:     proto.LineAt(cf.PC - 1),
+			PC:       cf.PC - 1,
+		})
+	}
+	return entries
+}
+
+func (s *RuntimeState) newError(op int, msg string, operands []cpi.KValue) *RuntimeError {
+	return &RuntimeError{
+		Opcode:    op,
+		Operands:  typeNames(operands),
+		Message:   msg,
+		Traceback: s.traceback(),
+		Kind:      KindRuntime,
+	}
+}
+
+// dict returns the value of e caught by pcall, a dict with the message, the
+// kind, the traceback of e and the value raised by error, if it is not the
+// message.
+func (e *RuntimeError) dict() cpi.KDict {
+	d := cpi.NewKDict(4)
+	d.SetField("message", cpi.KString(e.Error()))
+	d.SetField("kind", cpi.KString(e.Kind))
+	traceback := cpi.NewKList(len(e.Traceback))
+	for _, entry := range e.Traceback {
+		traceback.Append(cpi.KString(entry.String()))
+	}
+	d.SetField("traceback", traceback)
+	if e.Value != nil && e.Value.Type() != cpi.KTypeString {
+		d.SetField("value", e.Value)
+	}
+	return d
+}
+
+// RaiseError aborts the running instruction with a RuntimeError. operands are
+// the values the instruction failed on, only their types are recorded.
+func (s *RuntimeState) RaiseError(inst uint32, msg string, operands ...cpi.KValue) {
+	s.raise(opGetOpCode(inst), msg, operands...)
+}
+
+func (s *RuntimeState) raise(op int, msg string, operands ...cpi.KValue) {
+	panic(s.newError(op, msg, operands))
+}
+
+// abort stops the script because of cause, which is not a script failure.
+func (s *RuntimeState) abort(cause error) {
+	err := s.newError(NoOpcode, cause.Error(), nil)
+	err.Cause = cause
+	panic(err)
+}
+
+// RaiseHostError is RaiseError for host functions, which run outside any
+// instruction of their own.
+func (s *RuntimeState) RaiseHostError(format string, args ...any) {
+	panic(s.newError(NoOpcode, fmt.Sprintf(format, args...), nil))
+}
+
+// recoverError turns a panic raised while executing s into a RuntimeError.
+// Go runtime panics are wrapped too, so a broken script can not crash the host.
+func (s *RuntimeState) recoverError(r any) *RuntimeError {
+	switch r := r.(type) {
+	case *RuntimeError:
+		return r
+	case error:
+		return s.newError(NoOpcode, r.Error(), nil)
+	default:
+		return s.newError(NoOpcode, fmt.Sprint(r), nil)
+	}
+}
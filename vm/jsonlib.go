@@ -0,0 +1,300 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/khoakmp/kala/cpi"
+)
+
+// jsonMaxDepth bounds the nesting of the arrays and objects decoded by
+// json.decode.
+const jsonMaxDepth = 1000
+
+// openJSON returns the json library. Objects are decoded into dicts and
+// dicts are encoded with their keys in insertion order.
+func openJSON() cpi.KDict {
+	return newLib("json", []libFunc{
+		{"decode", jsonDecode},
+		{"encode", jsonEncode},
+	})
+}
+
+// json.encode(v, opts?) returns v as JSON. opts.indent, a number of spaces
+// or a string, puts each element on its own line indented by it.
+func jsonEncode(s *State) int {
+	e := &jsonEncoder{rt: s.rt}
+	if _, ok := s.Arg(2).(cpi.KNil); !ok {
+		switch indent := s.CheckDict(2).GetField("indent").(type) {
+		case cpi.KNil:
+		case cpi.KNumber:
+			e.indent = strings.Repeat(" ", min(max(int(indent), 0), 16))
+		case cpi.KString:
+			e.indent = string(indent)
+		default:
+			s.RaiseError("bad argument #2 to 'json.encode' (indent must be a number or a string, got %s)",
+				typeName(indent))
+		}
+	}
+	if err := e.encode(s.Arg(1)); err != nil {
+		s.RaiseError("%s", err)
+	}
+	e.account()
+	s.Push(cpi.KString(e.buf.String()))
+	return 1
+}
+
+type jsonEncoder struct {
+	rt      *RuntimeState
+	buf     bytes.Buffer
+	indent  string
+	charged int // bytes of buf charged to the run
+	values  int // values encoded so far
+	// dicts and lists being encoded, to detect cycles, and the path from
+	// the root to the value being encoded, for error messages
+	parents []cpi.KValue
+	path    []string
+}
+
+// errorf returns an encoding error about the value at the current path.
+func (e *jsonEncoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("cannot encode %s at %s", fmt.Sprintf(format, args...), "$"+strings.Join(e.path, ""))
+}
+
+// account charges the output written since its last call to the run, and
+// checks the context every ctxCheckInterval values. The output is not bounded
+// by the size of the value: a dict or list used at several places, which is
+// not a cycle, is written once for each of them.
+func (e *jsonEncoder) account() {
+	e.rt.allocate(e.buf.Len() - e.charged)
+	e.charged = e.buf.Len()
+	e.values++
+	if e.values%ctxCheckInterval == 0 {
+		e.rt.checkContext()
+	}
+}
+
+func (e *jsonEncoder) newline() {
+	if e.indent == "" {
+		return
+	}
+	e.buf.WriteByte('\n')
+	for range e.parents {
+		e.buf.WriteString(e.indent)
+	}
+}
+
+// enter pushes the dict or list v, failing if it is already being encoded.
+func (e *jsonEncoder) enter(v cpi.KValue) error {
+	for _, p := range e.parents {
+		if sameValue(p, v) {
+			return e.errorf("cyclic %s", typeName(v))
+		}
+	}
+	e.parents = append(e.parents, v)
+	return nil
+}
+
+func (e *jsonEncoder) leave(empty bool) {
+	e.parents = e.parents[:len(e.parents)-1]
+	if !empty {
+		e.newline()
+	}
+}
+
+func (e *jsonEncoder) encode(v cpi.KValue) error {
+	e.account()
+	switch v := v.(type) {
+	case nil, cpi.KNil:
+		e.buf.WriteString("null")
+	case cpi.KBool:
+		e.buf.WriteString(v.Str())
+	case cpi.KNumber:
+		if math.IsInf(float64(v), 0) || math.IsNaN(float64(v)) {
+			return e.errorf("number %v", float64(v))
+		}
+		b, _ := json.Marshal(float64(v))
+		e.buf.Write(b)
+	case cpi.KString:
+		writeJSONString(&e.buf, string(v))
+	case cpi.KList:
+		if err := e.enter(v); err != nil {
+			return err
+		}
+		e.buf.WriteByte('[')
+		for i := range v.Len() {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.newline()
+			e.path = append(e.path, fmt.Sprintf("[%d]", i))
+			if err := e.encode(v.GetAt(i)); err != nil {
+				return err
+			}
+			e.path = e.path[:len(e.path)-1]
+		}
+		e.leave(v.Len() == 0)
+		e.buf.WriteByte(']')
+	case cpi.KDict:
+		if err := e.enter(v); err != nil {
+			return err
+		}
+		e.buf.WriteByte('{')
+		for i := range v.Len() {
+			key, value := v.GetKeyValue(i)
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.newline()
+			writeJSONString(&e.buf, key)
+			e.buf.WriteByte(':')
+			if e.indent != "" {
+				e.buf.WriteByte(' ')
+			}
+			e.path = append(e.path, "."+key)
+			if err := e.encode(value); err != nil {
+				return err
+			}
+			e.path = e.path[:len(e.path)-1]
+		}
+		e.leave(v.Len() == 0)
+		e.buf.WriteByte('}')
+	default:
+		return e.errorf("%s", typeName(v))
+	}
+	return nil
+}
+
+// sameValue reports whether the dicts or lists a and b are the same one.
+func sameValue(a, b cpi.KValue) bool {
+	switch a := a.(type) {
+	case cpi.KDict:
+		b, ok := b.(cpi.KDict)
+		return ok && a.Same(b)
+	case cpi.KList:
+		b, ok := b.(cpi.KList)
+		return ok && a.Same(b)
+	}
+	return false
+}
+
+// writeJSONString writes str as a JSON string. Bytes which are not valid
+// UTF-8 are replaced by U+FFFD.
+func writeJSONString(buf *bytes.Buffer, str string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		switch c := str[i]; {
+		case r == utf8.RuneError && size <= 1:
+			buf.WriteString(`\ufffd`)
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c < ' ':
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		default:
+			buf.WriteString(str[i : i+size])
+		}
+		i += size
+	}
+	buf.WriteByte('"')
+}
+
+// json.decode(str) returns the value of the JSON document str.
+func jsonDecode(s *State) int {
+	d := &jsonDecoder{s: s, dec: json.NewDecoder(strings.NewReader(s.CheckString(1)))}
+	v, err := d.decode(0)
+	if err == nil {
+		if _, err = d.dec.Token(); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("unexpected data after the top-level value")
+		}
+	}
+	if err != nil {
+		s.RaiseError("invalid JSON: %s (offset %d)", err, d.dec.InputOffset())
+	}
+	s.Push(v)
+	return 1
+}
+
+type jsonDecoder struct {
+	s      *State
+	dec    *json.Decoder
+	tokens int // tokens decoded so far
+}
+
+func (d *jsonDecoder) decode(depth int) (cpi.KValue, error) {
+	tok, err := d.dec.Token()
+	if err == io.EOF {
+		return nil, errors.New("unexpected end of JSON input")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if depth >= jsonMaxDepth {
+		return nil, errors.New("nesting too deep")
+	}
+	rt := d.s.rt
+	if d.tokens++; d.tokens%ctxCheckInterval == 0 {
+		rt.checkContext()
+	}
+	switch tok := tok.(type) {
+	case nil:
+		return cpi.KNil{}, nil
+	case bool:
+		return cpi.KBool(tok), nil
+	case float64:
+		return cpi.KNumber(tok), nil
+	case string:
+		rt.allocate(len(tok))
+		return cpi.KString(tok), nil
+	case json.Delim:
+		if tok == '[' {
+			rt.allocateList(0)
+			list := cpi.NewKList(0)
+			for d.dec.More() {
+				v, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				rt.allocate(memValueSize)
+				list.Append(v)
+			}
+			_, err := d.dec.Token()
+			return list, err
+		}
+		rt.allocateDict(0)
+		dict := cpi.NewKDict(0)
+		for d.dec.More() {
+			key, err := d.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			rt.allocateField(dict, key.(string))
+			dict.SetField(key.(string), v)
+		}
+		_, err := d.dec.Token()
+		return dict, err
+	}
+	return nil, fmt.Errorf("unexpected token %v", tok)
+}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONEncode(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{`r = json.encode(nil)`, `null`},
+		{`r = json.encode([1, 2.5, -0.125, 1e21, true, "a\"\n\1é"])`, `[1,2.5,-0.125,1e+21,true,"a\"\n\u0001é"]`},
+		{`r = json.encode({z: 1, a: [], m: {}, "k y": "\255"})`, `{"z":1,"a":[],"m":{},"k y":"\ufffd"}`},
+		{`r = json.encode({a: 1, b: [1, {c: nil}]}, {indent: 2})`, "{\n  \"a\": 1,\n  \"b\": [\n    1,\n    {\n      \"c\": null\n    }\n  ]\n}"},
+		{`r = json.encode([ []], {indent: "\t"})`, "[\n\t[]\n]"},
+		{`shared = [1] r = json.encode({a: shared, b: shared})`, `{"a":[1],"b":[1]}`},
+	}
+	for _, test := range tests {
+		s := NewState()
+		err := s.DoString(test.script)
+		if assert.Nil(t, err, test.script) {
+			assert.Equal(t, cpi.KString(test.want), s.GetGlobal("r"), test.script)
+		}
+	}
+
+	errors := []struct {
+		script string
+		want   string
+	}{
+		{`d = {a: {}} d.a.self = d json.encode(d)`, "cannot encode cyclic dict at $.a.self"},
+		{`l = [1] l[1] = l json.encode(l)`, "cannot encode cyclic list at $[1]"},
+		{`json.encode({rows: [{f: print}]})`, "cannot encode function at $.rows[0].f"},
+		{`json.encode([math.huge])`, "cannot encode number +Inf at $[0]"},
+		{`json.encode(1, {indent: true})`, "bad argument #2 to 'json.encode' (indent must be a number or a string, got bool)"},
+	}
+	for _, test := range errors {
+		err := NewState().DoString(test.script)
+		if assert.NotNil(t, err, test.script) {
+			assert.Equal(t, test.want, err.Error(), test.script)
+		}
+	}
+}
+
+func TestJSONDecode(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	doc = json.decode(" {\"z\": 1, \"a\": [true, null, \"\\u00e9\"], \"n\": {}, \"z\": 2} ")
+	back = json.encode(doc)
+	scalar = json.decode("-1.5e2")
+	`)
+	assert.Nil(t, err)
+	doc := s.GetGlobal("doc").(cpi.KDict)
+	assert.Equal(t, "{ z:2.00, a:[true,nil,é], n:{}}", doc.Str())
+	assert.Equal(t, cpi.KString(`{"z":2,"a":[true,null,"é"],"n":{}}`), s.GetGlobal("back"))
+	assert.Equal(t, cpi.KNumber(-150), s.GetGlobal("scalar"))
+
+	errors := []struct {
+		src  string
+		want string
+	}{
+		{`{"a": }`, "invalid JSON: missing value after object key (offset 4)"},
+		{`[1, 2`, "invalid JSON: unexpected end of JSON input (offset 5)"},
+		{``, "invalid JSON: unexpected end of JSON input (offset 0)"},
+		{`1 2`, "invalid JSON: unexpected data after the top-level value (offset 3)"},
+	}
+	for _, test := range errors {
+		s := NewState()
+		s.SetGlobal("src", cpi.KString(test.src))
+		err := s.DoString(`json.decode(src)`)
+		if assert.NotNil(t, err, test.src) {
+			assert.Equal(t, test.want, err.Error(), test.src)
+		}
+	}
+
+	s.SetGlobal("src", cpi.KString(strings.Repeat("[", 2000)))
+	err = s.DoString(`json.decode(src)`)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "invalid JSON: nesting too deep (offset 1001)", err.Error())
+	}
+}
+
+func TestJSONEncodeLimits(t *testing.T) {
+	// a list shared at every level is not a cycle, but its encoding doubles
+	// with each level
+	const script = `
+	var l = [1]
+	for i = 0, 40 {
+		l = [l, l]
+	}
+	json.encode(l)
+	`
+	start := time.Now()
+	s := NewState(Options{MaxMemory: 1 << 20})
+	err := s.DoString(script)
+	assert.True(t, errors.Is(err, ErrMemoryLimit), "%v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s = NewState()
+	s.SetContext(ctx)
+	err = s.DoString(script)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
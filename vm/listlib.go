@@ -0,0 +1,232 @@
+package vm
+
+import (
+	"sort"
+
+	"github.com/khoakmp/kala/cpi"
+)
+
+// openList returns the list library. Its functions take indices from 0 like
+// the index operator, list.slice also takes negative indices counting from
+// the end of the list.
+func openList() cpi.KDict {
+	return newLib("list", []libFunc{
+		{"concat", listConcat},
+		{"filter", listFilter},
+		{"index", listIndex},
+		{"insert", listInsert},
+		{"map", listMap},
+		{"reduce", listReduce},
+		{"remove", listRemove},
+		{"reverse", listReverse},
+		{"slice", listSlice},
+		{"sort", listSort},
+	})
+}
+
+// call calls fn from a library function and returns its first result. An
+// error raised by fn aborts the library function with it.
+func (s *State) call(fn cpi.KValue, args ...cpi.KValue) cpi.KValue {
+	rets, err := s.Call(fn, args...)
+	if err != nil {
+		panic(err)
+	}
+	if len(rets) == 0 {
+		return cpi.KNil{}
+	}
+	return rets[0]
+}
+
+// newList returns a list of the values of arr, charged to the run.
+func (s *State) newList(arr []cpi.KValue) cpi.KList {
+	s.rt.allocateList(len(arr))
+	list := cpi.NewKList(len(arr))
+	list.AppendArray(arr)
+	return list
+}
+
+// values returns a copy of the values of l.
+func values(l cpi.KList) []cpi.KValue {
+	arr := make([]cpi.KValue, l.Len())
+	for i := range arr {
+		arr[i] = l.GetAt(i)
+	}
+	return arr
+}
+
+// list.sort(l, less?) sorts l in place. less(a, b) returns whether a goes
+// before b, by default numbers and strings are sorted in ascending order.
+// The sort is stable.
+func listSort(s *State) int {
+	l := s.CheckList(1)
+	var less func(a, b cpi.KValue) bool
+	if _, ok := s.Arg(2).(cpi.KNil); ok {
+		less = s.lessThan
+	} else {
+		fn := s.CheckFunction(2)
+		less = func(a, b cpi.KValue) bool {
+			return isTruthy(s.call(fn, a, b))
+		}
+	}
+	arr := values(l)
+	sort.SliceStable(arr, func(i, j int) bool {
+		return less(arr[i], arr[j])
+	})
+	for i, v := range arr {
+		l.SetAt(i, v)
+	}
+	return 0
+}
+
+// lessThan is the default order of list.sort.
+func (s *State) lessThan(a, b cpi.KValue) bool {
+	switch a := a.(type) {
+	case cpi.KNumber:
+		if b, ok := b.(cpi.KNumber); ok {
+			return a < b
+		}
+	case cpi.KString:
+		if b, ok := b.(cpi.KString); ok {
+			return a < b
+		}
+	}
+	s.RaiseError("attempt to compare %s with %s", typeName(a), typeName(b))
+	return false
+}
+
+// list.insert(l, v) appends v to l, list.insert(l, i, v) inserts v at i.
+func listInsert(s *State) int {
+	l := s.CheckList(1)
+	if s.ArgCount() < 3 {
+		s.rt.allocate(memValueSize)
+		l.Append(s.Arg(2))
+		return 0
+	}
+	i := s.CheckInteger(2)
+	if i < 0 || i > l.Len() {
+		s.RaiseError("bad argument #2 to 'list.insert' (position out of bounds)")
+	}
+	s.rt.allocate(memValueSize)
+	l.Insert(i, s.Arg(3))
+	return 0
+}
+
+// list.remove(l, i?) removes the value at i from l and returns it. i defaults
+// to the last index, removing from an empty list returns nil.
+func listRemove(s *State) int {
+	l := s.CheckList(1)
+	if _, ok := s.Arg(2).(cpi.KNil); ok {
+		if l.Len() == 0 {
+			s.Push(cpi.KNil{})
+			return 1
+		}
+		s.Push(l.Remove(l.Len() - 1))
+		return 1
+	}
+	i := s.CheckInteger(2)
+	if i < 0 || i >= l.Len() {
+		s.RaiseError("bad argument #2 to 'list.remove' (position out of bounds)")
+	}
+	s.Push(l.Remove(i))
+	return 1
+}
+
+// list.slice(l, i, j?) returns a new list of the values of l from i up to
+// but excluding j, j defaults to the length of l.
+func listSlice(s *State) int {
+	l := s.CheckList(1)
+	n := l.Len()
+	i := seqIndex(s.CheckInteger(2), n)
+	j := max(seqIndex(s.OptInteger(3, n), n), i)
+	arr := make([]cpi.KValue, j-i)
+	for k := range arr {
+		arr[k] = l.GetAt(i + k)
+	}
+	s.Push(s.newList(arr))
+	return 1
+}
+
+// list.reverse(l) reverses l in place.
+func listReverse(s *State) int {
+	l := s.CheckList(1)
+	for i, j := 0, l.Len()-1; i < j; i, j = i+1, j-1 {
+		a, b := l.GetAt(i), l.GetAt(j)
+		l.SetAt(i, b)
+		l.SetAt(j, a)
+	}
+	return 0
+}
+
+// list.concat(l, ...) returns a new list of the values of all its arguments.
+func listConcat(s *State) int {
+	var arr []cpi.KValue
+	for i := 1; i <= max(s.ArgCount(), 1); i++ {
+		arr = append(arr, values(s.CheckList(i))...)
+	}
+	s.Push(s.newList(arr))
+	return 1
+}
+
+// list.index(l, v, start?) returns the first index from start of a value
+// equal to v, as with ==, or -1.
+func listIndex(s *State) int {
+	l := s.CheckList(1)
+	v := s.Arg(2)
+	for i := max(s.OptInteger(3, 0), 0); i < l.Len(); i++ {
+		if equalValue(l.GetAt(i), v) {
+			s.Push(cpi.KNumber(i))
+			return 1
+		}
+	}
+	s.Push(cpi.KNumber(-1))
+	return 1
+}
+
+// list.map(l, f) returns the list of the results of f(v, i) for the values
+// of l.
+func listMap(s *State) int {
+	l := s.CheckList(1)
+	fn := s.CheckFunction(2)
+	var arr []cpi.KValue
+	for i := 0; i < l.Len(); i++ {
+		arr = append(arr, s.call(fn, l.GetAt(i), cpi.KNumber(i)))
+	}
+	s.Push(s.newList(arr))
+	return 1
+}
+
+// list.filter(l, f) returns the list of the values v of l for which f(v, i)
+// is true.
+func listFilter(s *State) int {
+	l := s.CheckList(1)
+	fn := s.CheckFunction(2)
+	var arr []cpi.KValue
+	for i := 0; i < l.Len(); i++ {
+		if v := l.GetAt(i); isTruthy(s.call(fn, v, cpi.KNumber(i))) {
+			arr = append(arr, v)
+		}
+	}
+	s.Push(s.newList(arr))
+	return 1
+}
+
+// list.reduce(l, f, init?) folds the values of l from the first with
+// acc = f(acc, v). Without init, acc starts as the first value of l.
+func listReduce(s *State) int {
+	l := s.CheckList(1)
+	fn := s.CheckFunction(2)
+	start := 0
+	acc := s.Arg(3)
+	if s.ArgCount() < 3 {
+		if l.Len() == 0 {
+			s.RaiseError("bad argument #1 to 'list.reduce' (empty list and no initial value)")
+		}
+		acc = l.GetAt(0)
+		start = 1
+	}
+	for i := start; i < l.Len(); i++ {
+		acc = s.call(fn, acc, l.GetAt(i))
+	}
+	s.Push(acc)
+	return 1
+}
@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListLib(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{`r = [3, 1, 2] list.sort(r)`, "[1.00,2.00,3.00]"},
+		{`r = ["b", "a", "c"] list.sort(r)`, "[a,b,c]"},
+		{`r = [2, 3, 1] list.sort(r, func(a, b) { return b < a })`, "[3.00,2.00,1.00]"},
+		{`n = 0 list.sort([1, 2], func(a, b) { n = n + 1 return a < b }) r = [n]`, "[1.00]"},
+		{`
+		r = [{k: 2, n: "a"}, {k: 1, n: "b"}, {k: 2, n: "c"}, {k: 1, n: "d"}]
+		list.sort(r, func(a, b) { return a.k < b.k })
+		r = list.map(r, func(v) { return v.n })
+		`, "[b,d,a,c]"},
+		{`r = [1, 2] list.insert(r, 3) list.insert(r, 0, 0)`, "[0.00,1.00,2.00,3.00]"},
+		{`r = [1, 2, 3] x = list.remove(r, 0) y = list.remove(r) r = [x, y, r]`, "[1.00,3.00,[2.00]]"},
+		{`r = [] r = [list.remove(r)]`, "[nil]"},
+		{`r = list.slice([0, 1, 2, 3, 4], 1, 3)`, "[1.00,2.00]"},
+		{`r = list.slice([0, 1, 2, 3, 4], -2)`, "[3.00,4.00]"},
+		{`r = list.slice([0, 1], 2, 1)`, "[]"},
+		{`r = [1, 2, 3, 4] list.reverse(r)`, "[4.00,3.00,2.00,1.00]"},
+		{`r = list.concat([1], [], [2, 3])`, "[1.00,2.00,3.00]"},
+		{`d = {} r = [list.index([1, "a", d], d), list.index([1, 2, 1], 1, 1), list.index([], 1)]`, "[2.00,2.00,-1.00]"},
+		{`r = list.map([1, 2], func(v, i) { return v * 10 + i })`, "[10.00,21.00]"},
+		{`r = list.filter([1, 2, 3, 4], func(v) { return v % 2 == 0 })`, "[2.00,4.00]"},
+		{`r = [list.reduce([1, 2, 3], func(a, v) { return a + v }), list.reduce([], func(a, v) { return a }, 7)]`, "[6.00,7.00]"},
+	}
+	for _, test := range tests {
+		s := NewState()
+		err := s.DoString(test.script)
+		if assert.Nil(t, err, test.script) {
+			assert.Equal(t, test.want, s.GetGlobal("r").Str(), test.script)
+		}
+	}
+
+	errors := []struct {
+		script string
+		want   string
+	}{
+		{`list.sort([1, "a"])`, "attempt to compare string with number"},
+		{`list.sort([2, 1], func(a, b) { return a.x })`, "attempt to index a non-dict value (GETTABLEKS: number, string)"},
+		{`list.insert([], 2, 1)`, "bad argument #2 to 'list.insert' (position out of bounds)"},
+		{`list.remove([1], 1)`, "bad argument #2 to 'list.remove' (position out of bounds)"},
+		{`list.reduce([], func(a, v) { return a })`, "bad argument #1 to 'list.reduce' (empty list and no initial value)"},
+		{`list.map([1], 1)`, "bad argument #2 to 'list.map' (function expected, got number)"},
+	}
+	for _, test := range errors {
+		err := NewState().DoString(test.script)
+		if assert.NotNil(t, err, test.script) {
+			assert.Equal(t, test.want, err.Error(), test.script)
+		}
+	}
+}
+
+func TestListCallbackError(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	ok, e = pcall(list.map, [1, 2], func(v) { error("bad value", "validation") })
+	r = list.map([1, 2], func(v) { return v + 1 })
+	`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KBool(false), s.GetGlobal("ok"))
+	e := s.GetGlobal("e").(cpi.KDict)
+	assert.Equal(t, cpi.KString("bad value"), e.GetField("message"))
+	assert.Equal(t, cpi.KString("validation"), e.GetField("kind"))
+	assert.Equal(t, "[2.00,3.00]", s.GetGlobal("r").Str())
+	assert.Equal(t, 0, s.rt.stackValue.top)
+}
+
+func TestDictLib(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	d = {a: 1, b: 2, c: 3}
+	keys = dict.keys(d)
+	old = dict.delete(d, "b")
+	missing = dict.delete(d, "z")
+	d.b = 4
+	after = dict.keys(d)
+	vals = dict.values(d)
+	has = [dict.has(d, "a"), dict.has(d, "z")]
+	`)
+	assert.Nil(t, err)
+	assert.Equal(t, "[a,b,c]", s.GetGlobal("keys").Str())
+	assert.Equal(t, cpi.KNumber(2), s.GetGlobal("old"))
+	assert.Equal(t, cpi.KNil{}, s.GetGlobal("missing"))
+	assert.Equal(t, "[a,c,b]", s.GetGlobal("after").Str())
+	assert.Equal(t, "[1.00,3.00,4.00]", s.GetGlobal("vals").Str())
+	assert.Equal(t, "[true,false]", s.GetGlobal("has").Str())
+	d := s.GetGlobal("d").(cpi.KDict)
+	assert.Equal(t, 3, d.Len())
+}
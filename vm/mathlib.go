@@ -0,0 +1,181 @@
+package vm
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/khoakmp/kala/cpi"
+)
+
+// maxSafeInteger is the largest integer n such that all the integers in
+// [-n, n] are exactly represented by a KNumber.
+const maxSafeInteger = 1 << 53
+
+// isInteger reports whether v has an integer value which is exactly
+// represented, and so can be converted to an int and back without loss.
+func isInteger(v float64) bool {
+	return v == math.Trunc(v) && math.Abs(v) <= maxSafeInteger
+}
+
+// newRandom returns the generator used by math.random, seeded with seed.
+func newRandom(seed uint64) *rand.Rand {
+	return rand.New(rand.NewPCG(seed, seed))
+}
+
+// SetRandomSeed reseeds the generator of math.random, the following runs draw
+// the same numbers for the same seed. A State is otherwise seeded randomly.
+func (s *State) SetRandomSeed(seed int64) {
+	s.rt.random = newRandom(uint64(seed))
+}
+
+// openMath returns the math library.
+func openMath() cpi.KDict {
+	lib := newLib("math", []libFunc{
+		{"abs", mathFunc(math.Abs)},
+		{"acos", mathFunc(math.Acos)},
+		{"asin", mathFunc(math.Asin)},
+		{"atan", mathAtan},
+		{"ceil", mathFunc(math.Ceil)},
+		{"cos", mathFunc(math.Cos)},
+		{"exp", mathFunc(math.Exp)},
+		{"floor", mathFunc(math.Floor)},
+		{"isinteger", mathIsInteger},
+		{"log", mathLog},
+		{"max", mathMax},
+		{"min", mathMin},
+		{"pow", mathPow},
+		{"random", mathRandom},
+		{"randomseed", mathRandomSeed},
+		{"round", mathFunc(math.Round)},
+		{"sin", mathFunc(math.Sin)},
+		{"sqrt", mathFunc(math.Sqrt)},
+		{"tan", mathFunc(math.Tan)},
+		{"tointeger", mathToInteger},
+	})
+	lib.SetField("huge", cpi.KNumber(math.Inf(1)))
+	lib.SetField("pi", cpi.KNumber(math.Pi))
+	return lib
+}
+
+// mathFunc returns the library function applying f to its number argument.
+func mathFunc(f func(float64) float64) HostFunc {
+	return func(s *State) int {
+		s.Push(cpi.KNumber(f(s.CheckNumber(1))))
+		return 1
+	}
+}
+
+// math.atan(y, x?) returns the arc tangent of y/x, using the signs of both
+// to find the quadrant. x defaults to 1.
+func mathAtan(s *State) int {
+	s.Push(cpi.KNumber(math.Atan2(s.CheckNumber(1), s.OptNumber(2, 1))))
+	return 1
+}
+
+// math.log(x, base?) returns the logarithm of x in base, e by default.
+func mathLog(s *State) int {
+	x := s.CheckNumber(1)
+	if _, ok := s.Arg(2).(cpi.KNil); ok {
+		s.Push(cpi.KNumber(math.Log(x)))
+		return 1
+	}
+	var v float64
+	switch base := s.CheckNumber(2); base {
+	case 2:
+		v = math.Log2(x)
+	case 10:
+		v = math.Log10(x)
+	default:
+		v = math.Log(x) / math.Log(base)
+	}
+	s.Push(cpi.KNumber(v))
+	return 1
+}
+
+func mathPow(s *State) int {
+	s.Push(cpi.KNumber(math.Pow(s.CheckNumber(1), s.CheckNumber(2))))
+	return 1
+}
+
+// math.min(x, ...) returns the smallest of its arguments.
+func mathMin(s *State) int {
+	v := s.CheckNumber(1)
+	for i := 2; i <= s.ArgCount(); i++ {
+		v = math.Min(v, s.CheckNumber(i))
+	}
+	s.Push(cpi.KNumber(v))
+	return 1
+}
+
+// math.max(x, ...) returns the largest of its arguments.
+func mathMax(s *State) int {
+	v := s.CheckNumber(1)
+	for i := 2; i <= s.ArgCount(); i++ {
+		v = math.Max(v, s.CheckNumber(i))
+	}
+	s.Push(cpi.KNumber(v))
+	return 1
+}
+
+// math.random() returns a number in [0, 1), math.random(n) an integer in
+// [0, n) and math.random(m, n) an integer in [m, n).
+func mathRandom(s *State) int {
+	r := s.rt.random
+	var lo, hi int
+	switch s.ArgCount() {
+	case 0:
+		s.Push(cpi.KNumber(r.Float64()))
+		return 1
+	case 1:
+		hi = s.CheckInteger(1)
+	default:
+		lo, hi = s.CheckInteger(1), s.CheckInteger(2)
+	}
+	if lo >= hi {
+		s.RaiseError("bad argument #%d to 'math.random' (interval is empty)", s.ArgCount())
+	}
+	s.Push(cpi.KNumber(lo + r.IntN(hi-lo)))
+	return 1
+}
+
+// math.randomseed(n) reseeds the generator of math.random.
+func mathRandomSeed(s *State) int {
+	s.SetRandomSeed(int64(s.CheckInteger(1)))
+	return 0
+}
+
+// math.tointeger(x) returns x if it is an integer, or the integer written in
+// the string x, nil otherwise.
+func mathToInteger(s *State) int {
+	var v float64
+	switch x := s.Arg(1).(type) {
+	case cpi.KNumber:
+		v = float64(x)
+	case cpi.KString:
+		n, err := strconv.ParseFloat(strings.TrimSpace(string(x)), 64)
+		if err != nil {
+			s.Push(cpi.KNil{})
+			return 1
+		}
+		v = n
+	default:
+		s.Push(cpi.KNil{})
+		return 1
+	}
+	if !isInteger(v) {
+		s.Push(cpi.KNil{})
+		return 1
+	}
+	s.Push(cpi.KNumber(v))
+	return 1
+}
+
+// math.isinteger(x) reports whether x is a number with an integer value
+// small enough to be exact, i.e. in [-2^53, 2^53].
+func mathIsInteger(s *State) int {
+	v, ok := s.Arg(1).(cpi.KNumber)
+	s.Push(cpi.KBool(ok && isInteger(float64(v))))
+	return 1
+}
@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMathLib(t *testing.T) {
+	tests := []struct {
+		expr string
+		want cpi.KValue
+	}{
+		{`math.floor(-2.5)`, cpi.KNumber(-3)},
+		{`math.ceil(2.1)`, cpi.KNumber(3)},
+		{`math.round(2.5)`, cpi.KNumber(3)},
+		{`math.round(-2.5)`, cpi.KNumber(-3)},
+		{`math.abs(-4)`, cpi.KNumber(4)},
+		{`math.min(3, 1, 2)`, cpi.KNumber(1)},
+		{`math.max(3, 1, 2)`, cpi.KNumber(3)},
+		{`math.sqrt(16)`, cpi.KNumber(4)},
+		{`math.pow(2, 10)`, cpi.KNumber(1024)},
+		{`math.log(1000, 10)`, cpi.KNumber(3)},
+		{`math.log(8, 2)`, cpi.KNumber(3)},
+		{`math.log(math.exp(2))`, cpi.KNumber(2)},
+		{`math.cos(0)`, cpi.KNumber(1)},
+		{`math.atan(1, -1)`, cpi.KNumber(3 * math.Pi / 4)},
+		{`math.huge`, cpi.KNumber(math.Inf(1))},
+		{`-math.huge < -1e308`, cpi.KBool(true)},
+		{`math.pi`, cpi.KNumber(math.Pi)},
+		{`math.tointeger(3)`, cpi.KNumber(3)},
+		{`math.tointeger(3.5)`, cpi.KNil{}},
+		{`math.tointeger(" 42 ")`, cpi.KNumber(42)},
+		{`math.tointeger("4x")`, cpi.KNil{}},
+		{`math.tointeger(true)`, cpi.KNil{}},
+		{`math.isinteger(-7)`, cpi.KBool(true)},
+		{`math.isinteger(0.5)`, cpi.KBool(false)},
+		{`math.isinteger(math.huge)`, cpi.KBool(false)},
+		{`math.isinteger(1e300)`, cpi.KBool(false)},
+		{`math.isinteger("1")`, cpi.KBool(false)},
+	}
+	for _, test := range tests {
+		s := NewState()
+		err := s.DoString("r = " + test.expr)
+		if assert.Nil(t, err, test.expr) {
+			got := s.GetGlobal("r")
+			if want, ok := test.want.(cpi.KNumber); ok && want != got {
+				assert.InDelta(t, float64(want), float64(got.(cpi.KNumber)), 1e-12, test.expr)
+				continue
+			}
+			assert.Equal(t, test.want, got, test.expr)
+		}
+	}
+
+	errors := []struct {
+		expr string
+		want string
+	}{
+		{`math.floor("1")`, "bad argument #1 to 'math.floor' (number expected, got string)"},
+		{`math.max()`, "bad argument #1 to 'math.max' (number expected, got nil)"},
+		{`math.random(0)`, "bad argument #1 to 'math.random' (interval is empty)"},
+		{`math.random(5, 5)`, "bad argument #2 to 'math.random' (interval is empty)"},
+		{`math.random(1.5)`, "bad argument #1 to 'math.random' (number has no integer representation)"},
+	}
+	for _, test := range errors {
+		err := NewState().DoString("r = " + test.expr)
+		if assert.NotNil(t, err, test.expr) {
+			assert.Equal(t, test.want, err.Error(), test.expr)
+		}
+	}
+}
+
+func TestMathRandom(t *testing.T) {
+	script := `
+	r = []
+	for i = 0, 100 {
+		r[i] = math.random(-3, 3)
+	}
+	f = math.random()
+	`
+	draw := func(s *State) cpi.KList {
+		assert.Nil(t, s.DoString(script))
+		f := s.GetGlobal("f").(cpi.KNumber)
+		assert.True(t, 0 <= f && f < 1)
+		return s.GetGlobal("r").(cpi.KList)
+	}
+
+	s1, s2 := NewState(), NewState()
+	s1.SetRandomSeed(42)
+	s2.SetRandomSeed(42)
+	r := draw(s1)
+	assert.Equal(t, r, draw(s2))
+	seen := map[cpi.KValue]bool{}
+	for i := range r.Len() {
+		v := r.GetAt(i).(cpi.KNumber)
+		assert.True(t, -3 <= v && v < 3)
+		seen[v] = true
+	}
+	assert.Len(t, seen, 6)
+
+	// reseeding from the script replays the same numbers
+	assert.Nil(t, s1.DoString(`math.randomseed(7) a = math.random(1000) math.randomseed(7) b = math.random(1000)`))
+	assert.Equal(t, s1.GetGlobal("a"), s1.GetGlobal("b"))
+}
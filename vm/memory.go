@@ -0,0 +1,37 @@
+package vm
+
+import "github.com/khoakmp/kala/cpi"
+
+// Approximate sizes in bytes of the values allocated by scripts, charged to
+// Options.MaxMemory. They only need to be of the right order of magnitude.
+const (
+	memValueSize     = 16 // one KValue slot of a list or of the stack
+	memListSize      = 32
+	memDictSize      = 64
+	memDictEntrySize = 48 // map entry, key header and slot in the key order
+	memClosureSize   = 64
+	memUpvalueSize   = 8
+)
+
+// allocate charges n bytes to the current run.
+func (s *RuntimeState) allocate(n int) {
+	s.memUsed += int64(n)
+	if s.options.MaxMemory > 0 && s.memUsed > s.options.MaxMemory {
+		s.abort(ErrMemoryLimit)
+	}
+}
+
+func (s *RuntimeState) allocateList(n int) {
+	s.allocate(memListSize + n*memValueSize)
+}
+
+func (s *RuntimeState) allocateDict(n int) {
+	s.allocate(memDictSize + n*memDictEntrySize)
+}
+
+// allocateField charges the entry for key when it is not yet in dict.
+func (s *RuntimeState) allocateField(dict cpi.KDict, key string) {
+	if !dict.Has(key) {
+		s.allocate(memDictEntrySize + len(key))
+	}
+}
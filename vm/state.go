@@ -2,7 +2,9 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"math/rand/v2"
 
 	"github.com/khoakmp/kala/cpi"
 )
@@ -45,8 +47,9 @@ func (u *UpValue) Close(stack *StackValue) {
 
 // Stack of all local variable across func call stack
 type StackValue struct {
-	array []cpi.KValue
-	top   int // the position ready to write new value
+	array  []cpi.KValue
+	top    int             // the position ready to write new value
+	onGrow func(bytes int) // called after the array is reallocated
 }
 
 func newStackValue() *StackValue {
@@ -60,10 +63,17 @@ func (s *StackValue) CheckSize(minSize int) {
 	if len(s.array) >= minSize {
 		return
 	}
+	size := len(s.array) << 1
+	for size < minSize {
+		size <<= 1
+	}
 
-	arr := make([]cpi.KValue, len(s.array)<<1)
+	arr := make([]cpi.KValue, size)
 	copy(arr, s.array[:s.top])
 	s.array = arr
+	if s.onGrow != nil {
+		s.onGrow(size * memValueSize)
+	}
 }
 
 func (s *StackValue) Push(v cpi.KValue) {
@@ -98,7 +108,7 @@ func (s *StackValue) Set(idx int, v cpi.KValue) {
 }
 
 func (s *StackValue) Get(idx int) cpi.KValue {
-	if s.top <= idx {
+	if s.top <= idx || s.array[idx] == nil {
 		return cpi.KNil{}
 	}
 	return s.array[idx]
@@ -129,6 +139,7 @@ type ClosureFunc struct {
 	Proto    *cpi.FuncProto
 	Upvalues []*UpValue
 	GF       GlobalFunc
+	Name     string // name of a host function, used in tracebacks
 }
 
 func (c *ClosureFunc) Type() int {
@@ -139,6 +150,17 @@ func (c *ClosureFunc) Str() string {
 	return "closure"
 }
 
+// FuncName returns the debug name of the function.
+func (c *ClosureFunc) FuncName() string {
+	if c.IsGlobal {
+		if c.Name == "" {
+			return "host function"
+		}
+		return c.Name
+	}
+	return c.Proto.Name
+}
+
 func NewLocalClosure(proto *cpi.FuncProto) *ClosureFunc {
 	return &ClosureFunc{
 		IsGlobal: false,
@@ -169,6 +191,71 @@ func EmbeddedPrint(s *RuntimeState) {
 	cf.NumRetValue = 0
 }
 
+// EmbeddedError raises an error whose message is its first argument and
+// whose kind is its second one, "error" by default. A value which is not a
+// string is kept in the error, a dict caught by pcall is raised again with
+// its message and kind.
+func EmbeddedError(s *RuntimeState) {
+	cf := s.currentFrame
+	v := s.stackValue.Get(cf.LocalBase)
+	msg, kind := v.Str(), "error"
+	switch v := v.(type) {
+	case cpi.KString:
+		msg = string(v)
+	case cpi.KDict:
+		if m, ok := v.GetField("message").(cpi.KString); ok {
+			msg = string(m)
+			if k, ok := v.GetField("kind").(cpi.KString); ok {
+				kind = string(k)
+			}
+		}
+	}
+	if cf.NumArg > 1 {
+		k, ok := s.stackValue.Get(cf.LocalBase + 1).(cpi.KString)
+		if !ok {
+			s.RaiseHostError("bad argument #2 to 'error' (string expected, got %s)", typeName(s.stackValue.Get(cf.LocalBase+1)))
+		}
+		kind = string(k)
+	}
+	err := s.newError(NoOpcode, msg, nil)
+	err.Kind = kind
+	err.Value = v
+	panic(err)
+}
+
+// EmbeddedPCall calls its first argument with the other ones in protected
+// mode. It returns true and the results of the call, or false and the error
+// as a dict with message, kind and traceback. The frames of the failed call
+// are unwound, its upvalues closed and the stack restored. The errors which
+// stop the script for the host, those with a Cause, are not caught.
+func EmbeddedPCall(s *RuntimeState) {
+	cf := s.currentFrame
+	if cf.NumArg == 0 {
+		s.RaiseHostError("bad argument #1 to 'pcall' (value expected)")
+	}
+	fn := s.stackValue.Get(cf.LocalBase)
+	args := s.stackValue.CopyRange(cf.LocalBase+1, cf.NumArg-1)
+	rets, err := s.state.Call(fn, args...)
+	if err != nil {
+		rerr := err.(*RuntimeError)
+		if rerr.Cause != nil {
+			panic(rerr)
+		}
+		s.stackValue.Push(cpi.KBool(false))
+		s.stackValue.Push(rerr.dict())
+		cf.NumRetValue = 2
+		return
+	}
+	s.stackValue.Push(cpi.KBool(true))
+	for _, v := range rets {
+		s.stackValue.Push(v)
+	}
+	cf.NumRetValue = 1 + len(rets)
+}
+
+// GlobalFunc is a function implemented by the host. Its arguments are the
+// NumArg values from the LocalBase of the current frame. It returns values by
+// pushing them on the stack and setting NumRetValue of the frame to their count.
 type GlobalFunc func(s *RuntimeState)
 
 type CallFrame struct {
@@ -179,6 +266,9 @@ type CallFrame struct {
 	PC          int
 	NumArg      int
 	NumRetValue int
+
+	// line and pc of the last instruction seen by the debugger hook
+	hookLine, hookPC int
 }
 
 func newCallFrame(base, localBase, retBase, numRetValue int, closure *ClosureFunc) *CallFrame {
@@ -226,11 +316,40 @@ type RuntimeState struct {
 	currentFrame   *CallFrame
 	firstUV        *UpValue
 	Global         cpi.KDict
+	state          *State // embedding API handle passed to HostFuncs
+
+	options  Options
+	ctx      context.Context
+	numInsts int64                 // instructions executed by the current run
+	memUsed  int64                 // bytes allocated by the current run, see memory.go
+	hook     func(s *RuntimeState) // called before each instruction, see Debugger
+	random   *rand.Rand            // generator of math.random
 }
 
 func (s *RuntimeState) CallGFunction() {
 	cf := s.currentFrame
+	stack := s.stackValue
+	want := cf.NumRetValue
+
+	// values pushed by the function go right after its arguments
+	stack.CheckSize(cf.LocalBase + cf.NumArg)
+	stack.Clear(cf.LocalBase+cf.NumArg, stack.top)
+	stack.top = cf.LocalBase + cf.NumArg
+	cf.NumRetValue = 0
 	cf.Closure.GF(s)
+
+	nret := cf.NumRetValue
+	results := stack.CopyRange(stack.top-nret, nret)
+	if want >= 0 {
+		for len(results) < want {
+			results = append(results, cpi.KNil{})
+		}
+		results = results[:want]
+	}
+	stack.SetRange(cf.ReturnBase, results)
+	stack.Clear(cf.ReturnBase+len(results), stack.top)
+	stack.top = cf.ReturnBase + len(results)
+
 	s.stackCallFrame.Pop()
 	s.currentFrame = s.stackCallFrame.Last()
 }
@@ -240,14 +359,38 @@ func (s *RuntimeState) LastFrame() *CallFrame {
 }
 
 func CreateGlobal() cpi.KDict {
-	dict := cpi.NewKDict(1)
-	dict.SetField("print", NewGlobalClosure(EmbeddedPrint))
+	builtins := []struct {
+		name string
+		fn   GlobalFunc
+	}{
+		{"print", EmbeddedPrint},
+		{"error", EmbeddedError},
+		{"pcall", EmbeddedPCall},
+	}
+	dict := cpi.NewKDict(len(builtins))
+	for _, b := range builtins {
+		closure := NewGlobalClosure(b.fn)
+		closure.Name = b.name
+		dict.SetField(b.name, closure)
+	}
+	dict.SetField("string", openString())
+	dict.SetField("math", openMath())
+	dict.SetField("list", openList())
+	dict.SetField("dict", openDict())
+	dict.SetField("json", openJSON())
 	return dict
 }
 
-func NewRState() *RuntimeState {
-
-	return &RuntimeState{
+func NewRState(opts ...Options) *RuntimeState {
+	options := Options{}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if options.MaxCallDepth <= 0 {
+		options.MaxCallDepth = DefaultMaxCallDepth
+	}
+	s := &RuntimeState{
+		options:    options,
 		stackValue: newStackValue(),
 		stackCallFrame: StackCallFrame{
 			array: make([]*CallFrame, 0, 1),
@@ -255,7 +398,11 @@ func NewRState() *RuntimeState {
 		currentFrame: nil,
 		firstUV:      nil,
 		Global:       CreateGlobal(),
+		random:       newRandom(rand.Uint64()),
 	}
+	s.state = &State{rt: s}
+	s.stackValue.onGrow = s.allocate
+	return s
 }
 func (s *RuntimeState) CloseUpvalues(startIndex int) {
 	//fmt.Println("Close upvalues from", startIndex)
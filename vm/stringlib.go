@@ -0,0 +1,343 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/khoakmp/kala/cpi"
+)
+
+// libFunc is a function of a library dict such as string.
+type libFunc struct {
+	name string
+	fn   HostFunc
+}
+
+// newLib returns the dict of the library name. Its functions are named
+// "name.fn" in error messages and tracebacks.
+func newLib(name string, funcs []libFunc) cpi.KDict {
+	dict := cpi.NewKDict(len(funcs))
+	for _, f := range funcs {
+		dict.SetField(f.name, newHostFunction(name+"."+f.name, f.fn))
+	}
+	return dict
+}
+
+// openString returns the string library. Indices count runes from 0, a
+// negative index counts from the end of the string. Bytes which are not
+// valid UTF-8 count as one rune each and are kept as is.
+func openString() cpi.KDict {
+	return newLib("string", []libFunc{
+		{"endswith", strEndsWith},
+		{"find", strFind},
+		{"format", strFormat},
+		{"join", strJoin},
+		{"len", strLen},
+		{"lower", strLower},
+		{"repeat", strRepeat},
+		{"replace", strReplace},
+		{"split", strSplit},
+		{"startswith", strStartsWith},
+		{"sub", strSub},
+		{"trim", strTrim},
+		{"upper", strUpper},
+	})
+}
+
+// pushString pushes a string built by a library function, charging its
+// bytes to the run.
+func (s *State) pushString(str string) {
+	s.rt.allocate(len(str))
+	s.Push(cpi.KString(str))
+}
+
+// seqIndex converts the index i in a string of n runes or a list of n values,
+// which counts from the end if negative, into an index in [0, n].
+func seqIndex(i, n int) int {
+	if i < 0 {
+		i += n
+	}
+	return min(max(i, 0), n)
+}
+
+// runeOffset returns the byte offset of the i-th rune of str.
+func runeOffset(str string, i int) int {
+	off := 0
+	for ; i > 0 && off < len(str); i-- {
+		_, size := utf8.DecodeRuneInString(str[off:])
+		off += size
+	}
+	return off
+}
+
+// string.len(s) returns the number of runes of s.
+func strLen(s *State) int {
+	s.Push(cpi.KNumber(utf8.RuneCountInString(s.CheckString(1))))
+	return 1
+}
+
+// string.sub(s, i, j?) returns the runes of s from i up to but excluding j,
+// j defaults to the end of s.
+func strSub(s *State) int {
+	str := s.CheckString(1)
+	n := utf8.RuneCountInString(str)
+	i := seqIndex(s.CheckInteger(2), n)
+	j := seqIndex(s.OptInteger(3, n), n)
+	if i >= j {
+		s.Push(cpi.KString(""))
+		return 1
+	}
+	start := runeOffset(str, i)
+	end := start + runeOffset(str[start:], j-i)
+	s.pushString(str[start:end])
+	return 1
+}
+
+func strUpper(s *State) int {
+	s.pushString(strings.ToUpper(s.CheckString(1)))
+	return 1
+}
+
+func strLower(s *State) int {
+	s.pushString(strings.ToLower(s.CheckString(1)))
+	return 1
+}
+
+// string.trim(s, cutset?) removes the leading and trailing runes of s which
+// are in cutset, white space by default.
+func strTrim(s *State) int {
+	str := s.CheckString(1)
+	if _, ok := s.Arg(2).(cpi.KNil); ok {
+		s.Push(cpi.KString(strings.TrimSpace(str)))
+		return 1
+	}
+	s.Push(cpi.KString(strings.Trim(str, s.CheckString(2))))
+	return 1
+}
+
+// string.split(s, sep, n?) returns the list of the substrings of s between
+// the occurrences of sep, at most n of them if n is positive. An empty sep
+// splits s into its runes.
+func strSplit(s *State) int {
+	str := s.CheckString(1)
+	sep := s.CheckString(2)
+	parts := strings.SplitN(str, sep, s.OptInteger(3, -1))
+	s.rt.allocateList(len(parts))
+	s.rt.allocate(len(str))
+	list := cpi.NewKList(len(parts))
+	for _, p := range parts {
+		list.Append(cpi.KString(p))
+	}
+	s.Push(list)
+	return 1
+}
+
+// string.join(list, sep?) concatenates the strings of list, separated by sep.
+func strJoin(s *State) int {
+	list := s.CheckList(1)
+	sep := s.OptString(2, "")
+	parts := make([]string, list.Len())
+	for i := range parts {
+		v, ok := list.GetAt(i).(cpi.KString)
+		if !ok {
+			s.RaiseError("bad argument #1 to 'string.join' (string expected at index %d, got %s)",
+				i, typeName(list.GetAt(i)))
+		}
+		parts[i] = string(v)
+	}
+	s.pushString(strings.Join(parts, sep))
+	return 1
+}
+
+// string.replace(s, old, new, n?) replaces the first n occurrences of old in
+// s by new, all of them if n is missing or negative.
+func strReplace(s *State) int {
+	str := s.CheckString(1)
+	old := s.CheckString(2)
+	repl := s.CheckString(3)
+	n := s.OptInteger(4, -1)
+	if n < 0 {
+		n = strings.Count(str, old)
+	}
+	if n > 0 && len(repl) > len(old) {
+		s.rt.allocate(n * (len(repl) - len(old)))
+	}
+	s.pushString(strings.Replace(str, old, repl, n))
+	return 1
+}
+
+// string.find(s, sub, start?) returns the index of the first occurrence of
+// sub in s from start, -1 if there is none.
+func strFind(s *State) int {
+	str := s.CheckString(1)
+	sub := s.CheckString(2)
+	start := seqIndex(s.OptInteger(3, 0), utf8.RuneCountInString(str))
+	off := runeOffset(str, start)
+	i := strings.Index(str[off:], sub)
+	if i < 0 {
+		s.Push(cpi.KNumber(-1))
+		return 1
+	}
+	s.Push(cpi.KNumber(start + utf8.RuneCountInString(str[off:off+i])))
+	return 1
+}
+
+func strStartsWith(s *State) int {
+	s.Push(cpi.KBool(strings.HasPrefix(s.CheckString(1), s.CheckString(2))))
+	return 1
+}
+
+func strEndsWith(s *State) int {
+	s.Push(cpi.KBool(strings.HasSuffix(s.CheckString(1), s.CheckString(2))))
+	return 1
+}
+
+// string.repeat(s, n, sep?) returns n copies of s separated by sep.
+func strRepeat(s *State) int {
+	str := s.CheckString(1)
+	n := s.CheckInteger(2)
+	sep := s.OptString(3, "")
+	if n <= 0 {
+		s.Push(cpi.KString(""))
+		return 1
+	}
+	if size := len(str) + len(sep); size > 0 && n > math.MaxInt32/size {
+		s.RaiseError("resulting string too large")
+	}
+	s.rt.allocate(n*len(str) + (n-1)*len(sep))
+	if sep == "" {
+		s.Push(cpi.KString(strings.Repeat(str, n)))
+		return 1
+	}
+	s.Push(cpi.KString(strings.Repeat(str+sep, n-1) + str))
+	return 1
+}
+
+// string.format(fmt, ...) formats its arguments like printf. A verb is
+// written %[flags][width][.precision]verb with the flags "-+ #0" and the
+// verbs:
+//
+//	d, i    integer in base 10
+//	o, x, X integer in base 8 or 16
+//	c       the rune of an integer code point
+//	e, E, f, F, g, G  number
+//	s       the string of any value, as printed by print
+//	q       a string quoted as a script literal
+//	%       a literal %
+func strFormat(s *State) int {
+	format := s.CheckString(1)
+	buf := &chargedWriter{rt: s.rt}
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			buf.WriteByte(c)
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && isDigit(format[i]) {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			for i < len(format) && isDigit(format[i]) {
+				i++
+			}
+		}
+		if i >= len(format) {
+			s.RaiseError("invalid conversion '%s' to 'string.format'", format[start:])
+		}
+		spec, verb := format[start:i], format[i]
+		if verb == '%' {
+			if i != start+1 {
+				s.RaiseError("invalid conversion '%s' to 'string.format'", format[start:i+1])
+			}
+			buf.WriteByte('%')
+			continue
+		}
+		arg++
+		if arg > s.ArgCount() {
+			s.RaiseError("bad argument #%d to 'string.format' (no value)", arg)
+		}
+		switch verb {
+		case 'd', 'i':
+			fmt.Fprintf(buf, spec+"d", s.CheckInteger(arg))
+		case 'o', 'x', 'X':
+			fmt.Fprintf(buf, spec+string(verb), s.CheckInteger(arg))
+		case 'c':
+			fmt.Fprintf(buf, spec+"c", rune(s.CheckInteger(arg)))
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			fmt.Fprintf(buf, spec+string(verb), s.CheckNumber(arg))
+		case 's':
+			if spec == "%" {
+				cpi.WriteStr(buf, s.Arg(arg))
+				break
+			}
+			str := &chargedWriter{rt: s.rt}
+			cpi.WriteStr(str, s.Arg(arg))
+			fmt.Fprintf(buf, spec+"s", str.buf.String())
+		case 'q':
+			fmt.Fprintf(buf, spec+"s", quoteString(s.CheckString(arg)))
+		default:
+			s.RaiseError("invalid conversion '%s' to 'string.format'", format[start:i+1])
+		}
+	}
+	s.Push(cpi.KString(buf.buf.String()))
+	return 1
+}
+
+// chargedWriter collects the output of a library function, charging each
+// piece to the run before keeping it.
+type chargedWriter struct {
+	rt  *RuntimeState
+	buf strings.Builder
+}
+
+func (w *chargedWriter) Write(p []byte) (int, error) {
+	w.rt.allocate(len(p))
+	return w.buf.Write(p)
+}
+
+func (w *chargedWriter) WriteByte(c byte) error {
+	w.rt.allocate(1)
+	return w.buf.WriteByte(c)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// quoteString returns str as a double quoted string literal which reads back
+// as str.
+func quoteString(str string) string {
+	buf := &strings.Builder{}
+	buf.WriteByte('"')
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		switch c := str[i]; {
+		case r == utf8.RuneError && size <= 1, c < ' ' && c != '\n' && c != '\r' && c != '\t', c == 0x7f:
+			// 3 digits, so that a following digit is not read as part of it
+			fmt.Fprintf(buf, `\%03d`, c)
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		default:
+			buf.WriteString(str[i : i+size])
+		}
+		i += size
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
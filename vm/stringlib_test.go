@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/khoakmp/kala/cpi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringLib(t *testing.T) {
+	tests := []struct {
+		expr string
+		want cpi.KValue
+	}{
+		{`string.len("héllo")`, cpi.KNumber(5)},
+		{`string.len("a\255b")`, cpi.KNumber(3)},
+		{`string.sub("héllo", 1, 3)`, cpi.KString("él")},
+		{`string.sub("héllo", -3)`, cpi.KString("llo")},
+		{`string.sub("héllo", 3, 1)`, cpi.KString("")},
+		{`string.sub("héllo", 0, 99)`, cpi.KString("héllo")},
+		{`string.sub("a\255b", 1, 2)`, cpi.KString("\xff")},
+		{`string.upper("héllo")`, cpi.KString("HÉLLO")},
+		{`string.lower("ÉTÉ")`, cpi.KString("été")},
+		{`string.trim("  a b \n")`, cpi.KString("a b")},
+		{`string.trim("--a-", "-")`, cpi.KString("a")},
+		{`string.replace("a.b.c", ".", "::")`, cpi.KString("a::b::c")},
+		{`string.replace("a.b.c", ".", "", 1)`, cpi.KString("ab.c")},
+		{`string.find("héllo", "l")`, cpi.KNumber(2)},
+		{`string.find("héllo", "l", 3)`, cpi.KNumber(3)},
+		{`string.find("héllo", "z")`, cpi.KNumber(-1)},
+		{`string.startswith("héllo", "hé")`, cpi.KBool(true)},
+		{`string.endswith("héllo", "x")`, cpi.KBool(false)},
+		{`string.repeat("ab", 3)`, cpi.KString("ababab")},
+		{`string.repeat("ab", 3, ", ")`, cpi.KString("ab, ab, ab")},
+		{`string.repeat("ab", 0)`, cpi.KString("")},
+		{`string.join(string.split("a,b,,c", ","), "|")`, cpi.KString("a|b||c")},
+		{`#string.split("a,b,c", ",", 2)`, cpi.KNumber(2)},
+		{`string.join(string.split("hé", ""), " ")`, cpi.KString("h é")},
+		{`string.join([])`, cpi.KString("")},
+		{`string.format("%d items, %5.1f%%", 3, 2.25)`, cpi.KString("3 items,   2.2%")},
+		{`string.format("%-4s|%x|%c", "é", 255, 233)`, cpi.KString("é   |ff|é")},
+		{`string.format("%s %s %s", 1, true, nil)`, cpi.KString("1.00 true nil")},
+		{`string.format("%q", "a\"b\n\1")`, cpi.KString(`"a\"b\n\001"`)},
+	}
+	for _, test := range tests {
+		s := NewState()
+		err := s.DoString("r = " + test.expr)
+		if assert.Nil(t, err, test.expr) {
+			assert.Equal(t, test.want, s.GetGlobal("r"), test.expr)
+		}
+	}
+
+	errors := []struct {
+		expr string
+		want string
+	}{
+		{`string.upper(1)`, "bad argument #1 to 'string.upper' (string expected, got number)"},
+		{`string.sub("abc", 1.5)`, "bad argument #2 to 'string.sub' (number has no integer representation)"},
+		{`string.join(["a", 1])`, "bad argument #1 to 'string.join' (string expected at index 1, got number)"},
+		{`string.format("%d", 1.5)`, "bad argument #2 to 'string.format' (number has no integer representation)"},
+		{`string.format("%d %d", 1)`, "bad argument #3 to 'string.format' (no value)"},
+		{`string.format("%y", 1)`, "invalid conversion '%y' to 'string.format'"},
+		{`string.format("50%")`, "invalid conversion '%' to 'string.format'"},
+	}
+	for _, test := range errors {
+		err := NewState().DoString("r = " + test.expr)
+		if assert.NotNil(t, err, test.expr) {
+			assert.Equal(t, test.want, err.Error(), test.expr)
+		}
+	}
+}
+
+func TestStringLibMemory(t *testing.T) {
+	s := NewState(Options{MaxMemory: 1 << 20})
+	err := s.DoString(`r = string.repeat("x", 2097152)`)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrMemoryLimit, err.(*RuntimeError).Cause)
+	}
+
+	// a list shared at every level prints twice as long with each level, the
+	// output is charged as it is written
+	err = s.DoString(`
+	var l = [1]
+	for i = 0, 40 {
+		l = [l, l]
+	}
+	string.format("%s", l)`)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrMemoryLimit, err.(*RuntimeError).Cause)
+	}
+
+	err = s.DoString(`
+	var d = {n: 1}
+	d.self = d
+	r = string.format("%s|%8s", [d], [1])`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KString("[{ n:1.00, self:{...}}]|  [1.00]"), s.GetGlobal("r"))
+}
@@ -1,6 +1,9 @@
 package vm
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/khoakmp/kala/cpi"
 )
 
@@ -14,14 +17,50 @@ func Prepare(proto *cpi.FuncProto) *RuntimeState {
 	return state
 }
 
-func Run(proto *cpi.FuncProto) {
+// Run executes proto in a fresh RuntimeState. A failing script stops with a
+// *RuntimeError instead of panicking.
+func Run(proto *cpi.FuncProto) (err error) {
 	state := Prepare(proto)
-	frame := state.currentFrame
+	defer func() {
+		if r := recover(); r != nil {
+			err = state.recoverError(r)
+		}
+	}()
+	state.execute(0)
+	return nil
+}
 
-	for ; frame != nil; frame = state.currentFrame {
+// ctxCheckInterval is the number of instructions executed between two checks
+// of the context, which are too slow to be done on every instruction.
+const ctxCheckInterval = 1024
+
+// checkContext aborts the run if its context is done.
+func (s *RuntimeState) checkContext() {
+	if s.ctx != nil {
+		if err := s.ctx.Err(); err != nil {
+			s.abort(err)
+		}
+	}
+}
+
+// execute runs instructions until the call stack shrinks back to depth
+// frames, i.e. until the frame pushed above depth returns.
+func (s *RuntimeState) execute(depth int) {
+	for len(s.stackCallFrame.array) > depth {
+		s.numInsts++
+		if s.options.MaxInstructions > 0 && s.numInsts > s.options.MaxInstructions {
+			s.abort(ErrInstructionLimit)
+		}
+		if s.numInsts%ctxCheckInterval == 0 {
+			s.checkContext()
+		}
+		if s.hook != nil {
+			s.hook(s)
+		}
+		frame := s.currentFrame
 		inst := frame.Closure.Proto.InstList.At(frame.PC)
 		frame.PC++
-		execFunc[opGetOpCode(inst)](state, inst)
+		execFunc[opGetOpCode(inst)](s, inst)
 	}
 }
 
@@ -42,7 +81,7 @@ var execFunc [44]func(s *RuntimeState, inst uint32)
 
 func init() {
 	execFunc[0] = EXEC_OP_MOVE
-	execFunc[1] = nil // OP_MOVEN
+	execFunc[1] = EXEC_OP_MOVEN
 	execFunc[2] = EXEC_OP_LOADK
 	execFunc[3] = EXEC_OP_LOADBOOL
 	execFunc[4] = EXEC_OP_LOADNIL
@@ -55,12 +94,11 @@ func init() {
 	execFunc[11] = EXEC_OP_SETTABLE
 	execFunc[12] = EXEC_OP_SETTABLEKS
 	execFunc[13] = EXEC_OP_NEWTABLE
-	execFunc[14] = nil // OP_SELF
+	execFunc[14] = EXEC_OP_SELF
 
-	for i := 15; i < 20; i++ {
+	for i := 15; i <= 20; i++ {
 		execFunc[i] = EXEC_OP_Arithmetic
 	}
-	execFunc[20] = nil
 	execFunc[21] = EXEC_OP_UNM
 	execFunc[22] = EXEC_OP_NOT
 	execFunc[23] = EXEC_OP_LEN
@@ -70,13 +108,13 @@ func init() {
 		execFunc[i] = EXEC_OP_Relational
 	}
 	execFunc[29] = EXEC_OP_TEST
-	execFunc[30] = nil
+	execFunc[30] = EXEC_OP_TESTSET
 	execFunc[31] = EXEC_OP_CALL
-	execFunc[32] = nil
+	execFunc[32] = EXEC_OP_TAILCALL
 	execFunc[33] = EXEC_OP_RETURN
 	execFunc[34] = EXEC_OP_FORLOOP
-	execFunc[35] = nil // OP_FORPREP
-	execFunc[36] = nil // OP_TFORLOOP
+	execFunc[35] = EXEC_OP_FORPREP
+	execFunc[36] = EXEC_OP_TFORLOOP
 	execFunc[37] = EXEC_OP_SETLIST
 	execFunc[38] = EXEC_OP_CLOSE
 	execFunc[39] = EXEC_OP_CLOSURE
@@ -95,6 +133,22 @@ func EXEC_OP_MOVE(s *RuntimeState, inst uint32) {
 	stack.Set(ra, v)
 }
 
+func EXEC_OP_MOVEN(s *RuntimeState, inst uint32) {
+	// A B C   R(A) := R(B); followed by C MOVE instructions executed here
+	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+	cf := s.currentFrame
+	base := cf.LocalBase
+	stack := s.stackValue
+	stack.Set(base+a, stack.Get(base+b))
+
+	code := cf.Closure.Proto.InstList
+	for range c {
+		inst := code.At(cf.PC)
+		cf.PC++
+		stack.Set(base+opGetArgA(inst), stack.Get(base+opGetArgB(inst)))
+	}
+}
+
 func EXEC_OP_LOADK(s *RuntimeState, inst uint32) {
 	a, b := opGetArgA(inst), opGetArgB(inst)
 	cf := s.currentFrame
@@ -142,18 +196,26 @@ func EXEC_OP_GETTABLE(s *RuntimeState, inst uint32) {
 		case cpi.KString:
 			value = v.GetField(string(key))
 		case cpi.KNumber:
+			if int(key) < 0 || int(key) >= v.Len() {
+				s.RaiseError(inst, "dict index out of range", v, key)
+			}
 			value = v.GetAt(int(key))
 		default:
-			panic("wrong type")
+			s.RaiseError(inst, "invalid dict key", v, key)
 		}
 
 		//value = v.GetField(string(key.(cpi.KString)))
 	case cpi.KList:
 		n, ok := key.(cpi.KNumber)
 		if !ok {
-			panic("wrong type")
+			s.RaiseError(inst, "invalid list index", v, key)
+		}
+		if int(n) < 0 || int(n) >= v.Len() {
+			s.RaiseError(inst, "list index out of range", v, key)
 		}
 		value = v.GetAt(int(n))
+	default:
+		s.RaiseError(inst, "attempt to index a non-table value", v, key)
 	}
 	stack.Set(ra, value)
 }
@@ -165,8 +227,11 @@ func EXEC_OP_GETTABLEKS(s *RuntimeState, inst uint32) {
 	ra, rb := cf.LocalBase+a, cf.LocalBase+b
 
 	stack := s.stackValue
-	dict := stack.Get(rb).(cpi.KDict)
 	key := cf.Closure.Proto.Consts.GetAt(c).(cpi.KString)
+	dict, ok := stack.Get(rb).(cpi.KDict)
+	if !ok {
+		s.RaiseError(inst, "attempt to index a non-dict value", stack.Get(rb), key)
+	}
 
 	stack.Set(ra, dict.GetField(string(key)))
 }
@@ -184,9 +249,26 @@ func EXEC_OP_SETTABLE(s *RuntimeState, inst uint32) {
 
 	switch table := table.(type) {
 	case cpi.KDict:
-		table.SetField(string(key.(cpi.KString)), value)
+		k, ok := key.(cpi.KString)
+		if !ok {
+			s.RaiseError(inst, "invalid dict key", table, key)
+		}
+		s.allocateField(table, string(k))
+		table.SetField(string(k), value)
 	case cpi.KList:
-		table.SetAt(int(key.(cpi.KNumber)), value)
+		n, ok := key.(cpi.KNumber)
+		if !ok {
+			s.RaiseError(inst, "invalid list index", table, key)
+		}
+		if int(n) < 0 || int(n) > table.Len() {
+			s.RaiseError(inst, "list index out of range", table, key)
+		}
+		if int(n) == table.Len() {
+			s.allocate(memValueSize)
+		}
+		table.SetAt(int(n), value)
+	default:
+		s.RaiseError(inst, "attempt to index a non-table value", table, key)
 	}
 }
 
@@ -199,7 +281,11 @@ func EXEC_OP_SETTABLEKS(s *RuntimeState, inst uint32) {
 
 	v := s.GetValue(c)
 	key := cf.Closure.Proto.Consts.GetAt(b).(cpi.KString)
-	dict := stack.Get(ra).(cpi.KDict)
+	dict, ok := stack.Get(ra).(cpi.KDict)
+	if !ok {
+		s.RaiseError(inst, "attempt to index a non-dict value", stack.Get(ra), key)
+	}
+	s.allocateField(dict, string(key))
 	dict.SetField(string(key), v)
 }
 
@@ -238,6 +324,7 @@ func EXEC_OP_CLOSURE(s *RuntimeState, inst uint32) {
 	cf := s.currentFrame
 	ra := cf.LocalBase + a
 	childProto := cf.Closure.Proto.FuncProtos[bx]
+	s.allocate(memClosureSize + childProto.NumUpvalues*memUpvalueSize)
 	closure := NewLocalClosure(childProto)
 	instList := cf.Closure.Proto.InstList
 	//fmt.Println("num upvalues:", childProto.NumUpvalues)
@@ -267,7 +354,28 @@ func (s *RuntimeState) GetValue(rk int) cpi.KValue {
 	return s.stackValue.Get(rk + cf.LocalBase)
 }
 
-// ADD, SUB, MUL, DIV, MOD
+func EXEC_OP_SELF(s *RuntimeState, inst uint32) {
+	// A B C   R(A+1) := R(B); R(A) := R(B)[RK(C)]
+	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+	cf := s.currentFrame
+	ra, rb := cf.LocalBase+a, cf.LocalBase+b
+	stack := s.stackValue
+
+	obj := stack.Get(rb)
+	key := s.GetValue(c)
+	dict, ok := obj.(cpi.KDict)
+	if !ok {
+		s.RaiseError(inst, "attempt to call a method of a non-dict value", obj, key)
+	}
+	name, ok := key.(cpi.KString)
+	if !ok {
+		s.RaiseError(inst, "invalid method name", obj, key)
+	}
+	stack.Set(ra+1, obj)
+	stack.Set(ra, dict.GetField(string(name)))
+}
+
+// ADD, SUB, MUL, DIV, MOD, POW
 func EXEC_OP_Arithmetic(s *RuntimeState, inst uint32) {
 	op := opGetOpCode(inst)
 	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
@@ -279,7 +387,7 @@ func EXEC_OP_Arithmetic(s *RuntimeState, inst uint32) {
 	rval = s.GetValue(c)
 
 	if lval.Type() != cpi.KTypeNumber || rval.Type() != cpi.KTypeNumber {
-		panic("wrong type")
+		s.RaiseError(inst, "attempt to perform arithmetic on a non-number value", lval, rval)
 	}
 	var result cpi.KNumber
 	switch op {
@@ -292,7 +400,12 @@ func EXEC_OP_Arithmetic(s *RuntimeState, inst uint32) {
 	case cpi.OP_DIV:
 		result = lval.(cpi.KNumber) / rval.(cpi.KNumber)
 	case cpi.OP_MOD:
+		if int(rval.(cpi.KNumber)) == 0 {
+			s.RaiseError(inst, "attempt to perform 'n%%0'", lval, rval)
+		}
 		result = cpi.KNumber(int(lval.(cpi.KNumber)) % int(rval.(cpi.KNumber)))
+	case cpi.OP_POW:
+		result = cpi.KNumber(math.Pow(float64(lval.(cpi.KNumber)), float64(rval.(cpi.KNumber))))
 	}
 	s.stackValue.Set(ra, result)
 }
@@ -309,19 +422,19 @@ func EXEC_OP_Relational(s *RuntimeState, inst uint32) {
 	var r bool = a == 1
 	switch op {
 	case cpi.OP_EQ:
-		if (lval == rval) != r {
+		if equalValue(lval, rval) != r {
 			s.currentFrame.PC++
 		}
 	case cpi.OP_LT:
 		if lval.Type() != cpi.KTypeNumber || rval.Type() != cpi.KTypeNumber {
-			panic("wrong type")
+			s.RaiseError(inst, "attempt to compare non-number values", lval, rval)
 		}
 		if (lval.(cpi.KNumber) < rval.(cpi.KNumber)) != r {
 			s.currentFrame.PC++
 		}
 	case cpi.OP_LE:
 		if lval.Type() != cpi.KTypeNumber || rval.Type() != cpi.KTypeNumber {
-			panic("wrong type")
+			s.RaiseError(inst, "attempt to compare non-number values", lval, rval)
 		}
 		if (lval.(cpi.KNumber) <= rval.(cpi.KNumber)) != r {
 			s.currentFrame.PC++
@@ -329,24 +442,125 @@ func EXEC_OP_Relational(s *RuntimeState, inst uint32) {
 	}
 }
 
+// equalValue reports whether a and b are the same value. Dicts hold a Go map
+// and can not be compared with ==, they are equal only to themselves.
+func equalValue(a, b cpi.KValue) bool {
+	if da, ok := a.(cpi.KDict); ok {
+		db, ok := b.(cpi.KDict)
+		return ok && da.Same(db)
+	}
+	return a == b
+}
+
+// isTruthy reports whether v counts as true in a condition: true and the
+// numbers whose integer part is not 0. Every other value is false.
+func isTruthy(v cpi.KValue) bool {
+	switch v := v.(type) {
+	case cpi.KBool:
+		return bool(v)
+	case cpi.KNumber:
+		return int(v) != 0
+	}
+	return false
+}
+
 func EXEC_OP_JMP(s *RuntimeState, inst uint32) {
 	sbx := opGetArgSbx(inst)
 	s.currentFrame.PC += sbx
 }
 
+// forValues returns the counter, limit and step of the numeric for loop
+// whose counter is at ra.
+func (s *RuntimeState) forValues(inst uint32, ra int) (counter, limit, step cpi.KNumber) {
+	stack := s.stackValue
+	vcounter, vlimit, vstep := stack.Get(ra), stack.Get(ra+1), stack.Get(ra+2)
+	counter, ok1 := vcounter.(cpi.KNumber)
+	limit, ok2 := vlimit.(cpi.KNumber)
+	step, ok3 := vstep.(cpi.KNumber)
+	if !ok1 || !ok2 || !ok3 {
+		s.RaiseError(inst, "'for' initial value, limit and step must be numbers", vcounter, vlimit, vstep)
+	}
+	return
+}
+
+func EXEC_OP_FORPREP(s *RuntimeState, inst uint32) {
+	// A sBx   R(A)-=R(A+2); pc+=sBx
+	a, sbx := opGetArgA(inst), opGetArgSbx(inst)
+	cf := s.currentFrame
+	ra := cf.LocalBase + a
+	counter, _, step := s.forValues(inst, ra)
+	if step == 0 {
+		s.RaiseError(inst, "'for' step is zero")
+	}
+	s.stackValue.Set(ra, counter-step)
+	cf.PC += sbx
+}
+
 func EXEC_OP_FORLOOP(s *RuntimeState, inst uint32) {
+	// A sBx   R(A)+=R(A+2); if R(A) < R(A+1) (> for a negative step) then pc+=sBx
 	a, sbx := opGetArgA(inst), opGetArgSbx(inst)
 	cf := s.currentFrame
 	ra := cf.LocalBase + a
+	counter, limit, step := s.forValues(inst, ra)
+	counter += step
+	s.stackValue.Set(ra, counter)
+	if (step > 0 && counter < limit) || (step < 0 && counter > limit) {
+		cf.PC += sbx
+	}
+}
+
+func EXEC_OP_TFORLOOP(s *RuntimeState, inst uint32) {
+	// A C   R(A+3), R(A+4) := next item of R(A); if there is one R(A+2) := control else pc++
+	// A list or a dict is walked by index, the control value is the next index.
+	// A function is called as R(A)(R(A+1), R(A+2)) and the loop ends when it
+	// returns nil, the control value is its first result.
+	a := opGetArgA(inst)
+	cf := s.currentFrame
+	ra := cf.LocalBase + a
 	stack := s.stackValue
 
-	step := int(stack.Get(ra + 2).(cpi.KNumber))
-	counter := int(stack.Get(ra).(cpi.KNumber)) + step
-	stack.Set(ra, cpi.KNumber(counter))
-	limit := int(stack.Get(ra + 1).(cpi.KNumber))
-	if counter < limit {
-		cf.PC += sbx
+	var key, value cpi.KValue
+	switch obj := stack.Get(ra).(type) {
+	case cpi.KList, cpi.KDict:
+		idx := 0
+		if n, ok := stack.Get(ra + 2).(cpi.KNumber); ok {
+			idx = int(n)
+		}
+		switch obj := obj.(type) {
+		case cpi.KList:
+			if idx >= obj.Len() {
+				cf.PC++
+				return
+			}
+			key, value = cpi.KNumber(idx), obj.GetAt(idx)
+		case cpi.KDict:
+			if idx >= obj.Len() {
+				cf.PC++
+				return
+			}
+			k, v := obj.GetKeyValue(idx)
+			key, value = cpi.KString(k), v
+		}
+		stack.Set(ra+2, cpi.KNumber(idx+1))
+	case *ClosureFunc:
+		stack.Set(ra+3, obj)
+		stack.Set(ra+4, stack.Get(ra+1))
+		stack.Set(ra+5, stack.Get(ra+2))
+		stack.top = ra + 6
+		depth := len(s.stackCallFrame.array)
+		s.precall(ra+3, 2, -1)
+		s.execute(depth)
+		key, value = stack.Get(ra+3), stack.Get(ra+4)
+		if key.Type() == cpi.KTypeNil {
+			cf.PC++
+			return
+		}
+		stack.Set(ra+2, key)
+	default:
+		s.RaiseError(inst, "attempt to range over a non-iterable value", obj)
 	}
+	stack.Set(ra+3, key)
+	stack.Set(ra+4, value)
 }
 
 func EXEC_OP_LOADBOOL(s *RuntimeState, inst uint32) {
@@ -374,10 +588,12 @@ func EXEC_OP_NEWTABLE(s *RuntimeState, inst uint32) {
 	ra := cf.LocalBase + a
 
 	if c > 0 {
+		s.allocateDict(c)
 		dict := cpi.NewKDict(c)
 		s.stackValue.Set(ra, dict)
 		return
 	}
+	s.allocateList(b)
 	list := cpi.NewKList(b)
 	s.stackValue.Set(ra, list)
 }
@@ -396,7 +612,7 @@ func EXEC_OP_LEN(s *RuntimeState, inst uint32) {
 	case cpi.KList:
 		l = v.Len()
 	default:
-		panic("wrong type")
+		s.RaiseError(inst, "attempt to get length of a non-table value", v)
 	}
 	s.stackValue.Set(ra, cpi.KNumber(l))
 }
@@ -411,7 +627,7 @@ func EXEC_OP_NOT(s *RuntimeState, inst uint32) {
 		s.stackValue.Set(ra, !v)
 		return
 	}
-	panic("wrong type")
+	s.RaiseError(inst, "attempt to negate a non-bool value", v)
 }
 
 func EXEC_OP_UNM(s *RuntimeState, inst uint32) {
@@ -421,7 +637,7 @@ func EXEC_OP_UNM(s *RuntimeState, inst uint32) {
 	ra, rb := cf.LocalBase+a, cf.LocalBase+b
 	v, ok := s.stackValue.Get(rb).(cpi.KNumber)
 	if !ok {
-		panic("wrong type")
+		s.RaiseError(inst, "attempt to perform arithmetic on a non-number value", s.stackValue.Get(rb))
 	}
 	s.stackValue.Set(ra, -v)
 }
@@ -432,44 +648,100 @@ func EXEC_OP_TEST(s *RuntimeState, inst uint32) {
 	a, c := opGetArgA(inst), opGetArgC(inst)
 	cf := s.currentFrame
 	va := s.stackValue.Get(cf.LocalBase + a)
-	var bv bool
-	switch v := va.(type) {
-	case cpi.KBool:
-		bv = bool(v)
-	case cpi.KNumber:
-		bv = int(v) != 0
-	}
-	if bv != (c == 1) {
+	if isTruthy(va) != (c == 1) {
 		cf.PC++
 	}
 }
 
+func EXEC_OP_TESTSET(s *RuntimeState, inst uint32) {
+	// A B C   if (R(B) <=> C) then R(A) := R(B) else pc++
+	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+	cf := s.currentFrame
+	vb := s.stackValue.Get(cf.LocalBase + b)
+	if isTruthy(vb) == (c == 1) {
+		s.stackValue.Set(cf.LocalBase+a, vb)
+		return
+	}
+	cf.PC++
+}
+
 func EXEC_OP_CONCAT(s *RuntimeState, inst uint32) {
 	//  A B C   R(A) := R(B).. ... ..R(C)
 	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
 	cf := s.currentFrame
 	ra, rb, rc := cf.LocalBase+a, cf.LocalBase+b, cf.LocalBase+c
-	vb := s.stackValue.Get(rb).(cpi.KString)
-	vc := s.stackValue.Get(rc).(cpi.KString)
+	vb, okb := s.stackValue.Get(rb).(cpi.KString)
+	vc, okc := s.stackValue.Get(rc).(cpi.KString)
+	if !okb || !okc {
+		s.RaiseError(inst, "attempt to concatenate a non-string value", s.stackValue.Get(rb), s.stackValue.Get(rc))
+	}
+	s.allocate(len(vb) + len(vc))
 	s.stackValue.Set(ra, vb+vc)
 }
 
 func EXEC_OP_CALL(s *RuntimeState, inst uint32) {
 	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
 	cf := s.currentFrame
-	stack := s.stackValue
 	ra := cf.LocalBase + a
-	closure, ok := stack.Get(ra).(*ClosureFunc)
-	if !ok {
-		panic("wrong type: call non-function type")
+
+	var narg int = b - 1
+	if narg < 0 {
+		narg = s.stackValue.top - (ra + 1)
 	}
+	s.precall(ra, narg, c-1)
+}
+
+func EXEC_OP_TAILCALL(s *RuntimeState, inst uint32) {
+	// A B C   return R(A)(R(A+1) ... R(A+B-1))
+	// A Kala function replaces the current frame, so a chain of tail calls
+	// runs in constant frame space. A host function is called like with
+	// CALL and the RETURN A 0 that follows returns its results.
+	a, b := opGetArgA(inst), opGetArgB(inst)
+	cf := s.currentFrame
+	ra := cf.LocalBase + a
+	stack := s.stackValue
 
 	var narg int = b - 1
 	if narg < 0 {
 		narg = stack.top - (ra + 1)
 	}
+	closure, ok := stack.Get(ra).(*ClosureFunc)
+	if !ok || closure.IsGlobal {
+		s.precall(ra, narg, -1)
+		return
+	}
+
+	s.CloseUpvalues(cf.LocalBase)
+	stack.MoveRange(ra, cf.Base, narg+1)
+	stack.Clear(cf.Base+narg+1, stack.top)
+	stack.top = cf.Base + narg + 1
+
+	s.stackCallFrame.Pop()
+	s.precall(cf.Base, narg, cf.NumRetValue)
+	s.currentFrame.ReturnBase = cf.ReturnBase
+}
+
+// precall enters the function at register ra, called with the narg values
+// above it and expecting nret results (-1 for all of them). Host functions run
+// to completion before precall returns, Kala functions run once the dispatch
+// loop reaches their first instruction.
+func (s *RuntimeState) precall(ra, narg, nret int) {
+	stack := s.stackValue
+	closure, ok := stack.Get(ra).(*ClosureFunc)
+	if !ok {
+		s.raise(cpi.OP_CALL, "attempt to call a non-function value", stack.Get(ra))
+	}
+
+	if len(s.stackCallFrame.array) >= s.options.MaxCallDepth {
+		s.abort(ErrCallDepthLimit)
+	}
+
+	if !closure.IsGlobal && narg < closure.Proto.NumParams {
+		s.raise(cpi.OP_CALL, fmt.Sprintf("wrong number of arguments to '%s': expected %d, got %d",
+			closure.Proto.Name, closure.Proto.NumParams, narg))
+	}
 
-	callFrame := newCallFrame(ra, ra+1, ra, c-1, closure)
+	callFrame := newCallFrame(ra, ra+1, ra, nret, closure)
 	callFrame.NumArg = narg
 
 	s.stackCallFrame.Push(callFrame)
@@ -482,11 +754,7 @@ func EXEC_OP_CALL(s *RuntimeState, inst uint32) {
 
 	proto := closure.Proto
 	localbase := ra + 1
-
 	npar := proto.NumParams
-	if narg < npar {
-		panic("wrong number arguments")
-	}
 
 	var nvarg int = 0
 
@@ -495,6 +763,7 @@ func EXEC_OP_CALL(s *RuntimeState, inst uint32) {
 	}
 
 	if nvarg > 0 {
+		s.allocateList(nvarg)
 		vargs := stack.CopyRange(localbase+npar, nvarg)
 		stack.MoveRange(localbase, localbase+nvarg, npar)
 		stack.SetRange(localbase, vargs)
@@ -507,6 +776,8 @@ func EXEC_OP_CALL(s *RuntimeState, inst uint32) {
 		list := cpi.NewKList(0)
 		stack.Set(localbase+npar, list)
 	}
+	// the registers of a loaded function are checked against its frame size
+	stack.CheckSize(callFrame.LocalBase + int(proto.NumUsedRegisters))
 
 	s.currentFrame = callFrame
 }
@@ -524,7 +795,7 @@ func EXEC_OP_RETURN(s *RuntimeState, inst uint32) {
 	}
 
 	if nret < cf.NumRetValue {
-		panic("wrong number return value")
+		s.RaiseError(inst, fmt.Sprintf("wrong number of return values: expected %d, got %d", cf.NumRetValue, nret))
 	}
 
 	if cf.NumRetValue >= 0 {
@@ -547,10 +818,14 @@ func EXEC_OP_SETLIST(s *RuntimeState, inst uint32) {
 	cf := s.currentFrame
 	ra := cf.LocalBase + a
 	stack := s.stackValue
+	if b == 0 {
+		b = stack.top - (ra + 1)
+	}
 	list, ok := stack.Get(ra).(cpi.KList)
 	if !ok {
 		list = cpi.NewKList(b)
 	}
+	s.allocate(b * memValueSize)
 	for i := 0; i < b; i++ {
 		list.Append(stack.Get(ra + 1 + i))
 	}
@@ -561,7 +836,11 @@ func EXEC_OP_APPEND(s *RuntimeState, inst uint32) {
 	a, b := opGetArgA(inst), opGetArgB(inst)
 	cf := s.currentFrame
 	ra, rb := cf.LocalBase+a, cf.LocalBase+b
-	list := s.stackValue.Get(ra).(cpi.KList)
+	list, ok := s.stackValue.Get(ra).(cpi.KList)
+	if !ok {
+		s.RaiseError(inst, "attempt to append to a non-list value", s.stackValue.Get(ra))
+	}
+	s.allocate(memValueSize)
 	v := s.stackValue.Get(rb)
 	list.Append(v)
 }
@@ -581,12 +860,33 @@ func EXEC_OP_GETFIELD(s *RuntimeState, inst uint32) {
 		s.stackValue.Set(ra, cpi.KNumber(index))
 		s.stackValue.Set(ra+1, value)
 	default:
-		panic("wrong type")
+		s.RaiseError(inst, "attempt to range over a non-table value", v)
 	}
 }
 func EXEC_OP_VARARG(s *RuntimeState, inst uint32) {
-	// A B     R(A) R(A+1) ... R(A+B-1) = vararg
+	// A B     R(A) R(A+1) ... R(A+B-2) = vararg, all of them if B is 0
+	a, b := opGetArgA(inst), opGetArgB(inst)
+	cf := s.currentFrame
+	ra := cf.LocalBase + a
+	stack := s.stackValue
 
+	// the varargs are stored between the function and its locals
+	nvarg := max(cf.LocalBase-cf.Base-1, 0)
+	n := b - 1
+	if n < 0 {
+		n = nvarg
+	}
+	for i := range n {
+		var v cpi.KValue = cpi.KNil{}
+		if i < nvarg {
+			v = stack.Get(cf.Base + 1 + i)
+		}
+		stack.Set(ra+i, v)
+	}
+	if b == 0 {
+		stack.Clear(ra+n, stack.top)
+		stack.top = ra + n
+	}
 }
 
 func EXEC_OP_NOP(s *RuntimeState, inst uint32) {}
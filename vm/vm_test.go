@@ -16,7 +16,11 @@ func compile(src string) *cpi.FuncProto {
 	if err != nil {
 		panic(err)
 	}
-	return cpi.Compile(chunk)
+	proto, err := cpi.Compile(chunk)
+	if err != nil {
+		panic(err)
+	}
+	return proto
 }
 
 func TestCopyValue(t *testing.T) {
@@ -572,3 +576,301 @@ func TestForRange(t *testing.T) {
 		assert.Equal(t, 1, int(lst.GetAt(1).(cpi.KNumber)))
 	})
 }
+
+func TestRuntimeError(t *testing.T) {
+	t.Run("arithmetic", func(t *testing.T) {
+		src := `
+		func add(x, y) {
+			return x + y
+		}
+		var a = add(1, "kmp")
+	`
+		err := Run(compile(src))
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.Equal(t, cpi.OP_ADD, rerr.Opcode)
+		assert.Equal(t, []string{"number", "string"}, rerr.Operands)
+		assert.Equal(t, "attempt to perform arithmetic on a non-number value (ADD: number, string)", rerr.Error())
+		assert.Equal(t, 2, len(rerr.Traceback))
+		assert.Equal(t, "add", rerr.Traceback[0].Function)
+		assert.Equal(t, "main chunk", rerr.Traceback[1].Function)
+	})
+
+	t.Run("traceback", func(t *testing.T) {
+		src := `var a = 1
+func calc(x) {
+	return x .. "!"
+}
+var b = calc(a)`
+		chunk, err := parse.Parse(bytes.NewReader([]byte(src)), "script.kala")
+		assert.Nil(t, err)
+		proto, err := cpi.Compile(chunk)
+		assert.Nil(t, err)
+		rerr := Run(proto).(*RuntimeError)
+		assert.Equal(t, "stack traceback:\n\tscript.kala:3 in calc\n\tscript.kala:5 in main chunk", rerr.StackTrace())
+	})
+
+	t.Run("index_non_dict", func(t *testing.T) {
+		src := `
+		var a = 1
+		var b = a.name
+	`
+		err := Run(compile(src))
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.Equal(t, cpi.OP_GETTABLEKS, rerr.Opcode)
+		assert.Equal(t, []string{"number", "string"}, rerr.Operands)
+	})
+
+	t.Run("list_out_of_range", func(t *testing.T) {
+		err := Run(compile(`var a = [1,2]
+		var b = a[5]`))
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.Equal(t, "list index out of range", rerr.Message)
+	})
+
+	t.Run("call_non_function", func(t *testing.T) {
+		err := Run(compile(`var a = {}
+		a()`))
+		rerr, ok := err.(*RuntimeError)
+		assert.True(t, ok)
+		assert.Equal(t, cpi.OP_CALL, rerr.Opcode)
+		assert.Equal(t, []string{"dict"}, rerr.Operands)
+	})
+
+	t.Run("compare_dicts", func(t *testing.T) {
+		assert.Nil(t, Run(compile(`var a, b = {}, {}
+		var c = a == b`)))
+	})
+}
+
+func TestPow(t *testing.T) {
+	s := NewState()
+	assert.Nil(t, s.DoString(`a = 2 ^ 10
+	b = 2 ^ 3 ^ 2
+	c = -2 ^ 2`))
+	assert.Equal(t, cpi.KNumber(1024), s.GetGlobal("a"))
+	assert.Equal(t, cpi.KNumber(512), s.GetGlobal("b"))
+	assert.Equal(t, cpi.KNumber(-4), s.GetGlobal("c"))
+}
+
+func TestMethodCall(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	var counter = {n: 0}
+	counter.add = func(self, k) {
+		self.n = self.n + k
+		return self.n
+	}
+	counter:add(2)
+	result = counter:add(3)`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KNumber(5), s.GetGlobal("result"))
+
+	err = s.DoString(`var a = 1
+	a:add()`)
+	rerr, ok := err.(*RuntimeError)
+	assert.True(t, ok)
+	assert.Equal(t, cpi.OP_SELF, rerr.Opcode)
+}
+
+func TestLogicalValue(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	var none
+	a = none or "default"
+	b = 1 and "y"
+	c = false and "y"
+	d = 0 or {}
+	called = false
+	var touch = func() {
+		called = true
+		return 1
+	}
+	e = true or touch()
+	f = "x" or "y"
+	g = 0.5 or [] and 2`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KString("default"), s.GetGlobal("a"))
+	assert.Equal(t, cpi.KString("y"), s.GetGlobal("b"))
+	assert.Equal(t, cpi.KBool(false), s.GetGlobal("c"))
+	assert.Equal(t, cpi.KTypeDict, s.GetGlobal("d").Type())
+	assert.Equal(t, cpi.KBool(true), s.GetGlobal("e"))
+	assert.Equal(t, cpi.KBool(false), s.GetGlobal("called"))
+	// only true and the numbers with a non-zero integer part are true
+	assert.Equal(t, cpi.KString("y"), s.GetGlobal("f"))
+	assert.Equal(t, "[]", s.GetGlobal("g").Str())
+}
+
+func TestVarArg(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	var pack = func(...) {
+		return [...]
+	}
+	var second = func(a, b) {
+		return b
+	}
+	var forward = func(...) {
+		return second(...)
+	}
+	all = pack(1, 2, 3)
+	none = pack()
+	b = forward("x", "y")`)
+	assert.Nil(t, err)
+	all := s.GetGlobal("all").(cpi.KList)
+	assert.Equal(t, 3, all.Len())
+	assert.Equal(t, cpi.KNumber(3), all.GetAt(2))
+	assert.Equal(t, 0, s.GetGlobal("none").(cpi.KList).Len())
+	assert.Equal(t, cpi.KString("y"), s.GetGlobal("b"))
+
+	err = s.DoString(`var f = func(a) {
+		return ...
+	}`)
+	_, ok := err.(*cpi.CompileError)
+	assert.True(t, ok)
+}
+
+func TestMalformedNumber(t *testing.T) {
+	s := NewState()
+	err := s.DoString("var a = 1\nvar b = 0x10")
+	cerr, ok := err.(*cpi.CompileError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, cerr.Pos.Line)
+	assert.Equal(t, `malformed number "0x10"`, cerr.Message)
+}
+
+func TestForStep(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	down = []
+	for i = 5, 0, -2 {
+		append(down, i)
+	}
+	half = 0
+	for x = 0, 1, 0.25 {
+		half = half + 1
+	}`)
+	assert.Nil(t, err)
+	down := s.GetGlobal("down").(cpi.KList)
+	assert.Equal(t, 3, down.Len())
+	assert.Equal(t, cpi.KNumber(1), down.GetAt(2))
+	assert.Equal(t, cpi.KNumber(4), s.GetGlobal("half"))
+
+	err = s.DoString(`for i = 0, 10, 0 {}`)
+	rerr, ok := err.(*RuntimeError)
+	assert.True(t, ok)
+	assert.Equal(t, cpi.OP_FORPREP, rerr.Opcode)
+	assert.Equal(t, "'for' step is zero", rerr.Message)
+}
+
+func TestRangeFunction(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	var upto = func(n) {
+		return func(state, i) {
+			if i == nil {
+				i = 0
+			}
+			if i >= n {
+				return nil, nil
+			}
+			return i + 1, (i + 1) * 10
+		}
+	}
+	sum = 0
+	for i, v = range upto(5) {
+		sum = sum + v
+		if i == 3 {
+			break
+		}
+	}`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KNumber(60), s.GetGlobal("sum"))
+
+	err = s.DoString(`for i, v = range 3 {}`)
+	rerr, ok := err.(*RuntimeError)
+	assert.True(t, ok)
+	assert.Equal(t, cpi.OP_TFORLOOP, rerr.Opcode)
+}
+
+func TestTailCall(t *testing.T) {
+	s := NewState()
+	err := s.DoString(`
+	var pair = func(a) {
+		return a, a * 2
+	}
+	wrap = func(a) {
+		return pair(a)
+	}
+	result = [wrap(4)]`)
+	assert.Nil(t, err)
+	result := s.GetGlobal("result").(cpi.KList)
+	assert.Equal(t, 2, result.Len())
+	assert.Equal(t, cpi.KNumber(8), result.GetAt(1))
+
+	rets, err := s.Call(s.GetGlobal("wrap"), cpi.KNumber(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []cpi.KValue{cpi.KNumber(1), cpi.KNumber(2)}, rets)
+}
+
+func TestMoveN(t *testing.T) {
+	s := NewState()
+	assert.Nil(t, s.DoString(`var a, b, c = 1, "two", [3]
+	var x, y, z = a, b, c
+	r = [x, y, z]`))
+	r := s.GetGlobal("r").(cpi.KList)
+	assert.Equal(t, cpi.KNumber(1), r.GetAt(0))
+	assert.Equal(t, cpi.KString("two"), r.GetAt(1))
+	assert.Equal(t, cpi.KTypeList, r.GetAt(2).Type())
+}
+
+func TestTailCallFrames(t *testing.T) {
+	s := NewState(Options{MaxCallDepth: 20})
+	err := s.DoString(`
+	var walk = func(lst, i, acc) {
+		if i >= #lst {
+			return acc
+		}
+		return walk(lst, i + 1, acc + lst[i])
+	}
+	var even
+	var odd = func(n) {
+		if n == 0 {
+			return false
+		}
+		return even(n - 1)
+	}
+	even = func(n) {
+		if n == 0 {
+			return true
+		}
+		return odd(n - 1)
+	}
+	var lst = []
+	for i = 0, 1000 {
+		append(lst, i)
+	}
+	sum = walk(lst, 0, 0)
+	result = even(10001)`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KNumber(499500), s.GetGlobal("sum"))
+	assert.Equal(t, cpi.KBool(false), s.GetGlobal("result"))
+	assert.Equal(t, 0, len(s.rt.stackCallFrame.array))
+
+	// a closure created by the frame being replaced keeps its upvalues
+	err = s.DoString(`
+	var id = func(f) {
+		return f
+	}
+	var make = func(v) {
+		var get = func() {
+			return v
+		}
+		return id(get)
+	}
+	result = make(7)()`)
+	assert.Nil(t, err)
+	assert.Equal(t, cpi.KNumber(7), s.GetGlobal("result"))
+}